@@ -0,0 +1,14 @@
+package memberlist
+
+// AliveDelegate is used to involve a client in processing a node "alive"
+// message. It can be used to enforce an admission policy, for example to
+// keep out nodes whose meta data lacks a required capability or that
+// speak an incompatible version of the application.
+type AliveDelegate interface {
+	// NotifyAlive is invoked when an alive message for a node arrives,
+	// before it is processed, including alive messages for the local
+	// node and repeats for nodes that are already members. If the return
+	// value is non-nil, the message is ignored. It is called with the
+	// node lock held, so it must not call back into the Memberlist.
+	NotifyAlive(peer *Node) error
+}
@@ -0,0 +1,48 @@
+package memberlist
+
+import (
+	"fmt"
+)
+
+// Alive is the message a node gossips to announce that it is alive, or
+// that its address or meta data changed. It mirrors the internal message
+// so that tools can craft and inspect gossip without running a
+// Memberlist. A node only accepts an alive message about another node if
+// its Incarnation is higher than the one it knows of.
+type Alive struct {
+	Incarnation uint32
+	Node        string
+	Addr        []byte
+	Port        uint16
+	Meta        []byte
+
+	// The versions of the protocol/delegate that are being spoken, order:
+	// pmin, pmax, pcur, dmin, dmax, dcur
+	Vsn []uint8
+}
+
+// EncodeAlive encodes an alive message, including the message type byte,
+// exactly as memberlist sends it. The result can be sent as a packet on
+// its own, or as part of a compound one, to a node that doesn't use a
+// label or encryption. The encoding is deterministic.
+func EncodeAlive(a *Alive) ([]byte, error) {
+	in := alive(*a)
+	buf, err := encode(aliveMsg, &in)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeAlive decodes an alive message as produced by EncodeAlive
+func DecodeAlive(buf []byte) (*Alive, error) {
+	if len(buf) < 1 || messageType(buf[0]) != aliveMsg {
+		return nil, fmt.Errorf("Not an alive message")
+	}
+	var out alive
+	if err := decode(buf[1:], &out); err != nil {
+		return nil, fmt.Errorf("Failed to decode alive message: %v", err)
+	}
+	a := Alive(out)
+	return &a, nil
+}
@@ -0,0 +1,72 @@
+package memberlist
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEncodeDecodeAlive(t *testing.T) {
+	a := Alive{
+		Incarnation: 3,
+		Node:        "test",
+		Addr:        []byte{127, 0, 0, 1},
+		Port:        7946,
+		Meta:        []byte("meta"),
+		Vsn:         []uint8{1, 4, 2, 0, 0, 0},
+	}
+	buf, err := EncodeAlive(&a)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The encoding matches what memberlist itself sends
+	internal, err := encode(aliveMsg, &alive{
+		Incarnation: 3,
+		Node:        "test",
+		Addr:        []byte{127, 0, 0, 1},
+		Port:        7946,
+		Meta:        []byte("meta"),
+		Vsn:         []uint8{1, 4, 2, 0, 0, 0},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(buf, internal.Bytes()) {
+		t.Fatalf("bad: %v %v", buf, internal.Bytes())
+	}
+
+	out, err := DecodeAlive(buf)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(*out, a) {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Other messages and junk are refused
+	ping, err := encode(pingMsg, &ping{SeqNo: 1})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, bad := range [][]byte{nil, ping.Bytes(), {byte(aliveMsg), 0xc1}} {
+		if _, err := DecodeAlive(bad); err == nil {
+			t.Fatalf("expected err for %v", bad)
+		}
+	}
+}
+
+func TestEncodeAlive_Ingest(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	buf, err := EncodeAlive(&Alive{Node: "test", Addr: []byte{127, 0, 0, 2}, Port: 7946, Incarnation: 1})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m.handleCommand(buf, nil, time.Now())
+	if _, ok := m.GetNode("test"); !ok {
+		t.Fatalf("node not added")
+	}
+}
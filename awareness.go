@@ -0,0 +1,54 @@
+package memberlist
+
+import (
+	"sync"
+)
+
+// awareness manages a simple metric for tracking the estimated health of the
+// local node. Health is primarily the node's ability to respond in the soft
+// real-time manner required for correct health checking of other nodes in the
+// cluster.
+type awareness struct {
+	sync.RWMutex
+
+	// max is the upper threshold for the score (the lower threshold is
+	// always zero).
+	max int
+
+	// score is the current awareness score. Lower values are healthier and
+	// zero is the minimum value.
+	score int
+}
+
+// newAwareness returns a new awareness object.
+func newAwareness(max int) *awareness {
+	return &awareness{
+		max:   max,
+		score: 0,
+	}
+}
+
+// ApplyDelta takes the given delta and applies it to the score in a
+// thread-safe manner. It also enforces a floor of zero and a max of max,
+// so deltas may not change the overall score if it's railed at one of the
+// extremes.
+func (a *awareness) ApplyDelta(delta int) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.score += delta
+	if a.score > (a.max - 1) {
+		a.score = (a.max - 1)
+	}
+	if a.score < 0 {
+		a.score = 0
+	}
+}
+
+// GetHealthScore returns the raw health score.
+func (a *awareness) GetHealthScore() int {
+	a.RLock()
+	defer a.RUnlock()
+
+	return a.score
+}
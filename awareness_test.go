@@ -0,0 +1,35 @@
+package memberlist
+
+import (
+	"testing"
+)
+
+func TestAwareness(t *testing.T) {
+	cases := []struct {
+		delta int
+		score int
+	}{
+		{0, 0},
+		{-1, 0},
+		{-10, 0},
+		{1, 1},
+		{-1, 0},
+		{10, 7},
+		{-1, 6},
+		{-1, 5},
+		{-1, 4},
+		{-1, 3},
+		{-1, 2},
+		{-1, 1},
+		{-1, 0},
+		{-1, 0},
+	}
+
+	a := newAwareness(8)
+	for i, c := range cases {
+		a.ApplyDelta(c.delta)
+		if a.GetHealthScore() != c.score {
+			t.Errorf("case %d: score mismatch %d != %d", i, a.score, c.score)
+		}
+	}
+}
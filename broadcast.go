@@ -12,6 +12,19 @@ are contradictory. For example, if we send "{suspect M1 inc: 1},
 then a following {alive M1 inc: 2} will invalidate that message
 */
 
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrBroadcastTooLarge is returned by QueueBroadcast for a message that
+// won't fit in a UDP packet, and so could never be gossiped. Messages of
+// that size can be sent to each node with SendToTCP instead.
+var ErrBroadcastTooLarge = fmt.Errorf("broadcast is too large to fit in a UDP packet")
+
+// ErrDraining is returned by QueueBroadcast once Drain has been called
+var ErrDraining = fmt.Errorf("memberlist is draining and not accepting broadcasts")
+
 type memberlistBroadcast struct {
 	node   string
 	msg    []byte
@@ -40,6 +53,84 @@ func (b *memberlistBroadcast) Finished() {
 	}
 }
 
+// userBroadcast wraps an application Broadcast so that it is framed as a
+// user message and handed to the Delegate's NotifyMsg on receipt.
+type userBroadcast struct {
+	b   Broadcast
+	msg []byte
+}
+
+func (u *userBroadcast) Invalidates(other Broadcast) bool {
+	// Only other user broadcasts can be invalidated by the application
+	ub, ok := other.(*userBroadcast)
+	if !ok {
+		return false
+	}
+	return u.b.Invalidates(ub.b)
+}
+
+func (u *userBroadcast) Message() []byte {
+	return u.msg
+}
+
+func (u *userBroadcast) Finished() {
+	u.b.Finished()
+}
+
+// QueueBroadcast is used to enqueue an application broadcast to be
+// gossiped to the cluster along with memberlist's own messages. The
+// message is delivered to the Delegate's NotifyMsg on each node that
+// receives it. The broadcast's Invalidates method is only ever passed
+// other broadcasts queued through this method.
+//
+// Messages larger than MaxBroadcastSize are rejected with
+// ErrBroadcastTooLarge, and all messages with ErrDraining once Drain
+// has been called.
+func (m *Memberlist) QueueBroadcast(b Broadcast) error {
+	if atomic.LoadInt32(&m.draining) == 1 {
+		return ErrDraining
+	}
+	raw := b.Message()
+	if len(raw) > m.MaxBroadcastSize() {
+		return ErrBroadcastTooLarge
+	}
+	msg := make([]byte, 1, len(raw)+1)
+	msg[0] = byte(userMsg)
+	msg = append(msg, raw...)
+	m.broadcasts.QueueBroadcast(&userBroadcast{b, msg})
+	return nil
+}
+
+// MaxBroadcastSize returns the largest message that can be broadcast with
+// QueueBroadcast, or returned from the Delegate's GetBroadcasts, and still
+// fit in a UDP packet on its own. It allows for the label and for
+// encryption or signing, but not for compression.
+func (m *Memberlist) MaxBroadcastSize() int {
+	size := udpSendBuf - compoundHeaderOverhead - compoundOverhead - userMsgOverhead
+	size -= labelOverhead(m.config.Label)
+	if m.config.EncryptionEnabled() {
+		primaryKey := m.config.Keyring.GetPrimaryKey()
+		size -= encryptOverhead(m.encryptionVersion(primaryKey))
+	} else if m.config.SigningEnabled() {
+		size -= signOverhead
+	}
+	return size
+}
+
+// NumPendingBroadcasts returns the number of broadcasts, both memberlist's
+// own and those queued with QueueBroadcast, that are still waiting to be
+// transmitted. It can be used to flow-control application broadcasts.
+func (m *Memberlist) NumPendingBroadcasts() int {
+	return m.broadcasts.NumQueued()
+}
+
+// GetBroadcastQueueStats returns a summary of the queue of broadcasts,
+// both memberlist's own and those queued with QueueBroadcast, that are
+// waiting to be gossiped. See QueueStats.
+func (m *Memberlist) GetBroadcastQueueStats() QueueStats {
+	return m.broadcasts.Stats()
+}
+
 // encodeAndBroadcast encodes a message and enqueues it for broadcast. Fails
 // silently if there is an encoding error.
 func (m *Memberlist) encodeAndBroadcast(node string, msgType messageType, msg interface{}) {
@@ -52,7 +143,7 @@ func (m *Memberlist) encodeAndBroadcast(node string, msgType messageType, msg in
 func (m *Memberlist) encodeBroadcastNotify(node string, msgType messageType, msg interface{}, notify chan struct{}) {
 	buf, err := encode(msgType, msg)
 	if err != nil {
-		m.logger.Printf("[ERR] Failed to encode message for broadcast: %s", err)
+		m.logger.Errorf("Failed to encode message for broadcast: %s", err)
 	} else {
 		m.queueBroadcast(node, buf.Bytes(), notify)
 	}
@@ -72,6 +163,7 @@ func (m *Memberlist) queueBroadcast(node string, msg []byte, notify chan struct{
 func (m *Memberlist) getBroadcasts(overhead, limit int) [][]byte {
 	// Get memberlist messages first
 	toSend := m.broadcasts.GetBroadcasts(overhead, limit)
+	m.setGauge([]string{"memberlist", "queue", "broadcasts"}, float32(m.broadcasts.NumQueued()))
 
 	// Check if the user has anything to broadcast
 	d := m.config.Delegate
@@ -87,8 +179,16 @@ func (m *Memberlist) getBroadcasts(overhead, limit int) [][]byte {
 		if avail > overhead+userMsgOverhead {
 			userMsgs := d.GetBroadcasts(overhead+userMsgOverhead, avail)
 
-			// Frame each user message
+			// Frame each user message, dropping any that would overflow
+			// the packet
 			for _, msg := range userMsgs {
+				if len(msg)+overhead+userMsgOverhead > avail {
+					m.logger.Errorf("Dropping user broadcast of %d bytes, over the %d bytes available",
+						len(msg), avail-overhead-userMsgOverhead)
+					m.incrCounter([]string{"memberlist", "broadcasts", "dropped"}, 1)
+					continue
+				}
+				avail -= len(msg) + overhead + userMsgOverhead
 				buf := make([]byte, 1, len(msg)+1)
 				buf[0] = byte(userMsg)
 				buf = append(buf, msg...)
@@ -96,5 +196,17 @@ func (m *Memberlist) getBroadcasts(overhead, limit int) [][]byte {
 			}
 		}
 	}
+
+	// Let the application rewrite or drop them on their way out
+	if transform := m.config.TransformBroadcast; transform != nil {
+		out := toSend[:0]
+		for _, msg := range toSend {
+			if msg = transform(msg); msg != nil {
+				out = append(out, msg)
+			}
+		}
+		toSend = out
+	}
+	atomic.AddUint64(&m.stats.BroadcastsSent, uint64(len(toSend)))
 	return toSend
 }
@@ -1,6 +1,7 @@
 package memberlist
 
 import (
+	"bytes"
 	"reflect"
 	"testing"
 )
@@ -25,3 +26,135 @@ func TestMemberlistBroadcast_Message(t *testing.T) {
 		t.Fatalf("messages do not match")
 	}
 }
+
+// namedBroadcast invalidates other broadcasts with the same name
+type namedBroadcast struct {
+	name     string
+	msg      []byte
+	finished bool
+}
+
+func (n *namedBroadcast) Invalidates(other Broadcast) bool {
+	return n.name == other.(*namedBroadcast).name
+}
+
+func (n *namedBroadcast) Message() []byte {
+	return n.msg
+}
+
+func (n *namedBroadcast) Finished() {
+	n.finished = true
+}
+
+func TestMemberlist_QueueBroadcast(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	b1 := &namedBroadcast{name: "a", msg: []byte("one")}
+	m.QueueBroadcast(b1)
+	m.encodeAndBroadcast("test", aliveMsg, &alive{Node: "test"})
+	if n := m.NumPendingBroadcasts(); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	// Only the user broadcast with the same name is invalidated
+	b2 := &namedBroadcast{name: "a", msg: []byte("two")}
+	m.QueueBroadcast(b2)
+	if n := m.NumPendingBroadcasts(); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+	if !b1.finished {
+		t.Fatalf("should finish invalidated broadcast")
+	}
+
+	// User broadcasts are framed as user messages
+	var found bool
+	for _, msg := range m.broadcasts.GetBroadcasts(0, 1024) {
+		if messageType(msg[0]) == userMsg {
+			found = true
+			if string(msg[1:]) != "two" {
+				t.Fatalf("bad: %s", msg[1:])
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("missing user broadcast")
+	}
+}
+
+func TestMemberlist_QueueBroadcast_TooLarge(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	max := m.MaxBroadcastSize()
+	big := &namedBroadcast{name: "big", msg: make([]byte, max+1)}
+	if err := m.QueueBroadcast(big); err != ErrBroadcastTooLarge {
+		t.Fatalf("expected ErrBroadcastTooLarge, got %v", err)
+	}
+	if n := m.NumPendingBroadcasts(); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	// The largest allowed broadcast fits in a gossip packet on its own
+	fits := &namedBroadcast{name: "fits", msg: make([]byte, max)}
+	if err := m.QueueBroadcast(fits); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if msgs := m.getBroadcasts(compoundOverhead, udpSendBuf-compoundHeaderOverhead); len(msgs) != 1 {
+		t.Fatalf("expected the broadcast to be sent, got %d messages", len(msgs))
+	}
+
+	// Labels take up space too
+	m.config.Label = "label"
+	if size := m.MaxBroadcastSize(); size != max-labelOverhead("label") {
+		t.Fatalf("bad: %d", size)
+	}
+}
+
+func TestMemberlist_TransformBroadcast(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	var seen [][]byte
+	m.config.TransformBroadcast = func(msg []byte) []byte {
+		seen = append(seen, msg)
+		if messageType(msg[0]) == userMsg {
+			return nil
+		}
+		return append([]byte{msg[0]}, bytes.ToUpper(msg[1:])...)
+	}
+
+	m.queueBroadcast("test", []byte{byte(aliveMsg), 'a', 'b'}, nil)
+	m.QueueBroadcast(&namedBroadcast{name: "a", msg: []byte("dropped")})
+
+	msgs := m.getBroadcasts(compoundOverhead, 1024)
+	if len(seen) != 2 {
+		t.Fatalf("expected both broadcasts to be seen, got %d", len(seen))
+	}
+	if len(msgs) != 1 || string(msgs[0][1:]) != "AB" {
+		t.Fatalf("bad: %q", msgs)
+	}
+
+	// The queued messages are left alone for retransmits
+	for _, b := range m.broadcasts.bcQueue {
+		if msg := b.b.Message(); string(msg[1:]) != "ab" && string(msg[1:]) != "dropped" {
+			t.Fatalf("bad: %q", msg)
+		}
+	}
+}
+
+func TestMemberlist_GetBroadcasts_DropsOversized(t *testing.T) {
+	sink := newMockSink()
+	m, d := GetMemberlistDelegate(t)
+	defer m.Shutdown()
+	m.config.MetricsSink = sink
+
+	d.broadcasts = [][]byte{[]byte("small"), make([]byte, 200)}
+	msgs := m.getBroadcasts(compoundOverhead, 100)
+	if len(msgs) != 1 || string(msgs[0][1:]) != "small" {
+		t.Fatalf("bad: %v", msgs)
+	}
+	if n := sink.counter("memberlist.broadcasts.dropped"); n != 1 {
+		t.Fatalf("bad dropped count: %v", n)
+	}
+}
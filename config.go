@@ -1,7 +1,11 @@
 package memberlist
 
 import (
+	"crypto/tls"
+	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"os"
 	"time"
 )
@@ -17,6 +21,52 @@ type Config struct {
 	BindAddr string
 	Port     int
 
+	// BindAddrs, if set, lists several addresses to listen on instead of
+	// BindAddr, for hosts with separate networks, such as management and
+	// data networks. Each is bound on Port. Packets and streams are sent
+	// from the address on the same network as the destination. The first
+	// address is advertised unless AdvertiseAddr is set. This only applies
+	// when memberlist creates its own NetTransport.
+	BindAddrs []string
+
+	// Configuration related to what address to advertise to other
+	// cluster members. Used for nat traversal or when running in a
+	// container with port mapping. If AdvertiseAddr is not set, the
+	// address we are bound to is advertised, and if AdvertisePort is
+	// zero, Port is advertised. AdvertiseAddr must be an IP address.
+	AdvertiseAddr string
+	AdvertisePort int
+
+	// AdvertiseAddrFunc, if set, is called for the address and port to
+	// advertise each time this node builds an alive message for itself,
+	// that is on startup, on UpdateNode or SetMeta, and when refuting a
+	// suspicion or death, so that the advertised address can follow
+	// changes such as a failover between network interfaces. A zero port
+	// keeps the current one. If it
+	// returns an error or an unusable IP, a warning is logged and the
+	// address is left as it was. Peers that already know this node see a
+	// new address as a conflict, see ConflictDelegate, and only pick it
+	// up once failure detection has removed the old one, unless they use
+	// ConflictPreferNewerIncarnation.
+	AdvertiseAddrFunc func() (net.IP, uint16, error)
+
+	// PreferredCIDR, if set, picks the address to advertise when bound to
+	// all interfaces and no AdvertiseAddr is given. The first interface
+	// address within it is used, such as "10.0.0.0/16" for a data network,
+	// so that multi-homed hosts don't advertise whichever private address
+	// happens to be listed first, like that of a docker0 bridge. If no
+	// address matches, a warning is logged and the first private address
+	// is used as usual.
+	PreferredCIDR string
+
+	// Resolver, if set, replaces the built-in DNS resolution of the hosts
+	// given to Join and ProbeAddr, for discovery through a service mesh,
+	// Consul or etcd, or split-horizon DNS. It is called with each host
+	// as given, including any port, and returns the nodes to contact as
+	// *net.TCPAddr, *net.UDPAddr or *net.IPAddr values. Addresses without
+	// a port use Port.
+	Resolver func(host string) ([]net.Addr, error)
+
 	// ProtocolVersion is the configured protocol version that we
 	// will _speak_. This must be between ProtocolVersionMin and
 	// ProtocolVersionMax.
@@ -26,11 +76,32 @@ type Config struct {
 	// a remote node for a full state sync.
 	TCPTimeout time.Duration
 
+	// TCPKeepAlive is the keep-alive period for the TCP connections used
+	// for push/pull syncs and user messages, both dialed and accepted,
+	// when memberlist creates its own NetTransport. Keep-alives let the
+	// OS notice and close connections to nodes that dropped off the
+	// network mid-transfer. Zero uses the Go default, which is currently
+	// 15 seconds, and a negative value turns keep-alives off.
+	TCPKeepAlive time.Duration
+
+	// PushPullConnIdleTimeout keeps the TCP connection used for a push/pull
+	// sync open afterwards, so the next sync with the same node can skip
+	// the dial. A pooled connection is closed once it has been idle this
+	// long, and discarded if it fails, in which case a new one is dialed.
+	// Zero, the default, closes connections after every sync.
+	//
+	// It should be set on all nodes. While idle, a pooled connection holds
+	// one of the receiving node's stream workers, so keep it well below
+	// PushPullInterval on large clusters.
+	PushPullConnIdleTimeout time.Duration
+
 	// IndirectChecks is the number of nodes that will be asked to perform
 	// an indirect probe of a node in the case a direct probe fails. Memberlist
 	// waits for an ack from any single indirect node, so increasing this
 	// number will increase the likelihood that an indirect probe will succeed
-	// at the expense of bandwidth.
+	// at the expense of bandwidth. Operators on lossy networks may want to
+	// raise it to avoid falsely suspecting healthy nodes. The relays are
+	// picked at random from the alive nodes, excluding the target.
 	IndirectChecks int
 
 	// RetransmitMult is the multiplier for the number of retransmissions
@@ -55,16 +126,56 @@ type Config struct {
 	// an inaccessible node is considered part of the cluster before declaring
 	// it dead, giving that suspect node more time to refute if it is indeed
 	// still alive.
+	//
+	// When other nodes independently suspect the same node, the timeout is
+	// shortened, down to a minimum of 2 * log(N+1) * ProbeInterval once
+	// SuspicionMult-2 peers have confirmed the suspicion. Suspect nodes are
+	// also re-probed at that minimum interval, so they learn of the
+	// suspicion and can refute it sooner.
 	SuspicionMult int
 
+	// SuspicionMaxTimeoutMult changes the bounds of the suspicion timeout
+	// when set. The timeout given by SuspicionMult then becomes the
+	// minimum, which leaves a suspect node time to refute, and the timeout
+	// starts out at SuspicionMaxTimeoutMult times that. It shrinks toward
+	// the minimum as the SuspicionMult-2 confirmations arrive, so a node
+	// that many peers can't reach is still declared dead quickly, while a
+	// single false report has to survive much longer. If there are too
+	// few nodes to expect confirmations, the maximum is used. The timeout
+	// in effect when a node is declared dead is logged and sampled in the
+	// memberlist.suspect.timeout metric, in milliseconds.
+	SuspicionMaxTimeoutMult int
+
+	// AwarenessMaxMultiplier bounds the health score of the local node,
+	// as returned by GetHealthScore. The score rises when this node fails
+	// to probe others or has to refute being suspected, and falls again
+	// as probes succeed, staying between 0 (healthy) and
+	// AwarenessMaxMultiplier-1.
+	AwarenessMaxMultiplier int
+
+	// MaxNodes is an optional limit on the number of live nodes this
+	// node will track. Once it is reached, alive messages about nodes we
+	// haven't seen before are ignored, and joins that would take the
+	// cluster past the limit are refused. Nodes that are already members
+	// are unaffected. This is a safety valve against runaway deployments,
+	// not a cluster-wide guarantee. Zero means no limit.
+	MaxNodes int
+
 	// PushPullInterval is the interval between complete state syncs.
 	// Complete state syncs are done with a single node over TCP and are
 	// quite expensive relative to standard gossiped messages. Setting this
-	// to zero will disable state push/pull syncs completely.
+	// to zero or a negative value will disable state push/pull syncs
+	// completely, leaving convergence entirely to UDP gossip.
+	//
+	// The interval is scaled with the cluster size so that the number of
+	// TCP connections across the cluster doesn't grow without bound. Past
+	// 32 nodes it is multiplied by log2(N) - log2(32) + 1, rounded up, so a
+	// 1000 node cluster syncs every 6 * PushPullInterval.
 	//
 	// Setting this interval lower (more frequent) will increase convergence
 	// speeds across larger clusters at the expense of increased bandwidth
-	// usage.
+	// usage. Setting it higher, or disabling it, means a node that missed
+	// some gossip may take longer to learn the correct cluster state.
 	PushPullInterval time.Duration
 
 	// ProbeInterval and ProbeTimeout are used to configure probing
@@ -80,6 +191,35 @@ type Config struct {
 	ProbeInterval time.Duration
 	ProbeTimeout  time.Duration
 
+	// NodeZone and CrossZoneProbeTimeout allow a longer probe timeout for
+	// nodes across a slow link, such as in another datacenter, so that
+	// they aren't suspected because of the latency alone while nodes
+	// nearby are still checked quickly.
+	//
+	// NodeZone returns the zone a node is in, typically read from its
+	// meta data with DecodeTags, or an empty string if it isn't known.
+	// It is called for the local node too, and must not call back into
+	// the Memberlist.
+	//
+	// CrossZoneProbeTimeout is used instead of ProbeTimeout when probing
+	// a node whose zone is known and differs from ours. The time left for
+	// indirect probes is kept the same, so each probe of such a node
+	// takes longer. Zero uses ProbeTimeout for every node.
+	NodeZone              func(n *Node) string
+	CrossZoneProbeTimeout time.Duration
+
+	// ProbeIntervalMin and ProbeIntervalMax turn on an adaptive probe
+	// interval. ProbeInterval is then the interval for a 32 node cluster,
+	// and is scaled by log(33) / log(N+1) for other sizes, so tiny
+	// clusters probe less often and large ones more often, keeping the
+	// time until a failed node is noticed roughly even. The result is
+	// clamped to these bounds; a zero bound leaves that side unbounded.
+	// It never falls below ProbeTimeout, and neither bound may either.
+	// If both are zero, the default, ProbeInterval is used as is. The
+	// interval in use is returned by Memberlist.ProbeInterval.
+	ProbeIntervalMin time.Duration
+	ProbeIntervalMax time.Duration
+
 	// GossipInterval and GossipNodes are used to configure the gossip
 	// behavior of memberlist.
 	//
@@ -96,15 +236,203 @@ type Config struct {
 	GossipInterval time.Duration
 	GossipNodes    int
 
+	// IntervalJitter randomizes every probe, gossip and push/pull interval
+	// by up to this fraction of it either way, so 0.1 makes a 1 second
+	// interval anything from 0.9 to 1.1 seconds. The first tick is always
+	// delayed by a random part of the interval, but nodes that start at
+	// the same time can still drift into step and cause traffic spikes,
+	// which jitter prevents. It must be below 1, and zero, the default,
+	// keeps the intervals fixed.
+	IntervalJitter float64
+
+	// GossipToTheDeadTime is how long a dead node is kept in the node list
+	// after its death, so that the death is still passed on in push/pull
+	// syncs to nodes that missed the gossip, such as ones that were
+	// partitioned or are just joining. After this the node is evicted the
+	// next time the list is reshuffled. Longer values use more memory and
+	// bandwidth but make it more likely that stragglers learn of the death.
+	GossipToTheDeadTime time.Duration
+
+	// ShouldReap, if set, is asked before a node that has been dead for
+	// longer than GossipToTheDeadTime is evicted. Returning false keeps
+	// it in the node list, so its death is still passed on in push/pull
+	// syncs, and it is asked again at the next reshuffle. This lets
+	// applications hold on to nodes that are expected to come back, such
+	// as static members, while others age out. The Node must not be
+	// modified, and the function must not call back into the Memberlist.
+	ShouldReap func(n *Node, deadFor time.Duration) bool
+
+	// DeadNodeReclaimTime is how long a node must have been dead or left
+	// before an alive message for its name from a new address is taken as
+	// the node restarting there, which is accepted whatever its
+	// incarnation number. Before then such a message is handled as a
+	// conflict, see ConflictPolicy, so that a dead node's name can't be
+	// hijacked. This suits ephemeral containers that come back with a
+	// stable hostname but a new address. Zero, the default, keeps the name
+	// until the dead node is reaped, see GossipToTheDeadTime, unless
+	// ConflictPreferNewerIncarnation is used, which reclaims it at once.
+	DeadNodeReclaimTime time.Duration
+
+	// TransformBroadcast, if set, is called with each broadcast, both
+	// memberlist's own and the application's, just before it is gossiped
+	// or piggybacked on another message. It returns the bytes to send in
+	// its place, or nil to drop it from this packet. This allows for
+	// protocol translation between versions, or corrupting chosen
+	// messages to test resilience. The message starts with its message
+	// type byte and must not be modified in place, since the same bytes
+	// are retransmitted. Packets are sized for the original messages, so
+	// a transformed message shouldn't be any longer.
+	TransformBroadcast func(msg []byte) []byte
+
 	// EnableCompression is used to control message compression. This can
 	// be used to reduce bandwidth usage at the cost of slightly more CPU
 	// utilization. This is only available starting at protocol version 1.
 	EnableCompression bool
 
+	// CompressionAlgo selects the algorithm used when EnableCompression is
+	// set. The default, CompressionLZW, is understood by every node, while
+	// CompressionFlate usually gives better ratios for push/pull state but
+	// needs protocol version 3. If ProtocolVersion is lower than that, LZW
+	// is used instead so that older nodes can still read our messages.
+	// Incoming messages are decompressed with whichever algorithm they
+	// were sent with.
+	CompressionAlgo CompressionType
+
 	// SecretKey is provided if message level encryption and verification
-	// are to be used. This key must be 16 bytes.
+	// are to be used. This key must be 16, 24, or 32 bytes to select
+	// AES-128, AES-192, or AES-256 respectively. Messages only say which
+	// key size was used from protocol version 5, so that older nodes can
+	// still decrypt them during an upgrade. If a Keyring is also
+	// provided, SecretKey is added to it and used as the primary key.
 	SecretKey []byte
 
+	// AllowPublicUnencrypted silences the warning logged when a public
+	// address is advertised without encryption. Set it when the network
+	// itself is already encrypted, for example by a WireGuard or IPsec
+	// underlay. It doesn't change what is sent.
+	AllowPublicUnencrypted bool
+
+	// UDPBufferSize is the size of the receive buffer to request for the
+	// UDP listener, when memberlist creates its own NetTransport. Large,
+	// busy clusters may need more than the 2MB default to avoid dropping
+	// packets. The OS may clamp the size; the size achieved is logged.
+	UDPBufferSize int
+
+	// UDPMaxPacketSize is the largest packet, in bytes, to send over UDP.
+	// Packets above it, such as large SendToUDP messages, risk being
+	// fragmented or dropped by the network, so they are sent over TCP
+	// instead and a warning is logged, so the sizes of broadcasts and
+	// messages can be tuned. The receiving node handles them just like
+	// UDP packets. This needs ProtocolVersion 4 and TCP to be enabled;
+	// otherwise the warning is logged and the packet sent over UDP anyway.
+	// The TCP sends are made in the background, and packets are dropped
+	// if too many are waiting. Broadcasts piggybacked on other messages
+	// are kept within the limit, so they don't cause relaying. Zero, the
+	// default, sends every packet over UDP.
+	UDPMaxPacketSize int
+
+	// TLSConfig is used to secure the TCP connections used for push/pull
+	// state syncs and user messages, when memberlist creates its own
+	// NetTransport. It must hold this node's certificate and be able to
+	// verify those of other nodes. UDP gossip still relies on SecretKey
+	// or Keyring for encryption.
+	TLSConfig *tls.Config
+
+	// AckHandlerWarnThreshold is the number of outstanding ack handlers
+	// above which a warning is logged. Each probe registers a handler that
+	// is removed when the ack arrives or times out, so in a healthy node
+	// the count stays small. A background sweep checks it periodically to
+	// catch handlers that are never reaped. Set to zero to disable the
+	// sweep.
+	AckHandlerWarnThreshold int
+
+	// StreamWorkers is the number of goroutines that handle inbound TCP
+	// connections (push/pull syncs, user messages and relayed packets).
+	// Accepted connections wait for a free worker in a queue that holds
+	// up to HandoffQueueDepth of them; connections arriving when the
+	// queue is full are closed, logged and counted in the
+	// memberlist.tcp.rejected metric. This bounds the resources a flood of
+	// connections can use. Set StreamWorkers to zero to handle each
+	// connection in its own goroutine instead.
+	StreamWorkers     int
+	HandoffQueueDepth int
+
+	// Label is an optional string that is prepended to every packet and
+	// stream this node sends, and must match on those it receives. Messages
+	// with a different label, or none, are dropped and counted in the
+	// memberlist.label.mismatch metric. This keeps separate clusters that
+	// share a network from merging by mistake, for example during a
+	// blue/green deployment. It is not a security measure; use encryption
+	// for that. Labels may be at most 255 bytes.
+	Label string
+
+	// GossipVerifyIncomingDisabled and GossipVerifyOutgoingDisabled relax
+	// how strictly encryption is applied once SecretKey or Keyring is set,
+	// so that it can be rolled out to a running cluster in phases. Both
+	// are false by default, so that a node holding keys is strict. They
+	// apply to signing in the same way.
+	//
+	// Unless GossipVerifyIncomingDisabled is set, any packet or stream
+	// that isn't encrypted with one of our keys is dropped; dropped
+	// packets are counted in the memberlist.udp.decrypt.failed metric.
+	// When set, messages that can't be decrypted are handled as plaintext.
+	//
+	// Unless GossipVerifyOutgoingDisabled is set, everything we send is
+	// encrypted. When set, we send plaintext even though we hold keys.
+	//
+	// To turn on encryption without a partition, first give every node the
+	// keys with both set, then clear GossipVerifyOutgoingDisabled
+	// everywhere, and finally GossipVerifyIncomingDisabled.
+	GossipVerifyIncomingDisabled bool
+	GossipVerifyOutgoingDisabled bool
+
+	// PlaintextExempt lists message types that are still accepted in
+	// plaintext over UDP while incoming messages are verified, so that
+	// liveness can be checked against nodes that aren't encrypting yet
+	// while everything else, including push/pull, must be encrypted. The
+	// names are "ping", "indirect-ping", "ack", "suspect", "alive", "dead"
+	// and "user". Other messages in the same plaintext packet are dropped.
+	// It is empty by default, and should only be set for the duration of
+	// a rollout, since anyone on the network can send these messages. It
+	// applies to signing in the same way.
+	PlaintextExempt []string
+
+	// EncryptMinSize, if set, leaves messages smaller than this many
+	// bytes unencrypted to save CPU, so that only larger ones such as
+	// push/pull syncs and packets carrying broadcasts are encrypted. It
+	// requires GossipVerifyIncomingDisabled, on this node and on every
+	// node it talks to, since they must accept plaintext.
+	//
+	// This gives up much of the protection encryption offers: anyone on
+	// the network can read the small messages, which include probes,
+	// acks and single alive, suspect and dead messages, and anyone can
+	// inject such messages. Only use it where the secrecy of the payload
+	// matters and that of the control traffic doesn't.
+	EncryptMinSize int
+
+	// Keyring is the set of keys used for message level encryption. It
+	// allows keys to be rotated at runtime; see the Keyring type. If only
+	// SecretKey is set, a Keyring holding just that key is created.
+	Keyring *Keyring
+
+	// SigningKey and SigningKeyring are used to sign messages instead of
+	// encrypting them, for when their integrity matters but their secrecy
+	// doesn't. An HMAC-SHA256 is appended to every packet and stream, and
+	// ones that fail verification are dropped and counted in the
+	// memberlist.udp.verify.failed metric. They work like SecretKey and
+	// Keyring: the key must be 16, 24 or 32 bytes, a keyring allows keys
+	// to be rotated, and GossipVerifyIncomingDisabled and
+	// GossipVerifyOutgoingDisabled allow signing to be rolled out in phases. They can't be combined
+	// with encryption, which already authenticates messages.
+	SigningKey     []byte
+	SigningKeyring *Keyring
+
+	// NodeMeta is static meta data to advertise for this node, for when
+	// there is no Delegate to provide it. EncodeTags can be used to build
+	// it from a set of tags. It is ignored if Delegate is set, and may be
+	// at most 128 bytes.
+	NodeMeta []byte
+
 	// Delegate and Events are delegates for receiving and providing
 	// data to memberlist via callback mechanisms. For Delegate, see
 	// the Delegate interface. For Events, see the EventDelegate interface.
@@ -119,9 +447,85 @@ type Config struct {
 	DelegateProtocolMax     uint8
 	Events                  EventDelegate
 
+	// Conflict is an optional delegate that is notified when an alive
+	// message arrives for a known node name but with a different
+	// address. See the ConflictDelegate interface.
+	Conflict ConflictDelegate
+
+	// ConflictPolicy decides whether such an alive message is rejected,
+	// which is the default, or may move the node to the new address. See
+	// the ConflictPolicy type.
+	ConflictPolicy ConflictPolicy
+
+	// Merge is an optional delegate that can veto merging the state of a
+	// peer during a push/pull. See the MergeDelegate interface.
+	Merge MergeDelegate
+
+	// Alive is an optional delegate that can veto alive messages, and so
+	// keep nodes out of the cluster. See the AliveDelegate interface.
+	Alive AliveDelegate
+
+	// Refute is an optional delegate that is notified when other nodes
+	// suspect this node or declare it dead, and this node refutes it. See
+	// the RefuteDelegate interface.
+	Refute RefuteDelegate
+
+	// Ping is an optional delegate that is notified with the round trip
+	// time of each successful probe, and can piggyback a payload on the
+	// acks this node sends. See the PingDelegate interface.
+	Ping PingDelegate
+
+	// Probe is an optional delegate that is notified when a direct or
+	// indirect probe of another node fails. See the ProbeDelegate
+	// interface.
+	Probe ProbeDelegate
+
+	// MetricsSink is an optional sink that receives counters, samples and
+	// gauges about the protocol, such as probes, state transitions and
+	// bytes transferred. See the MetricsSink interface.
+	MetricsSink MetricsSink
+
+	// NotifyPacket, if set, is called with every packet received, before
+	// its label is checked or it is decrypted or decoded. It is meant for
+	// debugging, for example to capture traffic that triggers a decoding
+	// bug so it can be replayed, and not for application logic. It is
+	// called from the packet handling loop, so it must be quick, and it
+	// must not modify buf or keep it after returning.
+	NotifyPacket func(from net.Addr, buf []byte)
+
+	// NotifySendError, if set, is called each time the transport fails to
+	// send a packet, for example because the socket buffer is full or the
+	// network is down. These failures are also counted in
+	// Stats.UDPPacketsDropped, but only logged every so often. It is called
+	// from the goroutine doing the send, so it must be quick.
+	NotifySendError func(to net.Addr, err error)
+
 	// LogOutput is the writer where logs should be sent. If this is not
-	// set, logging will go to stderr by default.
+	// set, logging will go to stderr by default. It is ignored if Logger
+	// is set.
 	LogOutput io.Writer
+
+	// Logger is used to emit leveled log messages. If this is not set, a
+	// Logger that writes to LogOutput is created; see NewLogger.
+	Logger Logger
+
+	// Rand is the source of randomness used to pick which nodes to probe,
+	// gossip with and sync state with, and to stagger the timers. If this
+	// is not set, a source seeded with the current time is used. Tests
+	// can set a fixed seed to reproduce the same ordering on every run.
+	// Memberlist serializes access, so the source need not be thread-safe.
+	Rand rand.Source
+
+	// TransportMode selects whether UDP, TCP or both are used. Turning one
+	// off also turns off the features that need it; see TransportMode.
+	// When memberlist creates its own NetTransport, only the listeners
+	// for the selected protocols are started.
+	TransportMode TransportMode
+
+	// Transport is used to communicate with other nodes. If this is not
+	// set, a NetTransport bound to BindAddr and Port is created, which
+	// sends packets over UDP and streams over TCP.
+	Transport Transport
 }
 
 // DefaultLANConfig returns a sane set of configurations for Memberlist.
@@ -133,23 +537,30 @@ type Config struct {
 func DefaultLANConfig() *Config {
 	hostname, _ := os.Hostname()
 	return &Config{
-		Name:             hostname,
-		BindAddr:         "0.0.0.0",
-		Port:             7946,
-		ProtocolVersion:  ProtocolVersionMax,
-		TCPTimeout:       10 * time.Second,       // Timeout after 10 seconds
-		IndirectChecks:   3,                      // Use 3 nodes for the indirect ping
-		RetransmitMult:   4,                      // Retransmit a message 4 * log(N+1) nodes
-		SuspicionMult:    5,                      // Suspect a node for 5 * log(N+1) * Interval
-		PushPullInterval: 30 * time.Second,       // Low frequency
-		ProbeTimeout:     500 * time.Millisecond, // Reasonable RTT time for LAN
-		ProbeInterval:    1 * time.Second,        // Failure check every second
-
-		GossipNodes:    3,                      // Gossip to 3 nodes
-		GossipInterval: 200 * time.Millisecond, // Gossip more rapidly
+		Name:                   hostname,
+		BindAddr:               "0.0.0.0",
+		Port:                   7946,
+		ProtocolVersion:        ProtocolVersion2Compatible,
+		TCPTimeout:             10 * time.Second,       // Timeout after 10 seconds
+		IndirectChecks:         3,                      // Use 3 nodes for the indirect ping
+		RetransmitMult:         4,                      // Retransmit a message 4 * log(N+1) nodes
+		SuspicionMult:          5,                      // Suspect a node for 5 * log(N+1) * Interval
+		AwarenessMaxMultiplier: 8,                      // Health scores range from 0 to 7
+		PushPullInterval:       30 * time.Second,       // Low frequency
+		ProbeTimeout:           500 * time.Millisecond, // Reasonable RTT time for LAN
+		ProbeInterval:          1 * time.Second,        // Failure check every second
+
+		GossipNodes:         3,                      // Gossip to 3 nodes
+		GossipInterval:      200 * time.Millisecond, // Gossip more rapidly
+		GossipToTheDeadTime: 30 * time.Second,       // Same as push/pull
 
 		EnableCompression: true, // Enable compression by default
 		SecretKey:         nil,
+
+		AckHandlerWarnThreshold: 1024, // Far more than probing needs
+
+		StreamWorkers:     16,
+		HandoffQueueDepth: 1024,
 	}
 }
 
@@ -165,6 +576,7 @@ func DefaultWANConfig() *Config {
 	conf.ProbeInterval = 5 * time.Second
 	conf.GossipNodes = 4 // Gossip less frequently, but to an additional node
 	conf.GossipInterval = 500 * time.Millisecond
+	conf.GossipToTheDeadTime = 60 * time.Second
 	return conf
 }
 
@@ -181,5 +593,151 @@ func DefaultLocalConfig() *Config {
 	conf.ProbeTimeout = 200 * time.Millisecond
 	conf.ProbeInterval = time.Second
 	conf.GossipInterval = 100 * time.Millisecond
+	conf.GossipToTheDeadTime = 15 * time.Second
 	return conf
 }
+
+// Validate checks the configuration for settings that memberlist can't
+// work with, returning an error that describes the first one found. It
+// doesn't modify the configuration. Create calls this before doing
+// anything else, but it can also be used to check a configuration ahead
+// of time.
+func (c *Config) Validate() error {
+	if c.ProtocolVersion < ProtocolVersionMin {
+		return fmt.Errorf("Protocol version '%d' too low. Must be in range: [%d, %d]",
+			c.ProtocolVersion, ProtocolVersionMin, ProtocolVersionMax)
+	} else if c.ProtocolVersion > ProtocolVersionMax {
+		return fmt.Errorf("Protocol version '%d' too high. Must be in range: [%d, %d]",
+			c.ProtocolVersion, ProtocolVersionMin, ProtocolVersionMax)
+	}
+
+	if len(c.SecretKey) > 0 {
+		if err := validateKey(c.SecretKey); err != nil {
+			return fmt.Errorf("Invalid SecretKey: %v", err)
+		}
+	}
+
+	if (len(c.SecretKey) > 0 || c.EncryptionEnabled()) && c.ProtocolVersion < 1 {
+		return fmt.Errorf("Encryption is not supported before protocol version 1")
+	}
+
+	if len(c.SigningKey) > 0 {
+		if err := validateKey(c.SigningKey); err != nil {
+			return fmt.Errorf("Invalid SigningKey: %v", err)
+		}
+	}
+	if (len(c.SecretKey) > 0 || c.EncryptionEnabled()) && (len(c.SigningKey) > 0 || c.SigningEnabled()) {
+		return fmt.Errorf("Signing can't be combined with encryption")
+	}
+
+	if c.EnableCompression && c.CompressionAlgo > CompressionFlate {
+		return fmt.Errorf("Unknown compression algorithm %d", c.CompressionAlgo)
+	}
+
+	if len(c.Label) > labelMaxSize {
+		return fmt.Errorf("Label is %d bytes, the maximum is %d", len(c.Label), labelMaxSize)
+	}
+
+	if c.ProbeIntervalMax > 0 && c.ProbeIntervalMin > c.ProbeIntervalMax {
+		return fmt.Errorf("ProbeIntervalMin %v is above ProbeIntervalMax %v",
+			c.ProbeIntervalMin, c.ProbeIntervalMax)
+	}
+	if c.ProbeIntervalMin > 0 && c.ProbeIntervalMin < c.ProbeTimeout {
+		return fmt.Errorf("ProbeIntervalMin %v is below ProbeTimeout %v",
+			c.ProbeIntervalMin, c.ProbeTimeout)
+	}
+	if c.ProbeIntervalMax > 0 && c.ProbeIntervalMax < c.ProbeTimeout {
+		return fmt.Errorf("ProbeIntervalMax %v is below ProbeTimeout %v",
+			c.ProbeIntervalMax, c.ProbeTimeout)
+	}
+
+	if c.CrossZoneProbeTimeout < 0 {
+		return fmt.Errorf("CrossZoneProbeTimeout must not be negative")
+	}
+
+	if c.DeadNodeReclaimTime < 0 {
+		return fmt.Errorf("DeadNodeReclaimTime must not be negative")
+	}
+
+	if c.SuspicionMaxTimeoutMult < 0 {
+		return fmt.Errorf("SuspicionMaxTimeoutMult must not be negative")
+	}
+
+	if c.EncryptMinSize < 0 {
+		return fmt.Errorf("EncryptMinSize must not be negative")
+	}
+	if c.EncryptMinSize > 0 && !c.GossipVerifyIncomingDisabled {
+		return fmt.Errorf("EncryptMinSize requires GossipVerifyIncomingDisabled")
+	}
+
+	if c.UDPMaxPacketSize < 0 {
+		return fmt.Errorf("UDPMaxPacketSize must not be negative")
+	}
+
+	if c.ConflictPolicy < ConflictRejectAndAlert || c.ConflictPolicy > ConflictPreferNewerIncarnation {
+		return fmt.Errorf("Unknown conflict policy %d", c.ConflictPolicy)
+	}
+	if c.IntervalJitter < 0 || c.IntervalJitter >= 1 {
+		return fmt.Errorf("IntervalJitter must be at least 0 and below 1")
+	}
+	if c.PushPullConnIdleTimeout < 0 {
+		return fmt.Errorf("PushPullConnIdleTimeout must not be negative")
+	}
+	if c.StreamWorkers < 0 {
+		return fmt.Errorf("StreamWorkers must not be negative")
+	}
+	if c.HandoffQueueDepth < 0 {
+		return fmt.Errorf("HandoffQueueDepth must not be negative")
+	}
+
+	if len(c.NodeMeta) > metaMaxSize {
+		return fmt.Errorf("Node meta data is %d bytes, the maximum is %d", len(c.NodeMeta), metaMaxSize)
+	}
+
+	if c.TransportMode < TransportUDPAndTCP || c.TransportMode > TransportTCPOnly {
+		return fmt.Errorf("Unknown transport mode %d", c.TransportMode)
+	}
+
+	for _, addr := range c.BindAddrs {
+		if net.ParseIP(addr) == nil {
+			return fmt.Errorf("Bind address '%s' is not an IP address", addr)
+		}
+	}
+
+	if c.AdvertiseAddr != "" && net.ParseIP(c.AdvertiseAddr) == nil {
+		return fmt.Errorf("Advertise address '%s' is not an IP address", c.AdvertiseAddr)
+	}
+
+	for _, name := range c.PlaintextExempt {
+		if _, ok := plaintextExemptTypes[name]; !ok {
+			return fmt.Errorf("Unknown message type '%s' in PlaintextExempt", name)
+		}
+	}
+
+	if c.PreferredCIDR != "" {
+		if _, _, err := net.ParseCIDR(c.PreferredCIDR); err != nil {
+			return fmt.Errorf("Invalid PreferredCIDR: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// bindAddr returns the address that is advertised by default, which is
+// the first of BindAddrs if set
+func (c *Config) bindAddr() string {
+	if len(c.BindAddrs) > 0 {
+		return c.BindAddrs[0]
+	}
+	return c.BindAddr
+}
+
+// EncryptionEnabled returns whether or not encryption is enabled
+func (c *Config) EncryptionEnabled() bool {
+	return c.Keyring != nil && len(c.Keyring.GetKeys()) > 0
+}
+
+// SigningEnabled returns whether or not signing is enabled
+func (c *Config) SigningEnabled() bool {
+	return c.SigningKeyring != nil && len(c.SigningKeyring.GetKeys()) > 0
+}
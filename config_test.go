@@ -0,0 +1,76 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	cases := []struct {
+		name string
+		f    func(c *Config)
+		err  bool
+	}{
+		{"default", func(c *Config) {}, false},
+		{"protocol too high", func(c *Config) { c.ProtocolVersion = ProtocolVersionMax + 1 }, true},
+		{"good key", func(c *Config) { c.SecretKey = make([]byte, 32) }, false},
+		{"bad key", func(c *Config) { c.SecretKey = make([]byte, 20) }, true},
+		{"encryption before v1", func(c *Config) {
+			c.SecretKey = make([]byte, 16)
+			c.ProtocolVersion = 0
+		}, true},
+		{"signing key", func(c *Config) { c.SigningKey = make([]byte, 32) }, false},
+		{"bad signing key", func(c *Config) { c.SigningKey = make([]byte, 20) }, true},
+		{"signing and encryption", func(c *Config) {
+			c.SecretKey = make([]byte, 16)
+			c.SigningKey = make([]byte, 16)
+		}, true},
+		{"unknown compression", func(c *Config) { c.CompressionAlgo = CompressionType(42) }, true},
+		{"unknown compression disabled", func(c *Config) {
+			c.CompressionAlgo = CompressionType(42)
+			c.EnableCompression = false
+		}, false},
+		{"long label", func(c *Config) { c.Label = string(make([]byte, labelMaxSize+1)) }, true},
+		{"bind addrs", func(c *Config) { c.BindAddrs = []string{"10.0.0.1", "192.168.0.1"} }, false},
+		{"bind addrs name", func(c *Config) { c.BindAddrs = []string{"10.0.0.1", "localhost"} }, true},
+		{"advertise ip", func(c *Config) { c.AdvertiseAddr = "127.0.0.1" }, false},
+		{"advertise name", func(c *Config) { c.AdvertiseAddr = "localhost" }, true},
+		{"node meta", func(c *Config) { c.NodeMeta = make([]byte, metaMaxSize) }, false},
+		{"long node meta", func(c *Config) { c.NodeMeta = make([]byte, metaMaxSize+1) }, true},
+		{"probe bounds", func(c *Config) { c.ProbeIntervalMin, c.ProbeIntervalMax = c.ProbeTimeout, 2*c.ProbeTimeout }, false},
+		{"probe min only", func(c *Config) { c.ProbeIntervalMin = c.ProbeTimeout }, false},
+		{"probe bounds reversed", func(c *Config) { c.ProbeIntervalMin, c.ProbeIntervalMax = 2*c.ProbeTimeout, c.ProbeTimeout }, true},
+		{"probe min below timeout", func(c *Config) { c.ProbeIntervalMin = c.ProbeTimeout / 2 }, true},
+		{"probe max below timeout", func(c *Config) { c.ProbeIntervalMax = c.ProbeTimeout / 2 }, true},
+		{"udp only", func(c *Config) { c.TransportMode = TransportUDPOnly }, false},
+		{"negative cross zone timeout", func(c *Config) { c.CrossZoneProbeTimeout = -time.Second }, true},
+		{"suspicion max mult", func(c *Config) { c.SuspicionMaxTimeoutMult = 6 }, false},
+		{"encrypt min size", func(c *Config) {
+			c.EncryptMinSize = 512
+			c.GossipVerifyIncomingDisabled = true
+		}, false},
+		{"encrypt min size verifying", func(c *Config) { c.EncryptMinSize = 512 }, true},
+		{"negative suspicion max mult", func(c *Config) { c.SuspicionMaxTimeoutMult = -1 }, true},
+		{"negative push/pull idle timeout", func(c *Config) { c.PushPullConnIdleTimeout = -time.Second }, true},
+		{"unknown conflict policy", func(c *Config) { c.ConflictPolicy = ConflictPolicy(5) }, true},
+		{"interval jitter", func(c *Config) { c.IntervalJitter = 0.2 }, false},
+		{"interval jitter too high", func(c *Config) { c.IntervalJitter = 1 }, true},
+		{"plaintext exempt", func(c *Config) { c.PlaintextExempt = []string{"ping", "ack"} }, false},
+		{"unknown plaintext exempt", func(c *Config) { c.PlaintextExempt = []string{"push-pull"} }, true},
+		{"preferred cidr", func(c *Config) { c.PreferredCIDR = "10.0.0.0/8" }, false},
+		{"bad preferred cidr", func(c *Config) { c.PreferredCIDR = "10.0.0.0" }, true},
+		{"unknown transport mode", func(c *Config) { c.TransportMode = TransportMode(7) }, true},
+	}
+
+	for _, tc := range cases {
+		for _, c := range []*Config{DefaultLANConfig(), DefaultWANConfig(), DefaultLocalConfig()} {
+			tc.f(c)
+			err := c.Validate()
+			if tc.err && err == nil {
+				t.Fatalf("%s: expected err", tc.name)
+			} else if !tc.err && err != nil {
+				t.Fatalf("%s: err: %s", tc.name, err)
+			}
+		}
+	}
+}
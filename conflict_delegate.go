@@ -0,0 +1,40 @@
+package memberlist
+
+// ConflictPolicy decides what happens when an alive message arrives for
+// a known node name but with a different address, see
+// Config.ConflictPolicy
+type ConflictPolicy int
+
+const (
+	// ConflictRejectAndAlert keeps the existing node, logs an error and
+	// informs the ConflictDelegate, if any. This is the default.
+	ConflictRejectAndAlert ConflictPolicy = iota
+
+	// ConflictIgnore keeps the existing node without raising the alarm,
+	// for networks where conflicts are expected and harmless
+	ConflictIgnore
+
+	// ConflictPreferNewerIncarnation moves the node to the new address if
+	// the message has a higher incarnation number than we know, or if the
+	// node is dead or left, so that a node that restarts on a new address
+	// is picked up straight away. Other messages are rejected as with
+	// ConflictRejectAndAlert, as are any for this node's own name. Anyone
+	// who can send us an alive message can take over a name this way, so
+	// only use it on trusted networks or with encryption.
+	ConflictPreferNewerIncarnation
+)
+
+// ConflictDelegate is used to inform a client that
+// a node has attempted to join which would result in a
+// name conflict. This happens if two clients are configured
+// with the same name but different addresses.
+type ConflictDelegate interface {
+	// NotifyConflict is invoked when a name conflict is detected.
+	// The existing node is the one currently in the member list and
+	// other is the node that attempted to join with the same name.
+	// It isn't invoked if the node is moved to the new address, see
+	// ConflictPolicy.
+	// Neither Node argument may be modified. No internal locks are held,
+	// so it is safe to call back into the Memberlist from within it.
+	NotifyConflict(existing, other *Node)
+}
@@ -0,0 +1,99 @@
+package memberlist
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// connPool keeps a push/pull connection to each peer open between syncs,
+// see Config.PushPullConnIdleTimeout. A connection is taken out of the
+// pool while it is in use, so it is never shared.
+type connPool struct {
+	sync.Mutex
+	idleTimeout time.Duration
+	conns       map[string]*pooledConn
+	closed      bool
+}
+
+// pooledConn is an idle connection and when it was last used
+type pooledConn struct {
+	conn      net.Conn
+	idleSince time.Time
+}
+
+func newConnPool(idleTimeout time.Duration) *connPool {
+	return &connPool{
+		idleTimeout: idleTimeout,
+		conns:       make(map[string]*pooledConn),
+	}
+}
+
+// enabled returns whether connections are pooled at all
+func (p *connPool) enabled() bool {
+	return p.idleTimeout > 0
+}
+
+// get takes the idle connection to addr out of the pool, or returns nil
+// if there isn't one that has been idle for less than the idle timeout
+func (p *connPool) get(addr string) net.Conn {
+	p.Lock()
+	defer p.Unlock()
+
+	pc, ok := p.conns[addr]
+	if !ok {
+		return nil
+	}
+	delete(p.conns, addr)
+	if time.Since(pc.idleSince) >= p.idleTimeout {
+		pc.conn.Close()
+		return nil
+	}
+	return pc.conn
+}
+
+// put returns a healthy connection to the pool, closing it instead if
+// pooling is off, the pool is closed or it already holds one for addr.
+// Connections that have been idle for too long are closed on the way.
+func (p *connPool) put(addr string, conn net.Conn) {
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	for a, pc := range p.conns {
+		if now.Sub(pc.idleSince) >= p.idleTimeout {
+			pc.conn.Close()
+			delete(p.conns, a)
+		}
+	}
+
+	if _, ok := p.conns[addr]; ok || p.closed || !p.enabled() {
+		conn.Close()
+		return
+	}
+	p.conns[addr] = &pooledConn{conn: conn, idleSince: now}
+}
+
+// close closes all the idle connections, and any that are put back later
+func (p *connPool) close() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.closed = true
+	for addr, pc := range p.conns {
+		pc.conn.Close()
+		delete(p.conns, addr)
+	}
+}
+
+// peekConn is a net.Conn that reads through a bufio.Reader, so that we can
+// wait for the next message on a pooled connection without consuming it
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -20,6 +20,14 @@ type Delegate interface {
 	// overhead as provided with a limit on the total byte size allowed.
 	// The total byte size of the resulting data to send must not exceed
 	// the limit.
+	//
+	// It is called each time memberlist gossips or sends a packet that has
+	// room to spare, after memberlist's own pending broadcasts have been
+	// added. Each returned buffer is framed as a user message and is sent
+	// exactly once; it is up to the delegate to retransmit if needed. The
+	// buffers are delivered to NotifyMsg on the receiving nodes. For
+	// broadcasts that should be retransmitted and invalidated like
+	// memberlist's own, see Memberlist.QueueBroadcast instead.
 	GetBroadcasts(overhead, limit int) [][]byte
 
 	// LocalState is used for a TCP Push/Pull. This is sent to
@@ -34,3 +42,16 @@ type Delegate interface {
 	// boolean indicates this is for a join instead of a push/pull.
 	MergeRemoteState(buf []byte, join bool)
 }
+
+// BatchDelegate can optionally be implemented by a Delegate to receive
+// user messages in batches rather than one NotifyMsg call each.
+type BatchDelegate interface {
+	// NotifyMsgs is called instead of NotifyMsg with all the user
+	// messages from a single packet, or with the one message from a
+	// stream. Within a compound packet they are delivered after the
+	// packet's other messages have been handled, whereas NotifyMsg is
+	// called for each one in turn as it comes up. The same rules as for
+	// NotifyMsg apply: it must not block, and the byte slices may be
+	// modified after the call returns.
+	NotifyMsgs([][]byte)
+}
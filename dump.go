@@ -0,0 +1,181 @@
+package memberlist
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+// stateDumpVersion is the version of the format written by DumpState
+const stateDumpVersion = 1
+
+// StateDump is a diagnostic snapshot of a Memberlist's internal state, as
+// written by DumpState and read back by ReadStateDump. Times are given in
+// Unix nanoseconds, with zero meaning unset.
+type StateDump struct {
+	Version     int
+	Time        int64 // When the dump was taken
+	Name        string
+	SequenceNum uint32
+	Incarnation uint32
+	HealthScore int
+	Leaving     bool
+	Shutdown    bool
+	Config      DumpedConfig
+	Nodes       []DumpedNode
+	Broadcasts  []DumpedBroadcast
+	AckHandlers []uint32 // Sequence numbers of the probes awaiting an ack
+}
+
+// DumpedConfig is the subset of the Config that is useful for working
+// out why a cluster misbehaves.
+type DumpedConfig struct {
+	ProtocolVersion         uint8
+	DelegateProtocolVersion uint8
+	TransportMode           int
+	Encrypted               bool
+	Label                   string
+	ProbeInterval           time.Duration
+	ProbeTimeout            time.Duration
+	GossipInterval          time.Duration
+	GossipNodes             int
+	PushPullInterval        time.Duration
+	IndirectChecks          int
+	RetransmitMult          int
+	SuspicionMult           int
+	SuspicionMaxTimeoutMult int
+	GossipToTheDeadTime     time.Duration
+}
+
+// DumpedNode is the state of one node in a StateDump, including nodes
+// that are dead but not yet reaped.
+type DumpedNode struct {
+	Name          string
+	Addr          []byte
+	Port          uint16
+	Meta          []byte
+	Vsn           []uint8 // pmin, pmax, pcur, dmin, dmax, dcur
+	Incarnation   uint32
+	State         string // One of "alive", "suspect", "dead" or "left"
+	StateChange   int64
+	LastContact   int64
+	Confirmations int // Independent suspicions seen, if suspect
+}
+
+// DumpedBroadcast is a message waiting in the broadcast queue
+type DumpedBroadcast struct {
+	Node      string // The node the message is about, if known
+	Transmits int
+	Queued    int64
+	Message   []byte
+}
+
+// unixNano returns t in Unix nanoseconds, or zero if t is unset
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// DumpState writes a versioned snapshot of the internal state to w for
+// post-mortem debugging, such as attaching to a bug report when the
+// cluster fails to converge. Unlike SaveState it includes transient state
+// like pending broadcasts and outstanding probes, and can't be loaded
+// back into a Memberlist; use ReadStateDump to decode it.
+func (m *Memberlist) DumpState(w io.Writer) error {
+	t := m.tunables()
+	dump := StateDump{
+		Version:     stateDumpVersion,
+		Time:        time.Now().UnixNano(),
+		Name:        m.localName(),
+		SequenceNum: atomic.LoadUint32(&m.sequenceNum),
+		Incarnation: atomic.LoadUint32(&m.incarnation),
+		HealthScore: m.GetHealthScore(),
+		Config: DumpedConfig{
+			ProtocolVersion:         m.config.ProtocolVersion,
+			DelegateProtocolVersion: m.config.DelegateProtocolVersion,
+			TransportMode:           int(m.config.TransportMode),
+			Encrypted:               m.EncryptionEnabled(),
+			Label:                   m.config.Label,
+			ProbeInterval:           m.ProbeInterval(),
+			ProbeTimeout:            t.ProbeTimeout,
+			GossipInterval:          t.GossipInterval,
+			GossipNodes:             t.GossipNodes,
+			PushPullInterval:        t.PushPullInterval,
+			IndirectChecks:          t.IndirectChecks,
+			RetransmitMult:          t.RetransmitMult,
+			SuspicionMult:           t.SuspicionMult,
+			SuspicionMaxTimeoutMult: t.SuspicionMaxTimeoutMult,
+			GossipToTheDeadTime:     t.GossipToTheDeadTime,
+		},
+	}
+
+	m.startStopLock.Lock()
+	dump.Leaving = m.hasLeft()
+	dump.Shutdown = m.shutdown
+	m.startStopLock.Unlock()
+
+	m.nodeLock.RLock()
+	dump.Nodes = make([]DumpedNode, 0, len(m.nodes))
+	for _, n := range m.nodes {
+		d := DumpedNode{
+			Name:        n.Name,
+			Addr:        n.Addr,
+			Port:        n.Port,
+			Meta:        n.Meta,
+			Vsn:         []uint8{n.PMin, n.PMax, n.PCur, n.DMin, n.DMax, n.DCur},
+			Incarnation: n.Incarnation,
+			State:       n.State.String(),
+			StateChange: unixNano(n.StateChange),
+			LastContact: unixNano(n.LastContact),
+		}
+		if s, ok := m.nodeTimers[n.Name]; ok && n.State == StateSuspect {
+			d.Confirmations = int(atomic.LoadInt32(&s.n))
+		}
+		dump.Nodes = append(dump.Nodes, d)
+	}
+	m.nodeLock.RUnlock()
+
+	q := m.broadcasts
+	q.Lock()
+	for _, b := range q.bcQueue {
+		d := DumpedBroadcast{
+			Transmits: b.transmits,
+			Queued:    unixNano(b.queued),
+			Message:   b.b.Message(),
+		}
+		if mb, ok := b.b.(*memberlistBroadcast); ok {
+			d.Node = mb.node
+		}
+		dump.Broadcasts = append(dump.Broadcasts, d)
+	}
+	q.Unlock()
+
+	m.ackLock.Lock()
+	for seqNo := range m.ackHandlers {
+		dump.AckHandlers = append(dump.AckHandlers, seqNo)
+	}
+	m.ackLock.Unlock()
+
+	hd := codec.MsgpackHandle{}
+	enc := codec.NewEncoder(w, &hd)
+	return enc.Encode(&dump)
+}
+
+// ReadStateDump decodes a snapshot written by DumpState
+func ReadStateDump(r io.Reader) (*StateDump, error) {
+	var dump StateDump
+	hd := codec.MsgpackHandle{}
+	dec := codec.NewDecoder(r, &hd)
+	if err := dec.Decode(&dump); err != nil {
+		return nil, fmt.Errorf("Failed to decode state dump: %v", err)
+	}
+	if dump.Version != stateDumpVersion {
+		return nil, fmt.Errorf("Unsupported state dump version %d", dump.Version)
+	}
+	return &dump, nil
+}
@@ -0,0 +1,65 @@
+package memberlist
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMemberlist_DumpState(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	a1 := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1}
+	m.aliveNode(&a1)
+	a2 := alive{Node: "test2", Addr: []byte{127, 0, 0, 2}, Port: 8000, Meta: []byte("meta"), Incarnation: 3}
+	m.aliveNode(&a2)
+	s := suspect{Node: "test2", Incarnation: 3, From: "test3"}
+	m.suspectNode(&s)
+	m.setAckHandler(42, func([]byte, time.Time) {}, time.Minute)
+
+	var buf bytes.Buffer
+	if err := m.DumpState(&buf); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	dump, err := ReadStateDump(&buf)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if dump.Name != m.config.Name || dump.Config.ProtocolVersion != m.config.ProtocolVersion {
+		t.Fatalf("bad: %v", dump)
+	}
+	if len(dump.Nodes) != 2 {
+		t.Fatalf("bad nodes: %v", dump.Nodes)
+	}
+	for _, n := range dump.Nodes {
+		if n.Name != "test2" {
+			continue
+		}
+		if n.State != "suspect" || n.Incarnation != 3 || n.Port != 8000 ||
+			string(n.Meta) != "meta" || n.StateChange == 0 {
+			t.Fatalf("bad node: %v", n)
+		}
+	}
+
+	// The suspicion is queued for gossip
+	found := false
+	for _, b := range dump.Broadcasts {
+		if b.Node == "test2" && messageType(b.Message[0]) == suspectMsg {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("missing broadcast: %v", dump.Broadcasts)
+	}
+
+	if len(dump.AckHandlers) != 1 || dump.AckHandlers[0] != 42 {
+		t.Fatalf("bad ack handlers: %v", dump.AckHandlers)
+	}
+}
+
+func TestReadStateDump_Bad(t *testing.T) {
+	if _, err := ReadStateDump(bytes.NewReader([]byte("junk"))); err == nil {
+		t.Fatalf("expected error")
+	}
+}
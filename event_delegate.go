@@ -4,14 +4,33 @@ package memberlist
 // notifications about members joining and leaving. The methods in this
 // delegate may be called by multiple goroutines, but never concurrently.
 // This allows you to reason about ordering.
+//
+// The methods are invoked after the memberlist has released its internal
+// locks, so it is safe to call back into the Memberlist (for example to
+// call Members) from within them.
 type EventDelegate interface {
 	// NotifyJoin is invoked when a node is detected to have joined.
 	// The Node argument must not be modified.
 	NotifyJoin(*Node)
 
 	// NotifyLeave is invoked when a node is detected to have left.
+	// The Node's LeaveCause says whether it left on purpose or failed.
 	// The Node argument must not be modified.
 	NotifyLeave(*Node)
+
+	// NotifyUpdate is invoked when a node is detected to have
+	// updated, usually involving the meta data. The Node argument
+	// must not be modified.
+	NotifyUpdate(*Node)
+}
+
+// JoinEventDelegate can optionally be implemented by an EventDelegate to
+// hear when a join that JoinOrWait handed off to the background finally
+// succeeds. Like the other events it is never delivered concurrently.
+type JoinEventDelegate interface {
+	// NotifyJoined is invoked with the number of hosts that were joined.
+	// The NotifyJoin events for the nodes learnt from them come first.
+	NotifyJoined(numJoined int)
 }
 
 // ChannelEventDelegate is used to enable an application to receive
@@ -31,6 +50,7 @@ type NodeEventType int
 const (
 	NodeJoin NodeEventType = iota
 	NodeLeave
+	NodeUpdate
 )
 
 // NodeEvent is a single event related to node activity in the memberlist.
@@ -49,3 +69,29 @@ func (c *ChannelEventDelegate) NotifyJoin(n *Node) {
 func (c *ChannelEventDelegate) NotifyLeave(n *Node) {
 	c.Ch <- NodeEvent{NodeLeave, n}
 }
+
+func (c *ChannelEventDelegate) NotifyUpdate(n *Node) {
+	c.Ch <- NodeEvent{NodeUpdate, n}
+}
+
+// dispatchEvent delivers a node event to the configured EventDelegate.
+// It must be called without holding the nodeLock so that the delegate
+// is free to call back into the memberlist. A nil event is ignored.
+func (m *Memberlist) dispatchEvent(e *NodeEvent) {
+	if e == nil || m.config.Events == nil {
+		return
+	}
+
+	// Serialize delivery so the delegate is never invoked concurrently
+	m.eventLock.Lock()
+	defer m.eventLock.Unlock()
+
+	switch e.Event {
+	case NodeJoin:
+		m.config.Events.NotifyJoin(e.Node)
+	case NodeLeave:
+		m.config.Events.NotifyLeave(e.Node)
+	case NodeUpdate:
+		m.config.Events.NotifyUpdate(e.Node)
+	}
+}
@@ -0,0 +1,198 @@
+package memberlist
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// Keyring holds the set of keys used for message level encryption. The
+// first key in the ring is the primary key, which is used to encrypt all
+// outgoing messages. All of the keys are tried when decrypting incoming
+// messages, which allows the keys to be rotated across a running cluster:
+// install the new key on every node with AddKey, make it the primary with
+// UseKey, and then remove the old key with RemoveKey.
+type Keyring struct {
+	// Keys stores the key data used during encryption and decryption. It is
+	// ordered in such a way where the first key (index 0) is the primary key,
+	// which is used for encrypting messages, and is the first key tried during
+	// message decryption.
+	keys [][]byte
+
+	// The keyring lock is used while performing IO operations on the keyring.
+	l sync.Mutex
+}
+
+// NewKeyring constructs a new container for a set of encryption keys. The
+// keyring contains all key data used internally by memberlist.
+//
+// If only a primary key is passed, then it will be automatically added to the
+// keyring. If creating a keyring with multiple keys, one key must be designated
+// primary by passing it as the primaryKey. If the primaryKey does not exist in
+// the list of secondary keys, it will be automatically added at position 0.
+func NewKeyring(keys [][]byte, primaryKey []byte) (*Keyring, error) {
+	keyring := &Keyring{}
+
+	if len(keys) > 0 || len(primaryKey) > 0 {
+		if len(primaryKey) == 0 {
+			return nil, fmt.Errorf("Empty primary key not allowed")
+		}
+		if err := keyring.AddKey(primaryKey); err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if err := keyring.AddKey(key); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return keyring, nil
+}
+
+// validateKey checks that the key is usable as an encryption key. The
+// key length selects AES-128, AES-192 or AES-256.
+func validateKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	default:
+		return fmt.Errorf("key size must be 16, 24 or 32 bytes")
+	}
+}
+
+// AddKey will install a new key on the ring. Adding a key to the ring will make
+// it available for use in decryption. If the key already exists on the ring,
+// this function will just return noop. If the ring is empty, the key will
+// become the primary key.
+func (k *Keyring) AddKey(key []byte) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	k.l.Lock()
+	defer k.l.Unlock()
+
+	// No-op if key is already installed
+	for _, installedKey := range k.keys {
+		if bytes.Equal(installedKey, key) {
+			return nil
+		}
+	}
+
+	k.keys = append(k.keys, key)
+	return nil
+}
+
+// UseKey changes the key used to encrypt messages. This is the only key used to
+// encrypt messages, so peers should know this key before this method is called.
+func (k *Keyring) UseKey(key []byte) error {
+	k.l.Lock()
+	defer k.l.Unlock()
+
+	for i, installedKey := range k.keys {
+		if bytes.Equal(key, installedKey) {
+			// Move the key to the front, keeping the order of the rest
+			keys := make([][]byte, 0, len(k.keys))
+			keys = append(keys, installedKey)
+			keys = append(keys, k.keys[:i]...)
+			keys = append(keys, k.keys[i+1:]...)
+			k.keys = keys
+			return nil
+		}
+	}
+	return fmt.Errorf("Requested key is not in the keyring")
+}
+
+// RemoveKey drops a key from the keyring. This will return an error if the key
+// requested for removal is currently at position 0 (primary key).
+func (k *Keyring) RemoveKey(key []byte) error {
+	k.l.Lock()
+	defer k.l.Unlock()
+
+	if len(k.keys) > 0 && bytes.Equal(key, k.keys[0]) {
+		return fmt.Errorf("Removing the primary key is not allowed")
+	}
+	for i, installedKey := range k.keys {
+		if bytes.Equal(key, installedKey) {
+			keys := make([][]byte, 0, len(k.keys)-1)
+			keys = append(keys, k.keys[:i]...)
+			keys = append(keys, k.keys[i+1:]...)
+			k.keys = keys
+		}
+	}
+	return nil
+}
+
+// GetKeys returns the current set of keys on the ring.
+func (k *Keyring) GetKeys() [][]byte {
+	k.l.Lock()
+	defer k.l.Unlock()
+
+	return k.keys
+}
+
+// GetPrimaryKey returns the key on the ring at position 0. This is the key used
+// for encrypting messages, and is the first key tried for decrypting messages.
+func (k *Keyring) GetPrimaryKey() []byte {
+	k.l.Lock()
+	defer k.l.Unlock()
+
+	if len(k.keys) > 0 {
+		return k.keys[0]
+	}
+	return nil
+}
+
+// keyring returns the configured keyring, which holds the signing keys
+// if messages are signed rather than encrypted, or an error if neither
+// is enabled.
+func (m *Memberlist) keyring() (*Keyring, error) {
+	if m.config.SigningEnabled() {
+		return m.config.SigningKeyring, nil
+	}
+	if !m.config.EncryptionEnabled() {
+		return nil, fmt.Errorf("Encryption is not enabled")
+	}
+	return m.config.Keyring, nil
+}
+
+// AddKey installs a new key on the keyring of this node, making it
+// available for decryption. See Keyring.AddKey.
+func (m *Memberlist) AddKey(key []byte) error {
+	keyring, err := m.keyring()
+	if err != nil {
+		return err
+	}
+	return keyring.AddKey(key)
+}
+
+// UseKey changes the primary key used to encrypt outgoing messages on
+// this node. See Keyring.UseKey.
+func (m *Memberlist) UseKey(key []byte) error {
+	keyring, err := m.keyring()
+	if err != nil {
+		return err
+	}
+	return keyring.UseKey(key)
+}
+
+// RemoveKey removes a key from the keyring of this node. The primary
+// key cannot be removed. See Keyring.RemoveKey.
+func (m *Memberlist) RemoveKey(key []byte) error {
+	keyring, err := m.keyring()
+	if err != nil {
+		return err
+	}
+	return keyring.RemoveKey(key)
+}
+
+// GetKeys returns the keys currently installed on the keyring of this
+// node, with the primary key first. See Keyring.GetKeys.
+func (m *Memberlist) GetKeys() ([][]byte, error) {
+	keyring, err := m.keyring()
+	if err != nil {
+		return nil, err
+	}
+	return keyring.GetKeys(), nil
+}
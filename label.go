@@ -0,0 +1,76 @@
+package memberlist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// labelMaxSize is the longest label that fits in the one byte length of
+// the label header.
+const labelMaxSize = 255
+
+// labelOverhead returns the number of bytes the label header adds to a
+// packet or stream, which is zero when no label is configured.
+func labelOverhead(label string) int {
+	if label == "" {
+		return 0
+	}
+	return 2 + len(label)
+}
+
+// addLabelHeader prefixes buf with a header holding the given label:
+// the hasLabelMsg byte, the length of the label and the label itself.
+// Nothing is added for an empty label, so unlabeled clusters talk the
+// same as before.
+func addLabelHeader(buf []byte, label string) []byte {
+	if label == "" {
+		return buf
+	}
+	out := make([]byte, 0, labelOverhead(label)+len(buf))
+	out = append(out, byte(hasLabelMsg), byte(len(label)))
+	out = append(out, label...)
+	return append(out, buf...)
+}
+
+// removeLabelHeaderFromPacket strips the label header, if there is one,
+// from a packet and returns the rest of the packet along with the label.
+func removeLabelHeaderFromPacket(buf []byte) ([]byte, string, error) {
+	if len(buf) == 0 || messageType(buf[0]) != hasLabelMsg {
+		return buf, "", nil
+	}
+	if len(buf) < 2 {
+		return nil, "", fmt.Errorf("Truncated label header")
+	}
+	size := int(buf[1])
+	if size == 0 || len(buf) < 2+size {
+		return nil, "", fmt.Errorf("Invalid label header")
+	}
+	return buf[2+size:], string(buf[2 : 2+size]), nil
+}
+
+// removeLabelHeaderFromStream reads the label header, if there is one,
+// from the start of a stream and returns the label.
+func removeLabelHeaderFromStream(r *bufio.Reader) (string, error) {
+	peeked, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if messageType(peeked[0]) != hasLabelMsg {
+		return "", nil
+	}
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	size := int(header[1])
+	if size == 0 {
+		return "", fmt.Errorf("Invalid label header")
+	}
+	label := make([]byte, size)
+	if _, err := io.ReadFull(r, label); err != nil {
+		return "", err
+	}
+	return string(label), nil
+}
@@ -0,0 +1,121 @@
+package memberlist
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestLabel_Packet(t *testing.T) {
+	buf := []byte{byte(pingMsg), 1, 2, 3}
+
+	// No label leaves the packet as is
+	if out := addLabelHeader(buf, ""); !bytes.Equal(out, buf) {
+		t.Fatalf("bad: %v", out)
+	}
+	out, label, err := removeLabelHeaderFromPacket(buf)
+	if err != nil || label != "" || !bytes.Equal(out, buf) {
+		t.Fatalf("bad: %v %q %v", out, label, err)
+	}
+
+	labeled := addLabelHeader(buf, "blue")
+	out, label, err = removeLabelHeaderFromPacket(labeled)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if label != "blue" || !bytes.Equal(out, buf) {
+		t.Fatalf("bad: %v %q", out, label)
+	}
+
+	// Truncated headers are rejected
+	for _, bad := range [][]byte{
+		{byte(hasLabelMsg)},
+		{byte(hasLabelMsg), 0},
+		{byte(hasLabelMsg), 5, 'b', 'l'},
+	} {
+		if _, _, err := removeLabelHeaderFromPacket(bad); err == nil {
+			t.Fatalf("expected err for %v", bad)
+		}
+	}
+}
+
+func TestLabel_Stream(t *testing.T) {
+	buf := []byte{byte(pushPullMsg), 1, 2, 3}
+
+	r := bufio.NewReader(bytes.NewReader(addLabelHeader(buf, "green")))
+	label, err := removeLabelHeaderFromStream(r)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if label != "green" {
+		t.Fatalf("bad label: %q", label)
+	}
+	rest := make([]byte, len(buf))
+	if _, err := r.Read(rest); err != nil || !bytes.Equal(rest, buf) {
+		t.Fatalf("bad: %v %v", rest, err)
+	}
+
+	// Unlabeled streams are left untouched
+	r = bufio.NewReader(bytes.NewReader(buf))
+	label, err = removeLabelHeaderFromStream(r)
+	if err != nil || label != "" {
+		t.Fatalf("bad: %q %v", label, err)
+	}
+	if b, _ := r.ReadByte(); messageType(b) != pushPullMsg {
+		t.Fatalf("should not consume the message type")
+	}
+}
+
+func TestMemberlist_Join_Label(t *testing.T) {
+	sink := newMockSink()
+	c1 := testConfig()
+	c1.Label = "blue"
+	c1.MetricsSink = sink
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.Label = "blue"
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(m1.Members()) != 2 || len(m2.Members()) != 2 {
+		t.Fatalf("bad: %v %v", m1.Members(), m2.Members())
+	}
+
+	// A node with another label can't join
+	c3 := testConfig()
+	c3.Label = "green"
+	m3, err := Create(c3)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m3.Shutdown()
+
+	if _, err := m3.Join([]string{c1.BindAddr}); err == nil {
+		t.Fatalf("expected join to fail")
+	}
+	if len(m1.Members()) != 2 || len(m3.Members()) != 1 {
+		t.Fatalf("bad: %v %v", m1.Members(), m3.Members())
+	}
+	if sink.counter("memberlist.label.mismatch") == 0 {
+		t.Fatalf("expected label mismatch to be counted")
+	}
+}
+
+func TestCreate_LabelTooLong(t *testing.T) {
+	c := testConfig()
+	c.Label = string(make([]byte, labelMaxSize+1))
+	if _, err := Create(c); err == nil {
+		t.Fatalf("expected err")
+	}
+}
@@ -0,0 +1,44 @@
+package memberlist
+
+import (
+	"io"
+	"log"
+)
+
+// Logger is used by memberlist to emit leveled log messages. It can be
+// implemented to route memberlist's logs into an application's own
+// logging library. All the methods must be safe for concurrent use.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// NewLogger returns a Logger that writes to out, prefixing each message
+// with its level, for example "[WARN] ...". This is the Logger used when
+// only Config.LogOutput is set.
+func NewLogger(out io.Writer) Logger {
+	return &stdLogger{log.New(out, "", log.LstdFlags)}
+}
+
+// stdLogger adapts a *log.Logger to the Logger interface
+type stdLogger struct {
+	l *log.Logger
+}
+
+func (s *stdLogger) Debugf(format string, v ...interface{}) {
+	s.l.Printf("[DEBUG] "+format, v...)
+}
+
+func (s *stdLogger) Infof(format string, v ...interface{}) {
+	s.l.Printf("[INFO] "+format, v...)
+}
+
+func (s *stdLogger) Warnf(format string, v ...interface{}) {
+	s.l.Printf("[WARN] "+format, v...)
+}
+
+func (s *stdLogger) Errorf(format string, v ...interface{}) {
+	s.l.Printf("[ERR] "+format, v...)
+}
@@ -0,0 +1,100 @@
+package memberlist
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// captureLogger is a Logger that records each message with its level
+type captureLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (c *captureLogger) logf(level, format string, v ...interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	c.lines = append(c.lines, level+" "+fmt.Sprintf(format, v...))
+}
+
+func (c *captureLogger) Debugf(format string, v ...interface{}) { c.logf("DEBUG", format, v...) }
+func (c *captureLogger) Infof(format string, v ...interface{})  { c.logf("INFO", format, v...) }
+func (c *captureLogger) Warnf(format string, v ...interface{})  { c.logf("WARN", format, v...) }
+func (c *captureLogger) Errorf(format string, v ...interface{}) { c.logf("ERR", format, v...) }
+
+func TestNewLogger_Levels(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf)
+	l.Debugf("a %d", 1)
+	l.Infof("b %d", 2)
+	l.Warnf("c %d", 3)
+	l.Errorf("d %d", 4)
+
+	out := buf.String()
+	for _, expect := range []string{"[DEBUG] a 1", "[INFO] b 2", "[WARN] c 3", "[ERR] d 4"} {
+		if !strings.Contains(out, expect) {
+			t.Fatalf("missing %q in %q", expect, out)
+		}
+	}
+}
+
+func TestMemberlist_Logger(t *testing.T) {
+	var buf bytes.Buffer
+	l := &captureLogger{}
+
+	c := testConfig()
+	c.ProtocolVersion = 0
+	c.EnableCompression = true
+	c.LogOutput = &buf
+	c.Logger = l
+
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.Shutdown()
+
+	l.Lock()
+	defer l.Unlock()
+	found := false
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, "WARN Compression") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("bad: %v", l.lines)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("LogOutput should not be used: %s", buf.String())
+	}
+}
+
+func TestMemberlist_PublicUnencryptedWarning(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		l := &captureLogger{}
+		m := GetMemberlist(t)
+		m.logger = l
+		m.config.AdvertiseAddr = "8.8.8.8"
+		m.config.AllowPublicUnencrypted = allow
+		if err := m.setAlive(); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		m.Shutdown()
+
+		l.Lock()
+		found := false
+		for _, line := range l.lines {
+			if strings.HasPrefix(line, "WARN Binding to public address without encryption") {
+				found = true
+			}
+		}
+		l.Unlock()
+		if found == allow {
+			t.Fatalf("allow=%v: bad: %v", allow, l.lines)
+		}
+	}
+}
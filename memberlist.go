@@ -15,107 +15,212 @@ multiple routes.
 package memberlist
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"io"
+	"math"
+	"math/rand"
 	"net"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrShutdown is returned by operations that cannot be performed once
+// the memberlist has been shut down.
+var ErrShutdown = fmt.Errorf("memberlist has been shut down")
+
 type Memberlist struct {
+	stats Stats // Updated atomically, so kept first for 64-bit alignment
+
 	config         *Config
+	configLock     sync.RWMutex // Guards the settings ReloadConfig changes
+	name           atomic.Value // The local node's name, see localName
 	shutdown       bool
-	leave          bool
+	leave          int32 // Set by Leave, accessed atomically, see hasLeft
 	leaveBroadcast chan struct{}
+	draining       int32 // Set by Drain, accessed atomically
 
-	udpListener *net.UDPConn
-	tcpListener *net.TCPListener
+	shutdownCh chan struct{}
+
+	transport Transport
 
 	sequenceNum uint32 // Local sequence number
 	incarnation uint32 // Local incarnation number
 
-	nodeLock sync.RWMutex
-	nodes    []*nodeState          // Known nodes
-	nodeMap  map[string]*nodeState // Maps Addr.String() -> NodeState
+	nodeLock   sync.RWMutex
+	nodes      []*nodeState          // Known nodes
+	nodeMap    map[string]*nodeState // Maps Addr.String() -> NodeState
+	nodeTimers map[string]*suspicion // Maps Node.Name -> suspicion timer
+
+	eventLock sync.Mutex // Serializes EventDelegate callbacks
 
 	tickerLock sync.Mutex
 	tickers    []*time.Ticker
 	stopTick   chan struct{}
+	tickerWg   sync.WaitGroup // Tracks the goroutines started by startTickers
 	probeIndex int
 
+	paused        bool // Set by Pause, guarded by tickerLock
+	resumeTickers bool // Whether Resume should restart the tickers
+
+	streamQueue chan net.Conn    // Hands inbound connections to the stream workers
+	relayQueue  chan relayedSend // Hands oversized packets to the relay worker
+	connPool    *connPool        // Idle push/pull connections, by address
+
+	plaintextExempt map[messageType]bool // See Config.PlaintextExempt
+
+	sendErrLock       sync.Mutex
+	sendErrLogged     time.Time // When a failed packet send was last logged
+	sendErrSuppressed int       // Failed sends not logged since then
+
 	ackLock     sync.Mutex
 	ackHandlers map[uint32]*ackHandler
 
 	broadcasts *TransmitLimitedQueue
 
+	awareness *awareness
+
+	rng *rand.Rand // Used to pick nodes to probe and gossip with
+
 	startStopLock sync.Mutex
 
-	logger *log.Logger
+	wg sync.WaitGroup // Tracks the background goroutines for Shutdown
+
+	logger Logger
 }
 
 // newMemberlist creates the network listeners.
 // Does not schedule execution of background maintenence.
 func newMemberlist(conf *Config) (*Memberlist, error) {
-	if conf.ProtocolVersion < ProtocolVersionMin {
-		return nil, fmt.Errorf("Protocol version '%d' too low. Must be in range: [%d, %d]",
-			conf.ProtocolVersion, ProtocolVersionMin, ProtocolVersionMax)
-	} else if conf.ProtocolVersion > ProtocolVersionMax {
-		return nil, fmt.Errorf("Protocol version '%d' too high. Must be in range: [%d, %d]",
-			conf.ProtocolVersion, ProtocolVersionMin, ProtocolVersionMax)
+	if err := conf.Validate(); err != nil {
+		return nil, err
 	}
 
 	if len(conf.SecretKey) > 0 {
-		if conf.ProtocolVersion < 1 {
-			return nil, fmt.Errorf("Encryption is not supported before protocol version 1")
-		}
-		if len(conf.SecretKey) != 16 {
-			return nil, fmt.Errorf("SecretKey must be 16 bytes in length")
+		if conf.Keyring == nil {
+			keyring, err := NewKeyring(nil, conf.SecretKey)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid SecretKey: %v", err)
+			}
+			conf.Keyring = keyring
+		} else {
+			if err := conf.Keyring.AddKey(conf.SecretKey); err != nil {
+				return nil, fmt.Errorf("Invalid SecretKey: %v", err)
+			}
+			if err := conf.Keyring.UseKey(conf.SecretKey); err != nil {
+				return nil, err
+			}
 		}
 	} else {
 		conf.SecretKey = nil
 	}
 
-	tcpAddr := &net.TCPAddr{IP: net.ParseIP(conf.BindAddr), Port: conf.Port}
-	tcpLn, err := net.ListenTCP("tcp", tcpAddr)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to start TCP listener. Err: %s", err)
+	if len(conf.SigningKey) > 0 {
+		if conf.SigningKeyring == nil {
+			keyring, err := NewKeyring(nil, conf.SigningKey)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid SigningKey: %v", err)
+			}
+			conf.SigningKeyring = keyring
+		} else {
+			if err := conf.SigningKeyring.AddKey(conf.SigningKey); err != nil {
+				return nil, fmt.Errorf("Invalid SigningKey: %v", err)
+			}
+			if err := conf.SigningKeyring.UseKey(conf.SigningKey); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	udpAddr := &net.UDPAddr{IP: net.ParseIP(conf.BindAddr), Port: conf.Port}
-	udpLn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		tcpLn.Close()
-		return nil, fmt.Errorf("Failed to start UDP listener. Err: %s", err)
+	if conf.LogOutput == nil {
+		conf.LogOutput = os.Stderr
+	}
+	logger := conf.Logger
+	if logger == nil {
+		logger = NewLogger(conf.LogOutput)
 	}
 
-	// Set the UDP receive window size
-	setUDPRecvBuf(udpLn)
+	// Set up a network transport by default if a custom one wasn't given
+	transport := conf.Transport
+	if transport == nil {
+		nc := &NetTransportConfig{
+			BindAddr:         conf.BindAddr,
+			BindAddrs:        conf.BindAddrs,
+			BindPort:         conf.Port,
+			Logger:           logger,
+			TLSConfig:        conf.TLSConfig,
+			TCPKeepAlive:     conf.TCPKeepAlive,
+			HandshakeTimeout: conf.TCPTimeout,
+			UDPBufferSize:    conf.UDPBufferSize,
+			Mode:             conf.TransportMode,
+		}
+		nt, err := NewNetTransport(nc)
+		if err != nil {
+			return nil, err
+		}
+		transport = nt
+	}
 
-	if conf.LogOutput == nil {
-		conf.LogOutput = os.Stderr
+	// Advertise the port we actually got if we asked for any free one
+	if conf.Port == 0 {
+		conf.Port = boundPort(transport)
 	}
-	logger := log.New(conf.LogOutput, "", log.LstdFlags)
 
 	// Warn if compression is enabled with bad protocol version
 	if conf.EnableCompression && conf.ProtocolVersion < 1 {
-		logger.Printf("[WARN] Compression is enabled with an unsupported protocol")
+		logger.Warnf("Compression is enabled with an unsupported protocol")
 		conf.EnableCompression = false
 	}
 
 	m := &Memberlist{
 		config:         conf,
 		leaveBroadcast: make(chan struct{}, 1),
-		udpListener:    udpLn,
-		tcpListener:    tcpLn,
+		shutdownCh:     make(chan struct{}),
+		transport:      transport,
 		nodeMap:        make(map[string]*nodeState),
+		nodeTimers:     make(map[string]*suspicion),
 		ackHandlers:    make(map[uint32]*ackHandler),
 		broadcasts:     &TransmitLimitedQueue{RetransmitMult: conf.RetransmitMult},
+		connPool:       newConnPool(conf.PushPullConnIdleTimeout),
+		awareness:      newAwareness(conf.AwarenessMaxMultiplier),
+		rng:            newRand(conf.Rand),
 		logger:         logger,
 	}
+	m.name.Store(conf.Name)
 	m.broadcasts.NumNodes = func() int { return len(m.nodes) }
-	go m.tcpListen()
-	go m.udpListen()
+	for _, name := range conf.PlaintextExempt {
+		if m.plaintextExempt == nil {
+			m.plaintextExempt = make(map[messageType]bool)
+		}
+		m.plaintextExempt[plaintextExemptTypes[name]] = true
+	}
+	if conf.AckHandlerWarnThreshold > 0 {
+		m.wg.Add(1)
+		go m.ackHandlerSweep()
+	}
+	if conf.StreamWorkers > 0 {
+		m.streamQueue = make(chan net.Conn, conf.HandoffQueueDepth)
+		m.wg.Add(conf.StreamWorkers)
+		for i := 0; i < conf.StreamWorkers; i++ {
+			go m.streamWorker()
+		}
+	}
+	if conf.UDPMaxPacketSize > 0 && conf.TransportMode.tcp() {
+		m.relayQueue = make(chan relayedSend, relayQueueDepth)
+		m.wg.Add(1)
+		go m.relayWorker()
+	}
+	m.wg.Add(2)
+	go m.streamListen()
+	go m.packetListen()
 	return m, nil
 }
 
@@ -123,7 +228,8 @@ func newMemberlist(conf *Config) (*Memberlist, error) {
 // This will not connect to any other node (see Join) yet, but will start
 // all the listeners to allow other nodes to join this memberlist.
 // After creating a Memberlist, the configuration given should not be
-// modified by the user anymore.
+// modified by the user anymore. The configuration is checked with
+// Config.Validate first.
 func Create(conf *Config) (*Memberlist, error) {
 	m, err := newMemberlist(conf)
 	if err != nil {
@@ -141,90 +247,465 @@ func Create(conf *Config) (*Memberlist, error) {
 // by contacting all the given hosts and performing a state sync. Initially,
 // the Memberlist only contains our own state, so doing this will cause
 // remote nodes to become aware of the existence of this node, effectively
-// joining the cluster.
+// joining the cluster. A host may also be given as a DNS SRV name, such as
+// _gossip._tcp.example.com, in which case every target it lists is tried.
 //
 // This returns the number of hosts successfully contacted and an error if
 // none could be reached. If an error is returned, the node did not successfully
 // join the cluster.
 func (m *Memberlist) Join(existing []string) (int, error) {
+	return m.JoinContext(context.Background(), existing)
+}
+
+// JoinContext is like Join, but stops contacting further hosts once ctx is
+// done. Any deadline on ctx also bounds the TCP dial and state exchange with
+// each host, and cancelling ctx aborts an exchange that is in progress.
+func (m *Memberlist) JoinContext(ctx context.Context, existing []string) (int, error) {
+	results, err := m.joinDetailed(ctx, existing)
+
+	numSuccess := 0
+	for _, r := range results {
+		if r.Success {
+			numSuccess++
+		}
+	}
+	return numSuccess, err
+}
+
+// JoinRetry is like Join, but if none of the hosts can be reached it tries
+// the whole list again, up to attempts times in total. It waits
+// initialDelay before the first retry and doubles the wait after each
+// one. This is useful on startup, when the other nodes may still be
+// coming up. It returns as soon as an attempt reaches at least one host,
+// with the error from the last attempt if none did.
+func (m *Memberlist) JoinRetry(existing []string, attempts int, initialDelay time.Duration) (int, error) {
+	return m.JoinRetryContext(context.Background(), existing, attempts, initialDelay)
+}
+
+// JoinRetryContext is like JoinRetry, but gives up once ctx is done, both
+// while contacting hosts and while waiting to retry, returning ctx.Err().
+func (m *Memberlist) JoinRetryContext(ctx context.Context, existing []string, attempts int, initialDelay time.Duration) (int, error) {
+	numSuccess := 0
+	delay := initialDelay
+	var err error
+	for i := 0; ; i++ {
+		var n int
+		n, err = m.JoinContext(ctx, existing)
+		numSuccess += n
+		if err == nil || i+1 >= attempts {
+			break
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return numSuccess, ctxErr
+		}
+
+		m.logger.Warnf("Join attempt %d of %d failed, retrying in %v: %v", i+1, attempts, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return numSuccess, ctx.Err()
+		case <-m.shutdownCh:
+			return numSuccess, err
+		}
+		delay *= 2
+	}
+	return numSuccess, err
+}
+
+// SeedParseError is returned by JoinFromReader for a line of the seed list
+// that isn't a valid host[:port] entry, before any host is contacted
+type SeedParseError struct {
+	Line  int // Line number, starting at 1
+	Entry string
+	Err   error
+}
+
+func (e *SeedParseError) Error() string {
+	return fmt.Sprintf("Invalid seed %q on line %d: %v", e.Entry, e.Line, e.Err)
+}
+
+// JoinFromReader is like Join, but reads the hosts from r, one host[:port]
+// per line in any of the forms Join takes. Blank lines are skipped, as is
+// anything after a '#', so seed files can be commented. If a line can't
+// be parsed a *SeedParseError is returned and no host is contacted;
+// errors from contacting the hosts are returned as for Join.
+func (m *Memberlist) JoinFromReader(r io.Reader) (int, error) {
+	var seeds []string
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		entry := scanner.Text()
+		if i := strings.IndexByte(entry, '#'); i >= 0 {
+			entry = entry[:i]
+		}
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if err := checkSeed(entry); err != nil {
+			return 0, &SeedParseError{Line: line, Entry: entry, Err: err}
+		}
+		seeds = append(seeds, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("Failed to read seeds: %v", err)
+	}
+	if len(seeds) == 0 {
+		return 0, fmt.Errorf("No seeds to join")
+	}
+	return m.Join(seeds)
+}
+
+// checkSeed checks that a seed is a host, IP or SRV name, optionally with
+// a port, without resolving it
+func checkSeed(entry string) error {
+	if strings.ContainsAny(entry, " \t") {
+		return fmt.Errorf("Unexpected whitespace")
+	}
+	if net.ParseIP(entry) != nil {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(entry)
+	if ae, ok := err.(*net.AddrError); ok && ae.Err == "missing port in address" {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("Missing host")
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("Invalid port %q", port)
+	}
+	return nil
+}
+
+// JoinOrWait is like Join, but doesn't fail if none of the hosts can be
+// reached. The node carries on alone, as the first node of a new cluster
+// would, and keeps trying the hosts in the background every
+// GossipInterval until one of them answers, we leave, or we shut down.
+// If the EventDelegate implements JoinEventDelegate it is told when a
+// background join succeeds. It returns the number of hosts joined right
+// away, which is zero if the join was handed off to the background.
+func (m *Memberlist) JoinOrWait(existing []string) int {
+	numSuccess, err := m.Join(existing)
+	if err == nil {
+		return numSuccess
+	}
+
+	m.startStopLock.Lock()
+	defer m.startStopLock.Unlock()
+	if m.shutdown {
+		return 0
+	}
+
+	m.logger.Warnf("Failed to join any of %v, running alone until one answers: %v", existing, err)
+	m.wg.Add(1)
+	go m.joinInBackground(existing)
+	return 0
+}
+
+// joinInBackground retries a join that failed on every host until one
+// succeeds, then notifies the JoinEventDelegate if there is one. Shutdown
+// waits for it while holding the startStopLock, so it must not take that.
+func (m *Memberlist) joinInBackground(existing []string) {
+	defer m.wg.Done()
+
+	// Give up on a join in progress when we shut down
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-m.shutdownCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		interval := m.tunables().GossipInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		select {
+		case <-time.After(interval):
+		case <-m.shutdownCh:
+			return
+		}
+
+		if m.hasLeft() {
+			return
+		}
+
+		numSuccess, err := m.JoinContext(ctx, existing)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			m.logger.Debugf("Background join failed: %v", err)
+			continue
+		}
+
+		m.logger.Infof("Joined %d of %v in the background", numSuccess, existing)
+		if jd, ok := m.config.Events.(JoinEventDelegate); ok {
+			m.eventLock.Lock()
+			jd.NotifyJoined(numSuccess)
+			m.eventLock.Unlock()
+		}
+		return
+	}
+}
+
+// JoinWithAddrs is like Join, but takes addresses the caller has already
+// resolved, such as from a separate discovery system, and contacts them
+// as they are without any DNS lookups or default ports. Each address must
+// be a *net.TCPAddr or *net.UDPAddr.
+func (m *Memberlist) JoinWithAddrs(addrs []net.Addr) (int, error) {
+	numSuccess := 0
+	var retErr error
+	for _, addr := range addrs {
+		var ip net.IP
+		var port int
+		switch a := addr.(type) {
+		case *net.TCPAddr:
+			ip, port = a.IP, a.Port
+		case *net.UDPAddr:
+			ip, port = a.IP, a.Port
+		default:
+			retErr = fmt.Errorf("Unsupported address type %T for %v", addr, addr)
+			continue
+		}
+
+		if err := m.pushPullNode(context.Background(), ip, uint16(port), true); err != nil {
+			retErr = err
+			continue
+		}
+		numSuccess++
+	}
+
+	if numSuccess > 0 {
+		retErr = nil
+	}
+	return numSuccess, retErr
+}
+
+// JoinResult is the outcome of contacting a single host during a join.
+type JoinResult struct {
+	Host    string // The host as it was given to JoinDetailed
+	Success bool   // Whether a state sync with the host completed
+	Err     error  // Why the host could not be joined, if it failed
+}
+
+// JoinDetailed is like Join, but returns the outcome of contacting each of
+// the given hosts, in the same order, so that callers can tell exactly
+// which hosts failed and why. The returned error follows the same rules as
+// Join: it is only set if no host could be reached.
+func (m *Memberlist) JoinDetailed(existing []string) ([]JoinResult, error) {
+	return m.joinDetailed(context.Background(), existing)
+}
+
+// joinDetailed attempts a push/pull with each of the existing hosts,
+// recording the result for every one of them.
+func (m *Memberlist) joinDetailed(ctx context.Context, existing []string) ([]JoinResult, error) {
 	// Attempt to join any of them
+	results := make([]JoinResult, len(existing))
 	numSuccess := 0
 	var retErr error
-	for _, exist := range existing {
-		addr, port, err := m.resolveAddr(exist)
-		if err != nil {
-			m.logger.Printf("[WARN] Failed to resolve %s: %v", exist, err)
+	for i, exist := range existing {
+		results[i].Host = exist
+		if err := ctx.Err(); err != nil {
+			results[i].Err = err
 			retErr = err
 			continue
 		}
 
-		if err := m.pushPullNode(addr, port, true); err != nil {
+		addrs, err := m.resolveAddr(exist)
+		if err != nil {
+			m.logger.Warnf("Failed to resolve %s: %v", exist, err)
+			results[i].Err = err
 			retErr = err
 			continue
 		}
 
-		numSuccess++
+		// A host may resolve to several nodes, for example through an
+		// SRV record. It counts as joined if any of them can be synced.
+		for _, a := range addrs {
+			if err := m.pushPullNode(ctx, a.ip, a.port, true); err != nil {
+				// Report the context error rather than the closed connection
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					err = ctxErr
+				}
+				results[i].Err = err
+				retErr = err
+				continue
+			}
+			results[i].Success = true
+		}
+
+		if results[i].Success {
+			results[i].Err = nil
+			numSuccess++
+		}
 	}
 
 	if numSuccess > 0 {
 		retErr = nil
 	}
 
-	return numSuccess, retErr
+	return results, retErr
 }
 
-// resolveAddr is used to resolve the address into an address,
-// port, and error. If no port is given, use the default
-func (m *Memberlist) resolveAddr(hostStr string) ([]byte, uint16, error) {
-	// Add the port if none
-START:
-	_, _, err := net.SplitHostPort(hostStr)
-	if ae, ok := err.(*net.AddrError); ok && ae.Err == "missing port in address" {
-		hostStr = fmt.Sprintf("%s:%d", hostStr, m.config.Port)
-		goto START
+// ipPort holds an address and port that a host resolved to
+type ipPort struct {
+	ip   net.IP
+	port uint16
+}
+
+// lookupSRV and lookupIP perform DNS lookups for resolveAddr. They are
+// variables so that tests can avoid depending on real DNS records.
+var (
+	lookupSRV = net.LookupSRV
+	lookupIP  = net.LookupIP
+)
+
+// resolveAddr is used to resolve the address into a list of addresses
+// and ports. If no port is given, use the default. Names of the form
+// _service._proto.name are looked up as DNS SRV records, which may
+// yield several addresses.
+func (m *Memberlist) resolveAddr(hostStr string) ([]ipPort, error) {
+	if m.config.Resolver != nil {
+		return m.resolveCustom(hostStr)
 	}
-	if err != nil {
-		return nil, 0, err
+	if isSRVName(hostStr) {
+		return m.resolveSRV(hostStr)
+	}
+
+	// Add the port if none. A bare IP (including an unbracketed IPv6
+	// literal) never carries a port, while a host or bracketed IPv6
+	// literal without a port needs its brackets removed before joining.
+	port := strconv.Itoa(m.config.Port)
+	if net.ParseIP(hostStr) != nil {
+		hostStr = net.JoinHostPort(hostStr, port)
+	} else {
+		_, _, err := net.SplitHostPort(hostStr)
+		if ae, ok := err.(*net.AddrError); ok && ae.Err == "missing port in address" {
+			host := strings.TrimSuffix(strings.TrimPrefix(hostStr, "["), "]")
+			hostStr = net.JoinHostPort(host, port)
+		} else if err != nil {
+			return nil, err
+		}
 	}
 
 	// Get the address
 	addr, err := net.ResolveTCPAddr("tcp", hostStr)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
 	// Return IP/Port
-	return addr.IP, uint16(addr.Port), nil
+	return []ipPort{{addr.IP, uint16(addr.Port)}}, nil
+}
+
+// resolveCustom resolves the host with Config.Resolver
+func (m *Memberlist) resolveCustom(hostStr string) ([]ipPort, error) {
+	resolved, err := m.config.Resolver(hostStr)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []ipPort
+	for _, addr := range resolved {
+		var ip net.IP
+		var port int
+		switch a := addr.(type) {
+		case *net.TCPAddr:
+			ip, port = a.IP, a.Port
+		case *net.UDPAddr:
+			ip, port = a.IP, a.Port
+		case *net.IPAddr:
+			ip = a.IP
+		default:
+			return nil, fmt.Errorf("Unsupported address type %T for %v", addr, addr)
+		}
+		if port == 0 {
+			port = m.config.Port
+		}
+		addrs = append(addrs, ipPort{ip, uint16(port)})
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("Resolver returned no addresses for %s", hostStr)
+	}
+	return addrs, nil
+}
+
+// isSRVName checks if the host looks like an SRV record name, such
+// as _gossip._tcp.example.com
+func isSRVName(hostStr string) bool {
+	return strings.HasPrefix(hostStr, "_") &&
+		(strings.Contains(hostStr, "._tcp.") || strings.Contains(hostStr, "._udp."))
+}
+
+// resolveSRV looks up the SRV records for name and resolves each target.
+// Targets that fail to resolve are skipped, and an error is only returned
+// if none of them could be resolved.
+func (m *Memberlist) resolveSRV(name string) ([]ipPort, error) {
+	_, srvs, err := lookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []ipPort
+	for _, srv := range srvs {
+		ips, err := lookupIP(srv.Target)
+		if err != nil || len(ips) == 0 {
+			m.logger.Warnf("Failed to resolve SRV target %s for %s: %v", srv.Target, name, err)
+			continue
+		}
+		addrs = append(addrs, ipPort{ips[0], srv.Port})
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("No SRV targets for %s could be resolved", name)
+	}
+	return addrs, nil
 }
 
 // setAlive is used to mark this node as being alive. This is the same
 // as if we received an alive notification our own network channel for
 // ourself.
 func (m *Memberlist) setAlive() error {
-	// Pick a private IP address
+	// Pick a private IP address, unless we've been told what to advertise
 	var ipAddr []byte
-	if m.config.BindAddr == "0.0.0.0" {
+	if m.config.AdvertiseAddr != "" {
+		ipAddr = net.ParseIP(m.config.AdvertiseAddr)
+		if ipAddr == nil {
+			return fmt.Errorf("Advertise address '%s' is not an IP address", m.config.AdvertiseAddr)
+		}
+
+		// Ensure IPv4 conversion if necessary
+		if ip4 := net.IP(ipAddr).To4(); ip4 != nil {
+			ipAddr = ip4
+		}
+	} else if bindIP := net.ParseIP(m.config.bindAddr()); bindIP != nil && bindIP.IsUnspecified() {
 		// We're not bound to a specific IP, so let's list the interfaces
-		// on this machine and use the first private IP we find.
+		// on this machine and use the first one in the preferred subnet,
+		// or else the first private IP we find, preferring IPv4 over IPv6.
 		addresses, err := net.InterfaceAddrs()
 		if err != nil {
 			return fmt.Errorf("Failed to get interface addresses! Err: %vn", err)
 		}
-
-		// Find private IPv4 address
-		for _, addr := range addresses {
-			ip, ok := addr.(*net.IPNet)
-			if !ok {
-				continue
+		if m.config.PreferredCIDR != "" {
+			_, preferred, err := net.ParseCIDR(m.config.PreferredCIDR)
+			if err != nil {
+				return fmt.Errorf("Invalid PreferredCIDR: %v", err)
 			}
-			if ip.IP.To4() == nil {
-				continue
+			ipAddr = findIPInNet(addresses, preferred)
+			if ipAddr == nil {
+				m.logger.Warnf("No address in PreferredCIDR %s, using the first private address", preferred)
 			}
-			if !isPrivateIP(ip.IP.String()) {
-				continue
-			}
-			ipAddr = ip.IP
-			break
+		}
+		if ipAddr == nil {
+			ipAddr = findPrivateIP(addresses)
 		}
 
 		// Failed to find private IP, error
@@ -233,30 +714,41 @@ func (m *Memberlist) setAlive() error {
 		}
 	} else {
 		// Use the IP that we're bound to.
-		addr := m.tcpListener.Addr().(*net.TCPAddr)
-		ipAddr = addr.IP
+		host, _, err := net.SplitHostPort(m.transport.LocalAddr().String())
+		if err != nil {
+			return fmt.Errorf("Failed to parse bound address! Err: %v", err)
+		}
+		ipAddr = net.ParseIP(host)
+		if ipAddr == nil {
+			return fmt.Errorf("Bound address '%s' is not an IP address", host)
+		}
 	}
 
+	// Advertise the port we're bound to, unless told otherwise
+	port := m.config.Port
+	if m.config.AdvertisePort != 0 {
+		port = m.config.AdvertisePort
+	}
+	ipAddr, advPort := m.advertiseAddr(ipAddr, uint16(port))
+
 	// Check if this is a public address without encryption
 	addrStr := net.IP(ipAddr).String()
-	if !isPrivateIP(addrStr) && !isLoopbackIP(addrStr) && m.config.SecretKey == nil {
-		m.logger.Printf("[WARN] Binding to public address without encryption!")
+	if !isPrivateIP(addrStr) && !isLoopbackIP(addrStr) && !m.config.EncryptionEnabled() &&
+		!m.config.AllowPublicUnencrypted {
+		m.logger.Warnf("Binding to public address without encryption!")
 	}
 
 	// Get the node meta data
-	var meta []byte
-	if m.config.Delegate != nil {
-		meta = m.config.Delegate.NodeMeta(metaMaxSize)
-		if len(meta) > metaMaxSize {
-			panic("Node meta data provided is longer than the limit")
-		}
+	meta, err := m.localMeta()
+	if err != nil {
+		return err
 	}
 
 	a := alive{
 		Incarnation: m.nextIncarnation(),
-		Node:        m.config.Name,
+		Node:        m.localName(),
 		Addr:        ipAddr,
-		Port:        uint16(m.config.Port),
+		Port:        advPort,
 		Meta:        meta,
 		Vsn: []uint8{
 			ProtocolVersionMin, ProtocolVersionMax, m.config.ProtocolVersion,
@@ -269,6 +761,534 @@ func (m *Memberlist) setAlive() error {
 	return nil
 }
 
+// hasLeft returns whether Leave has been called
+func (m *Memberlist) hasLeft() bool {
+	return atomic.LoadInt32(&m.leave) == 1
+}
+
+// boundPort returns the port the transport is listening on, or zero if
+// it can't tell
+func boundPort(t Transport) int {
+	switch addr := t.LocalAddr().(type) {
+	case nil:
+		return 0
+	case *net.TCPAddr:
+		return addr.Port
+	case *net.UDPAddr:
+		return addr.Port
+	default:
+		_, port, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return 0
+		}
+		p, _ := strconv.Atoi(port)
+		return p
+	}
+}
+
+// advertiseAddr returns the address and port to advertise for this node.
+// The given ones are returned unless Config.AdvertiseAddrFunc provides
+// valid replacements.
+func (m *Memberlist) advertiseAddr(ip net.IP, port uint16) (net.IP, uint16) {
+	if m.config.AdvertiseAddrFunc == nil {
+		return ip, port
+	}
+
+	newIP, newPort, err := m.config.AdvertiseAddrFunc()
+	if err != nil {
+		m.logger.Warnf("Failed to get advertise address, keeping %v:%d: %v", ip, port, err)
+		return ip, port
+	}
+	if newIP == nil || newIP.IsUnspecified() {
+		m.logger.Warnf("Advertise address '%v' is not usable, keeping %v:%d", newIP, ip, port)
+		return ip, port
+	}
+
+	// Ensure IPv4 conversion if necessary
+	if ip4 := newIP.To4(); ip4 != nil {
+		newIP = ip4
+	}
+	if newPort == 0 {
+		newPort = port
+	}
+	return newIP, newPort
+}
+
+// refuteAddr returns the address to refute a suspect or dead message about
+// the given node with, if that is us and Config.AdvertiseAddrFunc is set,
+// so a refutation doesn't advertise a stale address. The IP is nil
+// otherwise. It calls out to the application, so it must be called
+// without holding the nodeLock.
+func (m *Memberlist) refuteAddr(node string) (net.IP, uint16) {
+	if m.config.AdvertiseAddrFunc == nil || node != m.localName() {
+		return nil, 0
+	}
+	local := m.LocalNode()
+	if local == nil {
+		return nil, 0
+	}
+	return m.advertiseAddr(local.Addr, local.Port)
+}
+
+// setLocalAddr moves our own entry to the given address, if it is set and
+// has changed. The nodeLock must be held.
+func (m *Memberlist) setLocalAddr(state *nodeState, ip net.IP, port uint16) {
+	if ip == nil || (ip.Equal(state.Addr) && port == state.Port) {
+		return
+	}
+	m.logger.Infof("Advertised address changed from %v:%d to %v:%d",
+		state.Addr, state.Port, ip, port)
+	state.Addr = ip
+	state.Port = port
+}
+
+// localMeta returns the meta data to advertise for the local node, from
+// the Delegate if there is one and from Config.NodeMeta otherwise
+func (m *Memberlist) localMeta() ([]byte, error) {
+	if m.config.Delegate == nil {
+		return m.config.NodeMeta, nil
+	}
+
+	meta := m.config.Delegate.NodeMeta(metaMaxSize)
+	if len(meta) > metaMaxSize {
+		return nil, fmt.Errorf("Node meta data provided is longer than the limit")
+	}
+	return meta, nil
+}
+
+// UpdateNode is used to trigger re-advertising the local node. This is
+// primarily used with a Delegate to support dynamic updates to the local
+// meta data. The delegate's NodeMeta is invoked again and the result is
+// broadcast with a new incarnation number.
+//
+// This will block until the update message is successfully broadcasted
+// to a member of the cluster, if any exist or until a specified timeout
+// is reached.
+func (m *Memberlist) UpdateNode(timeout time.Duration) error {
+	// Get the node meta data
+	meta, err := m.localMeta()
+	if err != nil {
+		return err
+	}
+	return m.advertiseMeta(meta, timeout)
+}
+
+// SetMeta is a lighter alternative to UpdateNode for applications that
+// encode their own meta data. The given meta data is broadcast as is
+// with a new incarnation number, without calling the Delegate. It may be
+// at most 128 bytes. A later UpdateNode replaces it with the Delegate's
+// meta data, or Config.NodeMeta. Like UpdateNode, this blocks until the
+// update is broadcast or the timeout is reached.
+func (m *Memberlist) SetMeta(meta []byte, timeout time.Duration) error {
+	if len(meta) > metaMaxSize {
+		return fmt.Errorf("Node meta data is %d bytes, the maximum is %d", len(meta), metaMaxSize)
+	}
+	return m.advertiseMeta(meta, timeout)
+}
+
+// advertiseMeta broadcasts an alive message for the local node with the
+// given meta data and a new incarnation number, and waits for it to go
+// out for up to timeout if there are other nodes to send it to.
+func (m *Memberlist) advertiseMeta(meta []byte, timeout time.Duration) error {
+	// Get the existing node, and check for any other alive node
+	m.nodeLock.RLock()
+	state, ok := m.nodeMap[m.localName()]
+	var local nodeState
+	if ok {
+		local = *state
+	}
+	anyAlive := false
+	for _, n := range m.nodes {
+		if !n.deadOrLeft() && n.Name != m.localName() {
+			anyAlive = true
+			break
+		}
+	}
+	m.nodeLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("Local node is not alive")
+	}
+
+	// Pick up any change of the advertised address. Our own entry is
+	// updated first, as an alive message with another address would
+	// otherwise be taken as a conflict.
+	addr, port := m.advertiseAddr(local.Addr, local.Port)
+	if !addr.Equal(local.Addr) || port != local.Port {
+		m.logger.Infof("Advertised address changed from %v:%d to %v:%d",
+			local.Addr, local.Port, addr, port)
+		m.nodeLock.Lock()
+		state.Addr = addr
+		state.Port = port
+		m.nodeLock.Unlock()
+		local.Addr, local.Port = addr, port
+	}
+
+	// Format a new alive message
+	a := alive{
+		Incarnation: m.nextIncarnation(),
+		Node:        m.localName(),
+		Addr:        local.Addr,
+		Port:        local.Port,
+		Meta:        meta,
+		Vsn: []uint8{
+			ProtocolVersionMin, ProtocolVersionMax, m.config.ProtocolVersion,
+			m.config.DelegateProtocolMin, m.config.DelegateProtocolMax,
+			m.config.DelegateProtocolVersion,
+		},
+	}
+	notifyCh := make(chan struct{}, 1)
+	m.aliveNodeNotify(&a, notifyCh)
+
+	// Block until the broadcast goes out
+	if anyAlive {
+		var timeoutCh <-chan time.Time
+		if timeout > 0 {
+			timeoutCh = time.After(timeout)
+		}
+		select {
+		case <-notifyCh:
+		case <-timeoutCh:
+			return fmt.Errorf("timeout waiting for update broadcast")
+		}
+	}
+
+	return nil
+}
+
+// SetName renames the local node, for when its identity is only known
+// after the listeners are up. The node is re-advertised under the new name
+// with a new incarnation number, and a dead message is broadcast for the
+// old name, so other nodes see the old name leave and the new one join.
+// The local EventDelegate is notified the same way. An error is returned
+// if another live node already has the name.
+//
+// Config.Name is left as it was configured; LocalNode returns the name
+// in use.
+func (m *Memberlist) SetName(name string) error {
+	if name == "" {
+		return fmt.Errorf("Node name must not be empty")
+	}
+
+	m.nodeLock.Lock()
+	oldName := m.localName()
+	state, ok := m.nodeMap[oldName]
+	if !ok || m.hasLeft() {
+		m.nodeLock.Unlock()
+		return fmt.Errorf("Local node is not alive")
+	}
+	if name == oldName {
+		m.nodeLock.Unlock()
+		return nil
+	}
+	if other, ok := m.nodeMap[name]; ok {
+		if !other.deadOrLeft() {
+			m.nodeLock.Unlock()
+			return fmt.Errorf("Node name %q is in use by %s:%d", name, net.IP(other.Addr), other.Port)
+		}
+
+		// Take over the name from the dead node
+		for i, n := range m.nodes {
+			if n == other {
+				m.nodes = append(m.nodes[:i], m.nodes[i+1:]...)
+				break
+			}
+		}
+	}
+
+	// Re-register our state under the new name
+	old := state.Node
+	inc := m.nextIncarnation()
+	delete(m.nodeMap, oldName)
+	state.Name = name
+	state.Incarnation = inc
+	m.nodeMap[name] = state
+	m.name.Store(name)
+
+	// Keep a dead entry for the old name until the next reshuffle, so
+	// that older alive messages for it that are still being gossiped
+	// can't bring it back
+	retained := &nodeState{
+		Node:        old,
+		Incarnation: inc,
+		State:       StateLeft,
+		StateChange: time.Now(),
+	}
+	m.nodeMap[oldName] = retained
+	m.nodes = append(m.nodes, retained)
+
+	a := alive{
+		Incarnation: inc,
+		Node:        name,
+		Addr:        state.Addr,
+		Port:        state.Port,
+		Meta:        state.Meta,
+		Vsn: []uint8{
+			state.PMin, state.PMax, state.PCur,
+			state.DMin, state.DMax, state.DCur,
+		},
+	}
+	m.encodeAndBroadcast(name, aliveMsg, a)
+	d := dead{Incarnation: inc, Node: oldName, From: oldName}
+	m.encodeAndBroadcast(oldName, deadMsg, d)
+	joined := state.Node
+	m.nodeLock.Unlock()
+
+	m.logger.Infof("Renamed local node from %s to %s", oldName, name)
+	old.LeaveCause = LeaveCauseLeft
+	m.dispatchEvent(&NodeEvent{NodeLeave, &old})
+	m.dispatchEvent(&NodeEvent{NodeJoin, &joined})
+	return nil
+}
+
+// SendToUDP is used to directly send a message to another node, without
+// the use of the gossip mechanism. The message is delivered to the remote
+// Delegate's NotifyMsg as a user message. This is best effort and must
+// fit within a single UDP packet; use SendToTCP for reliable delivery.
+func (m *Memberlist) SendToUDP(to *Node, msg []byte) error {
+	// Encode as a user message
+	buf := make([]byte, 1, len(msg)+1)
+	buf[0] = byte(userMsg)
+	buf = append(buf, msg...)
+
+	// Send the message
+	destAddr := &net.UDPAddr{IP: to.Addr, Port: int(to.Port)}
+	return m.rawSendMsg(destAddr, buf)
+}
+
+// SendToTCP is used to directly send a message to another node over a
+// TCP stream, without the use of the gossip mechanism. The message is
+// delivered to the remote Delegate's NotifyMsg as a user message. Any
+// error dialing or writing to the node is returned.
+func (m *Memberlist) SendToTCP(to *Node, msg []byte) error {
+	destAddr := &net.TCPAddr{IP: to.Addr, Port: int(to.Port)}
+	return m.sendUserMsg(destAddr, msg)
+}
+
+// GossipNow runs a round of gossip straight away instead of waiting for
+// the next GossipInterval, sending the pending broadcasts to GossipNodes
+// random nodes as usual. Calling it after queueing an urgent broadcast cuts
+// the time it takes to spread, without shortening the interval for good.
+// The scheduled rounds carry on unchanged.
+func (m *Memberlist) GossipNow() error {
+	m.startStopLock.Lock()
+	shutdown := m.shutdown
+	m.startStopLock.Unlock()
+	if shutdown {
+		return ErrShutdown
+	}
+	if !m.config.TransportMode.udp() {
+		return ErrUDPDisabled
+	}
+
+	m.gossip()
+	return nil
+}
+
+// ProbeAddr pings the memberlist node at the given address, which need not
+// be a member, and waits up to timeout for its ack. The address takes the
+// same forms as in Join. It returns nil only if a valid ack came back,
+// which means the node uses the same label and encryption keys as we do,
+// so it can be used to check that a seed is healthy before joining it.
+// Broadcasts are not piggybacked on the ping, and any gossip the node
+// piggybacks on its ack is dropped, so the probe doesn't change the
+// member list.
+func (m *Memberlist) ProbeAddr(addr string, timeout time.Duration) error {
+	addrs, err := m.resolveAddr(addr)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("No addresses found for %s", addr)
+	}
+
+	p := ping{SeqNo: m.nextSeqNo()}
+	out, err := encode(pingMsg, &p)
+	if err != nil {
+		return err
+	}
+
+	ackCh := make(chan ackMessage, 1)
+	m.setAckChannel(p.SeqNo, ackCh, timeout)
+	m.isolateAck(p.SeqNo)
+	destAddr := &net.UDPAddr{IP: addrs[0].ip, Port: int(addrs[0].port)}
+	if err := m.rawSendMsg(destAddr, out.Bytes()); err != nil {
+		return err
+	}
+
+	if ack := <-ackCh; !ack.Complete {
+		return fmt.Errorf("No ack from %s within %v", addr, timeout)
+	}
+	return nil
+}
+
+// LocalAddr returns the addresses the TCP and UDP listeners are bound to,
+// which is useful to find the ports picked when Port is zero. Either is nil
+// if that protocol is disabled. A custom transport only reports one
+// address, which is returned for both.
+func (m *Memberlist) LocalAddr() (tcp, udp net.Addr) {
+	if nt, ok := m.transport.(*NetTransport); ok {
+		return nt.LocalAddrs()
+	}
+	addr := m.transport.LocalAddr()
+	return addr, addr
+}
+
+// localName returns the name of the local node. It starts out as
+// Config.Name and may be changed by SetName.
+func (m *Memberlist) localName() string {
+	return m.name.Load().(string)
+}
+
+// LocalNode is used to return the local Node. The returned structure is
+// a copy and may be freely modified. This returns nil if the local node
+// has not yet been marked alive.
+func (m *Memberlist) LocalNode() *Node {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	state, ok := m.nodeMap[m.localName()]
+	if !ok {
+		return nil
+	}
+
+	n := state.Node
+	return &n
+}
+
+// GetNode returns a copy of the node with the given name, and whether it
+// is currently a member of the cluster. As with Members, nodes that are
+// suspected of having failed are still considered members.
+func (m *Memberlist) GetNode(name string) (*Node, bool) {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	state, ok := m.nodeMap[name]
+	if !ok || state.deadOrLeft() {
+		return nil, false
+	}
+
+	n := state.Node
+	return &n, true
+}
+
+// GetHealthScore gives this node's idea of how well it is meeting the soft
+// real-time requirements of the protocol. Lower numbers are better, and zero
+// means "totally healthy". The score rises when probes of other nodes fail
+// or this node has to refute being suspected, and falls as probes succeed.
+func (m *Memberlist) GetHealthScore() int {
+	return m.awareness.GetHealthScore()
+}
+
+// ReloadConfig applies the settings of conf that can safely change while
+// running, so that convergence can be tuned on a live cluster. These are
+// ProbeInterval, ProbeTimeout, ProbeIntervalMin and ProbeIntervalMax,
+// GossipInterval, GossipNodes, GossipToTheDeadTime, PushPullInterval,
+// IndirectChecks, RetransmitMult, SuspicionMult and
+// SuspicionMaxTimeoutMult. The background tasks are restarted with the
+// new intervals, once any probe or gossip round in progress has finished.
+// Other settings in conf are ignored, except that changing the node's
+// name, addresses, transport, label or encryption keys is refused with an
+// error, as those need a new Memberlist. A Port of zero is taken as
+// unchanged, so a config built like the one that picked any free port can
+// be reloaded. The new values apply to suspicions started after the
+// reload.
+func (m *Memberlist) ReloadConfig(conf *Config) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+
+	old := m.config
+	switch {
+	case conf.Name != old.Name:
+		return fmt.Errorf("Name can't be reloaded, use SetName instead")
+	case conf.BindAddr != old.BindAddr || !reflect.DeepEqual(conf.BindAddrs, old.BindAddrs) ||
+		(conf.Port != 0 && conf.Port != old.Port):
+		return fmt.Errorf("Bind address and port can't be reloaded")
+	case conf.AdvertiseAddr != old.AdvertiseAddr || conf.AdvertisePort != old.AdvertisePort:
+		return fmt.Errorf("Advertise address and port can't be reloaded")
+	case conf.TransportMode != old.TransportMode || (conf.Transport != nil && conf.Transport != m.transport):
+		return fmt.Errorf("Transport can't be reloaded")
+	case conf.Label != old.Label:
+		return fmt.Errorf("Label can't be reloaded")
+	case !bytes.Equal(conf.SecretKey, old.SecretKey) || (conf.Keyring != nil && conf.Keyring != old.Keyring):
+		return fmt.Errorf("Encryption keys can't be reloaded, use the Keyring instead")
+	case !bytes.Equal(conf.SigningKey, old.SigningKey) || (conf.SigningKeyring != nil && conf.SigningKeyring != old.SigningKeyring):
+		return fmt.Errorf("Signing keys can't be reloaded, use the SigningKeyring instead")
+	}
+
+	m.tickerLock.Lock()
+	defer m.tickerLock.Unlock()
+
+	scheduled := m.stopTick != nil
+	if scheduled {
+		m.stopTickers()
+	}
+
+	m.configLock.Lock()
+	old.ProbeInterval = conf.ProbeInterval
+	old.ProbeTimeout = conf.ProbeTimeout
+	old.ProbeIntervalMin = conf.ProbeIntervalMin
+	old.ProbeIntervalMax = conf.ProbeIntervalMax
+	old.GossipInterval = conf.GossipInterval
+	old.GossipNodes = conf.GossipNodes
+	old.GossipToTheDeadTime = conf.GossipToTheDeadTime
+	old.PushPullInterval = conf.PushPullInterval
+	old.IndirectChecks = conf.IndirectChecks
+	old.SuspicionMult = conf.SuspicionMult
+	old.SuspicionMaxTimeoutMult = conf.SuspicionMaxTimeoutMult
+	old.RetransmitMult = conf.RetransmitMult
+	m.configLock.Unlock()
+
+	m.broadcasts.Lock()
+	m.broadcasts.RetransmitMult = conf.RetransmitMult
+	m.broadcasts.Unlock()
+
+	if scheduled {
+		m.startTickers()
+	}
+	m.logger.Infof("Reloaded configuration")
+	return nil
+}
+
+// tunables is a copy of the settings that ReloadConfig may change
+type tunables struct {
+	ProbeInterval           time.Duration
+	ProbeTimeout            time.Duration
+	ProbeIntervalMin        time.Duration
+	ProbeIntervalMax        time.Duration
+	GossipInterval          time.Duration
+	GossipNodes             int
+	GossipToTheDeadTime     time.Duration
+	PushPullInterval        time.Duration
+	IndirectChecks          int
+	RetransmitMult          int
+	SuspicionMult           int
+	SuspicionMaxTimeoutMult int
+}
+
+// tunables returns the current values of the settings that ReloadConfig
+// may change. These must be read through here rather than from m.config,
+// as they can change while the background tasks run.
+func (m *Memberlist) tunables() tunables {
+	m.configLock.RLock()
+	defer m.configLock.RUnlock()
+	c := m.config
+	return tunables{
+		ProbeInterval:           c.ProbeInterval,
+		ProbeTimeout:            c.ProbeTimeout,
+		ProbeIntervalMin:        c.ProbeIntervalMin,
+		ProbeIntervalMax:        c.ProbeIntervalMax,
+		GossipInterval:          c.GossipInterval,
+		GossipNodes:             c.GossipNodes,
+		GossipToTheDeadTime:     c.GossipToTheDeadTime,
+		PushPullInterval:        c.PushPullInterval,
+		IndirectChecks:          c.IndirectChecks,
+		RetransmitMult:          c.RetransmitMult,
+		SuspicionMult:           c.SuspicionMult,
+		SuspicionMaxTimeoutMult: c.SuspicionMaxTimeoutMult,
+	}
+}
+
 // Members returns a list of all known live nodes. The node structures
 // returned must not be modified. If you wish to modify a Node, make a
 // copy first.
@@ -278,7 +1298,90 @@ func (m *Memberlist) Members() []*Node {
 
 	nodes := make([]*Node, 0, len(m.nodes))
 	for _, n := range m.nodes {
-		if n.State != stateDead {
+		if !n.deadOrLeft() {
+			nodes = append(nodes, &n.Node)
+		}
+	}
+
+	return nodes
+}
+
+// MembersByState returns the known nodes that are in the given state, for
+// example the suspect ones so that requests can be routed around them
+// before they are declared dead. Dead and left nodes are only known until
+// they are reaped, see GossipToTheDeadTime. The same rules as for Members
+// apply to the returned nodes.
+func (m *Memberlist) MembersByState(state NodeStateType) []*Node {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	var nodes []*Node
+	for _, n := range m.nodes {
+		if n.State != state {
+			continue
+		}
+
+		// Skip old entries for nodes that have since rejoined
+		if other, ok := m.nodeMap[n.Name]; n.deadOrLeft() && ok && other != n {
+			continue
+		}
+		nodes = append(nodes, &n.Node)
+	}
+
+	return nodes
+}
+
+// MembersByLatency returns the alive nodes, closest first, going by the
+// round trip time of the last direct probe of each, for routing requests
+// to the nearest replica. The local node comes first, and nodes we don't
+// have a round trip time for yet come last. The times are a best effort
+// estimate taken from a single probe every probe cycle, so they lag
+// behind changes in the network and can be thrown off by one slow ack.
+// The same rules as for Members apply to the returned nodes.
+func (m *Memberlist) MembersByLatency() []*Node {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	var states []*nodeState
+	for _, n := range m.nodes {
+		if n.State == StateAlive {
+			states = append(states, n)
+		}
+	}
+
+	// Sort by RTT with the local node first and the unknowns last
+	rank := func(n *nodeState) time.Duration {
+		switch {
+		case n.Name == m.localName():
+			return -1
+		case n.RTT == 0:
+			return time.Duration(math.MaxInt64)
+		}
+		return n.RTT
+	}
+	sort.SliceStable(states, func(i, j int) bool {
+		return rank(states[i]) < rank(states[j])
+	})
+
+	nodes := make([]*Node, 0, len(states))
+	for _, n := range states {
+		nodes = append(nodes, &n.Node)
+	}
+	return nodes
+}
+
+// Filter returns the known live nodes for which fn returns true, like
+// Members but without building the full list first. fn is called with
+// the node lock held, so it must not modify the Node or call back into
+// the Memberlist, which would deadlock. The same rules as for Members
+// apply to the returned nodes.
+func (m *Memberlist) Filter(fn func(*Node) bool) []*Node {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	var nodes []*Node
+	for _, n := range m.nodes {
+		if !n.deadOrLeft() && fn(&n.Node) {
 			nodes = append(nodes, &n.Node)
 		}
 	}
@@ -295,7 +1398,7 @@ func (m *Memberlist) NumMembers() (alive int) {
 	defer m.nodeLock.RUnlock()
 
 	for _, n := range m.nodes {
-		if n.State != stateDead {
+		if !n.deadOrLeft() {
 			alive++
 		}
 	}
@@ -303,6 +1406,51 @@ func (m *Memberlist) NumMembers() (alive int) {
 	return
 }
 
+// EstimateNumNodes returns the cluster size the broadcast queue uses to
+// work out how many times to retransmit each broadcast. It counts every
+// entry in the node list, including dead and left nodes that haven't been
+// reaped yet, so the gap between it and NumMembers shows how many such
+// entries are lingering and inflating the retransmit limit.
+func (m *Memberlist) EstimateNumNodes() int {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+	return m.broadcasts.NumNodes()
+}
+
+// NodeSnapshot is a point in time copy of what this node knows about
+// another, as returned by AllNodes.
+type NodeSnapshot struct {
+	Node
+	State       string        // One of "alive", "suspect", "dead" or "left"
+	Incarnation uint32        // Last known incarnation number
+	StateAge    time.Duration // Time since the last state change
+}
+
+// AllNodes returns a snapshot of every node this node is tracking,
+// including those that are suspect or dead and not yet reaped. Unlike
+// Members, the results are copies and may be freely modified. It is
+// intended for diagnostics, such as finding out why a node is stuck in
+// the suspect state.
+func (m *Memberlist) AllNodes() []NodeSnapshot {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	now := time.Now()
+	nodes := make([]NodeSnapshot, 0, len(m.nodes))
+	for _, n := range m.nodes {
+		s := NodeSnapshot{
+			Node:        n.Node,
+			State:       n.State.String(),
+			Incarnation: n.Incarnation,
+			StateAge:    now.Sub(n.StateChange),
+		}
+		s.Addr = append(net.IP(nil), n.Addr...)
+		s.Meta = append([]byte(nil), n.Meta...)
+		nodes = append(nodes, s)
+	}
+	return nodes
+}
+
 // Leave will broadcast a leave message but will not shutdown the background
 // listeners, meaning the node will continue participating in gossip and state
 // updates.
@@ -311,35 +1459,45 @@ func (m *Memberlist) NumMembers() (alive int) {
 // a member of the cluster, if any exist or until a specified timeout
 // is reached.
 //
-// This method is safe to call multiple times, but must not be called
-// after the cluster is already shut down.
+// This method is safe to call multiple times. If the cluster has already
+// been shut down, ErrShutdown is returned and no leave message is sent, so
+// callers should check the returned error.
 func (m *Memberlist) Leave(timeout time.Duration) error {
+	return m.LeaveWithReason(timeout, 0)
+}
+
+// LeaveWithReason works like Leave, but carries an application defined
+// reason code in the leave message. Other nodes see it as the LeaveReason
+// of the Node passed to their EventDelegate's NotifyLeave, which lets them
+// tell a planned departure, such as scaling down, apart from a failure.
+// Zero is reserved to mean that no reason was given.
+func (m *Memberlist) LeaveWithReason(timeout time.Duration, reason uint8) error {
 	m.startStopLock.Lock()
 	defer m.startStopLock.Unlock()
 
 	if m.shutdown {
-		panic("leave after shutdown")
+		return ErrShutdown
 	}
 
-	if !m.leave {
-		m.leave = true
-
-		state, ok := m.nodeMap[m.config.Name]
+	if atomic.CompareAndSwapInt32(&m.leave, 0, 1) {
+		state, ok := m.nodeMap[m.localName()]
 		if !ok {
-			m.logger.Println("[WARN] Leave but we're not in the node map.")
+			m.logger.Warnf("Leave but we're not in the node map.")
 			return nil
 		}
 
 		d := dead{
 			Incarnation: state.Incarnation,
 			Node:        state.Name,
+			Reason:      reason,
+			From:        state.Name,
 		}
 		m.deadNode(&d)
 
 		// Check for any other alive node
 		anyAlive := false
 		for _, n := range m.nodes {
-			if n.State != stateDead {
+			if !n.deadOrLeft() {
 				anyAlive = true
 				break
 			}
@@ -362,6 +1520,68 @@ func (m *Memberlist) Leave(timeout time.Duration) error {
 	return nil
 }
 
+// Drain is a more thorough Leave for orchestrated exits, such as rolling
+// deployments. It stops QueueBroadcast accepting new broadcasts, gossips
+// the ones pending when it was called every GossipInterval until they
+// have all gone out, then leaves the cluster and waits for the leave
+// message to be gossiped too. Broadcasts queued since, such as about
+// other nodes' state changes, aren't waited for. Once it returns, peers
+// have most likely heard of the departure and Shutdown can be called.
+// Like Leave it is best effort, so an error is returned if timeout passes
+// first. Since draining may never finish in a busy cluster, timeout must
+// be positive.
+func (m *Memberlist) Drain(timeout time.Duration) error {
+	if timeout <= 0 {
+		return fmt.Errorf("Drain needs a positive timeout")
+	}
+	atomic.StoreInt32(&m.draining, 1)
+
+	start := time.Now()
+	deadline := start.Add(timeout)
+	interval := m.tunables().GossipInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	// Broadcasts only go out over UDP, and there's no one to send them
+	// to if we're on our own
+	for m.config.TransportMode.udp() && m.hasAlivePeers() {
+		pending := m.broadcasts.numQueuedBefore(start)
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout draining %d pending broadcasts", pending)
+		}
+		if err := m.GossipNow(); err != nil {
+			return err
+		}
+		select {
+		case <-time.After(interval):
+		case <-m.shutdownCh:
+			return ErrShutdown
+		}
+	}
+
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return fmt.Errorf("timeout draining before the leave broadcast")
+	}
+	return m.Leave(remaining)
+}
+
+// hasAlivePeers returns whether any other node is still a member
+func (m *Memberlist) hasAlivePeers() bool {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+	for _, n := range m.nodes {
+		if n.Name != m.localName() && !n.deadOrLeft() {
+			return true
+		}
+	}
+	return false
+}
+
 // ProtocolVersion returns the protocol version currently in use by
 // this memberlist.
 func (m *Memberlist) ProtocolVersion() uint8 {
@@ -371,12 +1591,135 @@ func (m *Memberlist) ProtocolVersion() uint8 {
 	return m.config.ProtocolVersion
 }
 
+// EncryptionEnabled returns whether messages to and from this memberlist
+// are encrypted, using either SecretKey or a Keyring with keys installed.
+func (m *Memberlist) EncryptionEnabled() bool {
+	return m.config.EncryptionEnabled()
+}
+
+// NodeVersion holds the protocol and delegate protocol version ranges a
+// node advertised in its last alive message, along with the versions it
+// is currently speaking.
+type NodeVersion struct {
+	PMin uint8 // Minimum protocol version this understands
+	PMax uint8 // Maximum protocol version this understands
+	PCur uint8 // Current version node is speaking
+	DMin uint8 // Min protocol version for the delegate to understand
+	DMax uint8 // Max protocol version for the delegate to understand
+	DCur uint8 // Current version delegate is speaking
+}
+
+// NodeVersions returns the protocol versions of every live node, keyed by
+// node name. This is useful to confirm that all nodes have moved to a new
+// protocol version during a rolling upgrade.
+func (m *Memberlist) NodeVersions() map[string]NodeVersion {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	versions := make(map[string]NodeVersion, len(m.nodeMap))
+	for _, n := range m.nodes {
+		if n.deadOrLeft() {
+			continue
+		}
+		versions[n.Name] = NodeVersion{
+			PMin: n.PMin, PMax: n.PMax, PCur: n.PCur,
+			DMin: n.DMin, DMax: n.DMax, DCur: n.DCur,
+		}
+	}
+	return versions
+}
+
+// GetDelegateProtocol returns the delegate protocol versions advertised by
+// the live node with the given name, or false if there is no such node.
+// Layered protocols can use this to pick a message format that a given
+// peer understands during a rolling upgrade.
+func (m *Memberlist) GetDelegateProtocol(name string) (min, max, cur uint8, ok bool) {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	state, ok := m.nodeMap[name]
+	if !ok || state.deadOrLeft() {
+		return 0, 0, 0, false
+	}
+	return state.DMin, state.DMax, state.DCur, true
+}
+
+// Pause stops this node taking part in the protocol without shutting it
+// down, for example during a maintenance window. The probe, gossip and
+// push/pull tickers are stopped, but the listeners stay open and the
+// member list is kept, so the node still answers pings and state syncs
+// from its peers and can pick up where it left off with Resume.
+//
+// While paused the node doesn't probe other nodes, so it won't notice
+// failures, and doesn't gossip, so it won't refute suspicions of itself
+// or spread broadcasts. If its replies to peers' probes are lost for
+// long enough during a pause, peers may suspect it and then declare it
+// dead, so pauses should be kept short.
+//
+// Pausing a paused Memberlist does nothing. ErrShutdown is returned once
+// it has been shut down.
+func (m *Memberlist) Pause() error {
+	m.startStopLock.Lock()
+	defer m.startStopLock.Unlock()
+	if m.shutdown {
+		return ErrShutdown
+	}
+
+	m.tickerLock.Lock()
+	defer m.tickerLock.Unlock()
+	if m.paused {
+		return nil
+	}
+	m.paused = true
+	m.resumeTickers = m.stopTick != nil
+	if m.resumeTickers {
+		m.stopTickers()
+	}
+	return nil
+}
+
+// Resume restarts the tickers stopped by Pause, with the current
+// intervals. Resuming a Memberlist that isn't paused does nothing.
+// ErrShutdown is returned once it has been shut down.
+func (m *Memberlist) Resume() error {
+	m.startStopLock.Lock()
+	defer m.startStopLock.Unlock()
+	if m.shutdown {
+		return ErrShutdown
+	}
+
+	m.tickerLock.Lock()
+	defer m.tickerLock.Unlock()
+	if !m.paused {
+		return nil
+	}
+	m.paused = false
+	if m.resumeTickers && m.stopTick == nil {
+		m.startTickers()
+	}
+	m.resumeTickers = false
+	return nil
+}
+
+// Paused returns whether Pause has been called without a Resume since
+func (m *Memberlist) Paused() bool {
+	m.tickerLock.Lock()
+	defer m.tickerLock.Unlock()
+	return m.paused
+}
+
 // Shutdown will stop any background maintanence of network activity
 // for this memberlist, causing it to appear "dead". A leave message
 // will not be broadcasted prior, so the cluster being left will have
 // to detect this node's shutdown using probing. If you wish to more
 // gracefully exit the cluster, call Leave prior to shutting down.
 //
+// Shutdown blocks until the listeners and the background maintenance have
+// stopped, which may include waiting for a probe or state sync that is in
+// progress to finish. When called from a delegate callback it can't wait
+// for the goroutine the callback runs on, so it returns once everything
+// has been told to stop.
+//
 // This method is safe to call multiple times.
 func (m *Memberlist) Shutdown() error {
 	m.startStopLock.Lock()
@@ -385,9 +1728,23 @@ func (m *Memberlist) Shutdown() error {
 	if !m.shutdown {
 		m.shutdown = true
 		m.deschedule()
-		m.udpListener.Close()
-		m.tcpListener.Close()
+
+		// The transport is shut down first, while we are still draining
+		// its channels, so its listeners can't block handing us a packet
+		m.transport.Shutdown()
+		close(m.shutdownCh)
+		m.connPool.close()
+		if !onMemberlistGoroutine() {
+			m.wg.Wait()
+		}
 	}
 
 	return nil
 }
+
+// ShutdownCh returns a channel that is closed once Shutdown has been
+// called, so that applications can select on it to coordinate their own
+// teardown.
+func (m *Memberlist) ShutdownCh() <-chan struct{} {
+	return m.shutdownCh
+}
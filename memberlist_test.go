@@ -1,9 +1,13 @@
 package memberlist
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -103,8 +107,8 @@ func GetMemberlist(t *testing.T) *Memberlist {
 
 func TestDefaultLANConfig_protocolVersion(t *testing.T) {
 	c := DefaultLANConfig()
-	if c.ProtocolVersion != ProtocolVersionMax {
-		t.Fatalf("should be max: %d", c.ProtocolVersion)
+	if c.ProtocolVersion != ProtocolVersion2Compatible {
+		t.Fatalf("should be compatible with version 2: %d", c.ProtocolVersion)
 	}
 }
 
@@ -146,6 +150,9 @@ func TestCreate_secretKey(t *testing.T) {
 		{make([]byte, 0), false},
 		{[]byte("abc"), true},
 		{make([]byte, 16), false},
+		{make([]byte, 24), false},
+		{make([]byte, 32), false},
+		{make([]byte, 64), true},
 	}
 
 	for _, tc := range cases {
@@ -180,6 +187,54 @@ func TestCreate_secretKeyEmpty(t *testing.T) {
 	}
 }
 
+func TestCreate_keyringAndSecretKey(t *testing.T) {
+	c := DefaultLANConfig()
+	c.BindAddr = getBindAddr().String()
+	keyring, err := NewKeyring(nil, TestKeys[0])
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	c.Keyring = keyring
+	c.SecretKey = TestKeys[1]
+
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.Shutdown()
+
+	// The SecretKey should become the primary key
+	keys, err := m.GetKeys()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(keys) != 2 || !bytes.Equal(keys[0], TestKeys[1]) {
+		t.Fatalf("bad: %v", keys)
+	}
+}
+
+func TestCreate_anyPort(t *testing.T) {
+	c := testConfig()
+	c.Port = 0
+
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.Shutdown()
+
+	tcp, udp := m.LocalAddr()
+	port := tcp.(*net.TCPAddr).Port
+	if port == 0 || port != udp.(*net.UDPAddr).Port {
+		t.Fatalf("bad: %v %v", tcp, udp)
+	}
+
+	// The picked port is the one we advertise
+	if n := m.LocalNode(); int(n.Port) != port {
+		t.Fatalf("bad: %d %d", n.Port, port)
+	}
+}
+
 func TestCreate(t *testing.T) {
 	c := testConfig()
 	c.ProtocolVersion = ProtocolVersionMin
@@ -240,9 +295,9 @@ func TestMemberList_Members(t *testing.T) {
 
 	m := &Memberlist{}
 	nodes := []*nodeState{
-		&nodeState{Node: *n1, State: stateAlive},
-		&nodeState{Node: *n2, State: stateDead},
-		&nodeState{Node: *n3, State: stateSuspect},
+		&nodeState{Node: *n1, State: StateAlive},
+		&nodeState{Node: *n2, State: StateDead},
+		&nodeState{Node: *n3, State: StateSuspect},
 	}
 	m.nodes = nodes
 
@@ -252,6 +307,362 @@ func TestMemberList_Members(t *testing.T) {
 	}
 }
 
+func TestMemberList_MembersByState(t *testing.T) {
+	n1 := &Node{Name: "test"}
+	n2 := &Node{Name: "test2"}
+	n3 := &Node{Name: "test3"}
+	n4 := &Node{Name: "test4"}
+
+	m := &Memberlist{}
+	m.nodes = []*nodeState{
+		&nodeState{Node: *n1, State: StateAlive},
+		&nodeState{Node: *n2, State: StateDead},
+		&nodeState{Node: *n3, State: StateSuspect},
+		&nodeState{Node: *n4, State: StateLeft},
+		&nodeState{Node: *n1, State: StateDead},
+	}
+	m.nodeMap = map[string]*nodeState{
+		"test":  m.nodes[0],
+		"test3": m.nodes[2],
+	}
+
+	if nodes := m.MembersByState(StateSuspect); !reflect.DeepEqual(nodes, []*Node{n3}) {
+		t.Fatalf("bad members: %v", nodes)
+	}
+	if nodes := m.MembersByState(StateLeft); !reflect.DeepEqual(nodes, []*Node{n4}) {
+		t.Fatalf("bad members: %v", nodes)
+	}
+
+	// The old entry of a node that rejoined is skipped
+	if nodes := m.MembersByState(StateDead); !reflect.DeepEqual(nodes, []*Node{n2}) {
+		t.Fatalf("bad members: %v", nodes)
+	}
+}
+
+func TestMemberList_MembersByLatency(t *testing.T) {
+	self := &Node{Name: "self"}
+	n1 := &Node{Name: "test1"}
+	n2 := &Node{Name: "test2"}
+	n3 := &Node{Name: "test3"}
+	n4 := &Node{Name: "test4"}
+	n5 := &Node{Name: "test5"}
+
+	m := &Memberlist{config: &Config{Name: "self"}}
+	m.name.Store("self")
+	m.nodes = []*nodeState{
+		&nodeState{Node: *n1, State: StateAlive},
+		&nodeState{Node: *n2, State: StateAlive, RTT: 30 * time.Millisecond},
+		&nodeState{Node: *self, State: StateAlive},
+		&nodeState{Node: *n3, State: StateAlive, RTT: 10 * time.Millisecond},
+		&nodeState{Node: *n4, State: StateSuspect, RTT: time.Millisecond},
+		&nodeState{Node: *n5, State: StateDead, RTT: time.Millisecond},
+	}
+
+	nodes := m.MembersByLatency()
+	if !reflect.DeepEqual(nodes, []*Node{self, n3, n2, n1}) {
+		t.Fatalf("bad members: %v", nodes)
+	}
+}
+
+func TestMemberList_ProbeNode_RTT(t *testing.T) {
+	m1, err := Create(testConfig())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+	c2 := testConfig()
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m1.Join([]string{c2.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m1.probeNode(m1.nodeMap[c2.Name])
+	if rtt := m1.nodeMap[c2.Name].RTT; rtt <= 0 {
+		t.Fatalf("expected an RTT to be recorded: %v", rtt)
+	}
+	if nodes := m1.MembersByLatency(); len(nodes) != 2 || nodes[1].Name != c2.Name {
+		t.Fatalf("bad members: %v", nodes)
+	}
+}
+
+func TestMemberlist_EstimateNumNodes(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	for i := 1; i <= 3; i++ {
+		a := alive{Node: fmt.Sprintf("test%d", i), Addr: []byte{127, 0, 0, byte(i)}, Incarnation: 1}
+		m.aliveNode(&a)
+	}
+	d := dead{Node: "test2", Incarnation: 1}
+	m.deadNode(&d)
+
+	// The dead node counts until it is reaped
+	if n := m.EstimateNumNodes(); n != 3 {
+		t.Fatalf("bad: %d", n)
+	}
+	if n := m.NumMembers(); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestMemberList_Filter(t *testing.T) {
+	n1 := &Node{Name: "test", Meta: []byte("web")}
+	n2 := &Node{Name: "test2", Meta: []byte("web")}
+	n3 := &Node{Name: "test3", Meta: []byte("db")}
+	n4 := &Node{Name: "test4", Meta: []byte("web")}
+
+	m := &Memberlist{}
+	m.nodes = []*nodeState{
+		&nodeState{Node: *n1, State: StateAlive},
+		&nodeState{Node: *n2, State: StateDead},
+		&nodeState{Node: *n3, State: StateAlive},
+		&nodeState{Node: *n4, State: StateSuspect},
+	}
+
+	web := m.Filter(func(n *Node) bool { return string(n.Meta) == "web" })
+	if !reflect.DeepEqual(web, []*Node{n1, n4}) {
+		t.Fatalf("bad members: %v", web)
+	}
+
+	none := m.Filter(func(n *Node) bool { return false })
+	if len(none) != 0 {
+		t.Fatalf("bad members: %v", none)
+	}
+}
+
+func TestMemberlist_AllNodes(t *testing.T) {
+	now := time.Now()
+	m := &Memberlist{}
+	m.nodes = []*nodeState{
+		&nodeState{Node: Node{Name: "test", Addr: []byte{127, 0, 0, 1}},
+			State: StateAlive, Incarnation: 1, StateChange: now},
+		&nodeState{Node: Node{Name: "test2"},
+			State: StateDead, Incarnation: 2, StateChange: now.Add(-time.Hour)},
+		&nodeState{Node: Node{Name: "test3"},
+			State: StateSuspect, Incarnation: 3, StateChange: now.Add(-time.Minute)},
+	}
+
+	nodes := m.AllNodes()
+	if len(nodes) != 3 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	expected := []struct {
+		name  string
+		state string
+		inc   uint32
+		age   time.Duration
+	}{
+		{"test", "alive", 1, 0},
+		{"test2", "dead", 2, time.Hour},
+		{"test3", "suspect", 3, time.Minute},
+	}
+	for i, e := range expected {
+		n := nodes[i]
+		if n.Name != e.name || n.State != e.state || n.Incarnation != e.inc {
+			t.Fatalf("bad: %v", n)
+		}
+		if n.StateAge < e.age || n.StateAge > e.age+time.Second {
+			t.Fatalf("bad age: %v", n.StateAge)
+		}
+	}
+
+	// Modifying the snapshot must not affect our state
+	nodes[0].Addr[3] = 2
+	if m.nodes[0].Addr[3] != 1 {
+		t.Fatalf("should return a copy")
+	}
+}
+
+func TestMemberlist_GetNode(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 8000, Incarnation: 1}
+	m.aliveNode(&a)
+
+	n, ok := m.GetNode("test")
+	if !ok || n.Name != "test" || n.Port != 8000 {
+		t.Fatalf("bad: %v %v", n, ok)
+	}
+
+	// Modifying the copy must not affect our state
+	n.Port = 9000
+	if m.nodeMap["test"].Port != 8000 {
+		t.Fatalf("should return a copy")
+	}
+
+	if _, ok := m.GetNode("missing"); ok {
+		t.Fatalf("should not find node")
+	}
+
+	d := dead{Node: "test", Incarnation: 1}
+	m.deadNode(&d)
+	if _, ok := m.GetNode("test"); ok {
+		t.Fatalf("should not return dead node")
+	}
+}
+
+func TestMemberlist_LocalNode(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	if n := m.LocalNode(); n != nil {
+		t.Fatalf("expected nil before alive: %v", n)
+	}
+
+	if err := m.setAlive(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	n := m.LocalNode()
+	if n == nil {
+		t.Fatalf("missing local node")
+	}
+	if n.Name != m.config.Name {
+		t.Fatalf("bad name: %s", n.Name)
+	}
+	if n.Addr.String() != m.config.BindAddr {
+		t.Fatalf("bad addr: %s", n.Addr)
+	}
+	if int(n.Port) != m.config.Port {
+		t.Fatalf("bad port: %d", n.Port)
+	}
+
+	// Modifying the copy must not affect our state
+	n.Name = "other"
+	if m.LocalNode().Name != m.config.Name {
+		t.Fatalf("local node was modified")
+	}
+}
+
+func TestMemberlist_ResolveAddr(t *testing.T) {
+	m := &Memberlist{config: &Config{Port: 7946}}
+
+	cases := []struct {
+		host string
+		ip   string
+		port uint16
+	}{
+		{"127.0.0.1", "127.0.0.1", 7946},
+		{"127.0.0.1:8000", "127.0.0.1", 8000},
+		{"::1", "::1", 7946},
+		{"[::1]", "::1", 7946},
+		{"[::1]:8000", "::1", 8000},
+	}
+
+	for _, tc := range cases {
+		addrs, err := m.resolveAddr(tc.host)
+		if err != nil {
+			t.Fatalf("err resolving %s: %v", tc.host, err)
+		}
+		if len(addrs) != 1 {
+			t.Fatalf("bad addrs for %s: %v", tc.host, addrs)
+		}
+		if !addrs[0].ip.Equal(net.ParseIP(tc.ip)) {
+			t.Fatalf("bad ip for %s: %v", tc.host, addrs[0].ip)
+		}
+		if addrs[0].port != tc.port {
+			t.Fatalf("bad port for %s: %d", tc.host, addrs[0].port)
+		}
+	}
+}
+
+func TestMemberlist_ResolveAddr_SRV(t *testing.T) {
+	m := &Memberlist{config: &Config{Port: 7946}, logger: NewLogger(ioutil.Discard)}
+
+	oldSRV, oldIP := lookupSRV, lookupIP
+	defer func() { lookupSRV, lookupIP = oldSRV, oldIP }()
+
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_gossip._tcp.example.com" {
+			t.Fatalf("bad name: %s", name)
+		}
+		return name, []*net.SRV{
+			{Target: "a.example.com.", Port: 8001},
+			{Target: "missing.example.com.", Port: 8002},
+			{Target: "b.example.com.", Port: 8003},
+		}, nil
+	}
+	lookupIP = func(host string) ([]net.IP, error) {
+		switch host {
+		case "a.example.com.":
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		case "b.example.com.":
+			return []net.IP{net.ParseIP("10.0.0.3")}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+
+	addrs, err := m.resolveAddr("_gossip._tcp.example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("bad: %v", addrs)
+	}
+	if !addrs[0].ip.Equal(net.ParseIP("10.0.0.1")) || addrs[0].port != 8001 {
+		t.Fatalf("bad: %v", addrs[0])
+	}
+	if !addrs[1].ip.Equal(net.ParseIP("10.0.0.3")) || addrs[1].port != 8003 {
+		t.Fatalf("bad: %v", addrs[1])
+	}
+
+	// Nothing resolves
+	lookupIP = func(host string) ([]net.IP, error) {
+		return nil, fmt.Errorf("no such host")
+	}
+	if _, err := m.resolveAddr("_gossip._tcp.example.com"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestMemberlist_ResolveAddr_Resolver(t *testing.T) {
+	var hosts []string
+	m := &Memberlist{config: &Config{Port: 7946}}
+	m.config.Resolver = func(host string) ([]net.Addr, error) {
+		hosts = append(hosts, host)
+		switch host {
+		case "web":
+			return []net.Addr{
+				&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8001},
+				&net.IPAddr{IP: net.ParseIP("10.0.0.2")},
+			}, nil
+		case "odd":
+			return []net.Addr{&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}}, nil
+		case "none":
+			return nil, nil
+		}
+		return nil, fmt.Errorf("no such service")
+	}
+
+	addrs, err := m.resolveAddr("web")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("bad: %v", addrs)
+	}
+	if !addrs[0].ip.Equal(net.ParseIP("10.0.0.1")) || addrs[0].port != 8001 {
+		t.Fatalf("bad: %v", addrs[0])
+	}
+	if !addrs[1].ip.Equal(net.ParseIP("10.0.0.2")) || addrs[1].port != 7946 {
+		t.Fatalf("bad: %v", addrs[1])
+	}
+
+	// Even plain IPs go through the resolver
+	for _, host := range []string{"127.0.0.1:8000", "odd", "none"} {
+		if _, err := m.resolveAddr(host); err == nil {
+			t.Fatalf("expected error for %s", host)
+		}
+	}
+	if !reflect.DeepEqual(hosts, []string{"web", "127.0.0.1:8000", "odd", "none"}) {
+		t.Fatalf("bad: %v", hosts)
+	}
+}
+
 func TestMemberlist_Join(t *testing.T) {
 	m1 := GetMemberlist(t)
 	m1.setAlive()
@@ -276,209 +687,1864 @@ func TestMemberlist_Join(t *testing.T) {
 		t.Fatal("unexpected 1: %d", num)
 	}
 	if err != nil {
-		t.Fatal("unexpected err: %s", err)
+		t.Fatal("unexpected err: %s", err)
+	}
+
+	// Check the hosts
+	if len(m2.Members()) != 2 {
+		t.Fatalf("should have 2 nodes! %v", m2.Members())
+	}
+}
+
+func TestMemberlist_EncryptionEnabled(t *testing.T) {
+	m1 := GetMemberlist(t)
+	defer m1.Shutdown()
+	if m1.EncryptionEnabled() {
+		t.Fatalf("encryption should be off")
+	}
+
+	c := testConfig()
+	c.SecretKey = TestKeys[0]
+	m2, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+	if !m2.EncryptionEnabled() {
+		t.Fatalf("encryption should be on")
+	}
+}
+
+func TestMemberlist_GossipVerify(t *testing.T) {
+	sink := newMockSink()
+	c1 := testConfig()
+	c1.SecretKey = TestKeys[0]
+	c1.GossipVerifyIncomingDisabled = true
+	c1.GossipVerifyOutgoingDisabled = true
+	c1.MetricsSink = sink
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	// While rolling out, a node holding keys still talks to plaintext ones
+	if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(m1.Members()) != 2 || len(m2.Members()) != 2 {
+		t.Fatalf("bad: %v %v", m1.Members(), m2.Members())
+	}
+
+	// Once verifying, plaintext is refused
+	m1.config.GossipVerifyIncomingDisabled = false
+	m1.config.GossipVerifyOutgoingDisabled = false
+	if _, err := m2.Join([]string{c1.BindAddr}); err == nil {
+		t.Fatalf("expected err")
+	}
+
+	ping, err := encode(pingMsg, &ping{SeqNo: 1})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m1.ingestPacket(ping.Bytes(), &net.UDPAddr{IP: net.ParseIP(c2.BindAddr), Port: c2.Port}, time.Now())
+	if n := sink.counter("memberlist.udp.decrypt.failed"); n < 1 {
+		t.Fatalf("bad: %v", n)
+	}
+}
+
+func TestMemberlist_GossipVerify_ConfigLiteral(t *testing.T) {
+	// A Config that isn't built from the defaults is strict too
+	sink := newMockSink()
+	d := &MockDelegate{}
+	c := &Config{
+		Name:            "literal",
+		BindAddr:        getBindAddr().String(),
+		ProtocolVersion: ProtocolVersionMax,
+		SecretKey:       TestKeys[0],
+		Delegate:        d,
+		MetricsSink:     sink,
+	}
+	m, err := newMemberlist(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.Shutdown()
+
+	if !m.encryptOutgoing(1) {
+		t.Fatalf("expected outgoing messages to be encrypted")
+	}
+
+	user := append([]byte{byte(userMsg)}, "injected"...)
+	m.ingestPacket(user, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 7946}, time.Now())
+	if len(d.msgs) != 0 {
+		t.Fatalf("plaintext was handled: %q", d.msgs)
+	}
+	if n := sink.counter("memberlist.udp.decrypt.failed"); n != 1 {
+		t.Fatalf("bad: %v", n)
+	}
+}
+
+func TestMemberlist_PlaintextExempt(t *testing.T) {
+	sink := newMockSink()
+	c := testConfig()
+	c.SecretKey = TestKeys[0]
+	c.PlaintextExempt = []string{"ping", "ack"}
+	c.MetricsSink = sink
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.Shutdown()
+
+	pingBuf, err := encode(pingMsg, &ping{SeqNo: 1})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	aliveBuf, err := encode(aliveMsg, &alive{Node: "evil", Addr: []byte{127, 0, 0, 9}, Incarnation: 1})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Only the ping is kept from a plaintext packet, also when compressed
+	compound := makeCompoundMessage([][]byte{pingBuf.Bytes(), aliveBuf.Bytes()})
+	if out := m.exemptPlaintext(compound.Bytes()); !bytes.Equal(out, pingBuf.Bytes()) {
+		t.Fatalf("bad: %v", out)
+	}
+	compressed, err := compressPayload(CompressionLZW, compound.Bytes())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if out := m.exemptPlaintext(compressed.Bytes()); !bytes.Equal(out, pingBuf.Bytes()) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	from := &net.UDPAddr{IP: net.ParseIP(c.BindAddr), Port: c.Port}
+	m.ingestPacket(compound.Bytes(), from, time.Now())
+	if n := sink.counter("memberlist.udp.decrypt.failed"); n != 0 {
+		t.Fatalf("bad: %v", n)
+	}
+	m.ingestPacket(aliveBuf.Bytes(), from, time.Now())
+	if n := sink.counter("memberlist.udp.decrypt.failed"); n != 1 {
+		t.Fatalf("bad: %v", n)
+	}
+	if m.NumMembers() != 1 {
+		t.Fatalf("plaintext alive should have been dropped: %v", m.Members())
+	}
+}
+
+func TestMemberlist_Signing(t *testing.T) {
+	sink := newMockSink()
+	c1 := testConfig()
+	c1.SigningKey = TestKeys[0]
+	c1.MetricsSink = sink
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+	if m1.EncryptionEnabled() {
+		t.Fatalf("signing should not encrypt")
+	}
+
+	c2 := testConfig()
+	c2.SigningKey = TestKeys[0]
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(m1.Members()) != 2 || len(m2.Members()) != 2 {
+		t.Fatalf("bad: %v %v", m1.Members(), m2.Members())
+	}
+
+	// A node with another key, or none, can't join
+	c3 := testConfig()
+	c3.SigningKey = TestKeys[1]
+	m3, err := Create(c3)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m3.Shutdown()
+	if _, err := m3.Join([]string{c1.BindAddr}); err == nil {
+		t.Fatalf("expected err")
+	}
+	m4, err := Create(testConfig())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m4.Shutdown()
+	if _, err := m4.Join([]string{c1.BindAddr}); err == nil {
+		t.Fatalf("expected err")
+	}
+
+	// Tampered and unsigned packets are dropped
+	ping, err := encode(pingMsg, &ping{SeqNo: 1})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	signed := signPacket(TestKeys[0], ping.Bytes())
+	signed[2] ^= 0xff
+	from := &net.UDPAddr{IP: net.ParseIP(c2.BindAddr), Port: c2.Port}
+	m1.ingestPacket(signed, from, time.Now())
+	m1.ingestPacket(ping.Bytes(), from, time.Now())
+	if n := sink.counter("memberlist.udp.verify.failed"); n != 2 {
+		t.Fatalf("bad: %v", n)
+	}
+
+	// The signing keys can be rotated like encryption keys
+	if err := m1.AddKey(TestKeys[1]); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := m3.AddKey(TestKeys[0]); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := m3.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestMemberlist_NodeVersions(t *testing.T) {
+	c1 := testConfig()
+	c1.ProtocolVersion = 1
+	c1.DelegateProtocolMax = 3
+	c1.DelegateProtocolVersion = 1
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.DelegateProtocolMax = 3
+	c2.DelegateProtocolVersion = 2
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m1.Join([]string{c2.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	versions := m1.NodeVersions()
+	if len(versions) != 2 {
+		t.Fatalf("bad: %v", versions)
+	}
+	if v := versions[c1.Name]; v.PCur != 1 || v.PMax != ProtocolVersionMax || v.DCur != 1 {
+		t.Fatalf("bad: %v", v)
+	}
+	if v := versions[c2.Name]; v.PCur != ProtocolVersion2Compatible || v.DMax != 3 || v.DCur != 2 {
+		t.Fatalf("bad: %v", v)
+	}
+}
+
+func TestMemberlist_GetDelegateProtocol(t *testing.T) {
+	c1 := testConfig()
+	c1.DelegateProtocolMin = 1
+	c1.DelegateProtocolMax = 2
+	c1.DelegateProtocolVersion = 1
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.DelegateProtocolMin = 1
+	c2.DelegateProtocolMax = 3
+	c2.DelegateProtocolVersion = 2
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m1.Join([]string{c2.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	min, max, cur, ok := m1.GetDelegateProtocol(c2.Name)
+	if !ok || min != 1 || max != 3 || cur != 2 {
+		t.Fatalf("bad: %d %d %d %v", min, max, cur, ok)
+	}
+	if _, _, _, ok := m1.GetDelegateProtocol("missing"); ok {
+		t.Fatalf("should not find node")
+	}
+}
+
+func TestMemberlist_Join_protocolVersions(t *testing.T) {
+	c1 := testConfig()
+	c2 := testConfig()
+	c3 := testConfig()
+	c3.ProtocolVersion = ProtocolVersionMax
+
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	m3, err := Create(c3)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m3.Shutdown()
+
+	_, err = m1.Join([]string{c2.BindAddr})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	yield()
+
+	_, err = m1.Join([]string{c3.BindAddr})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestMemberlist_Leave(t *testing.T) {
+	m1 := GetMemberlist(t)
+	m1.setAlive()
+	m1.schedule()
+	defer m1.Shutdown()
+
+	// Create a second node
+	c := DefaultLANConfig()
+	addr1 := getBindAddr()
+	c.Name = addr1.String()
+	c.BindAddr = addr1.String()
+	c.Port = m1.config.Port
+	c.GossipInterval = time.Millisecond
+
+	m2, err := Create(c)
+	if err != nil {
+		t.Fatal("unexpected err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	num, err := m2.Join([]string{m1.config.BindAddr})
+	if num != 1 {
+		t.Fatal("unexpected 1: %d", num)
+	}
+	if err != nil {
+		t.Fatal("unexpected err: %s", err)
+	}
+
+	// Check the hosts
+	if len(m2.Members()) != 2 {
+		t.Fatalf("should have 2 nodes! %v", m2.Members())
+	}
+	if len(m1.Members()) != 2 {
+		t.Fatalf("should have 2 nodes! %v", m2.Members())
+	}
+
+	// Leave
+	m1.Leave(time.Second)
+
+	// Wait for leave
+	time.Sleep(10 * time.Millisecond)
+
+	// m1 should think dead
+	if len(m1.Members()) != 1 {
+		t.Fatalf("should have 1 node")
+	}
+
+	if len(m2.Members()) != 1 {
+		t.Fatalf("should have 1 node")
+	}
+}
+
+func TestMemberlist_Drain(t *testing.T) {
+	c1 := testConfig()
+	c1.GossipInterval = 10 * time.Millisecond
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	d := &MockDelegate{}
+	c2 := testConfig()
+	c2.Delegate = d
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m1.Join([]string{c2.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := m1.QueueBroadcast(&namedBroadcast{name: "a", msg: []byte("hello")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := m1.Drain(5 * time.Second); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The pending broadcast and the leave should both have got through
+	if n := m1.NumPendingBroadcasts(); n != 0 {
+		t.Fatalf("expected no pending broadcasts, got %d", n)
+	}
+	for i := 0; i < 50 && m2.NumMembers() != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := m2.NumMembers(); n != 1 {
+		t.Fatalf("expected the drained node to have left, got %d members", n)
+	}
+	if len(d.msgs) == 0 || string(d.msgs[0]) != "hello" {
+		t.Fatalf("bad: %q", d.msgs)
+	}
+
+	// No more broadcasts are accepted
+	if err := m1.QueueBroadcast(&namedBroadcast{name: "b", msg: []byte("late")}); err != ErrDraining {
+		t.Fatalf("expected ErrDraining, got %v", err)
+	}
+}
+
+func TestMemberlist_Drain_NoTimeout(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	// Drain would wait forever in a busy cluster without a timeout, so it
+	// refuses to start
+	if err := m.Drain(0); err == nil {
+		t.Fatalf("expected err")
+	}
+	if err := m.QueueBroadcast(&namedBroadcast{name: "a", msg: []byte("hello")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestMemberlist_PauseResume(t *testing.T) {
+	c1 := testConfig()
+	c1.ProbeInterval = 10 * time.Millisecond
+	c1.ProbeTimeout = 5 * time.Millisecond
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m1.Join([]string{c2.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := m1.Pause(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !m1.Paused() {
+		t.Fatalf("should be paused")
+	}
+
+	// No more probes go out once any in flight have finished
+	time.Sleep(20 * time.Millisecond)
+	before := m1.Stats().ProbesSent
+	time.Sleep(50 * time.Millisecond)
+	if n := m1.Stats().ProbesSent; n != before {
+		t.Fatalf("probes sent while paused: %d -> %d", before, n)
+	}
+
+	// The paused node still answers pings
+	if err := m2.ProbeAddr(c1.BindAddr, time.Second); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := m1.Resume(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if m1.Paused() {
+		t.Fatalf("should not be paused")
+	}
+	for i := 0; i < 50 && m1.Stats().ProbesSent == before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := m1.Stats().ProbesSent; n == before {
+		t.Fatalf("no probes sent after resuming")
+	}
+
+	m1.Shutdown()
+	if err := m1.Pause(); err != ErrShutdown {
+		t.Fatalf("expected ErrShutdown, got %v", err)
+	}
+}
+
+func TestMemberlist_LeaveWithReason(t *testing.T) {
+	m := GetMemberlist(t)
+	m.setAlive()
+	defer m.Shutdown()
+
+	if err := m.LeaveWithReason(time.Second, 7); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// There are no other nodes, so the broadcast is left queued
+	var out dead
+	msg := m.broadcasts.bcQueue[0].b.Message()
+	if messageType(msg[0]) != deadMsg {
+		t.Fatalf("expected queued dead msg")
+	}
+	if err := decode(msg[1:], &out); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if out.Node != m.config.Name || out.Reason != 7 {
+		t.Fatalf("bad dead msg: %v", out)
+	}
+}
+
+func TestMemberlist_LeaveAfterShutdown(t *testing.T) {
+	m := GetMemberlist(t)
+	m.setAlive()
+	m.schedule()
+
+	if err := m.Shutdown(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := m.Leave(time.Second); err != ErrShutdown {
+		t.Fatalf("expected ErrShutdown: %v", err)
+	}
+
+	// Should be safe to call again
+	if err := m.Leave(time.Second); err != ErrShutdown {
+		t.Fatalf("expected ErrShutdown: %v", err)
+	}
+}
+
+func TestMemberlist_JoinShutdown(t *testing.T) {
+	m1 := GetMemberlist(t)
+	m1.setAlive()
+	m1.schedule()
+
+	// Create a second node
+	c := DefaultLANConfig()
+	addr1 := getBindAddr()
+	c.Name = addr1.String()
+	c.BindAddr = addr1.String()
+	c.Port = m1.config.Port
+	c.ProbeInterval = time.Millisecond
+	c.ProbeTimeout = 100 * time.Microsecond
+
+	m2, err := Create(c)
+	if err != nil {
+		t.Fatal("unexpected err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	num, err := m2.Join([]string{m1.config.BindAddr})
+	if num != 1 {
+		t.Fatal("unexpected 1: %d", num)
+	}
+	if err != nil {
+		t.Fatal("unexpected err: %s", err)
+	}
+
+	// Check the hosts
+	if len(m2.Members()) != 2 {
+		t.Fatalf("should have 2 nodes! %v", m2.Members())
+	}
+
+	m1.Shutdown()
+
+	time.Sleep(10 * time.Millisecond)
+
+	if len(m2.Members()) != 1 {
+		t.Fatalf("should have 1 nodes! %v", m2.Members())
+	}
+}
+
+func TestMemberlist_ShutdownCh(t *testing.T) {
+	m := GetMemberlist(t)
+	ch := m.ShutdownCh()
+
+	select {
+	case <-ch:
+		t.Fatalf("should not be closed before shutdown")
+	default:
+	}
+
+	// Shutting down twice must not close the channel twice
+	if err := m.Shutdown(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := m.Shutdown(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("should be closed after shutdown")
+	}
+}
+
+func TestMemberlist_Shutdown_Waits(t *testing.T) {
+	c := testConfig()
+	c.PushPullInterval = time.Hour // Long stagger before the first sync
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	start := time.Now()
+	if err := m.Shutdown(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed > time.Second {
+		t.Fatalf("shutdown took too long: %v", elapsed)
+	}
+
+	// Everything has exited already
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Millisecond):
+		t.Fatalf("goroutines still running after shutdown")
+	}
+}
+
+// shutdownEventDelegate shuts the memberlist down when a node leaves
+type shutdownEventDelegate struct {
+	ChannelEventDelegate
+	m *Memberlist
+}
+
+func (d *shutdownEventDelegate) NotifyLeave(n *Node) {
+	d.m.Shutdown()
+}
+
+func TestMemberlist_Shutdown_FromCallback(t *testing.T) {
+	events := &shutdownEventDelegate{
+		ChannelEventDelegate: ChannelEventDelegate{make(chan NodeEvent, 16)},
+	}
+	c1 := testConfig()
+	c1.Events = events
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+	events.m = m1
+
+	c2 := testConfig()
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The leave is delivered on m1's packet listener, which Shutdown
+	// can't wait for from there
+	d := dead{Node: c2.Name, Incarnation: 1, From: c2.Name}
+	buf, err := encode(deadMsg, &d)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP(c1.BindAddr), Port: c1.Port}
+	if err := m2.rawSendMsg(addr, buf.Bytes()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	select {
+	case <-m1.ShutdownCh():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("not shut down")
+	}
+
+	// The callback returned, so the rest of the shutdown didn't hang
+	done := make(chan struct{})
+	go func() {
+		m1.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("shutdown from a callback hung")
+	}
+}
+
+func TestMemberlist_delegateMeta(t *testing.T) {
+	c1 := testConfig()
+	c2 := testConfig()
+	c1.Delegate = &MockDelegate{meta: []byte("web")}
+	c2.Delegate = &MockDelegate{meta: []byte("lb")}
+
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	_, err = m1.Join([]string{c2.BindAddr})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	yield()
+
+	var roles map[string]string
+
+	// Check the roles of members of m1
+	m1m := m1.Members()
+	if len(m1m) != 2 {
+		t.Fatalf("bad: %#v", m1m)
+	}
+
+	roles = make(map[string]string)
+	for _, m := range m1m {
+		roles[m.Name] = string(m.Meta)
+	}
+
+	if r := roles[c1.Name]; r != "web" {
+		t.Fatalf("bad role for %s: %s", c1.Name, r)
+	}
+
+	if r := roles[c2.Name]; r != "lb" {
+		t.Fatalf("bad role for %s: %s", c2.Name, r)
+	}
+
+	// Check the roles of members of m2
+	m2m := m2.Members()
+	if len(m2m) != 2 {
+		t.Fatalf("bad: %#v", m2m)
+	}
+
+	roles = make(map[string]string)
+	for _, m := range m2m {
+		roles[m.Name] = string(m.Meta)
+	}
+
+	if r := roles[c1.Name]; r != "web" {
+		t.Fatalf("bad role for %s: %s", c1.Name, r)
+	}
+
+	if r := roles[c2.Name]; r != "lb" {
+		t.Fatalf("bad role for %s: %s", c2.Name, r)
+	}
+}
+
+func TestMemberlist_Advertise(t *testing.T) {
+	c := testConfig()
+	c.AdvertiseAddr = "10.1.2.3"
+	c.AdvertisePort = 12345
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.Shutdown()
+
+	n := m.LocalNode()
+	if !n.Addr.Equal(net.ParseIP("10.1.2.3")) || len(n.Addr) != net.IPv4len {
+		t.Fatalf("bad addr: %v", n.Addr)
+	}
+	if n.Port != 12345 {
+		t.Fatalf("bad port: %d", n.Port)
+	}
+
+	// Listeners are still bound to the bind address
+	host, _, err := net.SplitHostPort(m.transport.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if host != c.BindAddr {
+		t.Fatalf("bad bind addr: %s", host)
+	}
+}
+
+func TestMemberlist_Advertise_BadAddr(t *testing.T) {
+	c := testConfig()
+	c.AdvertiseAddr = "not-an-ip"
+	m, err := Create(c)
+	if err == nil {
+		m.Shutdown()
+		t.Fatalf("expected error")
+	}
+}
+
+func TestMemberlist_UpdateNode(t *testing.T) {
+	c1 := testConfig()
+	c2 := testConfig()
+	c1.GossipInterval = 5 * time.Millisecond
+	d1 := &MockDelegate{meta: []byte("follower")}
+	c1.Delegate = d1
+
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	_, err = m1.Join([]string{c2.BindAddr})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	yield()
+
+	// Change the meta and re-advertise
+	d1.meta = []byte("leader")
+	if err := m1.UpdateNode(time.Second); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if n := m1.LocalNode(); string(n.Meta) != "leader" {
+		t.Fatalf("bad local meta: %s", n.Meta)
+	}
+
+	yield()
+
+	var meta string
+	for _, n := range m2.Members() {
+		if n.Name == c1.Name {
+			meta = string(n.Meta)
+		}
+	}
+	if meta != "leader" {
+		t.Fatalf("bad remote meta: %s", meta)
+	}
+}
+
+func TestMemberlist_UpdateNode_MetaTooLarge(t *testing.T) {
+	m, d := GetMemberlistDelegate(t)
+	if err := m.setAlive(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.Shutdown()
+
+	d.meta = make([]byte, metaMaxSize+1)
+	if err := m.UpdateNode(0); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	if n := m.LocalNode(); len(n.Meta) != 0 {
+		t.Fatalf("meta should not change: %v", n.Meta)
+	}
+}
+
+func TestMemberlist_SetMeta(t *testing.T) {
+	c1 := testConfig()
+	c2 := testConfig()
+	c1.GossipInterval = 5 * time.Millisecond
+	d1 := &MockDelegate{meta: []byte("follower")}
+	c1.Delegate = d1
+
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	_, err = m1.Join([]string{c2.BindAddr})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	yield()
+
+	// The delegate is not consulted
+	if err := m1.SetMeta([]byte("leader"), time.Second); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if n := m1.LocalNode(); string(n.Meta) != "leader" {
+		t.Fatalf("bad local meta: %s", n.Meta)
+	}
+
+	yield()
+
+	var meta string
+	for _, n := range m2.Members() {
+		if n.Name == c1.Name {
+			meta = string(n.Meta)
+		}
+	}
+	if meta != "leader" {
+		t.Fatalf("bad remote meta: %s", meta)
+	}
+
+	if err := m1.SetMeta(make([]byte, metaMaxSize+1), 0); err == nil {
+		t.Fatalf("expected error")
+	}
+	if n := m1.LocalNode(); string(n.Meta) != "leader" {
+		t.Fatalf("meta should not change: %s", n.Meta)
+	}
+}
+
+func TestMemberlist_AdvertiseAddrFunc(t *testing.T) {
+	ip, port := net.IPv4(127, 0, 0, 10), uint16(8000)
+	var advErr error
+	c := testConfig()
+	c.AdvertiseAddrFunc = func() (net.IP, uint16, error) {
+		return ip, port, advErr
+	}
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.Shutdown()
+
+	check := func(wantIP net.IP, wantPort uint16) {
+		n := m.LocalNode()
+		if !n.Addr.Equal(wantIP) || n.Port != wantPort {
+			t.Fatalf("bad: %v:%d, expected %v:%d", n.Addr, n.Port, wantIP, wantPort)
+		}
+	}
+	check(ip, port)
+
+	// Refreshing picks up the new address
+	ip, port = net.IPv4(127, 0, 0, 11), 0
+	if err := m.UpdateNode(0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	check(ip, 8000)
+
+	// Errors and bad addresses keep the previous one
+	advErr = fmt.Errorf("no address")
+	if err := m.UpdateNode(0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	check(net.IPv4(127, 0, 0, 11), 8000)
+
+	ip, port, advErr = net.IPv4zero, 9000, nil
+	if err := m.UpdateNode(0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	check(net.IPv4(127, 0, 0, 11), 8000)
+
+	// Refuting a suspicion picks up the new address as well
+	ip, port = net.IPv4(127, 0, 0, 12), 0
+	m.nodeLock.RLock()
+	inc := m.nodeMap[c.Name].Incarnation
+	m.nodeLock.RUnlock()
+	s := suspect{Node: c.Name, Incarnation: inc, From: "other"}
+	m.suspectNode(&s)
+	check(ip, 8000)
+}
+
+func TestMemberlist_ReloadConfig(t *testing.T) {
+	c := testConfig()
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.Shutdown()
+
+	m.tickerLock.Lock()
+	oldStop := m.stopTick
+	m.tickerLock.Unlock()
+
+	reload := *c
+	reload.GossipInterval = 50 * time.Millisecond
+	reload.GossipNodes = 5
+	reload.RetransmitMult = 7
+	reload.ProbeInterval = 2 * time.Second
+	reload.EnableCompression = !c.EnableCompression // Ignored
+	if err := m.ReloadConfig(&reload); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if m.config.GossipInterval != 50*time.Millisecond || m.config.GossipNodes != 5 ||
+		m.config.ProbeInterval != 2*time.Second || m.config.EnableCompression == reload.EnableCompression {
+		t.Fatalf("bad config: %+v", m.config)
+	}
+	m.broadcasts.Lock()
+	mult := m.broadcasts.RetransmitMult
+	m.broadcasts.Unlock()
+	if mult != 7 {
+		t.Fatalf("bad retransmit mult: %d", mult)
+	}
+
+	// The tickers were restarted
+	m.tickerLock.Lock()
+	newStop := m.stopTick
+	m.tickerLock.Unlock()
+	if newStop == nil || newStop == oldStop {
+		t.Fatalf("tickers not restarted")
+	}
+
+	cases := []func(c *Config){
+		func(c *Config) { c.Name = "other" },
+		func(c *Config) { c.Port++ },
+		func(c *Config) { c.BindAddr = "127.0.0.99" },
+		func(c *Config) { c.AdvertisePort = 1234 },
+		func(c *Config) { c.Label = "blue" },
+		func(c *Config) { c.SecretKey = TestKeys[0] },
+		func(c *Config) { c.TransportMode = TransportTCPOnly },
+		func(c *Config) { c.GossipNodes = 1; c.ProbeIntervalMin = time.Hour; c.ProbeIntervalMax = time.Second },
+	}
+	for i, f := range cases {
+		bad := *c
+		f(&bad)
+		if err := m.ReloadConfig(&bad); err == nil {
+			t.Fatalf("case %d: expected error", i)
+		}
+		if m.config.GossipNodes != 5 {
+			t.Fatalf("case %d: config changed", i)
+		}
+	}
+}
+
+func TestMemberlist_ReloadConfig_AnyPort(t *testing.T) {
+	newConfig := func() *Config {
+		c := DefaultLANConfig()
+		c.BindAddr = "127.0.0.1"
+		c.Name = "reload-any-port"
+		c.Port = 0
+		return c
+	}
+	m, err := Create(newConfig())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.Shutdown()
+
+	// A fresh config asks for any port again, which isn't a change
+	reload := newConfig()
+	reload.GossipNodes = 5
+	if err := m.ReloadConfig(reload); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if m.config.GossipNodes != 5 || m.config.Port == 0 {
+		t.Fatalf("bad config: %+v", m.config)
+	}
+}
+
+func TestMemberlist_SetName(t *testing.T) {
+	// Test addresses are reused, so use names that other tests' nodes
+	// can't gossip about
+	c1 := testConfig()
+	c1.Name = "setname-peer"
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.Name = "setname-local"
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Names in use by a live peer are refused
+	oldName := c2.Name
+	if err := m2.SetName(c1.Name); err == nil {
+		t.Fatalf("expected err")
+	}
+	if err := m2.SetName(""); err == nil {
+		t.Fatalf("expected err")
+	}
+
+	ch := make(chan NodeEvent, 4)
+	m2.config.Events = &ChannelEventDelegate{ch}
+	before := m2.LocalNode()
+	if err := m2.SetName("renamed"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if n := m2.LocalNode(); n == nil || n.Name != "renamed" {
+		t.Fatalf("bad: %v", n)
+	}
+	if _, ok := m2.GetNode(oldName); ok {
+		t.Fatalf("old name should be gone")
+	}
+	if e := <-ch; e.Event != NodeLeave || e.Node.Name != oldName {
+		t.Fatalf("bad: %v", e)
+	}
+	if e := <-ch; e.Event != NodeJoin || e.Node.Name != "renamed" || !e.Node.Addr.Equal(before.Addr) {
+		t.Fatalf("bad: %v", e)
+	}
+
+	// The peer learns about the rename through gossip
+	for i := 0; i < 100; i++ {
+		_, hasOld := m1.GetNode(oldName)
+		_, hasNew := m1.GetNode("renamed")
+		if !hasOld && hasNew {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	var names []string
+	for _, n := range m1.Members() {
+		names = append(names, n.Name)
+	}
+	t.Fatalf("rename did not propagate: %v", names)
+}
+
+func TestMemberlist_SetName_StaleAlive(t *testing.T) {
+	c := testConfig()
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.Shutdown()
+
+	oldName := c.Name
+	local := m.LocalNode()
+	if err := m.SetName("renamed"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// An alive message for the old name from before the rename can't
+	// bring it back
+	a := alive{Node: oldName, Addr: local.Addr, Port: local.Port, Incarnation: 1}
+	m.aliveNode(&a)
+	if _, ok := m.GetNode(oldName); ok {
+		t.Fatalf("stale alive should be ignored")
+	}
+
+	// The old name can be taken back, without leaving a duplicate entry
+	if err := m.SetName(oldName); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	seen := make(map[string]bool)
+	for _, n := range m.nodes {
+		if seen[n.Name] {
+			t.Fatalf("duplicate entry for %s", n.Name)
+		}
+		seen[n.Name] = true
+	}
+}
+
+func TestMemberlist_ProbeAddr(t *testing.T) {
+	c1 := testConfig()
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	// m2 gossips about itself on the ack, which must be dropped
+	if err := m1.ProbeAddr(c2.BindAddr, time.Second); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, ok := m1.GetNode(c2.Name); ok {
+		t.Fatalf("should not become a member")
+	}
+
+	// Nodes of another cluster don't answer
+	c3 := testConfig()
+	c3.Label = "other"
+	m3, err := Create(c3)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m3.Shutdown()
+
+	if err := m1.ProbeAddr(c3.BindAddr, 50*time.Millisecond); err == nil {
+		t.Fatalf("expected err")
+	}
+	if err := m1.ProbeAddr(getBindAddr().String(), 50*time.Millisecond); err == nil {
+		t.Fatalf("expected err")
+	}
+}
+
+// customMergeDelegate only accepts peers whose meta matches its own
+type customMergeDelegate struct {
+	meta  string
+	peers []*Node
+}
+
+func (c *customMergeDelegate) NotifyMerge(peers []*Node) error {
+	c.peers = peers
+	for _, p := range peers {
+		if string(p.Meta) != c.meta {
+			return fmt.Errorf("node %s is in cluster %q", p.Name, p.Meta)
+		}
+	}
+	return nil
+}
+
+func TestMemberlist_Join_MergeDelegate(t *testing.T) {
+	c1 := testConfig()
+	c1.Delegate = &MockDelegate{meta: []byte("cluster-a")}
+	merge1 := &customMergeDelegate{meta: "cluster-a"}
+	c1.Merge = merge1
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.Delegate = &MockDelegate{meta: []byte("cluster-b")}
+	merge2 := &customMergeDelegate{meta: "cluster-b"}
+	c2.Merge = merge2
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	num, err := m2.Join([]string{c1.BindAddr})
+	if num != 0 || err == nil {
+		t.Fatalf("expected merge to be canceled: %d %v", num, err)
+	}
+
+	yield()
+
+	// Neither side should have merged the other
+	if len(m1.Members()) != 1 {
+		t.Fatalf("bad: %v", m1.Members())
+	}
+	if len(m2.Members()) != 1 {
+		t.Fatalf("bad: %v", m2.Members())
+	}
+	if len(merge1.peers) != 1 || merge1.peers[0].Name != c2.Name {
+		t.Fatalf("bad peers: %v", merge1.peers)
+	}
+	if len(merge2.peers) != 1 || merge2.peers[0].Name != c1.Name {
+		t.Fatalf("bad peers: %v", merge2.peers)
+	}
+}
+
+func TestMemberlist_Join_MaxNodes(t *testing.T) {
+	c1 := testConfig()
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A third node that only allows two nodes can't join the pair
+	c3 := testConfig()
+	c3.MaxNodes = 2
+	m3, err := Create(c3)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m3.Shutdown()
+
+	num, err := m3.Join([]string{c1.BindAddr})
+	if num != 0 || err == nil {
+		t.Fatalf("expected join to be refused: %d %v", num, err)
+	}
+	if len(m3.Members()) != 1 {
+		t.Fatalf("bad: %v", m3.Members())
+	}
+}
+
+func TestMemberlist_JoinContext_Canceled(t *testing.T) {
+	m, _ := GetMemberlistDelegate(t)
+	defer m.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	num, err := m.JoinContext(ctx, []string{getBindAddr().String()})
+	if num != 0 || err != context.Canceled {
+		t.Fatalf("bad: %d %v", num, err)
+	}
+}
+
+func TestMemberlist_JoinContext_Deadline(t *testing.T) {
+	m, _ := GetMemberlistDelegate(t)
+	defer m.Shutdown()
+
+	// Accept connections but never respond to the push/pull
+	list, err := net.Listen("tcp", net.JoinHostPort(getBindAddr().String(), "0"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer list.Close()
+	go func() {
+		for {
+			conn, err := list.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	num, err := m.JoinContext(ctx, []string{list.Addr().String(), list.Addr().String()})
+	if num != 0 || err != context.DeadlineExceeded {
+		t.Fatalf("bad: %d %v", num, err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed > time.Second {
+		t.Fatalf("join took too long: %v", elapsed)
+	}
+}
+
+func TestMemberlist_JoinWithAddrs(t *testing.T) {
+	c1 := testConfig()
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	// Addresses of the wrong type are skipped
+	addrs := []net.Addr{
+		&net.UnixAddr{Name: "/tmp/memberlist.sock", Net: "unix"},
+		&net.TCPAddr{IP: net.ParseIP(c1.BindAddr), Port: c1.Port},
+	}
+	num, err := m2.JoinWithAddrs(addrs)
+	if num != 1 || err != nil {
+		t.Fatalf("bad: %d %v", num, err)
+	}
+	if len(m2.Members()) != 2 {
+		t.Fatalf("should have 2 nodes! %v", m2.Members())
+	}
+
+	num, err = m2.JoinWithAddrs(addrs[:1])
+	if num != 0 || err == nil {
+		t.Fatalf("bad: %d %v", num, err)
+	}
+}
+
+func TestMemberlist_JoinRetry(t *testing.T) {
+	m1, err := Create(testConfig())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	// The seed only comes up after a couple of attempts have failed
+	c2 := testConfig()
+	addr := c2.BindAddr
+	created := make(chan *Memberlist, 1)
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		m2, err := Create(c2)
+		if err != nil {
+			t.Errorf("err: %s", err)
+		}
+		created <- m2
+	}()
+	defer func() {
+		if m2 := <-created; m2 != nil {
+			m2.Shutdown()
+		}
+	}()
+
+	num, err := m1.JoinRetry([]string{addr}, 10, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if num != 1 {
+		t.Fatalf("bad: %d", num)
+	}
+	if len(m1.Members()) != 2 {
+		t.Fatalf("bad: %v", m1.Members())
+	}
+}
+
+type joinedEventDelegate struct {
+	ChannelEventDelegate
+	joined chan int
+}
+
+func (j *joinedEventDelegate) NotifyJoined(n int) {
+	j.joined <- n
+}
+
+func TestMemberlist_JoinFromReader(t *testing.T) {
+	m1, err := Create(testConfig())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	seeds := fmt.Sprintf("# Seed nodes\n\n  %s:%d  # the other node\n", c2.BindAddr, c2.Port)
+	num, err := m1.JoinFromReader(strings.NewReader(seeds))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if num != 1 || m1.NumMembers() != 2 {
+		t.Fatalf("bad: %d %v", num, m1.Members())
+	}
+
+	// Bad lines are reported before contacting anyone
+	cases := []struct {
+		seeds string
+		line  int
+	}{
+		{"127.0.0.1\nbad host\n", 2},
+		{"host:port", 1},
+		{"\n\n:7946", 3},
+	}
+	for _, tc := range cases {
+		_, err := m1.JoinFromReader(strings.NewReader(tc.seeds))
+		perr, ok := err.(*SeedParseError)
+		if !ok || perr.Line != tc.line {
+			t.Fatalf("expected parse error on line %d for %q, got %v", tc.line, tc.seeds, err)
+		}
+	}
+
+	// Other forms Join takes are fine
+	for _, seed := range []string{"::1", "[::1]", "[::1]:7946", "node1", "_gossip._tcp.example.com"} {
+		if err := checkSeed(seed); err != nil {
+			t.Fatalf("%s: %v", seed, err)
+		}
+	}
+
+	if _, err := m1.JoinFromReader(strings.NewReader("# nothing\n")); err == nil {
+		t.Fatalf("expected error for an empty seed list")
+	}
+}
+
+func TestMemberlist_JoinOrWait(t *testing.T) {
+	events := &joinedEventDelegate{
+		ChannelEventDelegate: ChannelEventDelegate{make(chan NodeEvent, 16)},
+		joined:               make(chan int, 1),
+	}
+	c1 := testConfig()
+	c1.GossipInterval = 10 * time.Millisecond
+	c1.Events = events
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	// Nobody is there yet, so we carry on alone
+	c2 := testConfig()
+	if num := m1.JoinOrWait([]string{c2.BindAddr}); num != 0 {
+		t.Fatalf("bad: %d", num)
+	}
+	if len(m1.Members()) != 1 {
+		t.Fatalf("bad: %v", m1.Members())
+	}
+
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	select {
+	case n := <-events.joined:
+		if n != 1 {
+			t.Fatalf("bad: %d", n)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatalf("timeout")
+	}
+	if len(m1.Members()) != 2 {
+		t.Fatalf("bad: %v", m1.Members())
+	}
+}
+
+func TestMemberlist_JoinOrWait_Shutdown(t *testing.T) {
+	c := testConfig()
+	c.GossipInterval = time.Millisecond
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Retry in the background as fast as possible, so that Shutdown is
+	// likely to come in the middle of an attempt
+	if num := m.JoinOrWait([]string{getBindAddr().String()}); num != 0 {
+		t.Fatalf("bad: %d", num)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		m.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("shutdown blocked")
+	}
+
+	// Once shut down there's nothing left to retry
+	if num := m.JoinOrWait([]string{getBindAddr().String()}); num != 0 {
+		t.Fatalf("bad: %d", num)
+	}
+}
+
+func TestMemberlist_JoinRetry_Exhausted(t *testing.T) {
+	m, _ := GetMemberlistDelegate(t)
+	defer m.Shutdown()
+
+	start := time.Now()
+	num, err := m.JoinRetry([]string{getBindAddr().String()}, 3, 10*time.Millisecond)
+	if num != 0 || err == nil {
+		t.Fatalf("bad: %d %v", num, err)
+	}
+
+	// Waits 10ms then 20ms between the three attempts
+	if elapsed := time.Now().Sub(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("did not back off: %v", elapsed)
+	}
+}
+
+func TestMemberlist_JoinRetryContext_Canceled(t *testing.T) {
+	m, _ := GetMemberlistDelegate(t)
+	defer m.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	num, err := m.JoinRetryContext(ctx, []string{getBindAddr().String()}, 100, time.Hour)
+	if num != 0 || err != context.DeadlineExceeded {
+		t.Fatalf("bad: %d %v", num, err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed > time.Second {
+		t.Fatalf("retry took too long: %v", elapsed)
+	}
+}
+
+func TestMemberlist_Join_TCPTimeout(t *testing.T) {
+	m, _ := GetMemberlistDelegate(t)
+	defer m.Shutdown()
+	m.config.TCPTimeout = 50 * time.Millisecond
+
+	// Accept connections but never respond to the push/pull
+	list, err := net.Listen("tcp", net.JoinHostPort(getBindAddr().String(), "0"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
+	defer list.Close()
+	go func() {
+		for {
+			conn, err := list.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
 
-	// Check the hosts
-	if len(m2.Members()) != 2 {
-		t.Fatalf("should have 2 nodes! %v", m2.Members())
+	start := time.Now()
+	num, err := m.Join([]string{list.Addr().String()})
+	if num != 0 || err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("bad: %d %v", num, err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed > time.Second {
+		t.Fatalf("join took too long: %v", elapsed)
 	}
 }
 
-func TestMemberlist_Join_protocolVersions(t *testing.T) {
+func TestMemberlist_JoinDetailed(t *testing.T) {
 	c1 := testConfig()
-	c2 := testConfig()
-	c3 := testConfig()
-	c3.ProtocolVersion = ProtocolVersionMax
-
 	m1, err := Create(c1)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
 	defer m1.Shutdown()
 
+	c2 := testConfig()
 	m2, err := Create(c2)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
 	defer m2.Shutdown()
 
-	m3, err := Create(c3)
+	bad := "127.0.0.1:1"
+	results, err := m2.JoinDetailed([]string{bad, c1.BindAddr})
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	defer m3.Shutdown()
-
-	_, err = m1.Join([]string{c2.BindAddr})
-	if err != nil {
-		t.Fatalf("err: %s", err)
+	if len(results) != 2 {
+		t.Fatalf("bad: %v", results)
+	}
+	if results[0].Host != bad || results[0].Success || results[0].Err == nil {
+		t.Fatalf("bad: %v", results[0])
+	}
+	if results[1].Host != c1.BindAddr || !results[1].Success || results[1].Err != nil {
+		t.Fatalf("bad: %v", results[1])
 	}
 
-	yield()
+	// No host reachable
+	results, err = m2.JoinDetailed([]string{bad})
+	if err == nil || err != results[0].Err {
+		t.Fatalf("bad: %v %v", results, err)
+	}
+}
 
-	_, err = m1.Join([]string{c3.BindAddr})
+func TestMemberlist_GossipNow(t *testing.T) {
+	c1 := testConfig()
+	c1.GossipInterval = time.Hour
+	m1, err := Create(c1)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-}
-
-func TestMemberlist_Leave(t *testing.T) {
-	m1 := GetMemberlist(t)
-	m1.setAlive()
-	m1.schedule()
 	defer m1.Shutdown()
 
-	// Create a second node
-	c := DefaultLANConfig()
-	addr1 := getBindAddr()
-	c.Name = addr1.String()
-	c.BindAddr = addr1.String()
-	c.Port = m1.config.Port
-	c.GossipInterval = time.Millisecond
-
-	m2, err := Create(c)
+	c2 := testConfig()
+	c2.GossipInterval = time.Hour
+	m2, err := Create(c2)
 	if err != nil {
-		t.Fatal("unexpected err: %s", err)
+		t.Fatalf("err: %s", err)
 	}
 	defer m2.Shutdown()
 
-	num, err := m2.Join([]string{m1.config.BindAddr})
-	if num != 1 {
-		t.Fatal("unexpected 1: %d", num)
-	}
-	if err != nil {
-		t.Fatal("unexpected err: %s", err)
-	}
-
-	// Check the hosts
-	if len(m2.Members()) != 2 {
-		t.Fatalf("should have 2 nodes! %v", m2.Members())
-	}
-	if len(m1.Members()) != 2 {
-		t.Fatalf("should have 2 nodes! %v", m2.Members())
+	if _, err := m1.Join([]string{c2.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
 	}
 
-	// Leave
-	m1.Leave(time.Second)
-
-	// Wait for leave
-	time.Sleep(10 * time.Millisecond)
+	// Nothing is gossiped until we ask for it
+	a := alive{Node: "test3", Addr: []byte{127, 0, 0, 3}, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a)
 
-	// m1 should think dead
-	if len(m1.Members()) != 1 {
-		t.Fatalf("should have 1 node")
+	// The gossip targets are picked at random and may all be the
+	// unreachable node, so keep asking until it gets through
+	for i := 0; i < 100 && m2.NumMembers() != 3; i++ {
+		if err := m1.GossipNow(); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		yield()
+	}
+	if _, ok := m2.GetNode("test3"); !ok {
+		t.Fatalf("bad: %v", m2.Members())
 	}
 
-	if len(m2.Members()) != 1 {
-		t.Fatalf("should have 1 node")
+	m1.Shutdown()
+	if err := m1.GossipNow(); err != ErrShutdown {
+		t.Fatalf("bad: %v", err)
 	}
 }
 
-func TestMemberlist_JoinShutdown(t *testing.T) {
-	m1 := GetMemberlist(t)
-	m1.setAlive()
-	m1.schedule()
-
-	// Create a second node
-	c := DefaultLANConfig()
-	addr1 := getBindAddr()
-	c.Name = addr1.String()
-	c.BindAddr = addr1.String()
-	c.Port = m1.config.Port
-	c.ProbeInterval = time.Millisecond
-	c.ProbeTimeout = 100 * time.Microsecond
-
-	m2, err := Create(c)
-	if err != nil {
-		t.Fatal("unexpected err: %s", err)
+func TestMemberlist_SendTo(t *testing.T) {
+	m1, d1 := GetMemberlistDelegate(t)
+	if err := m1.setAlive(); err != nil {
+		t.Fatalf("err: %s", err)
 	}
+	defer m1.Shutdown()
+
+	m2, _ := GetMemberlistDelegate(t)
 	defer m2.Shutdown()
 
-	num, err := m2.Join([]string{m1.config.BindAddr})
-	if num != 1 {
-		t.Fatal("unexpected 1: %d", num)
+	target := m1.LocalNode()
+	if err := m2.SendToUDP(target, []byte("ping")); err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	if err != nil {
-		t.Fatal("unexpected err: %s", err)
+	if err := m2.SendToTCP(target, []byte("pong")); err != nil {
+		t.Fatalf("err: %s", err)
 	}
 
-	// Check the hosts
-	if len(m2.Members()) != 2 {
-		t.Fatalf("should have 2 nodes! %v", m2.Members())
-	}
+	yield()
 
-	m1.Shutdown()
+	if len(d1.msgs) != 2 {
+		t.Fatalf("should have 2 messages: %v", d1.msgs)
+	}
+	got := map[string]bool{string(d1.msgs[0]): true, string(d1.msgs[1]): true}
+	if !got["ping"] || !got["pong"] {
+		t.Fatalf("bad messages: %v", d1.msgs)
+	}
+}
 
-	time.Sleep(10 * time.Millisecond)
+func TestMemberlist_SendToTCP_Error(t *testing.T) {
+	m, _ := GetMemberlistDelegate(t)
+	defer m.Shutdown()
 
-	if len(m2.Members()) != 1 {
-		t.Fatalf("should have 1 nodes! %v", m2.Members())
+	// Nothing is listening on this address
+	n := &Node{Addr: getBindAddr(), Port: 1}
+	if err := m.SendToTCP(n, []byte("ping")); err == nil {
+		t.Fatalf("expected error")
 	}
 }
 
-func TestMemberlist_delegateMeta(t *testing.T) {
+func TestMemberlist_RotateKeys(t *testing.T) {
 	c1 := testConfig()
-	c2 := testConfig()
-	c1.Delegate = &MockDelegate{meta: []byte("web")}
-	c2.Delegate = &MockDelegate{meta: []byte("lb")}
-
+	c1.SecretKey = TestKeys[0]
 	m1, err := Create(c1)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
 	defer m1.Shutdown()
 
+	c2 := testConfig()
+	c2.SecretKey = TestKeys[0]
 	m2, err := Create(c2)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
 	defer m2.Shutdown()
 
-	_, err = m1.Join([]string{c2.BindAddr})
-	if err != nil {
+	// Install the new key everywhere, then promote it on one node only
+	for _, m := range []*Memberlist{m1, m2} {
+		if err := m.AddKey(TestKeys[1]); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if err := m1.UseKey(TestKeys[1]); err != nil {
 		t.Fatalf("err: %s", err)
 	}
 
-	yield()
+	// Nodes should still be able to talk using either key
+	if _, err := m1.Join([]string{c2.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
 
-	var roles map[string]string
+	// Finish the rotation and remove the old key
+	if err := m2.UseKey(TestKeys[1]); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, m := range []*Memberlist{m1, m2} {
+		if err := m.RemoveKey(TestKeys[0]); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
 
-	// Check the roles of members of m1
-	m1m := m1.Members()
-	if len(m1m) != 2 {
-		t.Fatalf("bad: %#v", m1m)
+	if len(m1.Members()) != 2 || len(m2.Members()) != 2 {
+		t.Fatalf("bad: %v %v", m1.Members(), m2.Members())
 	}
 
-	roles = make(map[string]string)
-	for _, m := range m1m {
-		roles[m.Name] = string(m.Meta)
+	// A node with only the old key can no longer join
+	c3 := testConfig()
+	c3.SecretKey = TestKeys[0]
+	m3, err := Create(c3)
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
+	defer m3.Shutdown()
+	if _, err := m3.Join([]string{c1.BindAddr}); err == nil {
+		t.Fatalf("expected err")
+	}
+}
 
-	if r := roles[c1.Name]; r != "web" {
-		t.Fatalf("bad role for %s: %s", c1.Name, r)
+func TestMemberlist_Keys_NoEncryption(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	if err := m.AddKey(TestKeys[0]); err == nil {
+		t.Fatalf("expected err")
 	}
+	if _, err := m.GetKeys(); err == nil {
+		t.Fatalf("expected err")
+	}
+}
 
-	if r := roles[c2.Name]; r != "lb" {
-		t.Fatalf("bad role for %s: %s", c2.Name, r)
+func TestMemberlist_NodeMeta(t *testing.T) {
+	meta, err := EncodeTags(map[string]string{"role": "web"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
 
-	// Check the roles of members of m2
-	m2m := m2.Members()
-	if len(m2m) != 2 {
-		t.Fatalf("bad: %#v", m2m)
+	c1 := testConfig()
+	c1.NodeMeta = meta
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
+	defer m1.Shutdown()
 
-	roles = make(map[string]string)
-	for _, m := range m2m {
-		roles[m.Name] = string(m.Meta)
+	// A delegate takes precedence
+	m2, d := GetMemberlistDelegate(t)
+	defer m2.Shutdown()
+	m2.config.NodeMeta = []byte("ignored")
+	d.meta = []byte("delegate")
+	if err := m2.setAlive(); err != nil {
+		t.Fatalf("err: %s", err)
 	}
 
-	if r := roles[c1.Name]; r != "web" {
-		t.Fatalf("bad role for %s: %s", c1.Name, r)
+	if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
 	}
 
-	if r := roles[c2.Name]; r != "lb" {
-		t.Fatalf("bad role for %s: %s", c2.Name, r)
+	tags, ok := m2.GetNodeTags(c1.Name)
+	if !ok || tags["role"] != "web" {
+		t.Fatalf("bad: %v %v", tags, ok)
+	}
+	n, ok := m1.GetNode(m2.config.Name)
+	if !ok || string(n.Meta) != "delegate" {
+		t.Fatalf("bad: %v %v", n, ok)
 	}
 }
 
@@ -638,6 +2704,110 @@ func TestMemberlist_Join_Proto1And2(t *testing.T) {
 	}
 }
 
+func TestMemberlist_Join_FlateCompression(t *testing.T) {
+	c1 := testConfig()
+	c1.ProtocolVersion = ProtocolVersionMax
+	c1.CompressionAlgo = CompressionFlate
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.ProtocolVersion = ProtocolVersionMax
+	c2.CompressionAlgo = CompressionFlate
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	num, err := m2.Join([]string{c1.BindAddr})
+	if num != 1 || err != nil {
+		t.Fatalf("unexpected join: %d %v", num, err)
+	}
+
+	if len(m1.Members()) != 2 || len(m2.Members()) != 2 {
+		t.Fatalf("bad: %v %v", m1.Members(), m2.Members())
+	}
+}
+
+func TestMemberlist_TransportMode(t *testing.T) {
+	// Nodes without UDP can still join and sync state over TCP
+	c1 := testConfig()
+	c1.TransportMode = TransportTCPOnly
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.TransportMode = TransportTCPOnly
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(m1.Members()) != 2 || len(m2.Members()) != 2 {
+		t.Fatalf("bad: %v %v", m1.Members(), m2.Members())
+	}
+	if err := m2.SendToUDP(m1.LocalNode(), []byte("hi")); err != ErrUDPDisabled {
+		t.Fatalf("expected ErrUDPDisabled: %v", err)
+	}
+
+	// Nodes without TCP can't join
+	c3 := testConfig()
+	c3.TransportMode = TransportUDPOnly
+	m3, err := Create(c3)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m3.Shutdown()
+
+	if _, err := m3.Join([]string{c1.BindAddr}); err != ErrTCPDisabled {
+		t.Fatalf("expected ErrTCPDisabled: %v", err)
+	}
+	if err := m3.SendToTCP(m1.LocalNode(), []byte("hi")); err != ErrTCPDisabled {
+		t.Fatalf("expected ErrTCPDisabled: %v", err)
+	}
+}
+
+func TestMemberlist_BindAddrs(t *testing.T) {
+	c1 := testConfig()
+	c1.BindAddrs = []string{c1.BindAddr, getBindAddr().String()}
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	// The first address is advertised
+	if n := m1.LocalNode(); n.Addr.String() != c1.BindAddrs[0] {
+		t.Fatalf("bad: %v", n.Addr)
+	}
+
+	// Nodes can join through any of them
+	c2 := testConfig()
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m2.Join([]string{c1.BindAddrs[1]}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(m1.Members()) != 2 || len(m2.Members()) != 2 {
+		t.Fatalf("bad: %v %v", m1.Members(), m2.Members())
+	}
+}
+
 func TestMemberlist_Join_IPv6(t *testing.T) {
 	c1 := DefaultLANConfig()
 	c1.Name = "A"
@@ -0,0 +1,13 @@
+package memberlist
+
+// MergeDelegate is used to involve a client in a potential cluster
+// merge operation. Whenever a TCP push/pull state exchange takes place,
+// including as part of a join, the delegate is shown the nodes known by
+// the peer before any of them are merged, and may cancel the merge based
+// on custom logic.
+type MergeDelegate interface {
+	// NotifyMerge is invoked when a merge could take place.
+	// Provides a list of the nodes known by the peer. If
+	// the return value is non-nil, the merge is canceled.
+	NotifyMerge(peers []*Node) error
+}
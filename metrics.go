@@ -0,0 +1,111 @@
+package memberlist
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsSink is used to export internal telemetry. Keys are given as a
+// slice of name parts, for example []string{"memberlist", "udp", "sent"},
+// which the sink may join in whatever way suits its backend. All the
+// methods must be thread-safe, and should not block, since they are
+// called from the protocol hot paths.
+type MetricsSink interface {
+	// IncrCounter adds val to the counter with the given key.
+	IncrCounter(key []string, val float32)
+
+	// AddSample records a single observation, such as a duration in
+	// milliseconds, for the given key.
+	AddSample(key []string, val float32)
+
+	// SetGauge sets the gauge with the given key to val.
+	SetGauge(key []string, val float32)
+}
+
+// Stats holds cumulative counts of the traffic this node has handled since
+// it was created. It is always kept, so it offers basic monitoring without
+// a MetricsSink.
+type Stats struct {
+	UDPPacketsSent     uint64
+	UDPBytesSent       uint64
+	UDPPacketsReceived uint64
+	UDPBytesReceived   uint64
+	UDPPacketsDropped  uint64 // Packets the transport failed to send
+
+	TCPConnsOpened   uint64 // Outbound connections dialed
+	TCPConnsAccepted uint64 // Inbound connections handed to us
+	TCPBytesSent     uint64
+	TCPBytesReceived uint64
+
+	PushPulls      uint64 // State syncs started by us, including joins
+	ProbesSent     uint64
+	AcksReceived   uint64
+	BroadcastsSent uint64 // Broadcasts taken from the queues for sending
+}
+
+// Stats returns a snapshot of the traffic counters. Each counter is read
+// atomically, but they are not read together, so they may be slightly out
+// of step with each other.
+func (m *Memberlist) Stats() Stats {
+	s := &m.stats
+	return Stats{
+		UDPPacketsSent:     atomic.LoadUint64(&s.UDPPacketsSent),
+		UDPBytesSent:       atomic.LoadUint64(&s.UDPBytesSent),
+		UDPPacketsReceived: atomic.LoadUint64(&s.UDPPacketsReceived),
+		UDPBytesReceived:   atomic.LoadUint64(&s.UDPBytesReceived),
+		UDPPacketsDropped:  atomic.LoadUint64(&s.UDPPacketsDropped),
+		TCPConnsOpened:     atomic.LoadUint64(&s.TCPConnsOpened),
+		TCPConnsAccepted:   atomic.LoadUint64(&s.TCPConnsAccepted),
+		TCPBytesSent:       atomic.LoadUint64(&s.TCPBytesSent),
+		TCPBytesReceived:   atomic.LoadUint64(&s.TCPBytesReceived),
+		PushPulls:          atomic.LoadUint64(&s.PushPulls),
+		ProbesSent:         atomic.LoadUint64(&s.ProbesSent),
+		AcksReceived:       atomic.LoadUint64(&s.AcksReceived),
+		BroadcastsSent:     atomic.LoadUint64(&s.BroadcastsSent),
+	}
+}
+
+// incrCounter forwards to the MetricsSink if one is configured
+func (m *Memberlist) incrCounter(key []string, val float32) {
+	if sink := m.config.MetricsSink; sink != nil {
+		sink.IncrCounter(key, val)
+	}
+}
+
+// addSample forwards to the MetricsSink if one is configured
+func (m *Memberlist) addSample(key []string, val float32) {
+	if sink := m.config.MetricsSink; sink != nil {
+		sink.AddSample(key, val)
+	}
+}
+
+// setGauge forwards to the MetricsSink if one is configured
+func (m *Memberlist) setGauge(key []string, val float32) {
+	if sink := m.config.MetricsSink; sink != nil {
+		sink.SetGauge(key, val)
+	}
+}
+
+// measureSince records the time elapsed since start in milliseconds
+func (m *Memberlist) measureSince(key []string, start time.Time) {
+	if sink := m.config.MetricsSink; sink != nil {
+		elapsed := time.Now().Sub(start)
+		sink.AddSample(key, float32(elapsed)/float32(time.Millisecond))
+	}
+}
+
+// streamReader counts the bytes received over a stream connection
+type streamReader struct {
+	r io.Reader
+	m *Memberlist
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		atomic.AddUint64(&s.m.stats.TCPBytesReceived, uint64(n))
+		s.m.incrCounter([]string{"memberlist", "tcp", "received"}, float32(n))
+	}
+	return n, err
+}
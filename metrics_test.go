@@ -0,0 +1,143 @@
+package memberlist
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mockSink is a MetricsSink that records everything it is sent
+type mockSink struct {
+	sync.Mutex
+	counters map[string]float32
+	samples  map[string][]float32
+	gauges   map[string]float32
+}
+
+func newMockSink() *mockSink {
+	return &mockSink{
+		counters: make(map[string]float32),
+		samples:  make(map[string][]float32),
+		gauges:   make(map[string]float32),
+	}
+}
+
+func (s *mockSink) IncrCounter(key []string, val float32) {
+	s.Lock()
+	defer s.Unlock()
+	s.counters[strings.Join(key, ".")] += val
+}
+
+func (s *mockSink) AddSample(key []string, val float32) {
+	s.Lock()
+	defer s.Unlock()
+	k := strings.Join(key, ".")
+	s.samples[k] = append(s.samples[k], val)
+}
+
+func (s *mockSink) SetGauge(key []string, val float32) {
+	s.Lock()
+	defer s.Unlock()
+	s.gauges[strings.Join(key, ".")] = val
+}
+
+func (s *mockSink) counter(key string) float32 {
+	s.Lock()
+	defer s.Unlock()
+	return s.counters[key]
+}
+
+func TestMemberlist_Metrics(t *testing.T) {
+	sink := newMockSink()
+	c1 := testConfig()
+	c1.MetricsSink = sink
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m1.Join([]string{c2.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if v := sink.counter("memberlist.pushPull.count"); v != 1 {
+		t.Fatalf("bad push/pull count: %v", v)
+	}
+	if v := sink.counter("memberlist.tcp.sent"); v <= 0 {
+		t.Fatalf("bad tcp sent: %v", v)
+	}
+	if v := sink.counter("memberlist.tcp.received"); v <= 0 {
+		t.Fatalf("bad tcp received: %v", v)
+	}
+
+	// Probe the other node to exercise the UDP path
+	m1.nodeLock.RLock()
+	n := m1.nodeMap[c2.Name]
+	m1.nodeLock.RUnlock()
+	m1.probeNode(n)
+
+	if v := sink.counter("memberlist.probe.sent"); v < 1 {
+		t.Fatalf("bad probes sent: %v", v)
+	}
+	if v := sink.counter("memberlist.udp.sent"); v <= 0 {
+		t.Fatalf("bad udp sent: %v", v)
+	}
+	if v := sink.counter("memberlist.udp.received"); v <= 0 {
+		t.Fatalf("bad udp received: %v", v)
+	}
+}
+
+func TestMemberlist_Stats(t *testing.T) {
+	m1, err := Create(testConfig())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m1.Join([]string{c2.BindAddr}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	s1 := m1.Stats()
+	if s1.PushPulls != 1 || s1.TCPConnsOpened != 1 || s1.TCPBytesSent == 0 || s1.TCPBytesReceived == 0 {
+		t.Fatalf("bad: %+v", s1)
+	}
+
+	// Probe the other node to exercise the UDP path
+	m1.nodeLock.RLock()
+	n := m1.nodeMap[c2.Name]
+	m1.nodeLock.RUnlock()
+	m1.probeNode(n)
+
+	s1 = m1.Stats()
+	if s1.ProbesSent != 1 || s1.AcksReceived < 1 || s1.UDPPacketsSent < 1 || s1.UDPBytesSent == 0 ||
+		s1.UDPPacketsReceived < 1 || s1.UDPBytesReceived == 0 {
+		t.Fatalf("bad: %+v", s1)
+	}
+	if s2 := m2.Stats(); s2.TCPConnsAccepted < 1 || s2.UDPPacketsReceived < 1 {
+		t.Fatalf("bad: %+v", s2)
+	}
+
+	before := m1.Stats().BroadcastsSent
+	m1.broadcasts.QueueBroadcast(&memberlistBroadcast{"test", []byte("test"), nil})
+	if msgs := m1.getBroadcasts(0, 1000); len(msgs) == 0 {
+		t.Fatalf("missing broadcast")
+	}
+	if sent := m1.Stats().BroadcastsSent; sent <= before {
+		t.Fatalf("bad: %d %d", sent, before)
+	}
+}
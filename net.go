@@ -3,20 +3,33 @@ package memberlist
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"github.com/ugorji/go/codec"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
 // This is the minimum and maximum protocol version that we can
 // _understand_. We're allowed to speak at any version within this
 // range. This range is inclusive.
+//
+// Version 3 adds the DEFLATE compression algorithm, see CompressionFlate.
+// Version 4 accepts packets relayed over a stream, see Config.UDPMaxPacketSize.
+// Version 5 understands encrypted messages labelled with the AES key size.
 const (
 	ProtocolVersionMin uint8 = 0
-	ProtocolVersionMax       = 2
+
+	// ProtocolVersion2Compatible is the version spoken by default. Nodes
+	// that only understand up to version 2 can still join a cluster
+	// speaking it, so clusters can be upgraded one node at a time before
+	// ProtocolVersion is raised.
+	ProtocolVersion2Compatible = 2
+
+	ProtocolVersionMax = 5
 )
 
 // messageType is an integer ID of a type of message that can be received
@@ -36,15 +49,51 @@ const (
 	userMsg // User mesg, not handled by us
 	compressMsg
 	encryptMsg
+	hasLabelMsg
+	relayedPacketMsg
+	signedMsg
 )
 
-// compressionType is used to specify the compression algorithm
-type compressionType uint8
+// plaintextExemptTypes maps the names used in Config.PlaintextExempt to
+// message types
+var plaintextExemptTypes = map[string]messageType{
+	"ping":          pingMsg,
+	"indirect-ping": indirectPingMsg,
+	"ack":           ackRespMsg,
+	"suspect":       suspectMsg,
+	"alive":         aliveMsg,
+	"dead":          deadMsg,
+	"user":          userMsg,
+}
+
+// CompressionType is used to specify the compression algorithm. It is
+// sent along with each compressed message, so receivers always know how
+// to decompress it.
+type CompressionType uint8
 
 const (
-	lzwAlgo compressionType = iota
+	// CompressionLZW is the original LZW based compression, which is
+	// understood by every protocol version.
+	CompressionLZW CompressionType = iota
+
+	// CompressionFlate uses DEFLATE, which usually compresses large
+	// payloads such as push/pull state better than LZW. It is only
+	// understood from protocol version 3.
+	CompressionFlate
 )
 
+// minFlateProtocolVersion is the lowest protocol version at which we
+// may send CompressionFlate messages.
+const minFlateProtocolVersion = 3
+
+// minRelayProtocolVersion is the lowest protocol version at which we may
+// send oversized packets over a stream instead.
+const minRelayProtocolVersion = 4
+
+// minKeySizeProtocolVersion is the lowest protocol version at which we may
+// send encryption versions 2 and 3, which older nodes can't decrypt.
+const minKeySizeProtocolVersion = 5
+
 const (
 	compoundHeaderOverhead = 2   // Assumed header overhead
 	compoundOverhead       = 2   // Assumed overhead per entry in compoundHeader
@@ -52,6 +101,7 @@ const (
 	udpBufSize             = 65536
 	udpRecvBuf             = 2 * 1024 * 1024
 	udpSendBuf             = 1400
+	relayQueueDepth        = 64 // Oversized packets waiting to be sent over TCP
 	userMsgOverhead        = 1
 	blockingWarning        = 10 * time.Millisecond // Warn if a UDP packet takes this long to process
 	maxPushStateBytes      = 10 * 1024 * 1024
@@ -64,20 +114,23 @@ type ping struct {
 
 // indirect ping sent to an indirect ndoe
 type indirectPingReq struct {
-	SeqNo  uint32
-	Target []byte
-	Port   uint16
+	SeqNo   uint32
+	Target  []byte
+	Port    uint16
+	Timeout time.Duration // How long to wait for the ack, zero from older senders
 }
 
 // ack response is sent for a ping
 type ackResp struct {
-	SeqNo uint32
+	SeqNo   uint32
+	Payload []byte
 }
 
 // suspect is broadcast when we suspect a node is dead
 type suspect struct {
 	Incarnation uint32
 	Node        string
+	From        string // Include who did the suspicion
 }
 
 // alive is broadcast when we know a node is alive.
@@ -99,6 +152,20 @@ type alive struct {
 type dead struct {
 	Incarnation uint32
 	Node        string
+	Reason      uint8  // Reason given by a node that is leaving
+	From        string // Node that declared it dead, which is Node if it left
+}
+
+// cause works out why the node is gone, as seen by the node named self
+func (d *dead) cause(self string) LeaveCause {
+	switch d.From {
+	case d.Node:
+		return LeaveCauseLeft
+	case self:
+		return LeaveCauseSuspicionTimeout
+	default:
+		return LeaveCauseDeclaredDead
+	}
 }
 
 // pushPullHeader is used to inform the
@@ -109,6 +176,19 @@ type pushPullHeader struct {
 	Join         bool // Is this a join request or a anti-entropy run
 }
 
+// userMsgHeader is used to encapsulate a userMsg sent over a stream
+type userMsgHeader struct {
+	UserMsgLen int // Encodes the byte length of user state
+}
+
+// relayedPacketHeader is used to encapsulate a packet sent over a stream
+// because it was too large for UDP
+type relayedPacketHeader struct {
+	Addr      []byte // The address the sender receives packets on
+	Port      uint16
+	PacketLen int // Encodes the byte length of the packet
+}
+
 // pushNodeState is used for pushPullReq when we are
 // transfering out node states
 type pushNodeState struct {
@@ -117,149 +197,316 @@ type pushNodeState struct {
 	Port        uint16
 	Meta        []byte
 	Incarnation uint32
-	State       nodeStateType
+	State       NodeStateType
 	Vsn         []uint8 // Protocol versions
 }
 
 // compress is used to wrap an underlying payload
 // using a specified compression algorithm
 type compress struct {
-	Algo compressionType
+	Algo CompressionType
 	Buf  []byte
 }
 
-// encryptionVersion returns the encryption version to use
-func (m *Memberlist) encryptionVersion() encryptionVersion {
-	switch m.ProtocolVersion() {
-	case 0:
+// compressionAlgo returns the compression algorithm to use for outgoing
+// messages. If the configured algorithm is newer than the protocol version
+// we are speaking, peers may not understand it, so we fall back to LZW.
+func (m *Memberlist) compressionAlgo() CompressionType {
+	algo := m.config.CompressionAlgo
+	if algo == CompressionFlate && m.ProtocolVersion() < minFlateProtocolVersion {
+		return CompressionLZW
+	}
+	return algo
+}
+
+// encryptionVersion returns the encryption version to use with the given
+// key. Protocol version 1 always uses the padded format, and versions
+// before minKeySizeProtocolVersion the unpadded one, neither of which
+// identify the key size. Receivers try every installed key for those, so
+// they work with any key size.
+func (m *Memberlist) encryptionVersion(key []byte) encryptionVersion {
+	switch vsn := m.ProtocolVersion(); {
+	case vsn == 0:
 		panic("encryption not supported")
-	case 1:
+	case vsn == 1:
 		return 0
-	default:
+	case vsn < minKeySizeProtocolVersion:
 		return 1
+	default:
+		return keyEncryptionVersion(key)
 	}
 }
 
-// setUDPRecvBuf is used to resize the UDP receive window. The function
-// attempts to set the read buffer to `udpRecvBuf` but backs off until
-// the read buffer can be set.
-func setUDPRecvBuf(c *net.UDPConn) {
-	size := udpRecvBuf
+// streamListen is a long running goroutine that pulls incoming streams from the
+// transport and hands them off for processing.
+func (m *Memberlist) streamListen() {
+	defer m.wg.Done()
 	for {
-		if err := c.SetReadBuffer(size); err == nil {
-			break
+		select {
+		case conn := <-m.transport.StreamCh():
+			atomic.AddUint64(&m.stats.TCPConnsAccepted, 1)
+			if m.streamQueue == nil {
+				go m.handleConn(conn)
+				continue
+			}
+			select {
+			case m.streamQueue <- conn:
+			default:
+				m.logger.Warnf("Stream handoff queue is full, rejecting connection from %s", conn.RemoteAddr())
+				m.incrCounter([]string{"memberlist", "tcp", "rejected"}, 1)
+				conn.Close()
+			}
+
+		case <-m.shutdownCh:
+			m.drainStreamQueue()
+			return
 		}
-		size = size / 2
 	}
 }
 
-// tcpListen listens for and handles incoming connections
-func (m *Memberlist) tcpListen() {
+// streamWorker handles connections from the stream queue until shutdown
+func (m *Memberlist) streamWorker() {
+	defer m.wg.Done()
 	for {
-		conn, err := m.tcpListener.AcceptTCP()
-		if err != nil {
-			if m.shutdown {
-				break
-			}
-			m.logger.Printf("[ERR] Error accepting TCP connection: %s", err)
-			continue
+		select {
+		case conn := <-m.streamQueue:
+			m.handleConn(conn)
+
+		case <-m.shutdownCh:
+			return
 		}
-		go m.handleConn(conn)
 	}
 }
 
-// handleConn handles a single incoming TCP connection
-func (m *Memberlist) handleConn(conn *net.TCPConn) {
-	m.logger.Printf("[INFO] Responding to push/pull sync with: %s", conn.RemoteAddr())
+// drainStreamQueue closes any connections still waiting for a worker
+func (m *Memberlist) drainStreamQueue() {
+	for {
+		select {
+		case conn := <-m.streamQueue:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// handleConn handles an incoming TCP connection. If push/pull connections
+// are pooled, one is kept open for further syncs until it has been idle
+// for PushPullConnIdleTimeout.
+func (m *Memberlist) handleConn(conn net.Conn) {
 	defer conn.Close()
 
-	join, remoteNodes, userState, err := m.readRemoteState(conn)
-	if err != nil {
-		m.logger.Printf("[ERR] Failed to receive remote state: %s", err)
+	idle := m.config.PushPullConnIdleTimeout
+	if idle <= 0 {
+		m.handleStream(conn)
 		return
 	}
 
-	if err := m.sendLocalState(conn, join); err != nil {
-		m.logger.Printf("[ERR] Failed to push local state: %s", err)
+	// Don't hold up Shutdown while waiting on an idle connection
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-m.shutdownCh:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	pc := &peekConn{Conn: conn, r: bufio.NewReader(conn)}
+	for m.handleStream(pc) {
+		pc.SetDeadline(time.Now().Add(idle))
+		if _, err := pc.r.Peek(1); err != nil {
+			return
+		}
 	}
+}
 
-	if err := m.verifyProtocol(remoteNodes); err != nil {
-		m.logger.Printf("[ERR] Push/pull verification failed: %s", err)
-		return
+// handleStream handles a single message from an incoming connection. It
+// returns true after a completed push/pull sync, as the peer may then
+// reuse the connection.
+func (m *Memberlist) handleStream(conn net.Conn) bool {
+	msgType, bufConn, dec, err := m.readStream(conn)
+	if err != nil {
+		m.logger.Errorf("Failed to receive stream: %s", err)
+		return false
 	}
 
-	// Merge the membership state
-	m.mergeState(remoteNodes)
+	switch msgType {
+	case userMsg:
+		if err := m.readUserMsg(bufConn, dec); err != nil {
+			m.logger.Errorf("Failed to receive user message: %s", err)
+		}
+	case relayedPacketMsg:
+		if err := m.readRelayedPacket(conn, bufConn, dec); err != nil {
+			m.logger.Errorf("Failed to receive relayed packet: %s", err)
+		}
+	case pushPullMsg:
+		m.logger.Infof("Responding to push/pull sync with: %s", conn.RemoteAddr())
+		join, remoteNodes, userState, err := m.readRemoteState(bufConn, dec)
+		if err != nil {
+			m.logger.Errorf("Failed to receive remote state: %s", err)
+			return false
+		}
+
+		sendErr := m.sendLocalState(conn, join)
+		if sendErr != nil {
+			m.logger.Errorf("Failed to push local state: %s", sendErr)
+		}
 
-	// Invoke the delegate for user state
-	if m.config.Delegate != nil {
-		m.config.Delegate.MergeRemoteState(userState, join)
+		if err := m.mergeRemoteState(join, remoteNodes, userState); err != nil {
+			m.logger.Errorf("Failed push/pull merge: %s", err)
+			return false
+		}
+		return sendErr == nil
+	default:
+		// Most likely a newer message type from a node speaking a later
+		// protocol version, so don't treat it as an error
+		m.logger.Debugf("Ignoring stream with unknown msgType (%d) from %s", msgType, conn.RemoteAddr())
+		m.incrCounter([]string{"memberlist", "tcp", "unknown"}, 1)
 	}
+	return false
 }
 
-// udpListen listens for and handles incoming UDP packets
-func (m *Memberlist) udpListen() {
-	mainBuf := make([]byte, udpBufSize)
-	var n int
-	var addr net.Addr
-	var err error
+// packetListen is a long running goroutine that pulls packets out of the
+// transport and hands them off for processing.
+func (m *Memberlist) packetListen() {
+	defer m.wg.Done()
 	var lastPacket time.Time
 	for {
 		// Do a check for potentially blocking operations
 		if !lastPacket.IsZero() && time.Now().Sub(lastPacket) > blockingWarning {
 			diff := time.Now().Sub(lastPacket)
-			m.logger.Printf(
-				"[WARN] Potential blocking operation. Last command took %v",
-				diff)
+			m.logger.Warnf("Potential blocking operation. Last command took %v", diff)
 		}
 
-		// Reset buffer
-		buf := mainBuf[0:udpBufSize]
+		select {
+		case packet := <-m.transport.PacketCh():
+			// Capture the current time
+			lastPacket = time.Now()
 
-		// Read a packet
-		n, addr, err = m.udpListener.ReadFrom(buf)
-		if err != nil {
-			if m.shutdown {
-				break
-			}
-			m.logger.Printf("[ERR] Error reading UDP packet: %s", err)
-			continue
-		}
+			// Ingest this packet
+			m.ingestPacket(packet.Buf, packet.From, packet.Timestamp)
 
-		// Check the length
-		if n < 1 {
-			m.logger.Printf("[ERR] UDP packet too short (%d bytes). From: %s",
-				len(buf), addr)
-			continue
+		case <-m.shutdownCh:
+			return
 		}
+	}
+}
 
-		// Capture the current time
-		lastPacket = time.Now()
+func (m *Memberlist) ingestPacket(buf []byte, from net.Addr, timestamp time.Time) {
+	atomic.AddUint64(&m.stats.UDPPacketsReceived, 1)
+	atomic.AddUint64(&m.stats.UDPBytesReceived, uint64(len(buf)))
+	m.incrCounter([]string{"memberlist", "udp", "received"}, float32(len(buf)))
+	if m.config.NotifyPacket != nil {
+		m.config.NotifyPacket(from, buf)
+	}
 
-		// Ingest this packet
-		m.ingestPacket(buf[:n], addr)
+	// Drop packets that are meant for another cluster
+	buf, label, err := removeLabelHeaderFromPacket(buf)
+	if err != nil {
+		m.logger.Errorf("Failed to read packet label from %s: %v", from, err)
+		return
+	}
+	if label != m.config.Label {
+		m.logger.Warnf("Discarding packet from %s with label %q, expected %q",
+			from, label, m.config.Label)
+		m.incrCounter([]string{"memberlist", "label", "mismatch"}, 1)
+		return
 	}
-}
 
-func (m *Memberlist) ingestPacket(buf []byte, from net.Addr) {
 	// Check if encryption is enabled
-	if m.config.SecretKey != nil {
+	if m.config.EncryptionEnabled() {
 		// Decrypt the payload
-		plain, err := decryptPayload(m.config.SecretKey, buf, nil)
-		if err != nil {
-			m.logger.Printf("[ERR] Decrypt packet failed: %v", err)
-			return
+		plain, err := decryptPayload(m.config.Keyring.GetKeys(), buf, nil)
+		if err == nil {
+			// Continue processing the plaintext buffer
+			buf = plain
+		} else if !m.config.GossipVerifyIncomingDisabled {
+			// Only messages exempt from encryption may be plaintext
+			exempt := m.exemptPlaintext(buf)
+			if exempt == nil {
+				m.logger.Errorf("Decrypt packet failed: %v", err)
+				m.incrCounter([]string{"memberlist", "udp", "decrypt", "failed"}, 1)
+				return
+			}
+			buf = exempt
 		}
 
-		// Continue processing the plaintext buffer
-		buf = plain
+		// Otherwise the packet may be plaintext from a node that isn't
+		// encrypting yet, so try to handle it as it is
+	} else if m.config.SigningEnabled() {
+		if len(buf) > 0 && messageType(buf[0]) == signedMsg {
+			// A bad signature means tampering, so always drop those
+			plain, err := verifyPacket(m.config.SigningKeyring.GetKeys(), buf)
+			if err != nil {
+				m.logger.Errorf("Verify packet from %s failed: %v", from, err)
+				m.incrCounter([]string{"memberlist", "udp", "verify", "failed"}, 1)
+				return
+			}
+			buf = plain
+		} else if !m.config.GossipVerifyIncomingDisabled {
+			exempt := m.exemptPlaintext(buf)
+			if exempt == nil {
+				m.logger.Errorf("Dropping unsigned packet from %s", from)
+				m.incrCounter([]string{"memberlist", "udp", "verify", "failed"}, 1)
+				return
+			}
+			buf = exempt
+		}
 	}
 
 	// Handle the command
-	m.handleCommand(buf, from)
+	m.handleCommand(buf, from, timestamp)
 }
 
-func (m *Memberlist) handleCommand(buf []byte, from net.Addr) {
+// exemptPlaintext returns the messages of a plaintext packet whose types
+// are in Config.PlaintextExempt, looking inside compound and compressed
+// messages, or nil if there are none
+func (m *Memberlist) exemptPlaintext(buf []byte) []byte {
+	if len(m.plaintextExempt) == 0 || len(buf) == 0 {
+		return nil
+	}
+
+	switch messageType(buf[0]) {
+	case compoundMsg:
+		_, parts, err := decodeCompoundMessage(buf[1:])
+		if err != nil {
+			return nil
+		}
+		var keep [][]byte
+		for _, part := range parts {
+			if part = m.exemptPlaintext(part); part != nil {
+				keep = append(keep, part)
+			}
+		}
+		switch len(keep) {
+		case 0:
+			return nil
+		case 1:
+			return keep[0]
+		}
+		return makeCompoundMessage(keep).Bytes()
+	case compressMsg:
+		payload, err := decompressPayload(buf[1:])
+		if err != nil {
+			return nil
+		}
+		return m.exemptPlaintext(payload)
+	default:
+		if m.plaintextExempt[messageType(buf[0])] {
+			return buf
+		}
+		return nil
+	}
+}
+
+func (m *Memberlist) handleCommand(buf []byte, from net.Addr, timestamp time.Time) {
+	if len(buf) < 1 {
+		m.logger.Errorf("Missing message type byte. From: %s", from)
+		return
+	}
+
 	// Decode the message type
 	msgType := messageType(buf[0])
 	buf = buf[1:]
@@ -267,13 +514,13 @@ func (m *Memberlist) handleCommand(buf []byte, from net.Addr) {
 	// Switch on the msgType
 	switch msgType {
 	case compoundMsg:
-		m.handleCompound(buf, from)
+		m.handleCompound(buf, from, timestamp)
 	case pingMsg:
 		m.handlePing(buf, from)
 	case indirectPingMsg:
 		m.handleIndirectPing(buf, from)
 	case ackRespMsg:
-		m.handleAck(buf, from)
+		m.handleAck(buf, from, timestamp)
 	case suspectMsg:
 		m.handleSuspect(buf, from)
 	case aliveMsg:
@@ -283,47 +530,74 @@ func (m *Memberlist) handleCommand(buf []byte, from net.Addr) {
 	case userMsg:
 		m.handleUser(buf, from)
 	case compressMsg:
-		m.handleCompressed(buf, from)
+		m.handleCompressed(buf, from, timestamp)
 	default:
-		m.logger.Printf("[ERR] UDP msg type (%d) not supported. From: %s", msgType, from)
+		// Most likely a newer message type from a node speaking a later
+		// protocol version. Only this message is skipped, the rest of a
+		// compound packet is still handled.
+		m.logger.Debugf("Ignoring UDP msg type (%d). From: %s", msgType, from)
+		m.incrCounter([]string{"memberlist", "udp", "unknown"}, 1)
 	}
 }
 
-func (m *Memberlist) handleCompound(buf []byte, from net.Addr) {
+func (m *Memberlist) handleCompound(buf []byte, from net.Addr, timestamp time.Time) {
 	// Decode the parts
 	trunc, parts, err := decodeCompoundMessage(buf)
 	if err != nil {
-		m.logger.Printf("[ERR] Failed to decode compound request: %s", err)
+		m.logger.Errorf("Failed to decode compound request: %s", err)
 		return
 	}
 
 	// Log any truncation
 	if trunc > 0 {
-		m.logger.Printf("[WARN] Compound request had %d truncated messages", trunc)
+		m.logger.Warnf("Compound request had %d truncated messages", trunc)
 	}
 
-	// Handle each message
+	// Gossip piggybacked on the ack to a ProbeAddr is dropped, so that
+	// probing a node doesn't change our view of the cluster
 	for _, part := range parts {
-		m.handleCommand(part, from)
+		if m.isolatedAck(part) {
+			m.handleCommand(part, from, timestamp)
+			return
+		}
+	}
+
+	// Handle each message in order, unless the delegate takes batches,
+	// in which case the user messages are gathered to be delivered
+	// together
+	_, batch := m.config.Delegate.(BatchDelegate)
+	var msgs [][]byte
+	for _, part := range parts {
+		if batch && len(part) > 0 && messageType(part[0]) == userMsg {
+			msgs = append(msgs, part[1:])
+			continue
+		}
+		m.handleCommand(part, from, timestamp)
+	}
+	if len(msgs) > 0 {
+		m.notifyMsgs(msgs)
 	}
 }
 
 func (m *Memberlist) handlePing(buf []byte, from net.Addr) {
 	var p ping
 	if err := decode(buf, &p); err != nil {
-		m.logger.Printf("[ERR] Failed to decode ping request: %s", err)
+		m.logger.Errorf("Failed to decode ping request: %s", err)
 		return
 	}
-	ack := ackResp{p.SeqNo}
+	ack := ackResp{SeqNo: p.SeqNo}
+	if m.config.Ping != nil {
+		ack.Payload = m.config.Ping.AckPayload()
+	}
 	if err := m.encodeAndSendMsg(from, ackRespMsg, &ack); err != nil {
-		m.logger.Printf("[ERR] Failed to send ack: %s", err)
+		m.logSendError("Failed to send ack", err)
 	}
 }
 
 func (m *Memberlist) handleIndirectPing(buf []byte, from net.Addr) {
 	var ind indirectPingReq
 	if err := decode(buf, &ind); err != nil {
-		m.logger.Printf("[ERR] Failed to decode indirect ping request: %s", err)
+		m.logger.Errorf("Failed to decode indirect ping request: %s", err)
 		return
 	}
 
@@ -339,33 +613,38 @@ func (m *Memberlist) handleIndirectPing(buf []byte, from net.Addr) {
 	destAddr := &net.UDPAddr{IP: ind.Target, Port: int(ind.Port)}
 
 	// Setup a response handler to relay the ack
-	respHandler := func() {
-		ack := ackResp{ind.SeqNo}
+	respHandler := func(payload []byte, timestamp time.Time) {
+		ack := ackResp{SeqNo: ind.SeqNo, Payload: payload}
 		if err := m.encodeAndSendMsg(from, ackRespMsg, &ack); err != nil {
-			m.logger.Printf("[ERR] Failed to forward ack: %s", err)
+			m.logSendError("Failed to forward ack", err)
 		}
 	}
-	m.setAckHandler(localSeqNo, respHandler, m.config.ProbeTimeout)
+	timeout := ind.Timeout
+	if timeout <= 0 {
+		timeout = m.tunables().ProbeTimeout
+	}
+	m.setAckHandler(localSeqNo, respHandler, timeout)
 
 	// Send the ping
 	if err := m.encodeAndSendMsg(destAddr, pingMsg, &ping); err != nil {
-		m.logger.Printf("[ERR] Failed to send ping: %s", err)
+		m.logSendError("Failed to send ping", err)
 	}
 }
 
-func (m *Memberlist) handleAck(buf []byte, from net.Addr) {
+func (m *Memberlist) handleAck(buf []byte, from net.Addr, timestamp time.Time) {
 	var ack ackResp
 	if err := decode(buf, &ack); err != nil {
-		m.logger.Printf("[ERR] Failed to decode ack response: %s", err)
+		m.logger.Errorf("Failed to decode ack response: %s", err)
 		return
 	}
-	m.invokeAckHandler(ack.SeqNo)
+	atomic.AddUint64(&m.stats.AcksReceived, 1)
+	m.invokeAckHandler(ack, timestamp)
 }
 
 func (m *Memberlist) handleSuspect(buf []byte, from net.Addr) {
 	var sus suspect
 	if err := decode(buf, &sus); err != nil {
-		m.logger.Printf("[ERR] Failed to decode suspect message: %s", err)
+		m.logger.Errorf("Failed to decode suspect message: %s", err)
 		return
 	}
 	m.suspectNode(&sus)
@@ -374,7 +653,7 @@ func (m *Memberlist) handleSuspect(buf []byte, from net.Addr) {
 func (m *Memberlist) handleAlive(buf []byte, from net.Addr) {
 	var live alive
 	if err := decode(buf, &live); err != nil {
-		m.logger.Printf("[ERR] Failed to decode alive message: %s", err)
+		m.logger.Errorf("Failed to decode alive message: %s", err)
 		return
 	}
 
@@ -390,7 +669,7 @@ func (m *Memberlist) handleAlive(buf []byte, from net.Addr) {
 func (m *Memberlist) handleDead(buf []byte, from net.Addr) {
 	var d dead
 	if err := decode(buf, &d); err != nil {
-		m.logger.Printf("[ERR] Failed to decode dead message: %s", err)
+		m.logger.Errorf("Failed to decode dead message: %s", err)
 		return
 	}
 	m.deadNode(&d)
@@ -398,23 +677,36 @@ func (m *Memberlist) handleDead(buf []byte, from net.Addr) {
 
 // handleUser is used to notify channels of incoming user data
 func (m *Memberlist) handleUser(buf []byte, from net.Addr) {
+	m.notifyMsgs([][]byte{buf})
+}
+
+// notifyMsgs hands user messages to the Delegate, in one call if it
+// implements BatchDelegate
+func (m *Memberlist) notifyMsgs(msgs [][]byte) {
 	d := m.config.Delegate
-	if d != nil {
-		d.NotifyMsg(buf)
+	if d == nil {
+		return
+	}
+	if bd, ok := d.(BatchDelegate); ok {
+		bd.NotifyMsgs(msgs)
+		return
+	}
+	for _, msg := range msgs {
+		d.NotifyMsg(msg)
 	}
 }
 
 // handleCompressed is used to unpack a compressed message
-func (m *Memberlist) handleCompressed(buf []byte, from net.Addr) {
+func (m *Memberlist) handleCompressed(buf []byte, from net.Addr, timestamp time.Time) {
 	// Try to decode the payload
 	payload, err := decompressPayload(buf)
 	if err != nil {
-		m.logger.Printf("[ERR] Failed to decompress payload: %v", err)
+		m.logger.Errorf("Failed to decompress payload: %v", err)
 		return
 	}
 
 	// Recursively handle the payload
-	m.handleCommand(payload, from)
+	m.handleCommand(payload, from, timestamp)
 }
 
 // encodeAndSendMsg is used to combine the encoding and sending steps
@@ -429,13 +721,37 @@ func (m *Memberlist) encodeAndSendMsg(to net.Addr, msgType messageType, msg inte
 	return nil
 }
 
+// encryptOutgoing returns whether a message of the given size should be
+// encrypted before it is sent, see Config.EncryptMinSize
+func (m *Memberlist) encryptOutgoing(size int) bool {
+	if !m.config.EncryptionEnabled() || m.config.GossipVerifyOutgoingDisabled {
+		return false
+	}
+	min := m.config.EncryptMinSize
+	return min <= 0 || !m.config.GossipVerifyIncomingDisabled || size >= min
+}
+
+// signOutgoing returns whether messages should be signed before they are
+// sent
+func (m *Memberlist) signOutgoing() bool {
+	return m.config.SigningEnabled() && !m.config.GossipVerifyOutgoingDisabled
+}
+
 // sendMsg is used to send a UDP message to another host. It will opportunistically
 // create a compoundMsg and piggy back other broadcasts
 func (m *Memberlist) sendMsg(to net.Addr, msg []byte) error {
-	// Check if we can piggy back any messages
-	bytesAvail := udpSendBuf - len(msg) - compoundHeaderOverhead
-	if m.config.SecretKey != nil {
-		bytesAvail -= encryptOverhead(m.encryptionVersion())
+	// Check if we can piggy back any messages, without going over the
+	// size that would have the packet relayed over TCP
+	bufSize := udpSendBuf
+	if limit := m.config.UDPMaxPacketSize; limit > 0 && limit < bufSize {
+		bufSize = limit
+	}
+	bytesAvail := bufSize - len(msg) - compoundHeaderOverhead - labelOverhead(m.config.Label)
+	if m.config.EncryptionEnabled() {
+		primaryKey := m.config.Keyring.GetPrimaryKey()
+		bytesAvail -= encryptOverhead(m.encryptionVersion(primaryKey))
+	} else if m.config.SigningEnabled() {
+		bytesAvail -= signOverhead
 	}
 	extra := m.getBroadcasts(compoundOverhead, bytesAvail)
 
@@ -458,11 +774,16 @@ func (m *Memberlist) sendMsg(to net.Addr, msg []byte) error {
 
 // rawSendMsg is used to send a UDP message to another host without modification
 func (m *Memberlist) rawSendMsg(to net.Addr, msg []byte) error {
+	if !m.config.TransportMode.udp() {
+		return ErrUDPDisabled
+	}
+	orig := msg
+
 	// Check if we have compression enabled
 	if m.config.EnableCompression {
-		buf, err := compressPayload(msg)
+		buf, err := compressPayload(m.compressionAlgo(), msg)
 		if err != nil {
-			m.logger.Printf("[WARN] Failed to compress payload: %v", err)
+			m.logger.Warnf("Failed to compress payload: %v", err)
 		} else {
 			// Only use compression if it reduced the size
 			if buf.Len() < len(msg) {
@@ -472,42 +793,271 @@ func (m *Memberlist) rawSendMsg(to net.Addr, msg []byte) error {
 	}
 
 	// Check if we have encryption enabled
-	if m.config.SecretKey != nil {
+	if m.encryptOutgoing(len(msg)) {
 		// Encrypt the payload
 		var buf bytes.Buffer
-		err := encryptPayload(m.encryptionVersion(), m.config.SecretKey, msg, nil, &buf)
+		primaryKey := m.config.Keyring.GetPrimaryKey()
+		err := encryptPayload(m.encryptionVersion(primaryKey), primaryKey, msg, nil, &buf)
 		if err != nil {
-			m.logger.Printf("[ERR] Encryption of message failed: %v", err)
+			m.logger.Errorf("Encryption of message failed: %v", err)
 			return err
 		}
 		msg = buf.Bytes()
+	} else if m.signOutgoing() {
+		msg = signPacket(m.config.SigningKeyring.GetPrimaryKey(), msg)
 	}
 
-	_, err := m.udpListener.WriteTo(msg, to)
-	return err
+	msg = addLabelHeader(msg, m.config.Label)
+
+	// Packets that are too large for the network are sent over a stream
+	// instead, if the other nodes are able to accept them that way
+	if limit := m.config.UDPMaxPacketSize; limit > 0 && len(msg) > limit {
+		if m.relayQueue != nil && m.ProtocolVersion() >= minRelayProtocolVersion {
+			m.logger.Warnf("Packet to %s is %d bytes, over the limit of %d, sending over TCP instead",
+				to, len(msg), limit)
+			return m.queueRelay(to, orig)
+		}
+		m.logger.Warnf("Packet to %s is %d bytes, over the limit of %d, and can't be sent over TCP",
+			to, len(msg), limit)
+	}
+
+	if err := m.transport.WriteTo(msg, to.String()); err != nil {
+		m.packetDropped(to, err)
+		return &sendError{err}
+	}
+	atomic.AddUint64(&m.stats.UDPPacketsSent, 1)
+	atomic.AddUint64(&m.stats.UDPBytesSent, uint64(len(msg)))
+	m.incrCounter([]string{"memberlist", "udp", "sent"}, float32(len(msg)))
+	return nil
+}
+
+// sendErrorLogInterval is how often failed packet sends are logged. A full
+// socket buffer or a network outage makes every send fail, so logging each
+// one would flood the logs.
+const sendErrorLogInterval = 10 * time.Second
+
+// sendError is returned by rawSendMsg when the transport fails to send a
+// packet. It has already been counted and logged by packetDropped.
+type sendError struct {
+	err error
+}
+
+func (e *sendError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sendError) Unwrap() error {
+	return e.err
+}
+
+// packetDropped records a packet the transport failed to send. Failures
+// are counted and passed to Config.NotifySendError individually, but only
+// logged once per sendErrorLogInterval, along with how many were not.
+func (m *Memberlist) packetDropped(to net.Addr, err error) {
+	atomic.AddUint64(&m.stats.UDPPacketsDropped, 1)
+	m.incrCounter([]string{"memberlist", "udp", "dropped"}, 1)
+
+	m.sendErrLock.Lock()
+	now := time.Now()
+	if !m.sendErrLogged.IsZero() && now.Sub(m.sendErrLogged) < sendErrorLogInterval {
+		m.sendErrSuppressed++
+		m.sendErrLock.Unlock()
+	} else {
+		suppressed := m.sendErrSuppressed
+		m.sendErrLogged, m.sendErrSuppressed = now, 0
+		m.sendErrLock.Unlock()
+		if suppressed > 0 {
+			m.logger.Errorf("Failed to send packet to %s: %v (%d more failed since the last report)",
+				to, err, suppressed)
+		} else {
+			m.logger.Errorf("Failed to send packet to %s: %v", to, err)
+		}
+	}
+
+	if fn := m.config.NotifySendError; fn != nil {
+		fn(to, err)
+	}
+}
+
+// logSendError logs a failure to send a message, unless it is a sendError
+// that packetDropped has already taken care of
+func (m *Memberlist) logSendError(what string, err error) {
+	if _, ok := err.(*sendError); ok {
+		return
+	}
+	m.logger.Errorf("%s: %s", what, err)
+}
+
+// dial opens a stream to addr through the transport
+func (m *Memberlist) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := m.transport.DialTimeout(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&m.stats.TCPConnsOpened, 1)
+	return conn, nil
+}
+
+// relayedSend is a packet waiting for the relay worker to send it over TCP
+type relayedSend struct {
+	to     net.Addr
+	packet []byte
+}
+
+// queueRelay hands a packet to the relay worker, so the caller, which may
+// be the packet listener answering a ping, isn't held up dialing a node
+// that may be unreachable. The packet is dropped if the queue is full.
+func (m *Memberlist) queueRelay(to net.Addr, packet []byte) error {
+	select {
+	case m.relayQueue <- relayedSend{to: to, packet: packet}:
+		m.incrCounter([]string{"memberlist", "udp", "relayed"}, 1)
+		return nil
+	default:
+		m.incrCounter([]string{"memberlist", "udp", "relay", "dropped"}, 1)
+		return fmt.Errorf("Relay queue is full, dropping packet to %s", to)
+	}
 }
 
-// sendState is used to initiate a push/pull over TCP with a remote node
-func (m *Memberlist) sendAndReceiveState(addr []byte, port uint16, join bool) ([]pushNodeState, []byte, error) {
+// relayWorker sends the packets from the relay queue until shutdown
+func (m *Memberlist) relayWorker() {
+	defer m.wg.Done()
+	for {
+		select {
+		case r := <-m.relayQueue:
+			if err := m.sendRelayedPacket(r.to, r.packet); err != nil {
+				m.logger.Errorf("Failed to relay packet to %s: %v", r.to, err)
+			}
+
+		case <-m.shutdownCh:
+			return
+		}
+	}
+}
+
+// sendRelayedPacket is used to stream a packet to another host, for when it
+// is too large to send over UDP
+func (m *Memberlist) sendRelayedPacket(to net.Addr, packet []byte) error {
+	conn, err := m.dial(to.String(), m.config.TCPTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Setup a deadline
+	conn.SetDeadline(time.Now().Add(m.config.TCPTimeout))
+
+	bufConn := bytes.NewBuffer(nil)
+	if err := bufConn.WriteByte(byte(relayedPacketMsg)); err != nil {
+		return err
+	}
+
+	// Tell the receiver where to reply, since the stream comes from
+	// another port and possibly another address
+	header := relayedPacketHeader{PacketLen: len(packet)}
+	m.nodeLock.RLock()
+	if local, ok := m.nodeMap[m.localName()]; ok {
+		header.Addr = local.Addr
+		header.Port = local.Port
+	}
+	m.nodeLock.RUnlock()
+
+	hd := codec.MsgpackHandle{}
+	enc := codec.NewEncoder(bufConn, &hd)
+	if err := enc.Encode(&header); err != nil {
+		return err
+	}
+	if _, err := bufConn.Write(packet); err != nil {
+		return err
+	}
+
+	return m.rawSendMsgStream(conn, bufConn.Bytes())
+}
+
+// sendState is used to initiate a push/pull over TCP with a remote node.
+// The exchange is aborted if ctx is done before it completes.
+func (m *Memberlist) sendAndReceiveState(ctx context.Context, addr []byte, port uint16, join bool) ([]pushNodeState, []byte, error) {
+	// Don't wait longer to connect than the context allows
+	timeout := m.config.TCPTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); remaining < timeout {
+			timeout = remaining
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
 	// Attempt to connect
-	dialer := net.Dialer{Timeout: m.config.TCPTimeout}
+	if !m.config.TransportMode.tcp() {
+		return nil, nil, ErrTCPDisabled
+	}
 	dest := net.TCPAddr{IP: addr, Port: int(port)}
-	conn, err := dialer.Dial("tcp", dest.String())
+
+	// Try a pooled connection first. It may have been closed by the peer
+	// in the meantime, so fall back to a new one if it fails.
+	if conn := m.connPool.get(dest.String()); conn != nil {
+		remote, userState, err := m.exchangeState(ctx, conn, &dest, join)
+		if err == nil {
+			m.connPool.put(dest.String(), conn)
+			return remote, userState, nil
+		}
+		conn.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, nil, ctxErr
+		}
+		m.logger.Debugf("Pooled connection to %s failed, dialing a new one: %v", &dest, err)
+	}
+
+	conn, err := m.dial(dest.String(), timeout)
 	if err != nil {
 		return nil, nil, err
 	}
-	defer conn.Close()
-	m.logger.Printf("[INFO] Initiating push/pull sync with: %s", conn.RemoteAddr())
+	remote, userState, err := m.exchangeState(ctx, conn, &dest, join)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	m.connPool.put(dest.String(), conn)
+	return remote, userState, nil
+}
 
-	// Send our state
+// exchangeState does a push/pull exchange over an open connection
+func (m *Memberlist) exchangeState(ctx context.Context, conn net.Conn, dest net.Addr, join bool) ([]pushNodeState, []byte, error) {
+	// Close the connection if the context is done, which unblocks any
+	// pending read or write
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	m.logger.Infof("Initiating push/pull sync with: %s", conn.RemoteAddr())
+
+	// Send our state. Both this and reading the remote state are bounded
+	// by TCPTimeout, so a peer that accepts the connection but never
+	// answers can't hang us.
 	if err := m.sendLocalState(conn, join); err != nil {
-		return nil, nil, err
+		return nil, nil, m.pushPullErr(dest, err)
 	}
 
 	// Read remote state
-	_, remote, userState, err := m.readRemoteState(conn)
+	msgType, bufConn, dec, err := m.readStream(conn)
+	if err != nil {
+		return nil, nil, m.pushPullErr(dest, err)
+	}
+
+	// Quit if not push/pull
+	if msgType != pushPullMsg {
+		err := fmt.Errorf("received invalid msgType (%d)", msgType)
+		return nil, nil, err
+	}
+
+	_, remote, userState, err := m.readRemoteState(bufConn, dec)
 	if err != nil {
-		err := fmt.Errorf("Reading remote state failed: %v", err)
+		err := fmt.Errorf("Reading remote state failed: %v", m.pushPullErr(dest, err))
 		return nil, nil, err
 	}
 
@@ -515,6 +1065,15 @@ func (m *Memberlist) sendAndReceiveState(addr []byte, port uint16, join bool) ([
 	return remote, userState, nil
 }
 
+// pushPullErr describes an error from a push/pull exchange with dest,
+// spelling out when it was caused by the peer not answering in time
+func (m *Memberlist) pushPullErr(dest net.Addr, err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return fmt.Errorf("Push/pull with %s timed out after %v: %v", dest, m.config.TCPTimeout, err)
+	}
+	return err
+}
+
 // sendLocalState is invoked to send our local state over a tcp connection
 func (m *Memberlist) sendLocalState(conn net.Conn, join bool) error {
 	// Setup a deadline
@@ -522,18 +1081,20 @@ func (m *Memberlist) sendLocalState(conn net.Conn, join bool) error {
 
 	// Prepare the local node state
 	m.nodeLock.RLock()
-	localNodes := make([]pushNodeState, len(m.nodes))
-	for idx, n := range m.nodes {
-		localNodes[idx].Name = n.Name
-		localNodes[idx].Addr = n.Addr
-		localNodes[idx].Port = n.Port
-		localNodes[idx].Incarnation = n.Incarnation
-		localNodes[idx].State = n.State
-		localNodes[idx].Meta = n.Meta
-		localNodes[idx].Vsn = []uint8{
-			n.PMin, n.PMax, n.PCur,
-			n.DMin, n.DMax, n.DCur,
-		}
+	localNodes := make([]pushNodeState, 0, len(m.nodes))
+	for _, n := range m.nodes {
+		localNodes = append(localNodes, pushNodeState{
+			Name:        n.Name,
+			Addr:        n.Addr,
+			Port:        n.Port,
+			Incarnation: n.Incarnation,
+			State:       n.State,
+			Meta:        n.Meta,
+			Vsn: []uint8{
+				n.PMin, n.PMax, n.PCur,
+				n.DMin, n.DMax, n.DCur,
+			},
+		})
 	}
 	m.nodeLock.RUnlock()
 
@@ -573,35 +1134,78 @@ func (m *Memberlist) sendLocalState(conn net.Conn, join bool) error {
 	}
 
 	// Get the send buffer
-	sendBuf := bufConn.Bytes()
+	return m.rawSendMsgStream(conn, bufConn.Bytes())
+}
 
+// rawSendMsgStream is used to stream a message to another host without
+// modification, after applying compression and encryption if enabled
+func (m *Memberlist) rawSendMsgStream(conn net.Conn, sendBuf []byte) error {
 	// Check if compresion is enabled
 	if m.config.EnableCompression {
-		compBuf, err := compressPayload(bufConn.Bytes())
+		compBuf, err := compressPayload(m.compressionAlgo(), sendBuf)
 		if err != nil {
-			m.logger.Printf("[ERROR] Failed to compress local state: %v", err)
+			m.logger.Errorf("Failed to compress payload: %v", err)
 		} else {
 			sendBuf = compBuf.Bytes()
 		}
 	}
 
 	// Check if encryption is enabled
-	if m.config.SecretKey != nil {
+	if m.encryptOutgoing(len(sendBuf)) {
 		crypt, err := m.encryptLocalState(sendBuf)
 		if err != nil {
-			m.logger.Printf("[ERROR] Failed to encrypt local state: %v", err)
+			m.logger.Errorf("Failed to encrypt payload: %v", err)
 			return err
 		}
 		sendBuf = crypt
+	} else if m.signOutgoing() {
+		sendBuf = signStream(m.config.SigningKeyring.GetPrimaryKey(), sendBuf)
 	}
 
 	// Write out the entire send buffer
+	sendBuf = addLabelHeader(sendBuf, m.config.Label)
+	atomic.AddUint64(&m.stats.TCPBytesSent, uint64(len(sendBuf)))
+	m.incrCounter([]string{"memberlist", "tcp", "sent"}, float32(len(sendBuf)))
 	if _, err := conn.Write(sendBuf); err != nil {
 		return err
 	}
 	return nil
 }
 
+// sendUserMsg is used to stream a user message to another host
+func (m *Memberlist) sendUserMsg(to net.Addr, sendBuf []byte) error {
+	if !m.config.TransportMode.tcp() {
+		return ErrTCPDisabled
+	}
+
+	conn, err := m.dial(to.String(), m.config.TCPTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Setup a deadline
+	conn.SetDeadline(time.Now().Add(m.config.TCPTimeout))
+
+	bufConn := bytes.NewBuffer(nil)
+	if err := bufConn.WriteByte(byte(userMsg)); err != nil {
+		return err
+	}
+
+	// Send our user message header
+	header := userMsgHeader{UserMsgLen: len(sendBuf)}
+	hd := codec.MsgpackHandle{}
+	enc := codec.NewEncoder(bufConn, &hd)
+	if err := enc.Encode(&header); err != nil {
+		return err
+	}
+	if _, err := bufConn.Write(sendBuf); err != nil {
+		return err
+	}
+
+	return m.rawSendMsgStream(conn, bufConn.Bytes())
+}
+
 // encryptLocalState is used to help encrypt local state before sending
 func (m *Memberlist) encryptLocalState(sendBuf []byte) ([]byte, error) {
 	var buf bytes.Buffer
@@ -611,13 +1215,14 @@ func (m *Memberlist) encryptLocalState(sendBuf []byte) ([]byte, error) {
 
 	// Write the size of the message
 	sizeBuf := make([]byte, 4)
-	encVsn := m.encryptionVersion()
+	key := m.config.Keyring.GetPrimaryKey()
+	encVsn := m.encryptionVersion(key)
 	encLen := encryptedLength(encVsn, len(sendBuf))
 	binary.BigEndian.PutUint32(sizeBuf, uint32(encLen))
 	buf.Write(sizeBuf)
 
 	// Write the encrypted cipher text to the buffer
-	err := encryptPayload(encVsn, m.config.SecretKey, sendBuf, buf.Bytes()[:5], &buf)
+	err := encryptPayload(encVsn, key, sendBuf, buf.Bytes()[:5], &buf)
 	if err != nil {
 		return nil, err
 	}
@@ -650,42 +1255,99 @@ func (m *Memberlist) decryptRemoteState(bufConn io.Reader) ([]byte, error) {
 	// Decrypt the cipherText
 	dataBytes := cipherText.Bytes()[:5]
 	cipherBytes := cipherText.Bytes()[5:]
-	return decryptPayload(m.config.SecretKey, cipherBytes, dataBytes)
+	keys := m.config.Keyring.GetKeys()
+	return decryptPayload(keys, cipherBytes, dataBytes)
 }
 
-// recvRemoteState is used to read the remote state from a connection
-func (m *Memberlist) readRemoteState(conn net.Conn) (bool, []pushNodeState, []byte, error) {
+// verifyRemoteState is used to read a signed stream and check its
+// signature, returning the payload
+func (m *Memberlist) verifyRemoteState(bufConn io.Reader) ([]byte, error) {
+	signed := bytes.NewBuffer(nil)
+	signed.WriteByte(byte(signedMsg))
+	if _, err := io.CopyN(signed, bufConn, 4); err != nil {
+		return nil, err
+	}
+
+	// Guard against being asked to read too much, as with encrypted state
+	moreBytes := binary.BigEndian.Uint32(signed.Bytes()[1:5])
+	if moreBytes > maxPushStateBytes {
+		return nil, fmt.Errorf("Remote node state is larger than limit (%d)", moreBytes)
+	}
+	if _, err := io.CopyN(signed, bufConn, int64(moreBytes)); err != nil {
+		return nil, err
+	}
+
+	data, err := verifyMAC(m.config.SigningKeyring.GetKeys(), signed.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 6 {
+		return nil, fmt.Errorf("Signed remote state is empty")
+	}
+	return data[5:], nil
+}
+
+// readStream is used to read from a stream connection, decrypting and
+// decompressing the stream if necessary
+func (m *Memberlist) readStream(conn net.Conn) (messageType, io.Reader, *codec.Decoder, error) {
 	// Setup a deadline
 	conn.SetDeadline(time.Now().Add(m.config.TCPTimeout))
 
 	// Created a buffered reader
-	var bufConn io.Reader = bufio.NewReader(conn)
+	br := bufio.NewReader(&streamReader{conn, m})
+	var bufConn io.Reader = br
+
+	// Refuse streams that are meant for another cluster
+	label, err := removeLabelHeaderFromStream(br)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if label != m.config.Label {
+		m.incrCounter([]string{"memberlist", "label", "mismatch"}, 1)
+		return 0, nil, nil,
+			fmt.Errorf("Discarding stream with label %q, expected %q", label, m.config.Label)
+	}
 
 	// Read the message type
 	buf := [1]byte{0}
 	if _, err := bufConn.Read(buf[:]); err != nil {
-		return false, nil, nil, err
+		return 0, nil, nil, err
 	}
 	msgType := messageType(buf[0])
 
 	// Check if the message is encrypted
 	if msgType == encryptMsg {
-		if m.config.SecretKey == nil {
-			return false, nil, nil,
-				fmt.Errorf("Remote state is encrypted and SecretKey is not configured")
+		if !m.config.EncryptionEnabled() {
+			return 0, nil, nil,
+				fmt.Errorf("Remote state is encrypted and encryption is not configured")
 		}
 
 		plain, err := m.decryptRemoteState(bufConn)
 		if err != nil {
-			return false, nil, nil, err
+			return 0, nil, nil, err
 		}
 
 		// Reset message type and bufConn
 		msgType = messageType(plain[0])
 		bufConn = bytes.NewReader(plain[1:])
-	} else if m.config.SecretKey != nil {
-		return false, nil, nil,
-			fmt.Errorf("SecretKey is configured but remote state is not encrypted")
+	} else if msgType == signedMsg {
+		if !m.config.SigningEnabled() {
+			return 0, nil, nil,
+				fmt.Errorf("Remote state is signed and signing is not configured")
+		}
+
+		plain, err := m.verifyRemoteState(bufConn)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		msgType = messageType(plain[0])
+		bufConn = bytes.NewReader(plain[1:])
+	} else if m.config.EncryptionEnabled() && !m.config.GossipVerifyIncomingDisabled {
+		return 0, nil, nil,
+			fmt.Errorf("Encryption is configured but remote state is not encrypted")
+	} else if m.config.SigningEnabled() && !m.config.GossipVerifyIncomingDisabled {
+		return 0, nil, nil,
+			fmt.Errorf("Signing is configured but remote state is not signed")
 	}
 
 	// Get the msgPack decoders
@@ -696,11 +1358,11 @@ func (m *Memberlist) readRemoteState(conn net.Conn) (bool, []pushNodeState, []by
 	if msgType == compressMsg {
 		var c compress
 		if err := dec.Decode(&c); err != nil {
-			return false, nil, nil, err
+			return 0, nil, nil, err
 		}
 		decomp, err := decompressBuffer(&c)
 		if err != nil {
-			return false, nil, nil, err
+			return 0, nil, nil, err
 		}
 
 		// Reset the message type
@@ -713,12 +1375,11 @@ func (m *Memberlist) readRemoteState(conn net.Conn) (bool, []pushNodeState, []by
 		dec = codec.NewDecoder(bufConn, &hd)
 	}
 
-	// Quit if not push/pull
-	if msgType != pushPullMsg {
-		err := fmt.Errorf("received invalid msgType (%d)", msgType)
-		return false, nil, nil, err
-	}
+	return msgType, bufConn, dec, nil
+}
 
+// readRemoteState is used to read the remote state from a connection
+func (m *Memberlist) readRemoteState(bufConn io.Reader, dec *codec.Decoder) (bool, []pushNodeState, []byte, error) {
 	// Read the push/pull header
 	var header pushPullHeader
 	if err := dec.Decode(&header); err != nil {
@@ -760,3 +1421,60 @@ func (m *Memberlist) readRemoteState(conn net.Conn) (bool, []pushNodeState, []by
 
 	return header.Join, remoteNodes, userBuf, nil
 }
+
+// readRelayedPacket is used to decode a packet that was sent over a stream
+// and handle it as if it had arrived over UDP
+func (m *Memberlist) readRelayedPacket(conn net.Conn, bufConn io.Reader, dec *codec.Decoder) error {
+	var header relayedPacketHeader
+	if err := dec.Decode(&header); err != nil {
+		return err
+	}
+	if header.PacketLen < 1 || header.PacketLen > maxPushStateBytes {
+		return fmt.Errorf("Invalid relayed packet length (%d)", header.PacketLen)
+	}
+
+	buf := make([]byte, header.PacketLen)
+	if _, err := io.ReadFull(bufConn, buf); err != nil {
+		return err
+	}
+
+	// Replies such as acks go to the address the sender receives packets
+	// on, falling back to the stream's address and our own port
+	from := &net.UDPAddr{IP: header.Addr, Port: int(header.Port)}
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && len(from.IP) == 0 {
+		from.IP = tcpAddr.IP
+	}
+	if from.Port == 0 {
+		from.Port = m.config.Port
+	}
+	m.handleCommand(buf, from, time.Now())
+	return nil
+}
+
+// readUserMsg is used to decode a userMsg from a stream
+func (m *Memberlist) readUserMsg(bufConn io.Reader, dec *codec.Decoder) error {
+	// Read the user message header
+	var header userMsgHeader
+	if err := dec.Decode(&header); err != nil {
+		return err
+	}
+
+	// Read the user message into a buffer
+	var userBuf []byte
+	if header.UserMsgLen > 0 {
+		userBuf = make([]byte, header.UserMsgLen)
+		bytes, err := io.ReadAtLeast(bufConn, userBuf, header.UserMsgLen)
+		if err == nil && bytes != header.UserMsgLen {
+			err = fmt.Errorf(
+				"Failed to read full user message (%d / %d)",
+				bytes, header.UserMsgLen)
+		}
+		if err != nil {
+			return err
+		}
+
+		m.notifyMsgs([][]byte{userBuf})
+	}
+
+	return nil
+}
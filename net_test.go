@@ -2,12 +2,15 @@ package memberlist
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/ugorji/go/codec"
 	"io"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -195,6 +198,130 @@ func TestHandleIndirectPing(t *testing.T) {
 	}
 }
 
+func TestHandleIndirectPing_Timeout(t *testing.T) {
+	c := testConfig()
+	c.EnableCompression = false
+	c.ProbeTimeout = 20 * time.Millisecond
+	m, err := newMemberlist(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.Shutdown()
+
+	requester, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer requester.Close()
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer target.Close()
+	deadline := time.Now().Add(time.Second)
+	requester.SetDeadline(deadline)
+	target.SetDeadline(deadline)
+
+	// The relay waits as long as the requester asked, rather than for its
+	// own ProbeTimeout
+	targetAddr := target.LocalAddr().(*net.UDPAddr)
+	ind := indirectPingReq{SeqNo: 100, Target: targetAddr.IP, Port: uint16(targetAddr.Port),
+		Timeout: 500 * time.Millisecond}
+	buf, err := encode(indirectPingMsg, &ind)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP(c.BindAddr), Port: c.Port}
+	requester.WriteTo(buf.Bytes(), addr)
+
+	in := make([]byte, 1500)
+	n, from, err := target.ReadFrom(in)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var p ping
+	if messageType(in[0]) != pingMsg || decode(in[1:n], &p) != nil {
+		t.Fatalf("bad ping %v", in[:n])
+	}
+
+	time.Sleep(5 * c.ProbeTimeout)
+	ack, err := encode(ackRespMsg, &ackResp{SeqNo: p.SeqNo})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	target.WriteTo(ack.Bytes(), from)
+
+	n, _, err = requester.ReadFrom(in)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var resp ackResp
+	if messageType(in[0]) != ackRespMsg || decode(in[1:n], &resp) != nil || resp.SeqNo != 100 {
+		t.Fatalf("bad response %v", in[:n])
+	}
+}
+
+func TestHandleIndirectPing_SourcePort(t *testing.T) {
+	m := GetMemberlist(t)
+	m.config.EnableCompression = false
+	defer m.Shutdown()
+
+	requester, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer requester.Close()
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer target.Close()
+	deadline := time.Now().Add(500 * time.Millisecond)
+	requester.SetDeadline(deadline)
+	target.SetDeadline(deadline)
+
+	targetAddr := target.LocalAddr().(*net.UDPAddr)
+	ind := indirectPingReq{SeqNo: 100, Target: targetAddr.IP, Port: uint16(targetAddr.Port)}
+	buf, err := encode(indirectPingMsg, &ind)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP(m.config.BindAddr), Port: m.config.Port}
+	requester.WriteTo(buf.Bytes(), addr)
+
+	// Both the forwarded ping and the ack sent back to the requester must
+	// come from the bound port, so a firewall only has to allow that one
+	in := make([]byte, 1500)
+	n, from, err := target.ReadFrom(in)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if port := from.(*net.UDPAddr).Port; port != m.config.Port {
+		t.Fatalf("ping sent from port %d, expected %d", port, m.config.Port)
+	}
+	var p ping
+	if messageType(in[0]) != pingMsg || decode(in[1:n], &p) != nil {
+		t.Fatalf("bad ping %v", in[:n])
+	}
+
+	ack, err := encode(ackRespMsg, &ackResp{SeqNo: p.SeqNo})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	target.WriteTo(ack.Bytes(), from)
+
+	n, from, err = requester.ReadFrom(in)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if port := from.(*net.UDPAddr).Port; port != m.config.Port {
+		t.Fatalf("ack sent from port %d, expected %d", port, m.config.Port)
+	}
+	if messageType(in[0]) != ackRespMsg {
+		t.Fatalf("bad response %v", in[:n])
+	}
+}
+
 func TestTCPPushPull(t *testing.T) {
 	m := GetMemberlist(t)
 	defer m.Shutdown()
@@ -205,7 +332,7 @@ func TestTCPPushPull(t *testing.T) {
 			Port: uint16(m.config.Port),
 		},
 		Incarnation: 0,
-		State:       stateSuspect,
+		State:       StateSuspect,
 		StateChange: time.Now().Add(-1 * time.Second),
 	})
 
@@ -221,17 +348,17 @@ func TestTCPPushPull(t *testing.T) {
 	localNodes[0].Addr = net.ParseIP(m.config.BindAddr)
 	localNodes[0].Port = uint16(m.config.Port)
 	localNodes[0].Incarnation = 1
-	localNodes[0].State = stateAlive
+	localNodes[0].State = StateAlive
 	localNodes[1].Name = "Test 1"
 	localNodes[1].Addr = net.ParseIP(m.config.BindAddr)
 	localNodes[1].Port = uint16(m.config.Port)
 	localNodes[1].Incarnation = 1
-	localNodes[1].State = stateAlive
+	localNodes[1].State = StateAlive
 	localNodes[2].Name = "Test 2"
 	localNodes[2].Addr = net.ParseIP(m.config.BindAddr)
 	localNodes[2].Port = uint16(m.config.Port)
 	localNodes[2].Incarnation = 1
-	localNodes[2].State = stateAlive
+	localNodes[2].State = StateAlive
 
 	// Send our node state
 	header := pushPullHeader{Nodes: 3}
@@ -314,7 +441,7 @@ func TestTCPPushPull(t *testing.T) {
 	if n.Incarnation != 0 {
 		t.Fatal("bad incarnation")
 	}
-	if n.State != stateSuspect {
+	if n.State != StateSuspect {
 		t.Fatal("bad state")
 	}
 }
@@ -404,9 +531,13 @@ func TestSendMsg_Piggyback(t *testing.T) {
 
 func TestEncryptDecryptState(t *testing.T) {
 	state := []byte("this is our internal state...")
+	keyring, err := NewKeyring(nil, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
 	m := &Memberlist{
 		config: &Config{
-			SecretKey:       []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+			Keyring:         keyring,
 			ProtocolVersion: ProtocolVersionMax,
 		},
 	}
@@ -429,3 +560,594 @@ func TestEncryptDecryptState(t *testing.T) {
 		t.Fatalf("Decrypt failed: %v", plain)
 	}
 }
+
+func TestCompressionAlgo_Fallback(t *testing.T) {
+	m := &Memberlist{config: &Config{CompressionAlgo: CompressionFlate}}
+
+	m.config.ProtocolVersion = 2
+	if algo := m.compressionAlgo(); algo != CompressionLZW {
+		t.Fatalf("expected LZW fallback, got %d", algo)
+	}
+
+	m.config.ProtocolVersion = 3
+	if algo := m.compressionAlgo(); algo != CompressionFlate {
+		t.Fatalf("expected flate, got %d", algo)
+	}
+}
+
+func TestEncryptionVersion_KeySize(t *testing.T) {
+	m := &Memberlist{config: &Config{}}
+	key := make([]byte, 32)
+
+	// Older nodes can't decrypt messages labelled with the key size
+	m.config.ProtocolVersion = minKeySizeProtocolVersion - 1
+	if vsn := m.encryptionVersion(key); vsn != 1 {
+		t.Fatalf("expected version 1, got %d", vsn)
+	}
+
+	m.config.ProtocolVersion = minKeySizeProtocolVersion
+	if vsn := m.encryptionVersion(key); vsn != 3 {
+		t.Fatalf("expected version 3, got %d", vsn)
+	}
+
+	// A 256 bit key works with the unlabelled version too
+	var buf bytes.Buffer
+	if err := encryptPayload(1, key, []byte("hello"), nil, &buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	plain, err := decryptPayload([][]byte{make([]byte, 16), key}, buf.Bytes(), nil)
+	if err != nil || string(plain) != "hello" {
+		t.Fatalf("bad: %q %v", plain, err)
+	}
+}
+
+func TestRawSendMsg_Relay(t *testing.T) {
+	sink := newMockSink()
+	c1 := testConfig()
+	c1.ProtocolVersion = minRelayProtocolVersion
+	c1.UDPMaxPacketSize = 1 // Relay everything
+	c1.MetricsSink = sink
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	d := &MockDelegate{}
+	c2 := testConfig()
+	c2.ProtocolVersion = minRelayProtocolVersion
+	c2.Delegate = d
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	addr := &net.UDPAddr{IP: net.ParseIP(c2.BindAddr), Port: c2.Port}
+	msg := bytes.Repeat([]byte("x"), 2*udpSendBuf)
+	if err := m1.SendToUDP(&Node{Addr: addr.IP, Port: uint16(addr.Port)}, msg); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A relayed ping is acked over UDP
+	ackCh := make(chan ackMessage, 1)
+	seqNo := m1.nextSeqNo()
+	m1.setAckChannel(seqNo, ackCh, time.Second)
+	if err := m1.encodeAndSendMsg(addr, pingMsg, &ping{SeqNo: seqNo}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if ack := <-ackCh; !ack.Complete {
+		t.Fatalf("should get ack")
+	}
+	yield()
+
+	if len(d.msgs) != 1 || !bytes.Equal(d.msgs[0], msg) {
+		t.Fatalf("bad: %v", d.msgs)
+	}
+	if n := sink.counter("memberlist.udp.relayed"); n != 2 {
+		t.Fatalf("bad: %v", n)
+	}
+	if n := sink.counter("memberlist.udp.sent"); n != 0 {
+		t.Fatalf("bad: %v", n)
+	}
+
+	// Below the relay protocol version it goes over UDP anyway
+	m1.config.ProtocolVersion = minRelayProtocolVersion - 1
+	if err := m1.SendToUDP(&Node{Addr: addr.IP, Port: uint16(addr.Port)}, []byte("hi")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if n := sink.counter("memberlist.udp.sent"); n == 0 {
+		t.Fatalf("should send over UDP")
+	}
+}
+
+// stuckDialTransport is a Transport whose dials hang until released, like
+// dials to an unreachable node
+type stuckDialTransport struct {
+	Transport
+	release chan struct{}
+}
+
+func (t *stuckDialTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	<-t.release
+	return nil, fmt.Errorf("unreachable")
+}
+
+func TestRawSendMsg_RelayUnreachable(t *testing.T) {
+	c := testConfig()
+	nt, err := NewNetTransport(&NetTransportConfig{BindAddr: c.BindAddr, Mode: c.TransportMode})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	release := make(chan struct{})
+	c.Port = 0
+	c.Transport = &stuckDialTransport{Transport: nt, release: release}
+	c.ProtocolVersion = minRelayProtocolVersion
+	c.UDPMaxPacketSize = 1 // Relay everything
+	c.EnableCompression = false
+	m, err := newMemberlist(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.Shutdown()
+	defer close(release)
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer udp.Close()
+	addr := &net.UDPAddr{IP: net.ParseIP(c.BindAddr), Port: c.Port}
+
+	// The ack to this ping has to be relayed, and the dial hangs
+	ping, err := encode(pingMsg, &ping{SeqNo: 1})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	udp.WriteTo(ping.Bytes(), addr)
+
+	// The packet listener carries on handling packets meanwhile
+	ackCh := make(chan ackMessage, 1)
+	seqNo := m.nextSeqNo()
+	m.setAckChannel(seqNo, ackCh, 5*time.Second)
+	ack, err := encode(ackRespMsg, &ackResp{SeqNo: seqNo})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	udp.WriteTo(ack.Bytes(), addr)
+	select {
+	case v := <-ackCh:
+		if !v.Complete {
+			t.Fatalf("ack timed out")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("packet listener is blocked")
+	}
+}
+
+func TestSendMsg_PiggybackLimit(t *testing.T) {
+	c := testConfig()
+	c.ProtocolVersion = minRelayProtocolVersion
+	c.UDPMaxPacketSize = 300
+	c.EnableCompression = false
+	m, err := newMemberlist(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.Shutdown()
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer udp.Close()
+	udp.SetDeadline(time.Now().Add(time.Second))
+
+	// A broadcast that would take the packet over the limit is left for
+	// another one, rather than having the packet relayed
+	m.broadcasts.QueueBroadcast(&memberlistBroadcast{"big", bytes.Repeat([]byte("x"), 400), nil})
+	m.broadcasts.QueueBroadcast(&memberlistBroadcast{"small", []byte("y"), nil})
+	ping, err := encode(pingMsg, &ping{SeqNo: 1})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := m.sendMsg(udp.LocalAddr(), ping.Bytes()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	in := make([]byte, 1500)
+	n, _, err := udp.ReadFrom(in)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if n > c.UDPMaxPacketSize || messageType(in[0]) != compoundMsg {
+		t.Fatalf("bad packet: %v", in[:n])
+	}
+	if q := m.broadcasts.NumQueued(); q != 1 {
+		t.Fatalf("bad: %d", q)
+	}
+}
+
+func TestIngestPacket_NotifyPacket(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	var got [][]byte
+	m.config.NotifyPacket = func(from net.Addr, buf []byte) {
+		got = append(got, append([]byte(nil), buf...))
+	}
+
+	// Packets are seen as they arrived, even ones that are then dropped
+	from := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 7946}
+	ping, err := encode(pingMsg, &ping{SeqNo: 1})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	raw := addLabelHeader(ping.Bytes(), "other")
+	m.ingestPacket(raw, from, time.Now())
+
+	if len(got) != 1 || !bytes.Equal(got[0], raw) {
+		t.Fatalf("bad: %v", got)
+	}
+}
+
+// failingTransport is a Transport that fails to send any packet
+type failingTransport struct {
+	Transport
+	err error
+}
+
+func (t *failingTransport) WriteTo(b []byte, addr string) error {
+	return t.err
+}
+
+func TestMemberlist_SendError(t *testing.T) {
+	c := testConfig()
+	nt, err := NewNetTransport(&NetTransportConfig{BindAddr: c.BindAddr, Mode: c.TransportMode})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	sendErr := fmt.Errorf("no buffer space available")
+	c.Port = 0
+	c.Transport = &failingTransport{Transport: nt, err: sendErr}
+
+	sink := newMockSink()
+	l := &captureLogger{}
+	c.MetricsSink = sink
+	c.Logger = l
+
+	var notified []error
+	c.NotifySendError = func(to net.Addr, err error) {
+		notified = append(notified, err)
+	}
+
+	m, err := newMemberlist(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.Shutdown()
+
+	to := &Node{Addr: net.ParseIP("127.0.0.1"), Port: 7946}
+	for i := 0; i < 3; i++ {
+		err := m.SendToUDP(to, []byte("hi"))
+		if err == nil || err.Error() != sendErr.Error() || !errors.Is(err, sendErr) {
+			t.Fatalf("bad: %v", err)
+		}
+	}
+
+	if n := m.Stats().UDPPacketsDropped; n != 3 {
+		t.Fatalf("bad: %d", n)
+	}
+	if n := m.Stats().UDPPacketsSent; n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+	if n := sink.counter("memberlist.udp.dropped"); n != 3 {
+		t.Fatalf("bad: %v", n)
+	}
+	if len(notified) != 3 || notified[0] != sendErr {
+		t.Fatalf("bad: %v", notified)
+	}
+
+	// Only the first failure is logged within the interval
+	l.Lock()
+	defer l.Unlock()
+	if len(l.lines) != 1 || !strings.HasPrefix(l.lines[0], "ERR Failed to send packet") {
+		t.Fatalf("bad: %v", l.lines)
+	}
+}
+
+func TestMemberlist_StreamHandoff(t *testing.T) {
+	sink := newMockSink()
+	c := testConfig()
+	c.TCPTimeout = 200 * time.Millisecond
+	c.StreamWorkers = 1
+	c.HandoffQueueDepth = 1
+	c.MetricsSink = sink
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.Shutdown()
+
+	// Idle connections tie up the only worker and fill the queue, so
+	// anything beyond that is turned away
+	addr := &net.TCPAddr{IP: net.ParseIP(c.BindAddr), Port: c.Port}
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer conn.Close()
+		yield()
+	}
+
+	for i := 0; i < 20 && sink.counter("memberlist.tcp.rejected") < 1; i++ {
+		yield()
+	}
+	if n := sink.counter("memberlist.tcp.rejected"); n != 1 {
+		t.Fatalf("expected one rejected connection, got %v", n)
+	}
+}
+
+func TestMemberlist_UnknownMsgType(t *testing.T) {
+	sink := newMockSink()
+	m := GetMemberlist(t)
+	m.config.EnableCompression = false
+	m.config.MetricsSink = sink
+	defer m.Shutdown()
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer udp.Close()
+	udp.SetDeadline(time.Now().Add(500 * time.Millisecond))
+
+	// A message type from the future shouldn't spoil the rest of a
+	// compound packet
+	ping, err := encode(pingMsg, &ping{SeqNo: 42})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	unknown := []byte{200, 1, 2, 3}
+	compound := makeCompoundMessage([][]byte{unknown, {}, ping.Bytes()})
+	m.ingestPacket(compound.Bytes(), udp.LocalAddr(), time.Now())
+
+	in := make([]byte, 1500)
+	n, _, err := udp.ReadFrom(in)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var ack ackResp
+	if messageType(in[0]) != ackRespMsg || decode(in[1:n], &ack) != nil || ack.SeqNo != 42 {
+		t.Fatalf("bad response %v", in[:n])
+	}
+	if c := sink.counter("memberlist.udp.unknown"); c != 1 {
+		t.Fatalf("bad udp count: %v", c)
+	}
+
+	// Same for streams
+	addr := &net.TCPAddr{IP: net.ParseIP(m.config.BindAddr), Port: m.config.Port}
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	conn.Write(unknown)
+	conn.Close()
+
+	for i := 0; i < 20 && sink.counter("memberlist.tcp.unknown") < 1; i++ {
+		yield()
+	}
+	if c := sink.counter("memberlist.tcp.unknown"); c != 1 {
+		t.Fatalf("bad tcp count: %v", c)
+	}
+}
+
+type batchDelegate struct {
+	MockDelegate
+	batches [][][]byte
+}
+
+func (b *batchDelegate) NotifyMsgs(msgs [][]byte) {
+	var batch [][]byte
+	for _, msg := range msgs {
+		batch = append(batch, append([]byte(nil), msg...))
+	}
+	b.batches = append(b.batches, batch)
+}
+
+func TestIngestPacket_BatchDelegate(t *testing.T) {
+	m, _ := GetMemberlistDelegate(t)
+	defer m.Shutdown()
+	d := &batchDelegate{}
+	m.config.Delegate = d
+
+	user := func(s string) []byte {
+		return append([]byte{byte(userMsg)}, s...)
+	}
+	alive, err := encode(aliveMsg, &alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	from := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 7946}
+
+	// All the user messages in a packet come in one call
+	compound := makeCompoundMessage([][]byte{user("a"), alive.Bytes(), user("b")})
+	m.ingestPacket(compound.Bytes(), from, time.Now())
+	m.ingestPacket(user("c"), from, time.Now())
+
+	expected := [][][]byte{
+		{[]byte("a"), []byte("b")},
+		{[]byte("c")},
+	}
+	if !reflect.DeepEqual(d.batches, expected) {
+		t.Fatalf("bad: %q", d.batches)
+	}
+	if len(d.msgs) != 0 {
+		t.Fatalf("NotifyMsg should not be called: %q", d.msgs)
+	}
+	if _, ok := m.nodeMap["test"]; !ok {
+		t.Fatalf("other messages should still be handled")
+	}
+}
+
+// orderDelegate records, for each user message, whether the node from the
+// alive message in the same packet was known when it arrived
+type orderDelegate struct {
+	MockDelegate
+	m     *Memberlist
+	known []bool
+}
+
+func (o *orderDelegate) NotifyMsg(msg []byte) {
+	_, ok := o.m.GetNode("test")
+	o.known = append(o.known, ok)
+}
+
+func TestIngestPacket_UserMsgOrder(t *testing.T) {
+	m, _ := GetMemberlistDelegate(t)
+	defer m.Shutdown()
+	d := &orderDelegate{m: m}
+	m.config.Delegate = d
+
+	user := func(s string) []byte {
+		return append([]byte{byte(userMsg)}, s...)
+	}
+	alive, err := encode(aliveMsg, &alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	from := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 7946}
+
+	// Without batching, messages are handled in the order they were sent
+	compound := makeCompoundMessage([][]byte{user("a"), alive.Bytes(), user("b")})
+	m.ingestPacket(compound.Bytes(), from, time.Now())
+	if !reflect.DeepEqual(d.known, []bool{false, true}) {
+		t.Fatalf("bad: %v", d.known)
+	}
+}
+
+func TestRawSendMsg_EncryptMinSize(t *testing.T) {
+	c := testConfig()
+	c.SecretKey = TestKeys[0]
+	c.GossipVerifyIncomingDisabled = true
+	c.EncryptMinSize = 64
+	c.EnableCompression = false
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.Shutdown()
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer udp.Close()
+	udp.SetDeadline(time.Now().Add(500 * time.Millisecond))
+
+	recv := func() []byte {
+		in := make([]byte, 1500)
+		n, _, err := udp.ReadFrom(in)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return in[:n]
+	}
+
+	// Small messages go out as they are
+	ping, err := encode(pingMsg, &ping{SeqNo: 1})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := m.rawSendMsg(udp.LocalAddr(), ping.Bytes()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if in := recv(); !bytes.Equal(in, ping.Bytes()) {
+		t.Fatalf("expected plaintext ping: %v", in)
+	}
+
+	// Larger ones are encrypted
+	user := append([]byte{byte(userMsg)}, make([]byte, 100)...)
+	if err := m.rawSendMsg(udp.LocalAddr(), user); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	plain, err := decryptPayload(m.config.Keyring.GetKeys(), recv(), nil)
+	if err != nil {
+		t.Fatalf("expected encrypted message: %s", err)
+	}
+	if !bytes.Equal(plain, user) {
+		t.Fatalf("bad: %v", plain)
+	}
+
+	// Everything is encrypted while incoming messages are verified
+	m.config.GossipVerifyIncomingDisabled = false
+	if err := m.rawSendMsg(udp.LocalAddr(), ping.Bytes()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := decryptPayload(m.config.Keyring.GetKeys(), recv(), nil); err != nil {
+		t.Fatalf("expected encrypted message: %s", err)
+	}
+}
+
+func TestMemberlist_PushPullConnPool(t *testing.T) {
+	c1 := testConfig()
+	c1.PushPullConnIdleTimeout = 5 * time.Second
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.PushPullConnIdleTimeout = 5 * time.Second
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	// Both syncs should go over the same connection
+	for i := 0; i < 2; i++ {
+		if err := m1.pushPullNode(context.Background(), net.ParseIP(c2.BindAddr), uint16(c2.Port), false); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if n := m1.Stats().TCPConnsOpened; n != 1 {
+		t.Fatalf("expected 1 connection opened, got %d", n)
+	}
+	if n := m2.Stats().TCPConnsAccepted; n != 1 {
+		t.Fatalf("expected 1 connection accepted, got %d", n)
+	}
+	if n := m2.NumMembers(); n != 2 {
+		t.Fatalf("expected 2 members, got %d", n)
+	}
+}
+
+func TestMemberlist_PushPullConnPool_PeerCloses(t *testing.T) {
+	c1 := testConfig()
+	c1.PushPullConnIdleTimeout = 5 * time.Second
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	// The peer doesn't pool, so it closes the connection after each sync
+	c2 := testConfig()
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	for i := 0; i < 2; i++ {
+		if err := m1.pushPullNode(context.Background(), net.ParseIP(c2.BindAddr), uint16(c2.Port), false); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		yield()
+	}
+	if n := m1.Stats().TCPConnsOpened; n != 2 {
+		t.Fatalf("expected 2 connections opened, got %d", n)
+	}
+}
@@ -0,0 +1,440 @@
+package memberlist
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NetTransportConfig is used to configure a net transport.
+type NetTransportConfig struct {
+	// BindAddr is the address the TCP and UDP listeners are bound to.
+	BindAddr string
+
+	// BindAddrs, if set, lists several addresses to bind listeners to
+	// instead of BindAddr. Packets and streams are sent from the address
+	// that is on the same network as the destination, or the first one if
+	// none is.
+	BindAddrs []string
+
+	// BindPort is the port to listen on, for both TCP and UDP. If zero, the
+	// first listener picks a free port and the rest share it.
+	BindPort int
+
+	// Logger is used to report errors from the listeners.
+	Logger Logger
+
+	// TLSConfig, if set, is used to secure the TCP streams. Accepted
+	// connections are wrapped with tls.Server and outgoing connections
+	// are dialed with tls.Client, so the config must hold a certificate
+	// and be able to verify the certificates of other nodes. UDP packets
+	// are not affected.
+	TLSConfig *tls.Config
+
+	// TCPKeepAlive is the keep-alive period for dialed and accepted TCP
+	// connections. Zero uses the Go default, and a negative value turns
+	// keep-alives off.
+	TCPKeepAlive time.Duration
+
+	// HandshakeTimeout bounds the TLS handshake of accepted connections.
+	// If zero, a default of 10 seconds is used.
+	HandshakeTimeout time.Duration
+
+	// UDPBufferSize is the receive buffer size to request for the UDP
+	// listener. If zero, a default of 2MB is used.
+	UDPBufferSize int
+
+	// Mode selects which listeners are started. The transport refuses to
+	// send over a protocol whose listener is not running.
+	Mode TransportMode
+}
+
+// NetTransport is a Transport implementation that uses connectionless UDP for
+// packet operations, and ad-hoc TCP connections for stream operations. This
+// is the default transport used by memberlist.
+type NetTransport struct {
+	config       *NetTransportConfig
+	logger       Logger
+	packetCh     chan *Packet
+	streamCh     chan net.Conn
+	bindIPs      []net.IP
+	bindNets     []*net.IPNet // The network of each bind address, if known
+	tcpListeners []*net.TCPListener
+	udpListeners []*net.UDPConn
+	port         int            // The bound port, which differs from BindPort if that's zero
+	wg           sync.WaitGroup // Tracks the listener goroutines
+	shutdown     int32
+	shutdownCh   chan struct{}
+}
+
+// NewNetTransport returns a net transport with the TCP and UDP listeners
+// bound to the configured addresses and port, or just one kind of them if
+// the configured Mode says so.
+func NewNetTransport(config *NetTransportConfig) (*NetTransport, error) {
+	addrs := config.BindAddrs
+	if len(addrs) == 0 {
+		addrs = []string{config.BindAddr}
+	}
+
+	logger := config.Logger
+	if logger == nil {
+		logger = NewLogger(os.Stderr)
+	}
+
+	t := &NetTransport{
+		config:     config,
+		logger:     logger,
+		packetCh:   make(chan *Packet),
+		streamCh:   make(chan net.Conn),
+		shutdownCh: make(chan struct{}),
+	}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		t.bindIPs = append(t.bindIPs, ip)
+		t.bindNets = append(t.bindNets, interfaceNet(ip))
+	}
+
+	// Binding any free port is racy, since the first listener picks the
+	// port and the others may find it taken by then, so retry a few times
+	tries := 1
+	if config.BindPort == 0 {
+		tries = bindRetries
+	}
+	var err error
+	for i := 0; i < tries; i++ {
+		if err = t.listen(); err == nil {
+			break
+		}
+		logger.Debugf("Got bind error: %v", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// All the listeners feed the same channels
+	for _, ln := range t.tcpListeners {
+		t.wg.Add(1)
+		go t.tcpListen(ln)
+	}
+	for _, ln := range t.udpListeners {
+		t.wg.Add(1)
+		go t.udpListen(ln)
+	}
+	return t, nil
+}
+
+// bindRetries is how many times NewNetTransport tries to bind the
+// listeners when any free port will do
+const bindRetries = 10
+
+// listen starts the listeners, on the same port for all of them. If any
+// of them fails, the ones already started are closed.
+func (t *NetTransport) listen() (err error) {
+	defer func() {
+		if err != nil {
+			t.closeListeners()
+		}
+	}()
+
+	t.port = t.config.BindPort
+	if t.config.Mode.tcp() {
+		for _, ip := range t.bindIPs {
+			tcpAddr := &net.TCPAddr{IP: ip, Port: t.port}
+			tcpLn, err := net.ListenTCP("tcp", tcpAddr)
+			if err != nil {
+				return fmt.Errorf("Failed to start TCP listener. Err: %s", err)
+			}
+			t.tcpListeners = append(t.tcpListeners, tcpLn)
+			t.port = tcpLn.Addr().(*net.TCPAddr).Port
+		}
+	}
+	if t.config.Mode.udp() {
+		for _, ip := range t.bindIPs {
+			udpAddr := &net.UDPAddr{IP: ip, Port: t.port}
+			udpLn, err := net.ListenUDP("udp", udpAddr)
+			if err != nil {
+				return fmt.Errorf("Failed to start UDP listener. Err: %s", err)
+			}
+			t.udpListeners = append(t.udpListeners, udpLn)
+			t.port = udpLn.LocalAddr().(*net.UDPAddr).Port
+			t.sizeUDPRecvBuf(udpLn)
+		}
+	}
+	return nil
+}
+
+// closeListeners closes and forgets the listeners started by listen
+func (t *NetTransport) closeListeners() {
+	for _, ln := range t.tcpListeners {
+		ln.Close()
+	}
+	for _, ln := range t.udpListeners {
+		ln.Close()
+	}
+	t.tcpListeners = nil
+	t.udpListeners = nil
+}
+
+// interfaceNet returns the network of the local interface address that
+// matches ip, or nil if it is a wildcard or isn't found
+func interfaceNet(ip net.IP) *net.IPNet {
+	if ip == nil || ip.IsUnspecified() {
+		return nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return n
+		}
+	}
+	return nil
+}
+
+// bindIndex returns the index of the bind address to send to ip from,
+// which is the first one on the same network, or else the first one
+func (t *NetTransport) bindIndex(ip net.IP) int {
+	for i, n := range t.bindNets {
+		if n != nil && n.Contains(ip) {
+			return i
+		}
+	}
+	return 0
+}
+
+// sizeUDPRecvBuf sets the receive window size of a UDP listener. The OS
+// may clamp what we ask for, so report what we actually got.
+func (t *NetTransport) sizeUDPRecvBuf(ln *net.UDPConn) {
+	size := t.config.UDPBufferSize
+	if size == 0 {
+		size = udpRecvBuf
+	}
+	set := setUDPRecvBuf(ln, size)
+	logf := t.logger.Debugf
+	if t.config.UDPBufferSize != 0 {
+		logf = t.logger.Infof
+	}
+	if actual, err := getUDPRecvBuf(ln); err == nil {
+		logf("UDP receive buffer requested %d bytes, set %d, actual %d", size, set, actual)
+	} else {
+		logf("UDP receive buffer requested %d bytes, set %d", size, set)
+	}
+}
+
+// See Transport. With several bind addresses, this is the first one.
+func (t *NetTransport) LocalAddr() net.Addr {
+	if len(t.tcpListeners) == 0 {
+		return t.udpListeners[0].LocalAddr()
+	}
+	return t.tcpListeners[0].Addr()
+}
+
+// LocalAddrs returns the addresses the first TCP and UDP listeners are
+// bound to, with the actual port if BindPort was zero. Either is nil if
+// that kind of listener isn't running.
+func (t *NetTransport) LocalAddrs() (tcp, udp net.Addr) {
+	if len(t.tcpListeners) > 0 {
+		tcp = t.tcpListeners[0].Addr()
+	}
+	if len(t.udpListeners) > 0 {
+		udp = t.udpListeners[0].LocalAddr()
+	}
+	return tcp, udp
+}
+
+// BindPort returns the port the listeners are bound to
+func (t *NetTransport) BindPort() int {
+	return t.port
+}
+
+// See Transport. Packets are sent from the UDP listener, so they always
+// come from the bound port, which keeps firewall rules simple.
+func (t *NetTransport) WriteTo(b []byte, addr string) error {
+	if len(t.udpListeners) == 0 {
+		return ErrUDPDisabled
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	ln := t.udpListeners[t.bindIndex(udpAddr.IP)]
+	_, err = ln.WriteTo(b, udpAddr)
+	return err
+}
+
+// See Transport.
+func (t *NetTransport) PacketCh() <-chan *Packet {
+	return t.packetCh
+}
+
+// See Transport.
+func (t *NetTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	if len(t.tcpListeners) == 0 {
+		return nil, ErrTCPDisabled
+	}
+
+	dialer := net.Dialer{Timeout: timeout, KeepAlive: t.config.TCPKeepAlive}
+
+	// Pick the source address when there is a choice
+	if len(t.bindIPs) > 1 {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if ip := t.bindIPs[t.bindIndex(tcpAddr.IP)]; !ip.IsUnspecified() {
+			dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	if t.config.TLSConfig != nil {
+		return tls.DialWithDialer(&dialer, "tcp", addr, t.config.TLSConfig)
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// See Transport.
+func (t *NetTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+// See Transport. This blocks until the listener goroutines have exited.
+func (t *NetTransport) Shutdown() error {
+	// This will avoid log spam about errors when we shut down.
+	if atomic.CompareAndSwapInt32(&t.shutdown, 0, 1) {
+		close(t.shutdownCh)
+	}
+
+	for _, ln := range t.tcpListeners {
+		ln.Close()
+	}
+	for _, ln := range t.udpListeners {
+		ln.Close()
+	}
+	t.wg.Wait()
+	return nil
+}
+
+// tcpListen listens for and hands off incoming connections
+func (t *NetTransport) tcpListen(ln *net.TCPListener) {
+	defer t.wg.Done()
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			if atomic.LoadInt32(&t.shutdown) == 1 {
+				break
+			}
+			t.logger.Errorf("Error accepting TCP connection: %s", err)
+			continue
+		}
+		t.setKeepAlive(conn)
+
+		// Handshake off the accept loop so a slow client can't stall it
+		if t.config.TLSConfig != nil {
+			go t.tlsHandshake(conn)
+			continue
+		}
+		select {
+		case t.streamCh <- conn:
+		case <-t.shutdownCh:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// setKeepAlive applies the configured keep-alive period to an accepted
+// connection, which otherwise gets the Go default
+func (t *NetTransport) setKeepAlive(conn *net.TCPConn) {
+	period := t.config.TCPKeepAlive
+	if period == 0 {
+		return
+	}
+	if period < 0 {
+		conn.SetKeepAlive(false)
+		return
+	}
+	conn.SetKeepAlive(true)
+	conn.SetKeepAlivePeriod(period)
+}
+
+// tlsHandshake wraps an accepted connection with TLS and hands it off once
+// the handshake has completed, closing it if the handshake fails
+func (t *NetTransport) tlsHandshake(conn net.Conn) {
+	timeout := t.config.HandshakeTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	tlsConn := tls.Server(conn, t.config.TLSConfig)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		t.logger.Errorf("TLS handshake with %s failed: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	// Don't block forever if we're shutting down
+	select {
+	case t.streamCh <- tlsConn:
+	case <-t.shutdownCh:
+		conn.Close()
+	}
+}
+
+// udpListen listens for and hands off incoming UDP packets
+func (t *NetTransport) udpListen(ln *net.UDPConn) {
+	defer t.wg.Done()
+	mainBuf := make([]byte, udpBufSize)
+	for {
+		// Reset buffer
+		buf := mainBuf[0:udpBufSize]
+
+		// Read a packet
+		n, addr, err := ln.ReadFrom(buf)
+		ts := time.Now()
+		if err != nil {
+			if atomic.LoadInt32(&t.shutdown) == 1 {
+				break
+			}
+			t.logger.Errorf("Error reading UDP packet: %s", err)
+			continue
+		}
+
+		// Check the length
+		if n < 1 {
+			t.logger.Errorf("UDP packet too short (%d bytes). From: %s",
+				len(buf), addr)
+			continue
+		}
+
+		// Copy the packet out, since the buffer is reused
+		pkt := make([]byte, n)
+		copy(pkt, buf[:n])
+		select {
+		case t.packetCh <- &Packet{Buf: pkt, From: addr, Timestamp: ts}:
+		case <-t.shutdownCh:
+			return
+		}
+	}
+}
+
+// setUDPRecvBuf is used to resize the UDP receive window. The function
+// attempts to set the read buffer to the given size but backs off until
+// the read buffer can be set, returning the size that was accepted.
+func setUDPRecvBuf(c *net.UDPConn, size int) int {
+	for size > 0 {
+		if err := c.SetReadBuffer(size); err == nil {
+			break
+		}
+		size = size / 2
+	}
+	return size
+}
@@ -0,0 +1,323 @@
+package memberlist
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTLSConfig returns a TLS config with a self-signed certificate that
+// both serves and trusts the name "memberlist"
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "memberlist"},
+		DNSNames:              []string{"memberlist"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		RootCAs:      pool,
+		ServerName:   "memberlist",
+	}
+}
+
+func TestNetTransport_TLS(t *testing.T) {
+	tlsConf := testTLSConfig(t)
+
+	c1 := testConfig()
+	c1.TLSConfig = tlsConf
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.TLSConfig = tlsConf
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+
+	// A plaintext client fails the handshake without stopping the listener
+	conn, err := net.Dial("tcp", m1.transport.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Write([]byte("not a tls handshake"))
+	conn.Close()
+
+	num, err := m2.Join([]string{c1.BindAddr})
+	if num != 1 || err != nil {
+		t.Fatalf("bad: %d %v", num, err)
+	}
+	if len(m1.Members()) != 2 || len(m2.Members()) != 2 {
+		t.Fatalf("bad: %v %v", m1.Members(), m2.Members())
+	}
+}
+
+func TestNetTransport_TLS_Mismatch(t *testing.T) {
+	c1 := testConfig()
+	c1.TLSConfig = testTLSConfig(t)
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	// A node that doesn't trust m1's certificate can't join
+	c2 := testConfig()
+	c2.TLSConfig = testTLSConfig(t)
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+
+	if num, err := m2.Join([]string{c1.BindAddr}); num != 0 || err == nil {
+		t.Fatalf("expected join to fail: %d %v", num, err)
+	}
+}
+
+func TestNetTransport_UDPBufferSize(t *testing.T) {
+	l := &captureLogger{}
+	nt, err := NewNetTransport(&NetTransportConfig{
+		BindAddr:      getBindAddr().String(),
+		BindPort:      0,
+		Logger:        l,
+		UDPBufferSize: 65536,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer nt.Shutdown()
+
+	actual, err := getUDPRecvBuf(nt.udpListeners[0])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if actual < 65536 {
+		t.Fatalf("bad: %d", actual)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if len(l.lines) != 1 || !strings.HasPrefix(l.lines[0], "INFO UDP receive buffer requested 65536 bytes") {
+		t.Fatalf("bad: %v", l.lines)
+	}
+}
+
+func TestNetTransport_Mode(t *testing.T) {
+	udp, err := NewNetTransport(&NetTransportConfig{
+		BindAddr: getBindAddr().String(),
+		Mode:     TransportUDPOnly,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer udp.Shutdown()
+
+	tcp, err := NewNetTransport(&NetTransportConfig{
+		BindAddr: getBindAddr().String(),
+		Mode:     TransportTCPOnly,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer tcp.Shutdown()
+
+	if len(udp.tcpListeners) != 0 || len(tcp.udpListeners) != 0 {
+		t.Fatalf("should only start the listener for the mode")
+	}
+	if udp.LocalAddr() == nil || tcp.LocalAddr() == nil {
+		t.Fatalf("should have a local address")
+	}
+
+	// Sending over the disabled protocol fails cleanly
+	if _, err := udp.DialTimeout(tcp.LocalAddr().String(), time.Second); err != ErrTCPDisabled {
+		t.Fatalf("expected ErrTCPDisabled: %v", err)
+	}
+	if err := tcp.WriteTo([]byte("hi"), udp.LocalAddr().String()); err != ErrUDPDisabled {
+		t.Fatalf("expected ErrUDPDisabled: %v", err)
+	}
+
+	// And works over the enabled one
+	if err := udp.WriteTo([]byte("hi"), udp.LocalAddr().String()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case p := <-udp.PacketCh():
+		if string(p.Buf) != "hi" {
+			t.Fatalf("bad: %q", p.Buf)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+	conn, err := tcp.DialTimeout(tcp.LocalAddr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+}
+
+func TestNetTransport_BindAddrs(t *testing.T) {
+	addrs := []string{getBindAddr().String(), getBindAddr().String()}
+	nt, err := NewNetTransport(&NetTransportConfig{
+		BindAddrs: addrs,
+		BindPort:  0,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer nt.Shutdown()
+
+	if len(nt.tcpListeners) != 2 || len(nt.udpListeners) != 2 {
+		t.Fatalf("should listen on each address")
+	}
+	if host, _, _ := net.SplitHostPort(nt.LocalAddr().String()); host != addrs[0] {
+		t.Fatalf("bad: %v", nt.LocalAddr())
+	}
+
+	// Packets to every address come out of the same channel
+	for _, ln := range nt.udpListeners {
+		if err := nt.WriteTo([]byte("hi"), ln.LocalAddr().String()); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		select {
+		case p := <-nt.PacketCh():
+			if string(p.Buf) != "hi" {
+				t.Fatalf("bad: %q", p.Buf)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+
+	// As do streams, which are sent from a bind address
+	for _, ln := range nt.tcpListeners {
+		conn, err := nt.DialTimeout(ln.Addr().String(), time.Second)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		select {
+		case in := <-nt.StreamCh():
+			defer in.Close()
+			host, _, _ := net.SplitHostPort(in.RemoteAddr().String())
+			if host != addrs[0] && host != addrs[1] {
+				t.Fatalf("bad: %v", in.RemoteAddr())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+}
+
+func TestNetTransport_LocalAddrs(t *testing.T) {
+	nt, err := NewNetTransport(&NetTransportConfig{
+		BindAddr: getBindAddr().String(),
+		BindPort: 0,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer nt.Shutdown()
+
+	tcp, udp := nt.LocalAddrs()
+	tcpPort := tcp.(*net.TCPAddr).Port
+	if tcpPort == 0 || tcpPort != udp.(*net.UDPAddr).Port || tcpPort != nt.BindPort() {
+		t.Fatalf("bad: %v %v %d", tcp, udp, nt.BindPort())
+	}
+
+	// A disabled protocol has no address
+	nt2, err := NewNetTransport(&NetTransportConfig{
+		BindAddr: getBindAddr().String(),
+		Mode:     TransportTCPOnly,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer nt2.Shutdown()
+	if tcp, udp := nt2.LocalAddrs(); tcp == nil || udp != nil {
+		t.Fatalf("bad: %v %v", tcp, udp)
+	}
+}
+
+func TestNetTransport_BindIndex(t *testing.T) {
+	_, mgmt, _ := net.ParseCIDR("10.0.0.1/24")
+	_, data, _ := net.ParseCIDR("192.168.0.1/24")
+	nt := &NetTransport{bindNets: []*net.IPNet{mgmt, nil, data}}
+
+	cases := map[string]int{
+		"10.0.0.7":    0,
+		"192.168.0.9": 2,
+		"172.16.0.1":  0,
+	}
+	for ip, expect := range cases {
+		if i := nt.bindIndex(net.ParseIP(ip)); i != expect {
+			t.Fatalf("%s: bad: %d", ip, i)
+		}
+	}
+}
+
+func TestNetTransport_Shutdown_Unread(t *testing.T) {
+	nt, err := NewNetTransport(&NetTransportConfig{
+		BindAddr: getBindAddr().String(),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Leave a packet and a stream waiting to be handed off
+	if err := nt.WriteTo([]byte("hi"), nt.LocalAddr().String()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn, err := nt.DialTimeout(nt.LocalAddr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		nt.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("shutdown blocked")
+	}
+}
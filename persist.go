@@ -0,0 +1,96 @@
+package memberlist
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ugorji/go/codec"
+)
+
+// savedStateVersion is the version of the format written by SaveState
+const savedStateVersion = 1
+
+// savedState is the format used to persist the member list
+type savedState struct {
+	Version int
+	Nodes   []pushNodeState
+}
+
+// SaveState writes the nodes this member currently knows about to w,
+// including their addresses, ports and last known state, so that they
+// can be restored with LoadState after a restart.
+func (m *Memberlist) SaveState(w io.Writer) error {
+	m.nodeLock.RLock()
+	state := savedState{
+		Version: savedStateVersion,
+		Nodes:   make([]pushNodeState, 0, len(m.nodeMap)),
+	}
+	for _, n := range m.nodes {
+		if n.deadOrLeft() {
+			continue
+		}
+		state.Nodes = append(state.Nodes, pushNodeState{
+			Name:        n.Name,
+			Addr:        n.Addr,
+			Port:        n.Port,
+			Meta:        n.Meta,
+			Incarnation: n.Incarnation,
+			State:       n.State,
+			Vsn: []uint8{
+				n.PMin, n.PMax, n.PCur,
+				n.DMin, n.DMax, n.DCur,
+			},
+		})
+	}
+	m.nodeLock.RUnlock()
+
+	hd := codec.MsgpackHandle{}
+	enc := codec.NewEncoder(w, &hd)
+	return enc.Encode(&state)
+}
+
+// LoadState reads nodes written by SaveState from r and adds them to the
+// member list, then starts a push/pull with one of them so that this node
+// can rejoin without relying solely on static seeds. Nodes are restored as
+// alive; any that no longer respond are detected and removed by the normal
+// failure detection. The local node itself is never restored.
+func (m *Memberlist) LoadState(r io.Reader) error {
+	var state savedState
+	hd := codec.MsgpackHandle{}
+	dec := codec.NewDecoder(r, &hd)
+	if err := dec.Decode(&state); err != nil {
+		return fmt.Errorf("Failed to decode saved state: %v", err)
+	}
+	if state.Version != savedStateVersion {
+		return fmt.Errorf("Unsupported saved state version %d", state.Version)
+	}
+
+	for _, n := range state.Nodes {
+		if n.Name == m.localName() || n.State == StateDead || n.State == StateLeft {
+			continue
+		}
+		a := alive{
+			Incarnation: n.Incarnation,
+			Node:        n.Name,
+			Addr:        n.Addr,
+			Port:        n.Port,
+			Meta:        n.Meta,
+			Vsn:         n.Vsn,
+		}
+		m.aliveNode(&a)
+	}
+
+	// Sync with a restored peer right away instead of waiting for the
+	// next push/pull interval. It is tracked like the other background
+	// tasks, so Shutdown waits for it.
+	m.startStopLock.Lock()
+	defer m.startStopLock.Unlock()
+	if m.config.TransportMode.tcp() && !m.shutdown {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.pushPull()
+		}()
+	}
+	return nil
+}
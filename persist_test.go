@@ -0,0 +1,74 @@
+package memberlist
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// unusedAddr returns a test address and a port that nothing listens on,
+// for nodes that should never answer
+func unusedAddr(t *testing.T) ([]byte, uint16) {
+	ip := getBindAddr().To4()
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	return ip, uint16(port)
+}
+
+func TestMemberlist_SaveLoadState(t *testing.T) {
+	m1 := GetMemberlist(t)
+	defer m1.Shutdown()
+	addr, port := unusedAddr(t)
+	a1 := alive{Node: m1.config.Name, Addr: addr, Port: port, Incarnation: 1}
+	m1.aliveNode(&a1)
+	addr, port = unusedAddr(t)
+	a2 := alive{Node: "test2", Addr: addr, Port: port, Meta: []byte("meta"), Incarnation: 3}
+	m1.aliveNode(&a2)
+	addr, port = unusedAddr(t)
+	a3 := alive{Node: "test3", Addr: addr, Port: port, Incarnation: 1}
+	m1.aliveNode(&a3)
+	d := dead{Node: "test3", Incarnation: 1}
+	m1.deadNode(&d)
+
+	var buf bytes.Buffer
+	if err := m1.SaveState(&buf); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	m2 := GetMemberlist(t)
+	defer m2.Shutdown()
+	if err := m2.LoadState(&buf); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The local node of m1 and the live peer are restored, not the dead one
+	m2.nodeLock.RLock()
+	defer m2.nodeLock.RUnlock()
+	if len(m2.nodeMap) != 2 {
+		t.Fatalf("bad: %v", m2.nodeMap)
+	}
+	n, ok := m2.nodeMap["test2"]
+	if !ok {
+		t.Fatalf("missing node")
+	}
+	if n.State != StateAlive || n.Port != a2.Port || n.Incarnation != 3 ||
+		!bytes.Equal(n.Addr, a2.Addr) || string(n.Meta) != "meta" {
+		t.Fatalf("bad: %v", n)
+	}
+	if _, ok := m2.nodeMap["test3"]; ok {
+		t.Fatalf("dead node should not be restored")
+	}
+}
+
+func TestMemberlist_LoadState_Bad(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	if err := m.LoadState(bytes.NewReader([]byte("junk"))); err == nil {
+		t.Fatalf("expected error")
+	}
+}
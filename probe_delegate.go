@@ -0,0 +1,39 @@
+package memberlist
+
+import "fmt"
+
+var (
+	// ErrProbeTimeout is passed to NotifyProbeFailed when a direct ping
+	// isn't acked before the probe timeout
+	ErrProbeTimeout = fmt.Errorf("no ack to direct ping before the probe timeout")
+
+	// ErrIndirectProbeTimeout is passed to NotifyProbeFailed when none of
+	// the indirect pings through other nodes are acked either
+	ErrIndirectProbeTimeout = fmt.Errorf("no ack to indirect pings through other nodes")
+)
+
+// ProbeDelegate is used to inform a client of failed probes of other
+// nodes. A failed direct ping is often followed by a successful indirect
+// one, so these are an early sign of flaky links or overloaded nodes,
+// before they lead to a node being suspected.
+//
+// The method is called from the probe loop, so it should return quickly.
+// No internal locks are held, so it is safe to call back into the
+// Memberlist from within it.
+type ProbeDelegate interface {
+	// NotifyProbeFailed is invoked when a direct or indirect ping of a
+	// node fails. The error is ErrProbeTimeout or ErrIndirectProbeTimeout
+	// for unanswered pings, or the error from sending the ping. The Node
+	// argument must not be modified.
+	NotifyProbeFailed(node *Node, err error)
+}
+
+// notifyProbeFailed informs the ProbeDelegate, if any, of a failed probe
+func (m *Memberlist) notifyProbeFailed(node *nodeState, err error) {
+	d := m.config.Probe
+	if d == nil {
+		return
+	}
+	n := node.Node
+	d.NotifyProbeFailed(&n, err)
+}
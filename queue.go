@@ -3,6 +3,7 @@ package memberlist
 import (
 	"sort"
 	"sync"
+	"time"
 )
 
 // TransmitLimitedQueue is used to queue messages to broadcast to
@@ -24,7 +25,8 @@ type TransmitLimitedQueue struct {
 }
 
 type limitedBroadcast struct {
-	transmits int // Number of transmissions attempted.
+	transmits int       // Number of transmissions attempted.
+	queued    time.Time // When the broadcast was queued
 	b         Broadcast
 }
 type limitedBroadcasts []*limitedBroadcast
@@ -63,7 +65,7 @@ func (q *TransmitLimitedQueue) QueueBroadcast(b Broadcast) {
 	}
 
 	// Append to the queue
-	q.bcQueue = append(q.bcQueue, &limitedBroadcast{0, b})
+	q.bcQueue = append(q.bcQueue, &limitedBroadcast{queued: time.Now(), b: b})
 }
 
 // GetBroadcasts is used to get a number of broadcasts, up to a byte limit
@@ -118,6 +120,54 @@ func (q *TransmitLimitedQueue) NumQueued() int {
 	return len(q.bcQueue)
 }
 
+// numQueuedBefore returns the number of queued messages that were queued
+// no later than t
+func (q *TransmitLimitedQueue) numQueuedBefore(t time.Time) int {
+	q.Lock()
+	defer q.Unlock()
+	n := 0
+	for _, b := range q.bcQueue {
+		if !b.queued.After(t) {
+			n++
+		}
+	}
+	return n
+}
+
+// QueueStats is a summary of the state of a TransmitLimitedQueue.
+type QueueStats struct {
+	// NumQueued is the number of broadcasts waiting to be transmitted.
+	NumQueued int
+
+	// OldestAge is how long the oldest broadcast in the queue has been
+	// waiting, or zero if the queue is empty.
+	OldestAge time.Duration
+
+	// TransmitLimit is the number of times each broadcast is transmitted
+	// before it is dropped from the queue, given the current cluster size.
+	TransmitLimit int
+}
+
+// Stats returns a summary of the queue. A queue that keeps growing, or
+// whose oldest broadcast keeps getting older, is saturated: broadcasts are
+// being queued faster than gossip can transmit them.
+func (q *TransmitLimitedQueue) Stats() QueueStats {
+	q.Lock()
+	defer q.Unlock()
+
+	stats := QueueStats{
+		NumQueued:     len(q.bcQueue),
+		TransmitLimit: retransmitLimit(q.RetransmitMult, q.NumNodes()),
+	}
+	now := time.Now()
+	for _, b := range q.bcQueue {
+		if age := now.Sub(b.queued); age > stats.OldestAge {
+			stats.OldestAge = age
+		}
+	}
+	return stats
+}
+
 // Reset clears all the queued messages
 func (q *TransmitLimitedQueue) Reset() {
 	q.Lock()
@@ -2,6 +2,7 @@ package memberlist
 
 import (
 	"testing"
+	"time"
 )
 
 func TestTransmitLimited_Queue(t *testing.T) {
@@ -134,6 +135,41 @@ func TestTransmitLimited_Prune(t *testing.T) {
 	}
 }
 
+func TestTransmitLimited_Stats(t *testing.T) {
+	q := &TransmitLimitedQueue{RetransmitMult: 2, NumNodes: func() int { return 10 }}
+
+	stats := q.Stats()
+	if stats.NumQueued != 0 || stats.OldestAge != 0 || stats.TransmitLimit != 4 {
+		t.Fatalf("bad: %#v", stats)
+	}
+
+	q.QueueBroadcast(&memberlistBroadcast{"test", []byte("1. this is a test."), nil})
+	time.Sleep(10 * time.Millisecond)
+	q.QueueBroadcast(&memberlistBroadcast{"foo", []byte("2. this is a test."), nil})
+
+	stats = q.Stats()
+	if stats.NumQueued != 2 || stats.TransmitLimit != 4 {
+		t.Fatalf("bad: %#v", stats)
+	}
+	if stats.OldestAge < 10*time.Millisecond || stats.OldestAge > time.Second {
+		t.Fatalf("bad age: %v", stats.OldestAge)
+	}
+}
+
+func TestTransmitLimited_numQueuedBefore(t *testing.T) {
+	q := &TransmitLimitedQueue{RetransmitMult: 2, NumNodes: func() int { return 10 }}
+	q.QueueBroadcast(&memberlistBroadcast{"test", []byte("1. this is a test."), nil})
+	mark := time.Now()
+	q.QueueBroadcast(&memberlistBroadcast{"foo", []byte("2. this is a test."), nil})
+
+	if n := q.numQueuedBefore(mark); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	if n := q.numQueuedBefore(time.Now()); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
 func TestLimitedBroadcastSort(t *testing.T) {
 	bc := limitedBroadcasts([]*limitedBroadcast{
 		&limitedBroadcast{
@@ -0,0 +1,35 @@
+package memberlist
+
+// RefuteDelegate is used to inform a client when other nodes believe
+// this node to be suspect or dead, which is often a sign of a network
+// partition or of this node being too overloaded to answer probes in
+// time. Memberlist refutes such messages by broadcasting a new alive
+// message for this node, unless it is leaving the cluster.
+//
+// The methods are invoked after the memberlist has released its internal
+// locks, so it is safe to call back into the Memberlist from within them.
+type RefuteDelegate interface {
+	// NotifySelfSuspected is invoked for every suspect or dead message
+	// about this node that is new to us, whether or not it is refuted.
+	NotifySelfSuspected()
+
+	// NotifySelfRefuted is invoked after NotifySelfSuspected if the
+	// message was refuted, once the refutation has been queued for
+	// broadcast. It isn't invoked for a death that is accepted because
+	// this node is leaving.
+	NotifySelfRefuted()
+}
+
+// notifySelfSuspected informs the RefuteDelegate, if any, of a suspect or
+// dead message about ourself, and whether we refuted it. It must be called
+// without holding the nodeLock.
+func (m *Memberlist) notifySelfSuspected(refuted bool) {
+	d := m.config.Refute
+	if d == nil {
+		return
+	}
+	d.NotifySelfSuspected()
+	if refuted {
+		d.NotifySelfRefuted()
+	}
+}
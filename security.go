@@ -17,13 +17,20 @@ currently support the following versions:
 
  0 - AES-GCM 128, using PKCS7 padding
  1 - AES-GCM 128, no padding. Padding not needed, caused bloat.
+ 2 - AES-GCM 192, no padding
+ 3 - AES-GCM 256, no padding
+
+Versions 0 and 1 predate support for larger keys, so a receiver tries
+every installed key for them. Versions 2 and 3 tell the receiver which
+key size was used, so it can report a missing key clearly. They are only
+sent from protocol version 5, since older nodes drop them.
 
 */
 type encryptionVersion uint8
 
 const (
 	minEncryptionVersion encryptionVersion = 0
-	maxEncryptionVersion encryptionVersion = 1
+	maxEncryptionVersion encryptionVersion = 3
 )
 
 const (
@@ -60,7 +67,7 @@ func encryptOverhead(vsn encryptionVersion) int {
 	switch vsn {
 	case 0:
 		return 45 // Version: 1, IV: 12, Padding: 16, Tag: 16
-	case 1:
+	case 1, 2, 3:
 		return 29 // Version: 1, IV: 12, Tag: 16
 	default:
 		panic("unsupported version")
@@ -82,8 +89,22 @@ func encryptedLength(vsn encryptionVersion, inp int) int {
 	return versionSize + nonceSize + inp + padding + tagSize
 }
 
+// keyEncryptionVersion returns the unpadded encryption version that
+// identifies the AES key size of the given key.
+func keyEncryptionVersion(key []byte) encryptionVersion {
+	switch len(key) {
+	case 24:
+		return 2
+	case 32:
+		return 3
+	default:
+		return 1
+	}
+}
+
 // encryptPayload is used to encrypt a message with a given key.
-// We make use of AES-128 in GCM mode. New byte buffer is the version,
+// We make use of AES in GCM mode, with the key size (128, 192 or 256 bits)
+// selected by the length of the key. New byte buffer is the version,
 // nonce, ciphertext and tag
 func encryptPayload(vsn encryptionVersion, key []byte, msg []byte, data []byte, dst *bytes.Buffer) error {
 	// Get the AES block cipher
@@ -135,10 +156,37 @@ func encryptPayload(vsn encryptionVersion, key []byte, msg []byte, data []byte,
 	return nil
 }
 
-// decryptPayload is used to decrypt a message with a given key,
-// and verify it's contents. Any padding will be removed, and a
-// slice to the plaintext is returned. Decryption is done IN PLACE!
-func decryptPayload(key []byte, msg []byte, data []byte) ([]byte, error) {
+// decryptMessage performs the actual decryption of ciphertext. This is in its
+// own function to allow it to be called on all keys easily.
+func decryptMessage(key, msg []byte, data []byte) ([]byte, error) {
+	// Get the AES block cipher
+	aesBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the GCM cipher mode
+	gcm, err := cipher.NewGCM(aesBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decrypt the message
+	nonce := msg[versionSize : versionSize+nonceSize]
+	ciphertext := msg[versionSize+nonceSize:]
+	plain, err := gcm.Open(nil, nonce, ciphertext, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Success!
+	return plain, nil
+}
+
+// decryptPayload is used to decrypt a message with one of the given keys,
+// and verify it's contents. Each key is tried in order until one succeeds.
+// Any padding will be removed, and a slice to the plaintext is returned.
+func decryptPayload(keys [][]byte, msg []byte, data []byte) ([]byte, error) {
 	// Ensure we have at least one byte
 	if len(msg) == 0 {
 		return nil, fmt.Errorf("Cannot decrypt empty payload")
@@ -155,30 +203,46 @@ func decryptPayload(key []byte, msg []byte, data []byte) ([]byte, error) {
 		return nil, fmt.Errorf("Payload is too small to decrypt: %d", len(msg))
 	}
 
-	// Get the AES block cipher
-	aesBlock, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
+	// Newer versions identify the key size, so only try matching keys
+	if vsn > 1 {
+		var sized [][]byte
+		for _, key := range keys {
+			if keyEncryptionVersion(key) == vsn {
+				sized = append(sized, key)
+			}
+		}
+		if len(sized) == 0 {
+			return nil, fmt.Errorf(
+				"Message is encrypted with a %d bit key, but no key of that size is installed",
+				aesKeyBits(vsn))
+		}
+		keys = sized
 	}
 
-	// Get the GCM cipher mode
-	gcm, err := cipher.NewGCM(aesBlock)
-	if err != nil {
-		return nil, err
+	for _, key := range keys {
+		plain, err := decryptMessage(key, msg, data)
+		if err == nil {
+			// Remove the PKCS7 padding for vsn 0
+			if vsn == 0 {
+				return pkcs7decode(plain, aes.BlockSize), nil
+			} else {
+				return plain, nil
+			}
+		}
 	}
 
-	// Decrypt the message
-	nonce := msg[versionSize : versionSize+nonceSize]
-	ciphertext := msg[versionSize+nonceSize:]
-	plain, err := gcm.Open(nil, nonce, ciphertext, data)
-	if err != nil {
-		return nil, err
-	}
+	return nil, fmt.Errorf("No installed keys could decrypt the message")
+}
 
-	// Remove the PKCS7 padding for vsn 0
-	if vsn == 0 {
-		return pkcs7decode(plain, aes.BlockSize), nil
-	} else {
-		return plain, nil
+// aesKeyBits returns the AES key size in bits identified by an
+// encryption version
+func aesKeyBits(vsn encryptionVersion) int {
+	switch vsn {
+	case 2:
+		return 192
+	case 3:
+		return 256
+	default:
+		return 128
 	}
 }
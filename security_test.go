@@ -3,6 +3,7 @@ package memberlist
 import (
 	"bytes"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -40,8 +41,19 @@ func TestEncryptDecrypt_V1(t *testing.T) {
 	encryptDecryptVersioned(1, t)
 }
 
+func TestEncryptDecrypt_V2(t *testing.T) {
+	encryptDecryptVersioned(2, t)
+}
+
+func TestEncryptDecrypt_V3(t *testing.T) {
+	encryptDecryptVersioned(3, t)
+}
+
 func encryptDecryptVersioned(vsn encryptionVersion, t *testing.T) {
-	k1 := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	k1 := make([]byte, aesKeyBits(vsn)/8)
+	for i := range k1 {
+		k1[i] = byte(i)
+	}
 	plaintext := []byte("this is a plain text message")
 	extra := []byte("random data")
 
@@ -56,7 +68,7 @@ func encryptDecryptVersioned(vsn encryptionVersion, t *testing.T) {
 		t.Fatalf("output length is unexpected %d %d %d", len(plaintext), buf.Len(), expLen)
 	}
 
-	msg, err := decryptPayload(k1, buf.Bytes(), extra)
+	msg, err := decryptPayload([][]byte{k1}, buf.Bytes(), extra)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -69,3 +81,55 @@ func encryptDecryptVersioned(vsn encryptionVersion, t *testing.T) {
 	}
 
 }
+
+func TestDecryptPayload_MultipleKeys(t *testing.T) {
+	k1 := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	k2 := []byte{15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0}
+	plaintext := []byte("this is a plain text message")
+
+	var buf bytes.Buffer
+	if err := encryptPayload(1, k2, plaintext, nil, &buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Should fail with only the wrong key
+	if _, err := decryptPayload([][]byte{k1}, buf.Bytes(), nil); err == nil {
+		t.Fatalf("expected err")
+	}
+
+	// Should succeed when any key matches
+	msg, err := decryptPayload([][]byte{k1, k2}, buf.Bytes(), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(msg, plaintext) {
+		t.Fatalf("bad: %s", msg)
+	}
+}
+
+func TestDecryptPayload_MissingKeySize(t *testing.T) {
+	k128 := make([]byte, 16)
+	k256 := make([]byte, 32)
+	plaintext := []byte("this is a plain text message")
+
+	var buf bytes.Buffer
+	if err := encryptPayload(keyEncryptionVersion(k256), k256, plaintext, nil, &buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if buf.Bytes()[0] != 3 {
+		t.Fatalf("bad version: %d", buf.Bytes()[0])
+	}
+
+	_, err := decryptPayload([][]byte{k128}, buf.Bytes(), nil)
+	if err == nil || !strings.Contains(err.Error(), "256 bit key") {
+		t.Fatalf("expected missing key error: %v", err)
+	}
+
+	msg, err := decryptPayload([][]byte{k128, k256}, buf.Bytes(), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(msg, plaintext) {
+		t.Fatalf("bad: %s", msg)
+	}
+}
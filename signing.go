@@ -0,0 +1,87 @@
+package memberlist
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+
+Signed messages carry an HMAC-SHA256 so that nodes sharing a signing key
+can detect tampered or spoofed messages without the cost of encrypting
+them. Packets are laid out as
+
+ signedMsg | payload | MAC
+
+and streams, which need the length up front, as
+
+ signedMsg | length (4 bytes) | payload | MAC
+
+where the MAC covers everything before it and the length counts the
+payload and the MAC.
+
+*/
+
+// macSize is the size of the MAC that is appended to signed messages
+const macSize = sha256.Size
+
+// signOverhead is the number of bytes signing adds to a packet
+const signOverhead = 1 + macSize
+
+// computeMAC returns the HMAC-SHA256 of data under key
+func computeMAC(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// signPacket wraps msg in a signedMsg, signed with key
+func signPacket(key, msg []byte) []byte {
+	buf := make([]byte, 0, len(msg)+signOverhead)
+	buf = append(buf, byte(signedMsg))
+	buf = append(buf, msg...)
+	return append(buf, computeMAC(key, buf)...)
+}
+
+// signStream wraps msg in a length prefixed signedMsg, signed with key
+func signStream(key, msg []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(signedMsg))
+	sizeBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(sizeBuf, uint32(len(msg)+macSize))
+	buf.Write(sizeBuf)
+	buf.Write(msg)
+	buf.Write(computeMAC(key, buf.Bytes()))
+	return buf.Bytes()
+}
+
+// verifyMAC checks the MAC at the end of buf against each of the keys,
+// returning the part of buf before the MAC if one of them matches
+func verifyMAC(keys [][]byte, buf []byte) ([]byte, error) {
+	if len(buf) < macSize {
+		return nil, fmt.Errorf("Signed message is too short (%d bytes)", len(buf))
+	}
+	data, sum := buf[:len(buf)-macSize], buf[len(buf)-macSize:]
+	for _, key := range keys {
+		if hmac.Equal(sum, computeMAC(key, data)) {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("No installed keys could verify the message")
+}
+
+// verifyPacket checks the signature of a signedMsg packet, returning the
+// payload if it is valid
+func verifyPacket(keys [][]byte, buf []byte) ([]byte, error) {
+	if len(buf) < signOverhead || messageType(buf[0]) != signedMsg {
+		return nil, fmt.Errorf("Packet is not signed")
+	}
+	data, err := verifyMAC(keys, buf)
+	if err != nil {
+		return nil, err
+	}
+	return data[1:], nil
+}
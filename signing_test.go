@@ -0,0 +1,40 @@
+package memberlist
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSignVerifyPacket(t *testing.T) {
+	msg := []byte("this is a test")
+	signed := signPacket(TestKeys[0], msg)
+	if len(signed) != len(msg)+signOverhead {
+		t.Fatalf("bad length: %d", len(signed))
+	}
+
+	plain, err := verifyPacket(TestKeys, signed)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(plain, msg) {
+		t.Fatalf("bad: %v", plain)
+	}
+
+	// Any other key fails
+	if _, err := verifyPacket(TestKeys[1:], signed); err == nil {
+		t.Fatalf("expected err")
+	}
+
+	// As does any change to the message
+	for i := range signed[1:] {
+		bad := append([]byte(nil), signed...)
+		bad[i+1] ^= 0x01
+		if _, err := verifyPacket(TestKeys, bad); err == nil {
+			t.Fatalf("expected err at %d", i+1)
+		}
+	}
+
+	if _, err := verifyPacket(TestKeys, msg); err == nil {
+		t.Fatalf("expected err")
+	}
+}
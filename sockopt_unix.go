@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package memberlist
+
+import (
+	"net"
+	"syscall"
+)
+
+// getUDPRecvBuf returns the receive buffer size the OS actually applied
+// to the connection, which may differ from the size that was requested.
+func getUDPRecvBuf(c *net.UDPConn) (int, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		size, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size, sockErr
+}
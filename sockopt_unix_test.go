@@ -0,0 +1,62 @@
+//go:build !windows
+// +build !windows
+
+package memberlist
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// keepAliveEnabled returns whether SO_KEEPALIVE is set on the connection
+func keepAliveEnabled(t *testing.T, conn net.Conn) bool {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var on int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		on, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if sockErr != nil {
+		t.Fatalf("err: %v", sockErr)
+	}
+	return on != 0
+}
+
+func TestNetTransport_TCPKeepAlive(t *testing.T) {
+	for _, period := range []time.Duration{time.Minute, -1} {
+		nt, err := NewNetTransport(&NetTransportConfig{
+			BindAddr:     getBindAddr().String(),
+			TCPKeepAlive: period,
+		})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer nt.Shutdown()
+
+		out, err := nt.DialTimeout(nt.LocalAddr().String(), time.Second)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer out.Close()
+
+		var in net.Conn
+		select {
+		case in = <-nt.StreamCh():
+			defer in.Close()
+		case <-time.After(time.Second):
+			t.Fatalf("timeout")
+		}
+
+		want := period > 0
+		if keepAliveEnabled(t, out) != want || keepAliveEnabled(t, in) != want {
+			t.Fatalf("bad keep-alive for period %v", period)
+		}
+	}
+}
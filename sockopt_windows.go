@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package memberlist
+
+import (
+	"fmt"
+	"net"
+)
+
+// getUDPRecvBuf is not supported on Windows.
+func getUDPRecvBuf(c *net.UDPConn) (int, error) {
+	return 0, fmt.Errorf("Reading the UDP receive buffer size is not supported")
+}
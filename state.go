@@ -1,23 +1,89 @@
 package memberlist
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"math"
-	"math/rand"
 	"net"
 	"reflect"
 	"sync/atomic"
 	"time"
 )
 
-type nodeStateType int
+// ackSweepInterval is how often the number of outstanding ack handlers
+// is checked against Config.AckHandlerWarnThreshold
+const ackSweepInterval = 10 * time.Second
+
+// NodeStateType is the state of a node as seen by the failure detector
+type NodeStateType int
 
 const (
-	stateAlive nodeStateType = iota
-	stateSuspect
-	stateDead
+	// StateAlive nodes are members that answer probes
+	StateAlive NodeStateType = iota
+
+	// StateSuspect nodes have failed a probe and will be declared dead
+	// unless they refute the suspicion in time
+	StateSuspect
+
+	// StateDead nodes failed to refute a suspicion, or were reported
+	// dead by another node
+	StateDead
+
+	// StateLeft nodes announced their own departure, using Leave
+	StateLeft
 )
 
+func (t NodeStateType) String() string {
+	switch t {
+	case StateAlive:
+		return "alive"
+	case StateSuspect:
+		return "suspect"
+	case StateDead:
+		return "dead"
+	case StateLeft:
+		return "left"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(t))
+	}
+}
+
+// LeaveCause is why a node stopped being a member of the cluster
+type LeaveCause int
+
+const (
+	// LeaveCauseNone is set on nodes that are still members
+	LeaveCauseNone LeaveCause = iota
+
+	// LeaveCauseLeft nodes announced their own departure, using Leave
+	LeaveCauseLeft
+
+	// LeaveCauseSuspicionTimeout nodes were declared dead by this node,
+	// after they failed to refute a suspicion in time
+	LeaveCauseSuspicionTimeout
+
+	// LeaveCauseDeclaredDead nodes were declared dead by another node
+	// whose suspicion timed out first. Dead messages from nodes that
+	// don't say who sent them are treated this way too.
+	LeaveCauseDeclaredDead
+)
+
+func (c LeaveCause) String() string {
+	switch c {
+	case LeaveCauseNone:
+		return "none"
+	case LeaveCauseLeft:
+		return "left"
+	case LeaveCauseSuspicionTimeout:
+		return "suspicion-timeout"
+	case LeaveCauseDeclaredDead:
+		return "declared-dead"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(c))
+	}
+}
+
 // Node represents a node in the cluster.
 type Node struct {
 	Name string
@@ -30,20 +96,48 @@ type Node struct {
 	DMin uint8  // Min protocol version for the delegate to understand
 	DMax uint8  // Max protocol version for the delegate to understand
 	DCur uint8  // Current version delegate is speaking
+
+	// LeaveReason is the reason the node gave when it left the cluster,
+	// see LeaveWithReason. It is only set on the Node passed to the
+	// EventDelegate's NotifyLeave, and is zero if the node was declared
+	// dead after failing probes, or left without giving a reason.
+	LeaveReason uint8
+
+	// LeaveCause tells a node that left on purpose apart from one that
+	// failed. Like LeaveReason it is only set for NotifyLeave.
+	LeaveCause LeaveCause
 }
 
 // NodeState is used to manage our state view of another node
 type nodeState struct {
 	Node
 	Incarnation uint32        // Last known incarnation number
-	State       nodeStateType // Current state
+	State       NodeStateType // Current state
 	StateChange time.Time     // Time last state change happened
+	LastContact time.Time     // Time of the last ack or alive message for the node
+	RTT         time.Duration // Round trip time of the last direct probe, zero if unknown
+}
+
+// deadOrLeft returns whether the node is no longer a member, whether it
+// failed or left
+func (n *nodeState) deadOrLeft() bool {
+	return n.State == StateDead || n.State == StateLeft
 }
 
 // ackHandler is used to register handlers for incoming acks
 type ackHandler struct {
-	handler func()
-	timer   *time.Timer
+	handler  func([]byte, time.Time)
+	timer    *time.Timer
+	isolated bool // Anything piggybacked on the ack is dropped, see isolateAck
+}
+
+// ackMessage is used to deliver the result of a probe over a channel. If
+// Complete is false the probe timed out, otherwise Payload holds any data
+// piggybacked on the ack and Timestamp is when the ack was received.
+type ackMessage struct {
+	Complete  bool
+	Payload   []byte
+	Timestamp time.Time
 }
 
 // Schedule is used to ensure the Tick is performed periodically. This
@@ -53,51 +147,117 @@ func (m *Memberlist) schedule() {
 	m.tickerLock.Lock()
 	defer m.tickerLock.Unlock()
 
-	// If we already have tickers, then don't do anything, since we're
-	// scheduled
-	if len(m.tickers) > 0 {
+	// If we already have a stop channel, then don't do anything, since
+	// we're scheduled
+	if m.stopTick != nil {
 		return
 	}
+	m.startTickers()
+}
+
+// startTickers starts the background tasks for the configured intervals.
+// The tickerLock must be held.
+func (m *Memberlist) startTickers() {
 
 	// Create the stop tick channel, a blocking channel. We close this
 	// when we should stop the tickers.
 	stopCh := make(chan struct{})
 
-	// Create a new probeTicker
-	if m.config.ProbeInterval > 0 {
-		t := time.NewTicker(m.config.ProbeInterval)
-		go m.triggerFunc(m.config.ProbeInterval, t.C, stopCh, m.probe)
-		m.tickers = append(m.tickers, t)
+	// Probes and gossip need UDP, while push/pull needs TCP
+	mode := m.config.TransportMode
+	tun := m.tunables()
+
+	// Create a new probeTicker, or a dynamic timer if the interval adapts
+	// to the cluster size
+	if tun.ProbeInterval > 0 && mode.udp() {
+		m.tickerWg.Add(1)
+		if m.adaptiveProbe() || m.config.IntervalJitter > 0 {
+			go m.probeTrigger(stopCh)
+		} else {
+			t := time.NewTicker(tun.ProbeInterval)
+			go m.triggerFunc(tun.ProbeInterval, t.C, stopCh, m.probe)
+			m.tickers = append(m.tickers, t)
+		}
 	}
 
 	// Create a push pull ticker if needed
-	if m.config.PushPullInterval > 0 {
-		go m.pushPullTrigger(stopCh)
+	if tun.PushPullInterval > 0 && mode.tcp() {
+		m.tickerWg.Add(1)
+		go m.pushPullTrigger(tun.PushPullInterval, stopCh)
 	}
 
 	// Create a gossip ticker if needed
-	if m.config.GossipInterval > 0 && m.config.GossipNodes > 0 {
-		t := time.NewTicker(m.config.GossipInterval)
-		go m.triggerFunc(m.config.GossipInterval, t.C, stopCh, m.gossip)
-		m.tickers = append(m.tickers, t)
+	if tun.GossipInterval > 0 && tun.GossipNodes > 0 && mode.udp() {
+		m.tickerWg.Add(1)
+		if m.config.IntervalJitter > 0 {
+			go m.jitterFunc(tun.GossipInterval, stopCh, m.gossip)
+		} else {
+			t := time.NewTicker(tun.GossipInterval)
+			go m.triggerFunc(tun.GossipInterval, t.C, stopCh, m.gossip)
+			m.tickers = append(m.tickers, t)
+		}
 	}
 
-	// If we made any tickers, then record the stopTick channel for
-	// later.
-	if len(m.tickers) > 0 {
-		m.stopTick = stopCh
-	}
+	// Record the stopTick channel for later, since even without any
+	// tickers the push/pull trigger may be running.
+	m.stopTick = stopCh
 }
 
 // triggerFunc is used to trigger a function call each time a
 // message is received until a stop tick arrives.
 func (m *Memberlist) triggerFunc(stagger time.Duration, C <-chan time.Time, stop <-chan struct{}, f func()) {
+	defer m.tickerWg.Done()
+
 	// Use a random stagger to avoid syncronizing
-	randStagger := time.Duration(uint64(rand.Int63()) % uint64(stagger))
-	time.Sleep(randStagger)
+	randStagger := time.Duration(uint64(m.rng.Int63()) % uint64(stagger))
+	select {
+	case <-time.After(randStagger):
+	case <-stop:
+		return
+	}
 	for {
 		select {
 		case <-C:
+			if stopped(stop) {
+				return
+			}
+			f()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// stopped returns whether the stop channel of a ticker has been closed.
+// A select picks at random between a tick and the stop when both are
+// ready, so this is checked again before starting a round.
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// jitterFunc is like triggerFunc, but calls f after a freshly jittered
+// interval each time, see Config.IntervalJitter
+func (m *Memberlist) jitterFunc(interval time.Duration, stop <-chan struct{}, f func()) {
+	defer m.tickerWg.Done()
+
+	// Use a random stagger to avoid syncronizing
+	randStagger := time.Duration(uint64(m.rng.Int63()) % uint64(interval))
+	select {
+	case <-time.After(randStagger):
+	case <-stop:
+		return
+	}
+	for {
+		select {
+		case <-time.After(m.jitter(interval)):
+			if stopped(stop) {
+				return
+			}
 			f()
 		case <-stop:
 			return
@@ -105,22 +265,43 @@ func (m *Memberlist) triggerFunc(stagger time.Duration, C <-chan time.Time, stop
 	}
 }
 
+// jitter randomizes interval by up to Config.IntervalJitter of it either
+// way
+func (m *Memberlist) jitter(interval time.Duration) time.Duration {
+	j := m.config.IntervalJitter
+	if j <= 0 {
+		return interval
+	}
+	return time.Duration(float64(interval) * (1 + j*(2*m.rng.Float64()-1)))
+}
+
 // pushPullTrigger is used to periodically trigger a push/pull until
 // a stop tick arrives. We don't use triggerFunc since the push/pull
 // timer is dynamically scaled based on cluster size to avoid network
 // saturation
-func (m *Memberlist) pushPullTrigger(stop <-chan struct{}) {
-	interval := m.config.PushPullInterval
+func (m *Memberlist) pushPullTrigger(interval time.Duration, stop <-chan struct{}) {
+	defer m.tickerWg.Done()
 
 	// Use a random stagger to avoid syncronizing
-	randStagger := time.Duration(uint64(rand.Int63()) % uint64(interval))
-	time.Sleep(randStagger)
+	randStagger := time.Duration(uint64(m.rng.Int63()) % uint64(interval))
+	select {
+	case <-time.After(randStagger):
+	case <-stop:
+		return
+	}
 
 	// Tick using a dynamic timer
 	for {
-		tickTime := pushPullScale(interval, len(m.nodes))
+		m.nodeLock.RLock()
+		numNodes := len(m.nodes)
+		m.nodeLock.RUnlock()
+
+		tickTime := m.jitter(pushPullScale(interval, numNodes))
 		select {
 		case <-time.After(tickTime):
+			if stopped(stop) {
+				return
+			}
 			m.pushPull()
 		case <-stop:
 			return
@@ -128,19 +309,94 @@ func (m *Memberlist) pushPullTrigger(stop <-chan struct{}) {
 	}
 }
 
+// probeTrigger is used to periodically probe until a stop tick arrives,
+// recomputing the interval before each probe, since it may adapt to the
+// cluster size or be jittered
+func (m *Memberlist) probeTrigger(stop <-chan struct{}) {
+	defer m.tickerWg.Done()
+
+	// Use a random stagger to avoid syncronizing
+	interval := m.ProbeInterval()
+	randStagger := time.Duration(uint64(m.rng.Int63()) % uint64(interval))
+	select {
+	case <-time.After(randStagger):
+	case <-stop:
+		return
+	}
+
+	// Tick using a dynamic timer
+	for {
+		select {
+		case <-time.After(m.jitter(m.ProbeInterval())):
+			if stopped(stop) {
+				return
+			}
+			m.probe()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// adaptiveProbe returns whether the probe interval adapts to the cluster
+// size, see Config.ProbeIntervalMin
+func (m *Memberlist) adaptiveProbe() bool {
+	t := m.tunables()
+	return t.ProbeIntervalMin > 0 || t.ProbeIntervalMax > 0
+}
+
+// ProbeInterval returns the interval between probes currently in use. This
+// is Config.ProbeInterval, unless the interval adapts to the cluster size,
+// in which case it is recomputed from the number of known nodes.
+func (m *Memberlist) ProbeInterval() time.Duration {
+	t := m.tunables()
+	if t.ProbeIntervalMin <= 0 && t.ProbeIntervalMax <= 0 {
+		return t.ProbeInterval
+	}
+
+	m.nodeLock.RLock()
+	numNodes := len(m.nodes)
+	m.nodeLock.RUnlock()
+
+	interval := probeIntervalScale(t.ProbeInterval, numNodes)
+	if min := t.ProbeIntervalMin; min > 0 && interval < min {
+		interval = min
+	}
+	if max := t.ProbeIntervalMax; max > 0 && interval > max {
+		interval = max
+	}
+
+	// A probe waits up to the interval for an ack, so it can't be shorter
+	// than the timeout for a direct ping
+	if interval < t.ProbeTimeout {
+		interval = t.ProbeTimeout
+	}
+	return interval
+}
+
 // Deschedule is used to stop the background maintenence. This is safe
 // to call multiple times.
 func (m *Memberlist) deschedule() {
 	m.tickerLock.Lock()
 	defer m.tickerLock.Unlock()
 
-	// If we have no tickers, then we aren't scheduled.
-	if len(m.tickers) == 0 {
+	// If we have no stop channel, then we aren't scheduled.
+	if m.stopTick == nil {
 		return
 	}
+	m.stopTickers()
+}
 
+// stopTickers stops the background tasks started by startTickers, and
+// waits for any round in progress to finish, unless it is called from a
+// delegate callback, which may be running on one of them. The tickerLock
+// must be held.
+func (m *Memberlist) stopTickers() {
 	// Close the stop channel so all the ticker listeners stop.
 	close(m.stopTick)
+	if !onMemberlistGoroutine() {
+		m.tickerWg.Wait()
+	}
 
 	// Explicitly stop all the tickers themselves so they don't take
 	// up any more resources, and get rid of the list.
@@ -148,6 +404,7 @@ func (m *Memberlist) deschedule() {
 		t.Stop()
 	}
 	m.tickers = nil
+	m.stopTick = nil
 }
 
 // Tick is used to perform a single round of failure detection and gossip
@@ -163,7 +420,9 @@ START:
 		return
 	}
 
-	// Handle the wrap around case
+	// Handle the wrap around case. Resetting reaps the dead nodes and
+	// shuffles the rest, so that over many rounds every node is probed
+	// with equal frequency regardless of when it was added to the list.
 	if m.probeIndex >= len(m.nodes) {
 		m.nodeLock.RUnlock()
 		m.resetNodes()
@@ -177,9 +436,9 @@ START:
 	var node nodeState
 
 	node = *m.nodes[m.probeIndex]
-	if node.Name == m.config.Name {
+	if node.Name == m.localName() {
 		skip = true
-	} else if node.State == stateDead {
+	} else if node.deadOrLeft() {
 		skip = true
 	}
 
@@ -201,70 +460,272 @@ func (m *Memberlist) probeNode(node *nodeState) {
 	ping := ping{SeqNo: m.nextSeqNo()}
 	destAddr := &net.UDPAddr{IP: node.Addr, Port: int(node.Port)}
 
-	// Setup an ack handler
-	ackCh := make(chan bool, m.config.IndirectChecks+1)
-	m.setAckChannel(ping.SeqNo, ackCh, m.config.ProbeInterval)
+	// Setup an ack handler, leaving the usual time for indirect probes
+	// after a longer timeout for a distant node
+	tun := m.tunables()
+	timeout := m.probeTimeout(&node.Node)
+	ackCh := make(chan ackMessage, tun.IndirectChecks+1)
+	m.setAckChannel(ping.SeqNo, ackCh, m.ProbeInterval()+timeout-tun.ProbeTimeout)
 
 	// Send the ping message
+	sent := time.Now()
 	if err := m.encodeAndSendMsg(destAddr, pingMsg, &ping); err != nil {
-		m.logger.Printf("[ERR] Failed to send ping: %s", err)
+		m.logSendError("Failed to send ping", err)
+		m.notifyProbeFailed(node, err)
 		return
 	}
+	atomic.AddUint64(&m.stats.ProbesSent, 1)
+	m.incrCounter([]string{"memberlist", "probe", "sent"}, 1)
 
 	// Wait for response or round-trip-time
 	select {
 	case v := <-ackCh:
-		if v == true {
+		if v.Complete == true {
+			m.awareness.ApplyDelta(-1)
+			rtt := v.Timestamp.Sub(sent)
+			m.addSample([]string{"memberlist", "probe", "rtt"},
+				float32(rtt)/float32(time.Millisecond))
+			if m.config.Ping != nil {
+				n := node.Node
+				m.config.Ping.NotifyPingComplete(&n, rtt, v.Payload)
+			}
+			m.markContact(node.Name, v.Timestamp)
+			m.setRTT(node.Name, rtt)
 			return
 		}
 
 		// As an edge case, if we get a timeout, we need to re-enqueue it
 		// here to break out of the select below
-		if v == false {
+		if v.Complete == false {
 			ackCh <- v
 		}
-	case <-time.After(m.config.ProbeTimeout):
+	case <-time.After(timeout):
 	}
+	m.incrCounter([]string{"memberlist", "probe", "timeout"}, 1)
+	m.notifyProbeFailed(node, ErrProbeTimeout)
 
 	// Get some random live nodes
 	m.nodeLock.RLock()
-	excludes := []string{m.config.Name, node.Name}
-	kNodes := kRandomNodes(m.config.IndirectChecks, excludes, m.nodes)
+	excludes := []string{m.localName(), node.Name}
+	kNodes := kRandomNodes(m.rng, tun.IndirectChecks, excludes, m.nodes)
 	m.nodeLock.RUnlock()
 
-	// Attempt an indirect ping
-	ind := indirectPingReq{SeqNo: ping.SeqNo, Target: node.Addr, Port: node.Port}
+	// Attempt an indirect ping. There may be fewer healthy peers available
+	// than the configured number of checks.
+	m.logger.Debugf("Probing %s indirectly through %d of %d requested relays",
+		node.Name, len(kNodes), tun.IndirectChecks)
+	m.addSample([]string{"memberlist", "probe", "relays"}, float32(len(kNodes)))
+	ind := indirectPingReq{SeqNo: ping.SeqNo, Target: node.Addr, Port: node.Port, Timeout: timeout}
 	for _, peer := range kNodes {
 		destAddr := &net.UDPAddr{IP: peer.Addr, Port: int(peer.Port)}
 		if err := m.encodeAndSendMsg(destAddr, indirectPingMsg, &ind); err != nil {
-			m.logger.Printf("[ERR] Failed to send indirect ping: %s", err)
+			m.logSendError("Failed to send indirect ping", err)
 		}
 	}
 
 	// Wait for the acks or timeout
 	select {
 	case v := <-ackCh:
-		if v == true {
+		if v.Complete == true {
+			m.markContact(node.Name, v.Timestamp)
 			return
 		}
 	}
 
-	// No acks received from target, suspect
-	s := suspect{Incarnation: node.Incarnation, Node: node.Name}
+	// No acks received from target, suspect. Failing to reach the node
+	// may also be a sign that we are unhealthy ourselves.
+	m.notifyProbeFailed(node, ErrIndirectProbeTimeout)
+	m.awareness.ApplyDelta(1)
+	s := suspect{Incarnation: node.Incarnation, Node: node.Name, From: m.localName()}
 	m.suspectNode(&s)
 }
 
+// probeTimeout returns how long to wait for an ack from the node before
+// trying indirect probes, see Config.CrossZoneProbeTimeout
+func (m *Memberlist) probeTimeout(node *Node) time.Duration {
+	timeout := m.tunables().ProbeTimeout
+	if m.config.NodeZone == nil || m.config.CrossZoneProbeTimeout <= 0 {
+		return timeout
+	}
+
+	local := m.LocalNode()
+	if local == nil {
+		return timeout
+	}
+	ours, theirs := m.config.NodeZone(local), m.config.NodeZone(node)
+	if ours != "" && theirs != "" && ours != theirs {
+		return m.config.CrossZoneProbeTimeout
+	}
+	return timeout
+}
+
+// markContact records that an ack from the named node arrived at the given
+// time, see NodeLastContact
+func (m *Memberlist) markContact(name string, t time.Time) {
+	m.nodeLock.Lock()
+	defer m.nodeLock.Unlock()
+	if state, ok := m.nodeMap[name]; ok && t.After(state.LastContact) {
+		state.LastContact = t
+	}
+}
+
+// setRTT records the round trip time of a direct probe of the named node,
+// see MembersByLatency
+func (m *Memberlist) setRTT(name string, rtt time.Duration) {
+	m.nodeLock.Lock()
+	defer m.nodeLock.Unlock()
+	if state, ok := m.nodeMap[name]; ok {
+		state.RTT = rtt
+	}
+}
+
+// NodeLastContact returns when we last heard from or about the named node,
+// meaning the last time one of our probes of it was acked or a new alive
+// message for it arrived. It returns false if the node is not known. A
+// node that is still alive but hasn't been heard from in a while may be
+// on its way to being suspected.
+func (m *Memberlist) NodeLastContact(name string) (time.Time, bool) {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	state, ok := m.nodeMap[name]
+	if !ok {
+		return time.Time{}, false
+	}
+	return state.LastContact, true
+}
+
+// ConvergenceHealth estimates how well this node is keeping up with the
+// cluster, as a percentage from 0 to 100: the share of the other live
+// members that are not suspected and have been heard from within the
+// given window, see NodeLastContact. It is a local heuristic, so it can't
+// tell that the rest of the cluster agrees with us, but a low number
+// means our view is going stale, which makes it a cheap readiness signal.
+//
+// Members are probed one at a time, so a window shorter than it takes to
+// probe all of them will report a healthy cluster as partly stale. A zero
+// window defaults to twice that time. A node with no other members is
+// always healthy.
+func (m *Memberlist) ConvergenceHealth(within time.Duration) int {
+	interval := m.ProbeInterval()
+
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	var others []*nodeState
+	for _, n := range m.nodeMap {
+		if n.Name != m.localName() && !n.deadOrLeft() {
+			others = append(others, n)
+		}
+	}
+	if len(others) == 0 {
+		return 100
+	}
+
+	if within <= 0 {
+		within = 2 * time.Duration(len(others)) * interval
+	}
+	fresh := 0
+	for _, n := range others {
+		if n.State == StateAlive && time.Since(n.LastContact) <= within {
+			fresh++
+		}
+	}
+	return fresh * 100 / len(others)
+}
+
+// reprobeSuspect re-probes a suspect node every interval for as long as it
+// stays suspect, outside of the regular probe cycle. The suspicion is sent
+// to the node directly ahead of the ping, so that if it is alive it gets a
+// chance to refute it without waiting for the gossip to reach it.
+func (m *Memberlist) reprobeSuspect(name string, changeTime time.Time, interval time.Duration) {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-time.After(interval):
+		case <-m.shutdownCh:
+			return
+		}
+
+		m.nodeLock.RLock()
+		state, ok := m.nodeMap[name]
+		stillSuspect := ok && state.State == StateSuspect && state.StateChange == changeTime
+		var node nodeState
+		if stillSuspect {
+			node = *state
+		}
+		m.nodeLock.RUnlock()
+		if !stillSuspect {
+			return
+		}
+
+		addr := &net.UDPAddr{IP: node.Addr, Port: int(node.Port)}
+		s := suspect{Incarnation: node.Incarnation, Node: node.Name, From: m.localName()}
+		if err := m.encodeAndSendMsg(addr, suspectMsg, &s); err != nil {
+			m.logSendError("Failed to send suspect message to "+node.Name, err)
+		}
+		if _, err := m.Ping(node.Name, addr); err != nil {
+			m.logger.Debugf("Re-probe of suspect node %s failed: %s", node.Name, err)
+		}
+	}
+}
+
+// NoPingResponseError is returned by Ping when no ack is received from
+// the node before the probe timeout.
+type NoPingResponseError struct {
+	node string
+}
+
+func (f NoPingResponseError) Error() string {
+	return fmt.Sprintf("No response from node %s", f.node)
+}
+
+// Ping sends a single ping to the given address and waits up to the
+// configured ProbeTimeout for the ack, returning the measured round trip
+// time. The node name is only used to describe the node in errors; this
+// works outside of the regular probe cycle and doesn't affect the node's
+// state or our health score.
+func (m *Memberlist) Ping(node string, addr net.Addr) (time.Duration, error) {
+	// Prepare a ping message and setup an ack handler
+	ping := ping{SeqNo: m.nextSeqNo()}
+	timeout := m.tunables().ProbeTimeout
+	ackCh := make(chan ackMessage, 1)
+	m.setAckChannel(ping.SeqNo, ackCh, timeout)
+
+	// Send a ping to the node
+	sent := time.Now()
+	if err := m.encodeAndSendMsg(addr, pingMsg, &ping); err != nil {
+		return 0, err
+	}
+
+	// Wait for response or timeout
+	select {
+	case v := <-ackCh:
+		if v.Complete == true {
+			m.markContact(node, v.Timestamp)
+			return v.Timestamp.Sub(sent), nil
+		}
+	case <-time.After(timeout):
+	}
+
+	return 0, NoPingResponseError{node}
+}
+
 // resetNodes is used when the tick wraps around. It will reap the
-// dead nodes and shuffle the node list.
+// nodes that have been dead for longer than GossipToTheDeadTime and
+// shuffle the node list.
 func (m *Memberlist) resetNodes() {
 	m.nodeLock.Lock()
 	defer m.nodeLock.Unlock()
 
 	// Move the dead nodes
-	deadIdx := moveDeadNodes(m.nodes)
+	deadIdx := moveDeadNodes(m.nodes, m.tunables().GossipToTheDeadTime, m.shouldReap)
 
 	// Deregister the dead nodes
 	for i := deadIdx; i < len(m.nodes); i++ {
+		if m.nodeMap[m.nodes[i].Name] == m.nodes[i] {
+			delete(m.nodeMap, m.nodes[i].Name)
+		}
 		m.nodes[i] = nil
 	}
 
@@ -272,7 +733,35 @@ func (m *Memberlist) resetNodes() {
 	m.nodes = m.nodes[0:deadIdx]
 
 	// Shuffle live nodes
-	shuffleNodes(m.nodes)
+	shuffleNodes(m.rng, m.nodes)
+}
+
+// shouldReap asks Config.ShouldReap whether a node that has been dead for
+// longer than GossipToTheDeadTime can be evicted. The nodeLock must be held.
+func (m *Memberlist) shouldReap(state *nodeState, deadFor time.Duration) bool {
+	if m.config.ShouldReap == nil {
+		return true
+	}
+
+	// A node that has since rejoined under the same name has a new entry,
+	// so the old one is of no use
+	if other, ok := m.nodeMap[state.Name]; ok && other != state {
+		return true
+	}
+
+	n := state.Node
+	return m.config.ShouldReap(&n, deadFor)
+}
+
+// canReclaim returns whether a dead or left node's name may be taken
+// over by a node at another address, see Config.DeadNodeReclaimTime.
+// The nodeLock must be held.
+func (m *Memberlist) canReclaim(state *nodeState) bool {
+	if m.config.ConflictPolicy == ConflictPreferNewerIncarnation {
+		return true
+	}
+	reclaimTime := m.config.DeadNodeReclaimTime
+	return reclaimTime > 0 && time.Since(state.StateChange) > reclaimTime
 }
 
 // gossip is invoked every GossipInterval period to broadcast our gossip
@@ -280,12 +769,12 @@ func (m *Memberlist) resetNodes() {
 func (m *Memberlist) gossip() {
 	// Get some random live nodes
 	m.nodeLock.RLock()
-	excludes := []string{m.config.Name}
-	kNodes := kRandomNodes(m.config.GossipNodes, excludes, m.nodes)
+	excludes := []string{m.localName()}
+	kNodes := kRandomNodes(m.rng, m.tunables().GossipNodes, excludes, m.nodes)
 	m.nodeLock.RUnlock()
 
 	// Compute the bytes available
-	bytesAvail := udpSendBuf - compoundHeaderOverhead
+	bytesAvail := udpSendBuf - compoundHeaderOverhead - labelOverhead(m.config.Label)
 
 	for _, node := range kNodes {
 		// Get any pending broadcasts
@@ -300,7 +789,7 @@ func (m *Memberlist) gossip() {
 		// Send the compound message
 		destAddr := &net.UDPAddr{IP: node.Addr, Port: int(node.Port)}
 		if err := m.rawSendMsg(destAddr, compound.Bytes()); err != nil {
-			m.logger.Printf("[ERR] Failed to send gossip to %s: %s", destAddr, err)
+			m.logSendError(fmt.Sprintf("Failed to send gossip to %s", destAddr), err)
 		}
 	}
 }
@@ -312,8 +801,8 @@ func (m *Memberlist) gossip() {
 func (m *Memberlist) pushPull() {
 	// Get a random live node
 	m.nodeLock.RLock()
-	excludes := []string{m.config.Name}
-	nodes := kRandomNodes(1, excludes, m.nodes)
+	excludes := []string{m.localName()}
+	nodes := kRandomNodes(m.rng, 1, excludes, m.nodes)
 	m.nodeLock.RUnlock()
 
 	// If no nodes, bail
@@ -323,23 +812,66 @@ func (m *Memberlist) pushPull() {
 	node := nodes[0]
 
 	// Attempt a push pull
-	if err := m.pushPullNode(node.Addr, node.Port, false); err != nil {
-		m.logger.Printf("[ERR] Push/Pull with %s failed: %s", node.Name, err)
+	if err := m.pushPullNode(context.Background(), node.Addr, node.Port, false); err != nil {
+		m.logger.Errorf("Push/Pull with %s failed: %s", node.Name, err)
 	}
 }
 
 // pushPullNode does a complete state exchange with a specific node.
-func (m *Memberlist) pushPullNode(addr []byte, port uint16, join bool) error {
+func (m *Memberlist) pushPullNode(ctx context.Context, addr []byte, port uint16, join bool) error {
+	defer m.measureSince([]string{"memberlist", "pushPull"}, time.Now())
+	atomic.AddUint64(&m.stats.PushPulls, 1)
+	m.incrCounter([]string{"memberlist", "pushPull", "count"}, 1)
+
 	// Attempt to send and receive with the node
-	remote, userState, err := m.sendAndReceiveState(addr, port, join)
+	remote, userState, err := m.sendAndReceiveState(ctx, addr, port, join)
 	if err != nil {
 		return err
 	}
 
+	return m.mergeRemoteState(join, remote, userState)
+}
+
+// mergeRemoteState is used to merge the remote state received during a
+// push/pull with our own. The MergeDelegate, if any, may cancel the merge
+// before any of the remote nodes are incorporated.
+func (m *Memberlist) mergeRemoteState(join bool, remote []pushNodeState, userState []byte) error {
 	if err := m.verifyProtocol(remote); err != nil {
 		return err
 	}
 
+	// Refuse a join that would take us past the node limit
+	if join && m.config.MaxNodes > 0 {
+		if total := m.countAfterMerge(remote); total > m.config.MaxNodes {
+			return fmt.Errorf("Joining would grow the cluster to %d nodes, over the limit of %d",
+				total, m.config.MaxNodes)
+		}
+	}
+
+	// Give the merge delegate a chance to veto the merge
+	if m.config.Merge != nil {
+		peers := make([]*Node, len(remote))
+		for idx, n := range remote {
+			peers[idx] = &Node{
+				Name: n.Name,
+				Addr: n.Addr,
+				Port: n.Port,
+				Meta: n.Meta,
+			}
+			if len(n.Vsn) > 5 {
+				peers[idx].PMin = n.Vsn[0]
+				peers[idx].PMax = n.Vsn[1]
+				peers[idx].PCur = n.Vsn[2]
+				peers[idx].DMin = n.Vsn[3]
+				peers[idx].DMax = n.Vsn[4]
+				peers[idx].DCur = n.Vsn[5]
+			}
+		}
+		if err := m.config.Merge.NotifyMerge(peers); err != nil {
+			return fmt.Errorf("Merge canceled: %v", err)
+		}
+	}
+
 	// Merge the state
 	m.mergeState(remote)
 
@@ -350,6 +882,36 @@ func (m *Memberlist) pushPullNode(addr []byte, port uint16, join bool) error {
 	return nil
 }
 
+// countAfterMerge returns the number of live nodes we would know about
+// after merging in the given remote state
+func (m *Memberlist) countAfterMerge(remote []pushNodeState) int {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	total := m.numLive()
+	for _, r := range remote {
+		if r.State == StateDead || r.State == StateLeft {
+			continue
+		}
+		if local, ok := m.nodeMap[r.Name]; !ok || local.deadOrLeft() {
+			total++
+		}
+	}
+	return total
+}
+
+// numLive returns the number of nodes in the node map that are neither
+// dead nor left, which is what MaxNodes limits. The nodeLock must be held.
+func (m *Memberlist) numLive() int {
+	live := 0
+	for _, state := range m.nodeMap {
+		if !state.deadOrLeft() {
+			live++
+		}
+	}
+	return live
+}
+
 // verifyProtocol verifies that all the remote nodes can speak with our
 // nodes and vice versa on both the core protocol as well as the
 // delegate protocol level.
@@ -376,7 +938,7 @@ func (m *Memberlist) verifyProtocol(remote []pushNodeState) error {
 
 	for _, rn := range remote {
 		// If the node isn't alive, then skip it
-		if rn.State != stateAlive {
+		if rn.State != StateAlive {
 			continue
 		}
 
@@ -405,7 +967,7 @@ func (m *Memberlist) verifyProtocol(remote []pushNodeState) error {
 
 	for _, n := range m.nodes {
 		// Ignore non-alive nodes
-		if n.State != stateAlive {
+		if n.State != StateAlive {
 			continue
 		}
 
@@ -482,17 +1044,17 @@ func (m *Memberlist) nextIncarnation() uint32 {
 // setAckChannel is used to attach a channel to receive a message when
 // an ack with a given sequence number is received. The channel gets sent
 // false on timeout
-func (m *Memberlist) setAckChannel(seqNo uint32, ch chan bool, timeout time.Duration) {
+func (m *Memberlist) setAckChannel(seqNo uint32, ch chan ackMessage, timeout time.Duration) {
 	// Create a handler function
-	handler := func() {
+	handler := func(payload []byte, timestamp time.Time) {
 		select {
-		case ch <- true:
+		case ch <- ackMessage{true, payload, timestamp}:
 		default:
 		}
 	}
 
 	// Add the handler
-	ah := &ackHandler{handler, nil}
+	ah := &ackHandler{handler: handler}
 	m.ackLock.Lock()
 	m.ackHandlers[seqNo] = ah
 	m.ackLock.Unlock()
@@ -503,18 +1065,43 @@ func (m *Memberlist) setAckChannel(seqNo uint32, ch chan bool, timeout time.Dura
 		delete(m.ackHandlers, seqNo)
 		m.ackLock.Unlock()
 		select {
-		case ch <- false:
+		case ch <- ackMessage{false, nil, time.Now()}:
 		default:
 		}
 	})
 }
 
+// isolateAck marks the ack with the given sequence number so that any
+// gossip piggybacked on it is dropped instead of being processed
+func (m *Memberlist) isolateAck(seqNo uint32) {
+	m.ackLock.Lock()
+	defer m.ackLock.Unlock()
+	if ah, ok := m.ackHandlers[seqNo]; ok {
+		ah.isolated = true
+	}
+}
+
+// isolatedAck returns whether msg is an ack that was marked by isolateAck
+func (m *Memberlist) isolatedAck(msg []byte) bool {
+	if len(msg) == 0 || messageType(msg[0]) != ackRespMsg {
+		return false
+	}
+	var ack ackResp
+	if err := decode(msg[1:], &ack); err != nil {
+		return false
+	}
+	m.ackLock.Lock()
+	defer m.ackLock.Unlock()
+	ah, ok := m.ackHandlers[ack.SeqNo]
+	return ok && ah.isolated
+}
+
 // setAckHandler is used to attach a handler to be invoked when an
 // ack with a given sequence number is received. If a timeout is reached,
 // the handler is deleted
-func (m *Memberlist) setAckHandler(seqNo uint32, handler func(), timeout time.Duration) {
+func (m *Memberlist) setAckHandler(seqNo uint32, handler func([]byte, time.Time), timeout time.Duration) {
 	// Add the handler
-	ah := &ackHandler{handler, nil}
+	ah := &ackHandler{handler: handler}
 	m.ackLock.Lock()
 	m.ackHandlers[seqNo] = ah
 	m.ackLock.Unlock()
@@ -527,22 +1114,74 @@ func (m *Memberlist) setAckHandler(seqNo uint32, handler func(), timeout time.Du
 	})
 }
 
+// NumAckHandlers returns the number of ack handlers that are waiting for
+// an ack or their timeout. This is meant for debugging; a count that keeps
+// growing means handlers are not being reaped.
+func (m *Memberlist) NumAckHandlers() int {
+	m.ackLock.Lock()
+	defer m.ackLock.Unlock()
+	return len(m.ackHandlers)
+}
+
+// ackHandlerSweep periodically checks the number of outstanding ack
+// handlers until shutdown
+func (m *Memberlist) ackHandlerSweep() {
+	defer m.wg.Done()
+	t := time.NewTicker(ackSweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			m.checkAckHandlers()
+		case <-m.shutdownCh:
+			return
+		}
+	}
+}
+
+// checkAckHandlers reports the number of outstanding ack handlers, and
+// warns if it is above the configured threshold
+func (m *Memberlist) checkAckHandlers() {
+	n := m.NumAckHandlers()
+	m.setGauge([]string{"memberlist", "ack", "handlers"}, float32(n))
+	if n > m.config.AckHandlerWarnThreshold {
+		m.logger.Warnf("%d ack handlers outstanding, above threshold of %d; handlers may be leaking",
+			n, m.config.AckHandlerWarnThreshold)
+	}
+}
+
 // Invokes an Ack handler if any is associated, and reaps the handler immediately
-func (m *Memberlist) invokeAckHandler(seqNo uint32) {
+func (m *Memberlist) invokeAckHandler(ack ackResp, timestamp time.Time) {
 	m.ackLock.Lock()
-	ah, ok := m.ackHandlers[seqNo]
-	delete(m.ackHandlers, seqNo)
+	ah, ok := m.ackHandlers[ack.SeqNo]
+	delete(m.ackHandlers, ack.SeqNo)
 	m.ackLock.Unlock()
 	if !ok {
 		return
 	}
 	ah.timer.Stop()
-	ah.handler()
+	ah.handler(ack.Payload, timestamp)
 }
 
 // aliveNode is invoked by the network layer when we get a message about a
 // live node.
 func (m *Memberlist) aliveNode(a *alive) {
+	m.aliveNodeNotify(a, nil)
+}
+
+// aliveNodeNotify works like aliveNode, but notifies the given channel
+// once the resulting re-broadcast is no longer being transmitted.
+func (m *Memberlist) aliveNodeNotify(a *alive, notify chan struct{}) {
+	// Any event or conflict is passed on once the nodeLock has been released
+	var event *NodeEvent
+	var existing, other *Node
+	defer func() {
+		if existing != nil {
+			m.config.Conflict.NotifyConflict(existing, other)
+		}
+		m.dispatchEvent(event)
+	}()
+
 	m.nodeLock.Lock()
 	defer m.nodeLock.Unlock()
 	state, ok := m.nodeMap[a.Node]
@@ -551,13 +1190,38 @@ func (m *Memberlist) aliveNode(a *alive) {
 	// in-queue to be processed but blocked by the locks above. If we let
 	// that aliveMsg process, it'll cause us to re-join the cluster. This
 	// ensures that we don't.
-	if m.leave && a.Node == m.config.Name {
+	if m.hasLeft() && a.Node == m.localName() {
 		return
 	}
 
+	// Give the alive delegate a chance to refuse the node
+	if m.config.Alive != nil {
+		peer := &Node{
+			Name: a.Node,
+			Addr: a.Addr,
+			Port: a.Port,
+			Meta: a.Meta,
+		}
+		if len(a.Vsn) >= 6 {
+			peer.PMin, peer.PMax, peer.PCur = a.Vsn[0], a.Vsn[1], a.Vsn[2]
+			peer.DMin, peer.DMax, peer.DCur = a.Vsn[3], a.Vsn[4], a.Vsn[5]
+		}
+		if err := m.config.Alive.NotifyAlive(peer); err != nil {
+			m.logger.Warnf("Ignoring alive message for %s: %s", a.Node, err)
+			return
+		}
+	}
+
 	// Check if we've never seen this node before, and if not, then
 	// store this node in our node map.
 	if !ok {
+		// Refuse to grow past the configured limit
+		if m.config.MaxNodes > 0 && m.numLive() >= m.config.MaxNodes {
+			m.logger.Warnf("Ignoring alive message for %s, cluster is at the limit of %d nodes",
+				a.Node, m.config.MaxNodes)
+			return
+		}
+
 		state = &nodeState{
 			Node: Node{
 				Name: a.Node,
@@ -565,7 +1229,7 @@ func (m *Memberlist) aliveNode(a *alive) {
 				Port: a.Port,
 				Meta: a.Meta,
 			},
-			State: stateDead,
+			State: StateDead,
 		}
 
 		// Add to map
@@ -576,7 +1240,7 @@ func (m *Memberlist) aliveNode(a *alive) {
 		// nodes did an append, failure detection bound would be
 		// very high.
 		n := len(m.nodes)
-		offset := randomOffset(n)
+		offset := randomOffset(m.rng, n)
 
 		// Add at the end and swap with the node at the offset
 		m.nodes = append(m.nodes, state)
@@ -584,10 +1248,48 @@ func (m *Memberlist) aliveNode(a *alive) {
 	}
 
 	// Check if this address is different than the existing node
+	moved := false
 	if !reflect.DeepEqual([]byte(state.Addr), a.Addr) || state.Port != a.Port {
-		m.logger.Printf("[ERR] Conflicting address for %s. Mine: %v:%d Theirs: %v:%d",
-			state.Name, state.Addr, state.Port, net.IP(a.Addr), a.Port)
-		return
+		policy := m.config.ConflictPolicy
+		switch {
+		case state.deadOrLeft() && a.Node != m.localName() && m.canReclaim(state):
+			// A dead node that comes back at a new address has restarted,
+			// so it is taken as a new node, whatever its incarnation
+			state.Addr = a.Addr
+			state.Port = a.Port
+			state.Incarnation = 0
+			moved = true
+
+		case policy == ConflictIgnore:
+			m.logger.Debugf("Ignoring conflicting address for %s. Mine: %v:%d Theirs: %v:%d",
+				state.Name, state.Addr, state.Port, net.IP(a.Addr), a.Port)
+			return
+
+		case policy == ConflictPreferNewerIncarnation && a.Incarnation > state.Incarnation &&
+			a.Node != m.localName():
+			m.logger.Warnf("Moving %s from %v:%d to %v:%d with newer incarnation %d",
+				state.Name, state.Addr, state.Port, net.IP(a.Addr), a.Port, a.Incarnation)
+			state.Addr = a.Addr
+			state.Port = a.Port
+			moved = true
+
+		default:
+			m.logger.Errorf("Conflicting address for %s. Mine: %v:%d Theirs: %v:%d",
+				state.Name, state.Addr, state.Port, net.IP(a.Addr), a.Port)
+
+			// Inform the conflict delegate if provided
+			if m.config.Conflict != nil {
+				other = &Node{
+					Name: a.Node,
+					Addr: a.Addr,
+					Port: a.Port,
+					Meta: a.Meta,
+				}
+				n := state.Node
+				existing = &n
+			}
+			return
+		}
 	}
 
 	// Bail if the incarnation number is old
@@ -606,28 +1308,42 @@ func (m *Memberlist) aliveNode(a *alive) {
 	}
 
 	// Re-Broadcast
-	m.encodeAndBroadcast(a.Node, aliveMsg, a)
+	m.encodeBroadcastNotify(a.Node, aliveMsg, a, notify)
 
 	// Update the state and incarnation number
 	oldState := state.State
+	oldMeta := state.Meta
 	state.Incarnation = a.Incarnation
 	state.Meta = a.Meta
-	if state.State != stateAlive {
-		state.State = stateAlive
+	state.LastContact = time.Now()
+	if state.State != StateAlive {
+		state.State = StateAlive
 		state.StateChange = time.Now()
 	}
-
-	// if Dead -> Alive, notify of join
-	if oldState == stateDead {
-		if m.config.Events != nil {
-			m.config.Events.NotifyJoin(&state.Node)
-		}
+	m.clearSuspicion(a.Node)
+
+	// if Dead -> Alive, notify of join, otherwise notify of any
+	// change to the meta data
+	n := state.Node
+	if oldState == StateDead || oldState == StateLeft {
+		event = &NodeEvent{NodeJoin, &n}
+	} else if moved || !bytes.Equal(oldMeta, a.Meta) {
+		event = &NodeEvent{NodeUpdate, &n}
 	}
 }
 
 // suspectNode is invoked by the network layer when we get a message
 // about a suspect node
 func (m *Memberlist) suspectNode(s *suspect) {
+	// Suspicions of ourself are reported once the nodeLock has been released
+	var suspected, refuted bool
+	defer func() {
+		if suspected {
+			m.notifySelfSuspected(refuted)
+		}
+	}()
+	advIP, advPort := m.refuteAddr(s.Node)
+
 	m.nodeLock.Lock()
 	defer m.nodeLock.Unlock()
 	state, ok := m.nodeMap[s.Node]
@@ -642,18 +1358,32 @@ func (m *Memberlist) suspectNode(s *suspect) {
 		return
 	}
 
+	// See if there's a suspicion timer we can confirm. If the info is new
+	// to us we will go ahead and re-gossip it. This allows for multiple
+	// independent confirmations to flow even when a node probes a node
+	// that's already suspect.
+	if timer, ok := m.nodeTimers[s.Node]; ok {
+		if timer.Confirm(s.From) {
+			m.encodeAndBroadcast(s.Node, suspectMsg, s)
+		}
+		return
+	}
+
 	// Ignore non-alive nodes
-	if state.State != stateAlive {
+	if state.State != StateAlive {
 		return
 	}
 
 	// If this is us we need to refute, otherwise re-broadcast
-	if state.Name == m.config.Name {
+	if state.Name == m.localName() {
+		suspected = true
+		m.awareness.ApplyDelta(1)
 		inc := m.nextIncarnation()
 		for s.Incarnation >= inc {
 			inc = m.nextIncarnation()
 		}
 		state.Incarnation = inc
+		m.setLocalAddr(state, advIP, advPort)
 
 		a := alive{
 			Incarnation: inc,
@@ -667,6 +1397,7 @@ func (m *Memberlist) suspectNode(s *suspect) {
 			},
 		}
 		m.encodeAndBroadcast(s.Node, aliveMsg, a)
+		refuted = true
 
 		return // Do not mark ourself suspect
 	} else {
@@ -675,34 +1406,93 @@ func (m *Memberlist) suspectNode(s *suspect) {
 
 	// Update the state
 	state.Incarnation = s.Incarnation
-	state.State = stateSuspect
+	state.State = StateSuspect
 	changeTime := time.Now()
 	state.StateChange = changeTime
-
-	// Setup a timeout for this
-	timeout := suspicionTimeout(m.config.SuspicionMult, len(m.nodes), m.config.ProbeInterval)
-	time.AfterFunc(timeout, func() {
+	m.incrCounter([]string{"memberlist", "state", "suspect"}, 1)
+
+	// Setup a suspicion timer. Without any confirmations the node is
+	// declared dead after the maximum timeout. Each independent peer that
+	// also suspects the node brings this closer to the minimum, which is
+	// reached once we have k confirmations. We subtract 2 because someone
+	// else started the suspicion, and we won't get a confirmation from
+	// ourselves. If there aren't enough nodes to give the expected
+	// confirmations, we don't expect any.
+	n := len(m.nodes)
+	min, max := m.suspicionBounds(n)
+	k := m.tunables().SuspicionMult - 2
+	if n-2 < k || k < 1 {
+		k = 0
+		min = max
+	}
+	fn := func(numConfirmations int, timeout time.Duration) {
 		m.nodeLock.Lock()
 		state, ok := m.nodeMap[s.Node]
-		timeout := ok && state.State == stateSuspect && state.StateChange == changeTime
+		expired := ok && state.State == StateSuspect && state.StateChange == changeTime
 		m.nodeLock.Unlock()
 
-		if timeout {
+		if expired {
+			m.logger.Infof("Marking %s as failed, suspect timeout of %v reached (%d peer confirmations)",
+				state.Name, timeout, numConfirmations)
+			m.addSample([]string{"memberlist", "suspect", "timeout"},
+				float32(timeout)/float32(time.Millisecond))
 			m.suspectTimeout(state)
 		}
-	})
+	}
+	m.nodeTimers[s.Node] = newSuspicion(s.From, k, min, max, fn)
+
+	// Re-probe the node while it is suspect, at the interval it would
+	// take to declare it dead with every confirmation in.
+	if min < max && m.config.TransportMode.udp() {
+		m.wg.Add(1)
+		go m.reprobeSuspect(s.Node, changeTime, min)
+	}
+}
+
+// suspicionBounds returns the minimum and maximum suspicion timeouts for a
+// cluster of n nodes, see Config.SuspicionMaxTimeoutMult
+func (m *Memberlist) suspicionBounds(n int) (min, max time.Duration) {
+	t := m.tunables()
+	if mult := t.SuspicionMaxTimeoutMult; mult > 0 {
+		min = suspicionTimeout(t.SuspicionMult, n, t.ProbeInterval)
+		return min, time.Duration(mult) * min
+	}
+	max = suspicionTimeout(t.SuspicionMult, n, t.ProbeInterval)
+	min = suspicionTimeout(2, n, t.ProbeInterval)
+	return min, max
 }
 
 // suspectTimeout is invoked when a suspect timeout has occurred
 func (m *Memberlist) suspectTimeout(n *nodeState) {
 	// Construct a dead message
-	d := dead{Incarnation: n.Incarnation, Node: n.Name}
+	d := dead{Incarnation: n.Incarnation, Node: n.Name, From: m.localName()}
 	m.deadNode(&d)
 }
 
+// clearSuspicion stops and removes the suspicion timer for the given node,
+// if there is one. The nodeLock must be held.
+func (m *Memberlist) clearSuspicion(name string) {
+	if timer, ok := m.nodeTimers[name]; ok {
+		timer.Stop()
+		delete(m.nodeTimers, name)
+	}
+}
+
 // deadNode is invoked by the network layer when we get a message
 // about a dead node
 func (m *Memberlist) deadNode(d *dead) {
+	// Any event or suspicion of ourself is reported once the nodeLock has
+	// been released
+	var event *NodeEvent
+	var suspected, refuted bool
+	defer func() {
+		m.dispatchEvent(event)
+		if suspected {
+			m.notifySelfSuspected(refuted)
+		}
+	}()
+	advIP, advPort := m.refuteAddr(d.Node)
+
 	m.nodeLock.Lock()
 	defer m.nodeLock.Unlock()
 	state, ok := m.nodeMap[d.Node]
@@ -718,18 +1508,22 @@ func (m *Memberlist) deadNode(d *dead) {
 	}
 
 	// Ignore if node is already dead
-	if state.State == stateDead {
+	if state.deadOrLeft() {
 		return
 	}
 
 	// Check if this is us
-	if state.Name == m.config.Name {
+	if state.Name == m.localName() {
+		suspected = true
+
 		// If we are not leaving we need to refute
-		if !m.leave {
+		if !m.hasLeft() {
+			m.awareness.ApplyDelta(1)
 			inc := m.nextIncarnation()
 			for d.Incarnation >= inc {
 				inc = m.nextIncarnation()
 			}
+			m.setLocalAddr(state, advIP, advPort)
 
 			a := alive{
 				Incarnation: inc,
@@ -743,6 +1537,7 @@ func (m *Memberlist) deadNode(d *dead) {
 				},
 			}
 			m.encodeAndBroadcast(d.Node, aliveMsg, a)
+			refuted = true
 
 			state.Incarnation = inc
 			return // Do not mark ourself dead
@@ -754,18 +1549,23 @@ func (m *Memberlist) deadNode(d *dead) {
 		m.encodeAndBroadcast(d.Node, deadMsg, d)
 	}
 
-	// Update the state
+	// Update the state, telling a node that announced its own departure
+	// apart from one that failed
+	cause := d.cause(m.localName())
 	state.Incarnation = d.Incarnation
-	state.State = stateDead
+	state.State = StateDead
+	if cause == LeaveCauseLeft {
+		state.State = StateLeft
+	}
 	state.StateChange = time.Now()
-
-	// Remove from the node map
-	delete(m.nodeMap, state.Name)
+	m.incrCounter([]string{"memberlist", "state", "dead"}, 1)
+	m.clearSuspicion(state.Name)
 
 	// Notify of death
-	if m.config.Events != nil {
-		m.config.Events.NotifyLeave(&state.Node)
-	}
+	n := state.Node
+	n.LeaveReason = d.Reason
+	n.LeaveCause = cause
+	event = &NodeEvent{NodeLeave, &n}
 }
 
 // mergeState is invoked by the network layer when we get a Push/Pull
@@ -775,7 +1575,7 @@ func (m *Memberlist) mergeState(remote []pushNodeState) {
 		// Look for a matching local node
 		m.nodeLock.RLock()
 		local, ok := m.nodeMap[r.Name]
-		sameState := ok && local.State == r.State && r.Name != m.config.Name
+		sameState := ok && local.State == r.State && r.Name != m.localName()
 		m.nodeLock.RUnlock()
 
 		// Skip if we agree on states
@@ -784,7 +1584,7 @@ func (m *Memberlist) mergeState(remote []pushNodeState) {
 		}
 
 		switch r.State {
-		case stateAlive:
+		case StateAlive:
 			a := alive{
 				Incarnation: r.Incarnation,
 				Node:        r.Name,
@@ -795,12 +1595,17 @@ func (m *Memberlist) mergeState(remote []pushNodeState) {
 			}
 			m.aliveNode(&a)
 
-		case stateDead:
+		case StateLeft:
+			// A node that left said so itself, so there's no doubt
+			d := dead{Incarnation: r.Incarnation, Node: r.Name, From: r.Name}
+			m.deadNode(&d)
+
+		case StateDead:
 			// If the remote node belives a node is dead, we prefer to
 			// suspect that node instead of declaring it dead instantly
 			fallthrough
-		case stateSuspect:
-			s := suspect{Incarnation: r.Incarnation, Node: r.Name}
+		case StateSuspect:
+			s := suspect{Incarnation: r.Incarnation, Node: r.Name, From: m.localName()}
 			m.suspectNode(&s)
 		}
 	}
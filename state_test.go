@@ -3,6 +3,10 @@ package memberlist
 import (
 	"bytes"
 	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -51,7 +55,7 @@ func TestMemberList_Probe(t *testing.T) {
 
 	// Should not be marked suspect
 	n := m1.nodeMap[addr2.String()]
-	if n.State != stateAlive {
+	if n.State != StateAlive {
 		t.Fatalf("Expect node to be alive")
 	}
 
@@ -61,6 +65,49 @@ func TestMemberList_Probe(t *testing.T) {
 	}
 }
 
+type probeFailedDelegate struct {
+	nodes []string
+	errs  []error
+}
+
+func (p *probeFailedDelegate) NotifyProbeFailed(node *Node, err error) {
+	p.nodes = append(p.nodes, node.Name)
+	p.errs = append(p.errs, err)
+}
+
+func TestMemberList_ProbeNode_NotifyProbeFailed(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	d := &probeFailedDelegate{}
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = time.Millisecond
+		c.ProbeInterval = 10 * time.Millisecond
+		c.Probe = d
+	})
+	defer m1.Shutdown()
+
+	// Nothing is listening on the second address
+	a1 := alive{Node: addr1.String(), Addr: []byte(addr1), Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1)
+	a2 := alive{Node: addr2.String(), Addr: []byte(addr2), Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a2)
+
+	m1.probeNode(m1.nodeMap[addr2.String()])
+	if len(d.errs) != 2 || d.errs[0] != ErrProbeTimeout || d.errs[1] != ErrIndirectProbeTimeout {
+		t.Fatalf("bad: %v", d.errs)
+	}
+	if d.nodes[0] != addr2.String() || d.nodes[1] != addr2.String() {
+		t.Fatalf("bad: %v", d.nodes)
+	}
+
+	// Successful probes aren't reported
+	d.nodes, d.errs = nil, nil
+	m1.probeNode(m1.nodeMap[addr1.String()])
+	if len(d.errs) != 0 {
+		t.Fatalf("bad: %v", d.errs)
+	}
+}
+
 func TestMemberList_ProbeNode_Suspect(t *testing.T) {
 	addr1 := getBindAddr()
 	addr2 := getBindAddr()
@@ -91,7 +138,7 @@ func TestMemberList_ProbeNode_Suspect(t *testing.T) {
 	m1.probeNode(n)
 
 	// Should be marked suspect
-	if n.State != stateSuspect {
+	if n.State != StateSuspect {
 		t.Fatalf("Expect node to be suspect")
 	}
 	time.Sleep(5 * time.Millisecond)
@@ -126,7 +173,7 @@ func TestMemberList_ProbeNode(t *testing.T) {
 	m1.probeNode(n)
 
 	// Should be marked suspect
-	if n.State != stateAlive {
+	if n.State != StateAlive {
 		t.Fatalf("Expect node to be alive")
 	}
 
@@ -136,6 +183,204 @@ func TestMemberList_ProbeNode(t *testing.T) {
 	}
 }
 
+func TestMemberList_ProbeTimeout_CrossZone(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	m.config.ProbeTimeout = 100 * time.Millisecond
+	m.config.CrossZoneProbeTimeout = time.Second
+	m.config.NodeZone = func(n *Node) string { return string(n.Meta) }
+
+	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Meta: []byte("dc1"), Incarnation: 1}
+	m.aliveNode(&a)
+
+	cases := []struct {
+		zone    string
+		timeout time.Duration
+	}{
+		{"dc1", 100 * time.Millisecond},
+		{"dc2", time.Second},
+		{"", 100 * time.Millisecond},
+	}
+	for _, c := range cases {
+		if timeout := m.probeTimeout(&Node{Meta: []byte(c.zone)}); timeout != c.timeout {
+			t.Fatalf("bad timeout for %q: %v", c.zone, timeout)
+		}
+	}
+
+	// Without a cross zone timeout every node is treated the same
+	m.config.CrossZoneProbeTimeout = 0
+	if timeout := m.probeTimeout(&Node{Meta: []byte("dc2")}); timeout != 100*time.Millisecond {
+		t.Fatalf("bad timeout: %v", timeout)
+	}
+}
+
+func TestMemberList_NodeLastContact(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = time.Millisecond
+		c.ProbeInterval = 10 * time.Millisecond
+	})
+	m2 := HostMemberlist(addr2.String(), t, nil)
+	defer m1.Shutdown()
+	defer m2.Shutdown()
+
+	if _, ok := m1.NodeLastContact("nope"); ok {
+		t.Fatalf("expected unknown node")
+	}
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a2)
+
+	alive, ok := m1.NodeLastContact(addr2.String())
+	if !ok || alive.IsZero() {
+		t.Fatalf("expected contact from alive message: %v %v", alive, ok)
+	}
+
+	// A successful probe should move it forward
+	time.Sleep(time.Millisecond)
+	m1.probeNode(m1.nodeMap[addr2.String()])
+	acked, ok := m1.NodeLastContact(addr2.String())
+	if !ok || !acked.After(alive) {
+		t.Fatalf("expected contact from ack after %v: %v", alive, acked)
+	}
+
+	// Older timestamps are ignored
+	m1.markContact(addr2.String(), alive)
+	if last, _ := m1.NodeLastContact(addr2.String()); !last.Equal(acked) {
+		t.Fatalf("bad: %v", last)
+	}
+}
+
+func TestMemberList_ConvergenceHealth(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	if h := m.ConvergenceHealth(time.Second); h != 100 {
+		t.Fatalf("expected a lone node to be healthy, got %d", h)
+	}
+
+	for i := 1; i <= 4; i++ {
+		a := alive{Node: fmt.Sprintf("test%d", i), Addr: []byte{127, 0, 0, byte(i)}, Incarnation: 1}
+		m.aliveNode(&a)
+	}
+	if h := m.ConvergenceHealth(time.Second); h != 100 {
+		t.Fatalf("bad: %d", h)
+	}
+
+	// One node hasn't been heard from in a while, and one is suspect
+	m.nodeMap["test1"].LastContact = time.Now().Add(-time.Hour)
+	m.nodeMap["test2"].State = StateSuspect
+	if h := m.ConvergenceHealth(time.Second); h != 50 {
+		t.Fatalf("bad: %d", h)
+	}
+
+	// Dead nodes don't count
+	d := dead{Node: "test1", Incarnation: 1}
+	m.deadNode(&d)
+	if h := m.ConvergenceHealth(time.Second); h != 66 {
+		t.Fatalf("bad: %d", h)
+	}
+
+	// The default window scales with the time it takes to probe everyone
+	m.nodeMap["test3"].LastContact = time.Now().Add(-5 * m.config.ProbeInterval)
+	if h := m.ConvergenceHealth(0); h != 66 {
+		t.Fatalf("bad: %d", h)
+	}
+	m.nodeMap["test3"].LastContact = time.Now().Add(-7 * m.config.ProbeInterval)
+	if h := m.ConvergenceHealth(0); h != 33 {
+		t.Fatalf("bad: %d", h)
+	}
+}
+
+type pingDelegate struct {
+	payload []byte
+	other   *Node
+	rtt     time.Duration
+	got     []byte
+}
+
+func (p *pingDelegate) AckPayload() []byte {
+	return p.payload
+}
+
+func (p *pingDelegate) NotifyPingComplete(other *Node, rtt time.Duration, payload []byte) {
+	p.other = other
+	p.rtt = rtt
+	p.got = payload
+}
+
+func TestMemberList_ProbeNode_Ping(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	p1 := &pingDelegate{}
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = 100 * time.Millisecond
+		c.ProbeInterval = time.Second
+		c.Ping = p1
+	})
+	m2 := HostMemberlist(addr2.String(), t, func(c *Config) {
+		c.Ping = &pingDelegate{payload: []byte("coords")}
+	})
+	defer m1.Shutdown()
+	defer m2.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a2)
+
+	n := m1.nodeMap[addr2.String()]
+	m1.probeNode(n)
+
+	if p1.other == nil || p1.other.Name != addr2.String() {
+		t.Fatalf("bad node: %v", p1.other)
+	}
+	if p1.rtt <= 0 {
+		t.Fatalf("bad rtt: %v", p1.rtt)
+	}
+	if string(p1.got) != "coords" {
+		t.Fatalf("bad payload: %s", p1.got)
+	}
+}
+
+func TestMemberList_Ping(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = 100 * time.Millisecond
+	})
+	defer m1.Shutdown()
+	m2 := HostMemberlist(addr2.String(), t, nil)
+	defer m2.Shutdown()
+
+	// Ping the other node
+	addr := &net.UDPAddr{IP: addr2, Port: m2.config.Port}
+	rtt, err := m1.Ping(addr2.String(), addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if rtt <= 0 {
+		t.Fatalf("bad rtt: %v", rtt)
+	}
+
+	// Ping a port with nothing listening
+	m2.Shutdown()
+	_, err = m1.Ping(addr2.String(), addr)
+	if _, ok := err.(NoPingResponseError); !ok {
+		t.Fatalf("expected no response error: %v", err)
+	}
+}
+
 func TestMemberList_ResetNodes(t *testing.T) {
 	m := GetMemberlist(t)
 	a1 := alive{Node: "test1", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
@@ -147,6 +392,17 @@ func TestMemberList_ResetNodes(t *testing.T) {
 	d := dead{Node: "test2", Incarnation: 1}
 	m.deadNode(&d)
 
+	// Recently dead nodes are kept around so their death is gossiped
+	m.config.GossipToTheDeadTime = 100 * time.Millisecond
+	m.resetNodes()
+	if len(m.nodes) != 3 {
+		t.Fatalf("Bad length")
+	}
+	if _, ok := m.nodeMap["test2"]; !ok {
+		t.Fatalf("test2 should still be mapped")
+	}
+
+	time.Sleep(200 * time.Millisecond)
 	m.resetNodes()
 	if len(m.nodes) != 2 {
 		t.Fatalf("Bad length")
@@ -156,6 +412,63 @@ func TestMemberList_ResetNodes(t *testing.T) {
 	}
 }
 
+func TestMemberList_ResetNodes_ShouldReap(t *testing.T) {
+	m := GetMemberlist(t)
+	m.config.GossipToTheDeadTime = 0
+	m.config.ShouldReap = func(n *Node, deadFor time.Duration) bool {
+		return n.Name != "test2"
+	}
+	for i := 1; i <= 3; i++ {
+		a := alive{Node: fmt.Sprintf("test%d", i), Addr: []byte{127, 0, 0, byte(i)}, Incarnation: 1}
+		m.aliveNode(&a)
+	}
+	for _, name := range []string{"test2", "test3"} {
+		d := dead{Node: name, Incarnation: 1}
+		m.deadNode(&d)
+	}
+
+	// The pinned node stays, while the other one is reaped
+	m.resetNodes()
+	if len(m.nodes) != 2 {
+		t.Fatalf("bad: %v", m.nodes)
+	}
+	for _, n := range m.nodes {
+		if n.Name == "test3" {
+			t.Fatalf("test3 should be reaped")
+		}
+	}
+
+	// Once it rejoins, its old entry goes
+	a := alive{Node: "test2", Addr: []byte{127, 0, 0, 2}, Incarnation: 2}
+	m.aliveNode(&a)
+	m.resetNodes()
+	if len(m.nodes) != 2 || m.nodeMap["test2"].State != StateAlive {
+		t.Fatalf("bad: %v", m.nodes)
+	}
+}
+
+func TestMemberList_ResetNodes_Shuffle(t *testing.T) {
+	m := GetMemberlist(t)
+	for i := 0; i < 10; i++ {
+		a := alive{Node: fmt.Sprintf("test%d", i), Addr: []byte{127, 0, 0, byte(i)}, Incarnation: 1}
+		m.aliveNode(&a)
+	}
+
+	// The first node should not always end up in the same position
+	positions := make(map[int]bool)
+	for round := 0; round < 20; round++ {
+		m.resetNodes()
+		for idx, n := range m.nodes {
+			if n.Name == "test0" {
+				positions[idx] = true
+			}
+		}
+	}
+	if len(positions) < 2 {
+		t.Fatalf("nodes not shuffled: %v", positions)
+	}
+}
+
 func TestMemberList_NextSeq(t *testing.T) {
 	m := &Memberlist{}
 	if m.nextSeqNo() != 1 {
@@ -166,10 +479,75 @@ func TestMemberList_NextSeq(t *testing.T) {
 	}
 }
 
+func TestMemberlist_ProbeInterval(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	// Fixed by default
+	if i := m.ProbeInterval(); i != m.config.ProbeInterval {
+		t.Fatalf("bad: %v", i)
+	}
+
+	// A tiny cluster is held to the upper bound
+	m.config.ProbeIntervalMin = 200 * time.Millisecond
+	m.config.ProbeIntervalMax = 2 * time.Second
+	for i := 0; i < 3; i++ {
+		a := alive{Node: fmt.Sprintf("node%d", i), Addr: []byte{127, 0, 0, byte(i + 1)}, Incarnation: 1}
+		m.aliveNode(&a)
+	}
+	if i := m.ProbeInterval(); i != 2*time.Second {
+		t.Fatalf("bad: %v", i)
+	}
+
+	// A large one probes faster, down to the lower bound
+	for i := 3; i < 1000; i++ {
+		a := alive{Node: fmt.Sprintf("node%d", i), Addr: []byte{10, 0, byte(i >> 8), byte(i)}, Incarnation: 1}
+		m.aliveNode(&a)
+	}
+	i := m.ProbeInterval()
+	if i >= m.config.ProbeInterval || i < m.config.ProbeIntervalMin {
+		t.Fatalf("bad: %v", i)
+	}
+	m.config.ProbeIntervalMin = m.config.ProbeInterval
+	if i := m.ProbeInterval(); i != m.config.ProbeInterval {
+		t.Fatalf("bad: %v", i)
+	}
+
+	// It never drops below the probe timeout, even without a lower bound
+	m.config.ProbeIntervalMin = 0
+	m.config.ProbeTimeout = 900 * time.Millisecond
+	if i := m.ProbeInterval(); i != m.config.ProbeTimeout {
+		t.Fatalf("bad: %v", i)
+	}
+}
+
+func TestMemberlist_Jitter(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	// Fixed by default
+	if d := m.jitter(time.Second); d != time.Second {
+		t.Fatalf("bad: %v", d)
+	}
+
+	m.config.IntervalJitter = 0.25
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := m.jitter(time.Second)
+		if d < 750*time.Millisecond || d > 1250*time.Millisecond {
+			t.Fatalf("bad: %v", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("expected the intervals to vary")
+	}
+}
+
 func TestMemberList_SetAckChannel(t *testing.T) {
 	m := &Memberlist{ackHandlers: make(map[uint32]*ackHandler)}
 
-	ch := make(chan bool, 1)
+	ch := make(chan ackMessage, 1)
 	m.setAckChannel(0, ch, 10*time.Millisecond)
 
 	if _, ok := m.ackHandlers[0]; !ok {
@@ -185,7 +563,7 @@ func TestMemberList_SetAckChannel(t *testing.T) {
 func TestMemberList_SetAckHandler(t *testing.T) {
 	m := &Memberlist{ackHandlers: make(map[uint32]*ackHandler)}
 
-	f := func() {}
+	f := func([]byte, time.Time) {}
 	m.setAckHandler(0, f, 10*time.Millisecond)
 
 	if _, ok := m.ackHandlers[0]; !ok {
@@ -202,14 +580,14 @@ func TestMemberList_InvokeAckHandler(t *testing.T) {
 	m := &Memberlist{ackHandlers: make(map[uint32]*ackHandler)}
 
 	// Does nothing
-	m.invokeAckHandler(0)
+	m.invokeAckHandler(ackResp{}, time.Now())
 
 	var b bool
-	f := func() { b = true }
+	f := func(payload []byte, timestamp time.Time) { b = true }
 	m.setAckHandler(0, f, 10*time.Millisecond)
 
 	// Should set b
-	m.invokeAckHandler(0)
+	m.invokeAckHandler(ackResp{0, nil}, time.Now())
 	if !b {
 		t.Fatalf("b not set")
 	}
@@ -219,23 +597,63 @@ func TestMemberList_InvokeAckHandler(t *testing.T) {
 	}
 }
 
+func TestMemberList_CheckAckHandlers(t *testing.T) {
+	sink := newMockSink()
+	logger := &captureLogger{}
+	c := &Config{AckHandlerWarnThreshold: 2, MetricsSink: sink}
+	m := &Memberlist{config: c, logger: logger, ackHandlers: make(map[uint32]*ackHandler)}
+
+	f := func([]byte, time.Time) {}
+	for i := uint32(0); i < 2; i++ {
+		m.setAckHandler(i, f, time.Minute)
+	}
+	if n := m.NumAckHandlers(); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	// At the threshold is fine
+	m.checkAckHandlers()
+	if len(logger.lines) != 0 {
+		t.Fatalf("bad: %v", logger.lines)
+	}
+	if g := sink.gauges["memberlist.ack.handlers"]; g != 2 {
+		t.Fatalf("bad: %v", g)
+	}
+
+	// Above it warns
+	m.setAckHandler(2, f, time.Minute)
+	m.checkAckHandlers()
+	if len(logger.lines) != 1 || !strings.HasPrefix(logger.lines[0], "WARN 3 ack handlers") {
+		t.Fatalf("bad: %v", logger.lines)
+	}
+
+	// Reaping brings the count back down
+	m.invokeAckHandler(ackResp{SeqNo: 2}, time.Now())
+	if n := m.NumAckHandlers(); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
 func TestMemberList_InvokeAckHandler_Channel(t *testing.T) {
 	m := &Memberlist{ackHandlers: make(map[uint32]*ackHandler)}
 
 	// Does nothing
-	m.invokeAckHandler(0)
+	m.invokeAckHandler(ackResp{}, time.Now())
 
-	ch := make(chan bool, 1)
+	ch := make(chan ackMessage, 1)
 	m.setAckChannel(0, ch, 10*time.Millisecond)
 
 	// Should send message
-	m.invokeAckHandler(0)
+	m.invokeAckHandler(ackResp{0, []byte("payload")}, time.Now())
 
 	select {
 	case v := <-ch:
-		if v != true {
+		if v.Complete != true {
 			t.Fatalf("Bad value")
 		}
+		if string(v.Payload) != "payload" {
+			t.Fatalf("bad payload: %s", v.Payload)
+		}
 	default:
 		t.Fatalf("message not sent")
 	}
@@ -245,6 +663,51 @@ func TestMemberList_InvokeAckHandler_Channel(t *testing.T) {
 	}
 }
 
+type capabilityAliveDelegate struct {
+	seen []string
+}
+
+func (c *capabilityAliveDelegate) NotifyAlive(peer *Node) error {
+	c.seen = append(c.seen, peer.Name)
+	if string(peer.Meta) != "capable" {
+		return fmt.Errorf("missing capability")
+	}
+	return nil
+}
+
+func TestMemberList_AliveNode_AliveDelegate(t *testing.T) {
+	ch := make(chan NodeEvent, 1)
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	d := &capabilityAliveDelegate{}
+	m.config.Alive = d
+	m.config.Events = &ChannelEventDelegate{ch}
+
+	a1 := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a1)
+	if _, ok := m.nodeMap["test"]; ok || len(m.nodes) != 0 {
+		t.Fatalf("should refuse node")
+	}
+
+	a2 := alive{Node: "test2", Addr: []byte{127, 0, 0, 2}, Incarnation: 1, Meta: []byte("capable")}
+	m.aliveNode(&a2)
+	if state, ok := m.nodeMap["test2"]; !ok || state.State != StateAlive {
+		t.Fatalf("should accept node")
+	}
+
+	if !reflect.DeepEqual(d.seen, []string{"test", "test2"}) {
+		t.Fatalf("bad: %v", d.seen)
+	}
+	select {
+	case e := <-ch:
+		if e.Node.Name != "test2" {
+			t.Fatalf("bad node name")
+		}
+	default:
+		t.Fatalf("no join message")
+	}
+}
+
 func TestMemberList_AliveNode_NewNode(t *testing.T) {
 	ch := make(chan NodeEvent, 1)
 	m := GetMemberlist(t)
@@ -265,7 +728,7 @@ func TestMemberList_AliveNode_NewNode(t *testing.T) {
 	if state.Incarnation != 1 {
 		t.Fatalf("bad incarnation")
 	}
-	if state.State != stateAlive {
+	if state.State != StateAlive {
 		t.Fatalf("bad state")
 	}
 	if time.Now().Sub(state.StateChange) > time.Second {
@@ -282,9 +745,107 @@ func TestMemberList_AliveNode_NewNode(t *testing.T) {
 		t.Fatalf("no join message")
 	}
 
-	// Check a broad cast is queued
-	if m.broadcasts.NumQueued() != 1 {
-		t.Fatalf("expected queued message")
+	// Check a broad cast is queued
+	if m.broadcasts.NumQueued() != 1 {
+		t.Fatalf("expected queued message")
+	}
+}
+
+func TestMemberList_AliveNode_MaxNodes(t *testing.T) {
+	m := GetMemberlist(t)
+	m.config.MaxNodes = 2
+
+	a1 := alive{Node: "test1", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a1)
+	a2 := alive{Node: "test2", Addr: []byte{127, 0, 0, 2}, Incarnation: 1}
+	m.aliveNode(&a2)
+
+	// Over the limit, should be ignored
+	a3 := alive{Node: "test3", Addr: []byte{127, 0, 0, 3}, Incarnation: 1}
+	m.aliveNode(&a3)
+	if _, ok := m.nodeMap["test3"]; ok {
+		t.Fatalf("should not add node over the limit")
+	}
+	if len(m.nodes) != 2 {
+		t.Fatalf("bad: %d", len(m.nodes))
+	}
+
+	// Existing members can still be updated
+	a2.Incarnation = 2
+	m.aliveNode(&a2)
+	if m.nodeMap["test2"].Incarnation != 2 {
+		t.Fatalf("existing node should be updated")
+	}
+
+	// Dead nodes don't count towards the limit
+	m.deadNode(&dead{Node: "test2", Incarnation: 2})
+	m.aliveNode(&a3)
+	if _, ok := m.nodeMap["test3"]; !ok {
+		t.Fatalf("should add node once another is dead")
+	}
+
+	remote := []pushNodeState{
+		{Name: "test2", State: StateDead},
+		{Name: "test4", State: StateAlive},
+	}
+	if n := m.countAfterMerge(remote); n != 3 {
+		t.Fatalf("bad count: %d", n)
+	}
+}
+
+func TestMemberList_AliveNode_ReclaimDeadName(t *testing.T) {
+	m := GetMemberlist(t)
+	m.config.ConflictPolicy = ConflictPreferNewerIncarnation
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 8000, Incarnation: 10}
+	m.aliveNode(&a)
+
+	d := dead{Node: "test", Incarnation: 10}
+	m.deadNode(&d)
+
+	// Restarted on a new address with a reset incarnation
+	a2 := alive{Node: "test", Addr: []byte{127, 0, 0, 2}, Port: 9000, Incarnation: 1}
+	m.aliveNode(&a2)
+
+	state, ok := m.nodeMap["test"]
+	if !ok || state.State != StateAlive {
+		t.Fatalf("restarted node should be alive")
+	}
+	if !bytes.Equal(state.Addr, a2.Addr) || state.Port != 9000 {
+		t.Fatalf("bad address: %v:%d", state.Addr, state.Port)
+	}
+}
+
+func TestMemberList_AliveNode_DeadNodeReclaimTime(t *testing.T) {
+	m := GetMemberlist(t)
+	m.config.DeadNodeReclaimTime = time.Minute
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 8000, Incarnation: 10}
+	m.aliveNode(&a)
+
+	d := dead{Node: "test", Incarnation: 10}
+	m.deadNode(&d)
+
+	// Not dead for long enough, so it's a conflict
+	a2 := alive{Node: "test", Addr: []byte{127, 0, 0, 2}, Port: 9000, Incarnation: 1}
+	m.aliveNode(&a2)
+
+	state := m.nodeMap["test"]
+	if state.State != StateDead {
+		t.Fatalf("bad state: %v", state.State)
+	}
+	if !bytes.Equal(state.Addr, a.Addr) || state.Port != 8000 {
+		t.Fatalf("bad address: %v:%d", state.Addr, state.Port)
+	}
+
+	// Once the reclaim time has passed the name can be reused
+	state.StateChange = state.StateChange.Add(-2 * time.Minute)
+	m.aliveNode(&a2)
+
+	if state.State != StateAlive || state.Incarnation != 1 {
+		t.Fatalf("bad state: %v %d", state.State, state.Incarnation)
+	}
+	if !bytes.Equal(state.Addr, a2.Addr) || state.Port != 9000 {
+		t.Fatalf("bad address: %v:%d", state.Addr, state.Port)
 	}
 }
 
@@ -300,19 +861,19 @@ func TestMemberList_AliveNode_SuspectNode(t *testing.T) {
 
 	// Make suspect
 	state := m.nodeMap["test"]
-	state.State = stateSuspect
+	state.State = StateSuspect
 	state.StateChange = state.StateChange.Add(-time.Hour)
 
 	// Old incarnation number, should not change
 	m.aliveNode(&a)
-	if state.State != stateSuspect {
+	if state.State != StateSuspect {
 		t.Fatalf("update with old incarnation!")
 	}
 
 	// Should reset to alive now
 	a.Incarnation = 2
 	m.aliveNode(&a)
-	if state.State != stateAlive {
+	if state.State != StateAlive {
 		t.Fatalf("no update with new incarnation!")
 	}
 
@@ -350,7 +911,7 @@ func TestMemberList_AliveNode_Idempotent(t *testing.T) {
 	// Should reset to alive now
 	a.Incarnation = 2
 	m.aliveNode(&a)
-	if state.State != stateAlive {
+	if state.State != StateAlive {
 		t.Fatalf("non idempotent")
 	}
 
@@ -398,6 +959,228 @@ func TestMemberList_AliveNode_ChangeMeta(t *testing.T) {
 	if bytes.Compare(state.Meta, a.Meta) != 0 {
 		t.Fatalf("meta did not update")
 	}
+
+	// Check for a NotifyUpdate
+	select {
+	case e := <-ch:
+		if e.Event != NodeUpdate {
+			t.Fatalf("bad event: %v", e)
+		}
+		if bytes.Compare(e.Node.Meta, a.Meta) != 0 {
+			t.Fatalf("meta did not update")
+		}
+	default:
+		t.Fatalf("missing event!")
+	}
+}
+
+func TestMemberList_AliveNode_SameMeta(t *testing.T) {
+	ch := make(chan NodeEvent, 1)
+	m := GetMemberlist(t)
+
+	a := alive{
+		Node:        "test",
+		Addr:        []byte{127, 0, 0, 1},
+		Meta:        []byte("val1"),
+		Incarnation: 1}
+	m.aliveNode(&a)
+
+	// Listen only after first join
+	m.config.Events = &ChannelEventDelegate{ch}
+
+	// Refresh with the same meta
+	a.Incarnation = 2
+	m.aliveNode(&a)
+
+	// Check for no update
+	select {
+	case e := <-ch:
+		t.Fatalf("unexpected event: %v", e)
+	default:
+	}
+}
+
+type conflictDelegate struct {
+	m        *Memberlist
+	existing *Node
+	other    *Node
+	members  int
+}
+
+func (c *conflictDelegate) NotifyConflict(existing, other *Node) {
+	c.existing = existing
+	c.other = other
+	if c.m != nil {
+		c.members = c.m.NumMembers()
+	}
+}
+
+func TestMemberList_AliveNode_Conflict(t *testing.T) {
+	m := GetMemberlist(t)
+	d := &conflictDelegate{m: m}
+	m.config.Conflict = d
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 8000, Incarnation: 1}
+	m.aliveNode(&a)
+
+	// Same name, different address
+	b := alive{Node: "test", Addr: []byte{127, 0, 0, 2}, Port: 9000, Incarnation: 2}
+	m.aliveNode(&b)
+
+	if d.existing == nil || d.other == nil {
+		t.Fatalf("expected conflict notification")
+	}
+	if !bytes.Equal(d.existing.Addr, a.Addr) || d.existing.Port != 8000 {
+		t.Fatalf("bad existing: %v", d.existing)
+	}
+	if !bytes.Equal(d.other.Addr, b.Addr) || d.other.Port != 9000 {
+		t.Fatalf("bad other: %v", d.other)
+	}
+
+	// The delegate can call back into the memberlist
+	if d.members != 1 {
+		t.Fatalf("bad members: %d", d.members)
+	}
+
+	// The existing entry must be untouched
+	state := m.nodeMap["test"]
+	if !bytes.Equal(state.Addr, a.Addr) || state.Incarnation != 1 {
+		t.Fatalf("node should not be overwritten: %v", state)
+	}
+}
+
+func TestMemberList_AliveNode_ConflictPolicy(t *testing.T) {
+	ch := make(chan NodeEvent, 1)
+	m := GetMemberlist(t)
+	d := &conflictDelegate{}
+	m.config.Conflict = d
+	m.config.Events = &ChannelEventDelegate{ch}
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 8000, Incarnation: 1}
+	m.aliveNode(&a)
+	<-ch
+	state := m.nodeMap["test"]
+
+	// Ignored conflicts don't reach the delegate
+	m.config.ConflictPolicy = ConflictIgnore
+	b := alive{Node: "test", Addr: []byte{127, 0, 0, 2}, Port: 9000, Incarnation: 2}
+	m.aliveNode(&b)
+	if d.other != nil || !bytes.Equal(state.Addr, a.Addr) {
+		t.Fatalf("conflict should be ignored: %v %v", d.other, state)
+	}
+
+	// An older or equal incarnation can't move the node
+	m.config.ConflictPolicy = ConflictPreferNewerIncarnation
+	b.Incarnation = 1
+	m.aliveNode(&b)
+	if d.other == nil || !bytes.Equal(state.Addr, a.Addr) {
+		t.Fatalf("conflict should be rejected: %v %v", d.other, state)
+	}
+
+	// A newer one does
+	d.other = nil
+	b.Incarnation = 2
+	m.aliveNode(&b)
+	if d.other != nil {
+		t.Fatalf("unexpected conflict notification")
+	}
+	if !bytes.Equal(state.Addr, b.Addr) || state.Port != 9000 || state.Incarnation != 2 {
+		t.Fatalf("node should have moved: %v", state)
+	}
+	select {
+	case e := <-ch:
+		if e.Event != NodeUpdate || e.Node.Port != 9000 {
+			t.Fatalf("bad event: %v", e)
+		}
+	default:
+		t.Fatalf("expected an update event")
+	}
+
+	// Our own name can't be taken over
+	if err := m.setAlive(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	<-ch
+	self := m.nodeMap[m.config.Name]
+	c := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 3}, Port: 9000, Incarnation: self.Incarnation + 10}
+	m.aliveNode(&c)
+	if bytes.Equal(self.Addr, c.Addr) {
+		t.Fatalf("local node should not have moved: %v", self)
+	}
+}
+
+func TestMemberList_AliveNode_ConflictPolicy_Dead(t *testing.T) {
+	m := GetMemberlist(t)
+	d := &conflictDelegate{}
+	m.config.Conflict = d
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 8000, Incarnation: 10}
+	m.aliveNode(&a)
+	m.deadNode(&dead{Node: "test", Incarnation: 10})
+	state := m.nodeMap["test"]
+
+	// A dead node's name can't be taken over when conflicts are ignored
+	m.config.ConflictPolicy = ConflictIgnore
+	b := alive{Node: "test", Addr: []byte{127, 0, 0, 2}, Port: 9000, Incarnation: 1}
+	m.aliveNode(&b)
+	if d.other != nil || state.State != StateDead || !bytes.Equal(state.Addr, a.Addr) {
+		t.Fatalf("conflict should be ignored: %v %v", d.other, state)
+	}
+
+	// Nor when they are rejected, which raises the alarm
+	m.config.ConflictPolicy = ConflictRejectAndAlert
+	m.aliveNode(&b)
+	if d.other == nil || state.State != StateDead || !bytes.Equal(state.Addr, a.Addr) {
+		t.Fatalf("conflict should be rejected: %v %v", d.other, state)
+	}
+}
+
+// membersEventDelegate calls back into the memberlist from each event
+// to ensure the callbacks are not invoked while holding the nodeLock.
+type membersEventDelegate struct {
+	m      *Memberlist
+	counts []int
+}
+
+func (d *membersEventDelegate) NotifyJoin(n *Node) {
+	d.counts = append(d.counts, d.m.NumMembers())
+}
+
+func (d *membersEventDelegate) NotifyLeave(n *Node) {
+	d.counts = append(d.counts, d.m.NumMembers())
+}
+
+func (d *membersEventDelegate) NotifyUpdate(n *Node) {
+	d.counts = append(d.counts, len(d.m.Members()))
+}
+
+func TestMemberList_Events_NoDeadlock(t *testing.T) {
+	m := GetMemberlist(t)
+	d := &membersEventDelegate{m: m}
+	m.config.Events = d
+
+	// Ensure we don't hang forever
+	timer := time.AfterFunc(time.Second, func() {
+		panic("deadlocked calling back into memberlist")
+	})
+	defer timer.Stop()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a)
+
+	a.Incarnation = 2
+	a.Meta = []byte("val")
+	m.aliveNode(&a)
+
+	dead := dead{Node: "test", Incarnation: 2}
+	m.deadNode(&dead)
+
+	if len(d.counts) != 3 {
+		t.Fatalf("bad: %v", d.counts)
+	}
+	if d.counts[0] != 1 || d.counts[1] != 1 || d.counts[2] != 0 {
+		t.Fatalf("bad: %v", d.counts)
+	}
 }
 
 func TestMemberList_SuspectNode_NoNode(t *testing.T) {
@@ -422,7 +1205,7 @@ func TestMemberList_SuspectNode(t *testing.T) {
 	s := suspect{Node: "test", Incarnation: 1}
 	m.suspectNode(&s)
 
-	if state.State != stateSuspect {
+	if state.State != StateSuspect {
 		t.Fatalf("Bad state")
 	}
 
@@ -444,7 +1227,7 @@ func TestMemberList_SuspectNode(t *testing.T) {
 	// Wait for the timeout
 	time.Sleep(10 * time.Millisecond)
 
-	if state.State != stateDead {
+	if state.State != StateDead {
 		t.Fatalf("Bad state")
 	}
 
@@ -466,6 +1249,54 @@ func TestMemberList_SuspectNode(t *testing.T) {
 	}
 }
 
+func TestMemberList_SuspicionBounds(t *testing.T) {
+	m := &Memberlist{config: &Config{SuspicionMult: 4, ProbeInterval: time.Second}}
+
+	min, max := m.suspicionBounds(9)
+	if min != 2*time.Second || max != 4*time.Second {
+		t.Fatalf("bad: %v %v", min, max)
+	}
+
+	// SuspicionMult becomes the lower bound
+	m.config.SuspicionMaxTimeoutMult = 3
+	min, max = m.suspicionBounds(9)
+	if min != 4*time.Second || max != 12*time.Second {
+		t.Fatalf("bad: %v %v", min, max)
+	}
+}
+
+func TestMemberList_SuspectNode_TimeoutMetric(t *testing.T) {
+	sink := newMockSink()
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	m.config.MetricsSink = sink
+	m.config.ProbeInterval = time.Millisecond
+	m.config.SuspicionMult = 1
+	m.config.SuspicionMaxTimeoutMult = 3
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a)
+
+	// Too few nodes for confirmations, so the maximum is used
+	s := suspect{Node: "test", Incarnation: 1}
+	m.suspectNode(&s)
+	time.Sleep(10 * time.Millisecond)
+
+	m.nodeLock.RLock()
+	state := m.nodeMap["test"]
+	dead := state != nil && state.State == StateDead
+	m.nodeLock.RUnlock()
+	if !dead {
+		t.Fatalf("should be dead: %v", state)
+	}
+
+	sink.Lock()
+	defer sink.Unlock()
+	samples := sink.samples["memberlist.suspect.timeout"]
+	if len(samples) != 1 || samples[0] != 3 {
+		t.Fatalf("bad: %v", samples)
+	}
+}
+
 func TestMemberList_SuspectNode_DoubleSuspect(t *testing.T) {
 	m := GetMemberlist(t)
 	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
@@ -477,7 +1308,7 @@ func TestMemberList_SuspectNode_DoubleSuspect(t *testing.T) {
 	s := suspect{Node: "test", Incarnation: 1}
 	m.suspectNode(&s)
 
-	if state.State != stateSuspect {
+	if state.State != StateSuspect {
 		t.Fatalf("Bad state")
 	}
 
@@ -503,6 +1334,49 @@ func TestMemberList_SuspectNode_DoubleSuspect(t *testing.T) {
 
 }
 
+func TestMemberList_SuspectNode_Confirm(t *testing.T) {
+	m := GetMemberlist(t)
+	m.config.ProbeInterval = 50 * time.Millisecond
+	m.config.SuspicionMult = 4
+	for i, name := range []string{"test", "peer1", "peer2", "peer3"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, byte(i + 1)}, Incarnation: 1}
+		m.aliveNode(&a)
+	}
+
+	state := m.nodeMap["test"]
+	s := suspect{Node: "test", Incarnation: 1, From: "peer1"}
+	m.suspectNode(&s)
+	if state.State != StateSuspect {
+		t.Fatalf("Bad state")
+	}
+
+	// A repeat from the same peer is not a confirmation
+	m.broadcasts.Reset()
+	m.suspectNode(&s)
+	if m.broadcasts.NumQueued() != 0 {
+		t.Fatalf("expected no queued messages")
+	}
+
+	// Independent suspicions are confirmations, and are re-broadcast
+	for _, from := range []string{"peer2", "peer3"} {
+		s := suspect{Node: "test", Incarnation: 1, From: from}
+		m.suspectNode(&s)
+	}
+	if m.broadcasts.NumQueued() != 1 {
+		t.Fatalf("expected queued suspect msg")
+	}
+
+	// With all the confirmations in, the node should be declared dead
+	// after the minimum timeout of 100ms rather than the full 200ms
+	time.Sleep(150 * time.Millisecond)
+	m.nodeLock.RLock()
+	dead := state.State == StateDead
+	m.nodeLock.RUnlock()
+	if !dead {
+		t.Fatalf("Bad state")
+	}
+}
+
 func TestMemberList_SuspectNode_OldSuspect(t *testing.T) {
 	m := GetMemberlist(t)
 	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 10}
@@ -517,7 +1391,7 @@ func TestMemberList_SuspectNode_OldSuspect(t *testing.T) {
 	s := suspect{Node: "test", Incarnation: 1}
 	m.suspectNode(&s)
 
-	if state.State != stateAlive {
+	if state.State != StateAlive {
 		t.Fatalf("Bad state")
 	}
 
@@ -539,7 +1413,7 @@ func TestMemberList_SuspectNode_Refute(t *testing.T) {
 	m.suspectNode(&s)
 
 	state := m.nodeMap[m.config.Name]
-	if state.State != stateAlive {
+	if state.State != StateAlive {
 		t.Fatalf("should still be alive")
 	}
 
@@ -552,6 +1426,11 @@ func TestMemberList_SuspectNode_Refute(t *testing.T) {
 	if messageType(m.broadcasts.bcQueue[0].b.Message()[0]) != aliveMsg {
 		t.Fatalf("expected queued alive msg")
 	}
+
+	// Refuting should hurt our health score
+	if score := m.GetHealthScore(); score != 1 {
+		t.Fatalf("bad: %d", score)
+	}
 }
 
 func TestMemberList_DeadNode_NoNode(t *testing.T) {
@@ -579,7 +1458,7 @@ func TestMemberList_DeadNode(t *testing.T) {
 	d := dead{Node: "test", Incarnation: 1}
 	m.deadNode(&d)
 
-	if state.State != stateDead {
+	if state.State != StateDead {
 		t.Fatalf("Bad state")
 	}
 
@@ -608,6 +1487,100 @@ func TestMemberList_DeadNode(t *testing.T) {
 	}
 }
 
+func TestMemberList_DeadNode_Reason(t *testing.T) {
+	ch := make(chan NodeEvent, 1)
+	m := GetMemberlist(t)
+	m.config.Events = &ChannelEventDelegate{ch}
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a)
+
+	// Read the join event
+	<-ch
+
+	d := dead{Node: "test", Incarnation: 1, Reason: 42}
+	m.deadNode(&d)
+
+	select {
+	case leave := <-ch:
+		if leave.Event != NodeLeave || leave.Node.LeaveReason != 42 {
+			t.Fatalf("bad leave event: %v", leave)
+		}
+	default:
+		t.Fatalf("no leave message")
+	}
+
+	// The reason should be passed on in the re-broadcast
+	var out dead
+	msg := m.broadcasts.bcQueue[0].b.Message()
+	if err := decode(msg[1:], &out); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if out.Reason != 42 {
+		t.Fatalf("bad reason: %d", out.Reason)
+	}
+}
+
+func TestMemberList_DeadNode_Left(t *testing.T) {
+	m := GetMemberlist(t)
+	for i := 1; i <= 3; i++ {
+		a := alive{Node: fmt.Sprintf("test%d", i), Addr: []byte{127, 0, 0, byte(i)}, Incarnation: 1}
+		m.aliveNode(&a)
+	}
+	state1, state2, state3 := m.nodeMap["test1"], m.nodeMap["test2"], m.nodeMap["test3"]
+
+	// A node that announces its own death has left
+	d := dead{Node: "test1", Incarnation: 1, From: "test1"}
+	m.deadNode(&d)
+	if state1.State != StateLeft || state1.State.String() != "left" {
+		t.Fatalf("bad state: %v", state1.State)
+	}
+
+	// One declared dead by another node is dead
+	d = dead{Node: "test2", Incarnation: 1, From: "test3"}
+	m.deadNode(&d)
+	if state2.State != StateDead {
+		t.Fatalf("bad state: %v", state2.State)
+	}
+
+	// A push/pull that says a node left is believed straight away
+	m.mergeState([]pushNodeState{{Name: "test3", Addr: []byte{127, 0, 0, 3}, Incarnation: 1, State: StateLeft}})
+	if state3.State != StateLeft {
+		t.Fatalf("bad state: %v", state3.State)
+	}
+	if n := m.NumMembers(); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestMemberList_DeadNode_LeaveCause(t *testing.T) {
+	ch := make(chan NodeEvent, 1)
+	m := GetMemberlist(t)
+	m.config.Events = &ChannelEventDelegate{ch}
+
+	cases := []struct {
+		node  string
+		from  string
+		cause LeaveCause
+	}{
+		{"test1", "test1", LeaveCauseLeft},
+		{"test2", m.config.Name, LeaveCauseSuspicionTimeout},
+		{"test3", "other", LeaveCauseDeclaredDead},
+		{"test4", "", LeaveCauseDeclaredDead},
+	}
+	for i, tc := range cases {
+		a := alive{Node: tc.node, Addr: []byte{127, 0, 0, byte(i + 1)}, Incarnation: 1}
+		m.aliveNode(&a)
+		<-ch
+
+		d := dead{Node: tc.node, Incarnation: 1, From: tc.from}
+		m.deadNode(&d)
+		leave := <-ch
+		if leave.Event != NodeLeave || leave.Node.LeaveCause != tc.cause {
+			t.Fatalf("%d: expected %v, got %v", i, tc.cause, leave.Node.LeaveCause)
+		}
+	}
+}
+
 func TestMemberList_DeadNode_Double(t *testing.T) {
 	ch := make(chan NodeEvent, 1)
 	m := GetMemberlist(t)
@@ -653,7 +1626,7 @@ func TestMemberList_DeadNode_OldDead(t *testing.T) {
 	d := dead{Node: "test", Incarnation: 1}
 	m.deadNode(&d)
 
-	if state.State != stateAlive {
+	if state.State != StateAlive {
 		t.Fatalf("Bad state")
 	}
 }
@@ -670,7 +1643,7 @@ func TestMemberList_DeadNode_Refute(t *testing.T) {
 	m.deadNode(&d)
 
 	state := m.nodeMap[m.config.Name]
-	if state.State != stateAlive {
+	if state.State != StateAlive {
 		t.Fatalf("should still be alive")
 	}
 
@@ -683,6 +1656,68 @@ func TestMemberList_DeadNode_Refute(t *testing.T) {
 	if messageType(m.broadcasts.bcQueue[0].b.Message()[0]) != aliveMsg {
 		t.Fatalf("expected queued alive msg")
 	}
+
+	// Refuting should hurt our health score
+	if score := m.GetHealthScore(); score != 1 {
+		t.Fatalf("bad: %d", score)
+	}
+}
+
+// mockRefuteDelegate records the calls it gets, calling back into the
+// memberlist to check that no locks are held.
+type mockRefuteDelegate struct {
+	m     *Memberlist
+	calls []string
+}
+
+func (d *mockRefuteDelegate) NotifySelfSuspected() {
+	d.m.Members()
+	d.calls = append(d.calls, "suspected")
+}
+
+func (d *mockRefuteDelegate) NotifySelfRefuted() {
+	d.m.Members()
+	d.calls = append(d.calls, "refuted")
+}
+
+func TestMemberList_RefuteDelegate(t *testing.T) {
+	m := GetMemberlist(t)
+	d := &mockRefuteDelegate{m: m}
+	m.config.Refute = d
+	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a)
+
+	// Suspicions about other nodes aren't reported
+	o := alive{Node: "test", Addr: []byte{127, 0, 0, 2}, Incarnation: 1}
+	m.aliveNode(&o)
+	os := suspect{Node: "test", Incarnation: 1}
+	m.suspectNode(&os)
+	if len(d.calls) != 0 {
+		t.Fatalf("bad: %v", d.calls)
+	}
+
+	s := suspect{Node: m.config.Name, Incarnation: 1}
+	m.suspectNode(&s)
+	expected := []string{"suspected", "refuted"}
+	if !reflect.DeepEqual(d.calls, expected) {
+		t.Fatalf("bad: %v", d.calls)
+	}
+
+	dm := dead{Node: m.config.Name, Incarnation: m.nodeMap[m.config.Name].Incarnation}
+	m.deadNode(&dm)
+	expected = append(expected, "suspected", "refuted")
+	if !reflect.DeepEqual(d.calls, expected) {
+		t.Fatalf("bad: %v", d.calls)
+	}
+
+	// A death isn't refuted while we are leaving
+	m.leave = 1
+	dm = dead{Node: m.config.Name, Incarnation: m.nodeMap[m.config.Name].Incarnation}
+	m.deadNode(&dm)
+	expected = append(expected, "suspected")
+	if !reflect.DeepEqual(d.calls, expected) {
+		t.Fatalf("bad: %v", d.calls)
+	}
 }
 
 func TestMemberList_MergeState(t *testing.T) {
@@ -702,25 +1737,25 @@ func TestMemberList_MergeState(t *testing.T) {
 			Name:        "test1",
 			Addr:        []byte{127, 0, 0, 1},
 			Incarnation: 2,
-			State:       stateAlive,
+			State:       StateAlive,
 		},
 		pushNodeState{
 			Name:        "test2",
 			Addr:        []byte{127, 0, 0, 2},
 			Incarnation: 1,
-			State:       stateSuspect,
+			State:       StateSuspect,
 		},
 		pushNodeState{
 			Name:        "test3",
 			Addr:        []byte{127, 0, 0, 3},
 			Incarnation: 1,
-			State:       stateDead,
+			State:       StateDead,
 		},
 		pushNodeState{
 			Name:        "test4",
 			Addr:        []byte{127, 0, 0, 4},
 			Incarnation: 2,
-			State:       stateAlive,
+			State:       StateAlive,
 		},
 	}
 
@@ -733,22 +1768,22 @@ func TestMemberList_MergeState(t *testing.T) {
 
 	// Check the states
 	state := m.nodeMap["test1"]
-	if state.State != stateAlive || state.Incarnation != 2 {
+	if state.State != StateAlive || state.Incarnation != 2 {
 		t.Fatalf("Bad state %v", state)
 	}
 
 	state = m.nodeMap["test2"]
-	if state.State != stateSuspect || state.Incarnation != 1 {
+	if state.State != StateSuspect || state.Incarnation != 1 {
 		t.Fatalf("Bad state %v", state)
 	}
 
 	state = m.nodeMap["test3"]
-	if state.State != stateSuspect {
+	if state.State != StateSuspect {
 		t.Fatalf("Bad state %v", state)
 	}
 
 	state = m.nodeMap["test4"]
-	if state.State != stateAlive || state.Incarnation != 2 {
+	if state.State != StateAlive || state.Incarnation != 2 {
 		t.Fatalf("Bad state %v", state)
 	}
 
@@ -807,6 +1842,76 @@ func TestMemberlist_Gossip(t *testing.T) {
 	}
 }
 
+func TestMemberlist_GossipNodes(t *testing.T) {
+	var network mockNetwork
+	t1, port1 := network.newTransport()
+	m1 := HostMemberlist("127.0.0.1", t, func(c *Config) {
+		c.Name = "m1"
+		c.Port = port1
+		c.Transport = t1
+		c.GossipNodes = 2
+	})
+	defer m1.Shutdown()
+
+	// Add some peers that just collect whatever they are sent
+	var peers []*mockTransport
+	for i := 0; i < 5; i++ {
+		tr, port := network.newTransport()
+		peers = append(peers, tr)
+		a := alive{Node: fmt.Sprintf("peer%d", i), Addr: []byte{127, 0, 0, 1},
+			Port: uint16(port), Incarnation: 1}
+		m1.aliveNode(&a)
+	}
+
+	// Gossip should only go to GossipNodes of the peers
+	m1.gossip()
+
+	reached := 0
+	for _, tr := range peers {
+		select {
+		case <-tr.packetCh:
+			reached++
+		default:
+		}
+	}
+	if reached != 2 {
+		t.Fatalf("expected gossip to 2 nodes, got %d", reached)
+	}
+}
+
+func TestMemberlist_Rand(t *testing.T) {
+	// Two memberlists with the same seed and the same history should make
+	// the same random choices
+	var orders [2][]string
+	var picks [2][]string
+	for i := range orders {
+		m := HostMemberlist(getBindAddr().String(), t, func(c *Config) {
+			c.Rand = rand.NewSource(42)
+		})
+		defer m.Shutdown()
+
+		for j := 0; j < 10; j++ {
+			a := alive{Node: fmt.Sprintf("test%d", j), Addr: []byte{127, 0, 0, byte(j + 1)}, Incarnation: 1}
+			m.aliveNode(&a)
+		}
+		m.resetNodes()
+
+		for _, n := range m.nodes {
+			orders[i] = append(orders[i], n.Name)
+		}
+		for _, n := range kRandomNodes(m.rng, 3, nil, m.nodes) {
+			picks[i] = append(picks[i], n.Name)
+		}
+	}
+
+	if !reflect.DeepEqual(orders[0], orders[1]) {
+		t.Fatalf("probe order differs: %v %v", orders[0], orders[1])
+	}
+	if !reflect.DeepEqual(picks[0], picks[1]) {
+		t.Fatalf("picks differ: %v %v", picks[0], picks[1])
+	}
+}
+
 func TestMemberlist_PushPull(t *testing.T) {
 	addr1 := getBindAddr()
 	addr2 := getBindAddr()
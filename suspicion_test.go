@@ -0,0 +1,86 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSuspicion_remainingSuspicionTime(t *testing.T) {
+	cases := []struct {
+		n        int32
+		k        int32
+		elapsed  time.Duration
+		min      time.Duration
+		max      time.Duration
+		expected time.Duration
+	}{
+		{0, 3, 0, 2 * time.Second, 30 * time.Second, 30 * time.Second},
+		{1, 3, 2 * time.Second, 2 * time.Second, 30 * time.Second, 14 * time.Second},
+		{2, 3, 3 * time.Second, 2 * time.Second, 30 * time.Second, 4810 * time.Millisecond},
+		{3, 3, 4 * time.Second, 2 * time.Second, 30 * time.Second, -2 * time.Second},
+		{4, 3, 5 * time.Second, 2 * time.Second, 30 * time.Second, -3 * time.Second},
+		{5, 3, 10 * time.Second, 2 * time.Second, 30 * time.Second, -8 * time.Second},
+		{0, 0, time.Second, 2 * time.Second, 30 * time.Second, time.Second},
+	}
+	for i, c := range cases {
+		remaining := remainingSuspicionTime(c.n, c.k, c.elapsed, c.min, c.max)
+		if remaining != c.expected {
+			t.Fatalf("case %d: remaining %v != expected %v", i, remaining, c.expected)
+		}
+	}
+}
+
+func TestSuspicion_Confirm(t *testing.T) {
+	const k = 2
+	const min = 50 * time.Millisecond
+	const max = 500 * time.Millisecond
+
+	fired := make(chan int, 1)
+	f := func(n int, timeout time.Duration) {
+		fired <- n
+	}
+	s := newSuspicion("me", k, min, max, f)
+
+	// Our own suspicion and repeats don't count
+	if s.Confirm("me") {
+		t.Fatalf("should not confirm from self")
+	}
+	if !s.Confirm("foo") {
+		t.Fatalf("should confirm")
+	}
+	if s.Confirm("foo") {
+		t.Fatalf("should not confirm twice")
+	}
+	if !s.Confirm("bar") {
+		t.Fatalf("should confirm")
+	}
+
+	// Once we have k confirmations no more are accepted
+	if s.Confirm("baz") {
+		t.Fatalf("should not confirm past k")
+	}
+
+	select {
+	case n := <-fired:
+		if n != k {
+			t.Fatalf("bad confirmations: %d", n)
+		}
+	case <-time.After(max / 2):
+		t.Fatalf("should have fired at the min timeout")
+	}
+}
+
+func TestSuspicion_Stop(t *testing.T) {
+	fired := make(chan struct{}, 1)
+	f := func(int, time.Duration) {
+		fired <- struct{}{}
+	}
+	s := newSuspicion("me", 0, 10*time.Millisecond, 10*time.Millisecond, f)
+	s.Stop()
+
+	select {
+	case <-fired:
+		t.Fatalf("should not have fired")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
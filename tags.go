@@ -0,0 +1,63 @@
+package memberlist
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ugorji/go/codec"
+)
+
+// tagsMagic marks node meta data that holds encoded tags, so it can be
+// told apart from meta data in other formats.
+const tagsMagic byte = 0xfa
+
+// EncodeTags encodes a map of tags into node meta data, for a Delegate to
+// return from NodeMeta. Tags give nodes a standard key/value layer over
+// the otherwise opaque meta data, which any library in the cluster can
+// read with DecodeTags or GetNodeTags. An error is returned if the
+// encoded tags don't fit in the 128 bytes allowed for meta data.
+func EncodeTags(tags map[string]string) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(tagsMagic)
+	hd := codec.MsgpackHandle{}
+	enc := codec.NewEncoder(buf, &hd)
+	if err := enc.Encode(tags); err != nil {
+		return nil, err
+	}
+
+	if buf.Len() > metaMaxSize {
+		return nil, fmt.Errorf("Encoded tags are %d bytes, the maximum is %d",
+			buf.Len(), metaMaxSize)
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeTags decodes node meta data created with EncodeTags. An error is
+// returned if the meta data holds something else.
+func DecodeTags(meta []byte) (map[string]string, error) {
+	if len(meta) == 0 || meta[0] != tagsMagic {
+		return nil, fmt.Errorf("Meta data does not hold tags")
+	}
+
+	var tags map[string]string
+	if err := decode(meta[1:], &tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// GetNodeTags returns the tags of the live node with the given name, as
+// encoded into its meta data with EncodeTags. It returns false if there
+// is no such node or its meta data doesn't hold tags.
+func (m *Memberlist) GetNodeTags(name string) (map[string]string, bool) {
+	n, ok := m.GetNode(name)
+	if !ok {
+		return nil, false
+	}
+
+	tags, err := DecodeTags(n.Meta)
+	if err != nil {
+		return nil, false
+	}
+	return tags, true
+}
@@ -0,0 +1,63 @@
+package memberlist
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTags_EncodeDecode(t *testing.T) {
+	tags := map[string]string{"role": "web", "dc": "east"}
+	meta, err := EncodeTags(tags)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	out, err := DecodeTags(meta)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(out, tags) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Meta data in some other format is not mistaken for tags
+	if _, err := DecodeTags([]byte("web")); err == nil {
+		t.Fatalf("expected err")
+	}
+	if _, err := DecodeTags(nil); err == nil {
+		t.Fatalf("expected err")
+	}
+}
+
+func TestTags_TooLarge(t *testing.T) {
+	tags := map[string]string{"big": strings.Repeat("x", metaMaxSize)}
+	if _, err := EncodeTags(tags); err == nil {
+		t.Fatalf("expected err")
+	}
+}
+
+func TestMemberlist_GetNodeTags(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	meta, err := EncodeTags(map[string]string{"role": "db"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Meta: meta, Incarnation: 1}
+	m.aliveNode(&a)
+	b := alive{Node: "other", Addr: []byte{127, 0, 0, 2}, Meta: []byte("raw"), Incarnation: 1}
+	m.aliveNode(&b)
+
+	tags, ok := m.GetNodeTags("test")
+	if !ok || tags["role"] != "db" {
+		t.Fatalf("bad: %v %v", tags, ok)
+	}
+	if _, ok := m.GetNodeTags("other"); ok {
+		t.Fatalf("should not decode raw meta")
+	}
+	if _, ok := m.GetNodeTags("missing"); ok {
+		t.Fatalf("should not find node")
+	}
+}
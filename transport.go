@@ -0,0 +1,100 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// TransportMode selects which halves of the transport memberlist uses: the
+// packet interface, which is UDP for a NetTransport, and the stream
+// interface, which is TCP.
+type TransportMode int
+
+const (
+	// TransportUDPAndTCP uses both packets and streams. This is the
+	// default.
+	TransportUDPAndTCP TransportMode = iota
+
+	// TransportUDPOnly uses only packets. Push/pull state syncs, and so
+	// Join, as well as SendToTCP are disabled. The cluster converges
+	// through gossip alone, and nodes have to be introduced to each other
+	// with LoadState instead of Join.
+	TransportUDPOnly
+
+	// TransportTCPOnly uses only streams. Probing and gossip are disabled,
+	// so failed nodes are not detected, and state only spreads through
+	// push/pull syncs.
+	TransportTCPOnly
+)
+
+// udp returns whether packets may be used in this mode
+func (t TransportMode) udp() bool {
+	return t != TransportTCPOnly
+}
+
+// tcp returns whether streams may be used in this mode
+func (t TransportMode) tcp() bool {
+	return t != TransportUDPOnly
+}
+
+var (
+	// ErrUDPDisabled is returned when sending a packet while the transport
+	// mode is TransportTCPOnly.
+	ErrUDPDisabled = fmt.Errorf("UDP is disabled by the transport mode")
+
+	// ErrTCPDisabled is returned when opening a stream while the transport
+	// mode is TransportUDPOnly.
+	ErrTCPDisabled = fmt.Errorf("TCP is disabled by the transport mode")
+)
+
+// Packet is used to provide some metadata about incoming packets from peers
+// over a packet connection, as well as the packet payload.
+type Packet struct {
+	// Buf has the raw contents of the packet.
+	Buf []byte
+
+	// From has the address of the peer. This is an actual net.Addr so we
+	// can expose some concrete details about incoming packets.
+	From net.Addr
+
+	// Timestamp is the time when the packet was received. This should be
+	// taken as close as possible to the actual receipt time to help make an
+	// accurate RTT measurement during probes.
+	Timestamp time.Time
+}
+
+// Transport is used to abstract over communicating with other peers. The packet
+// interface is assumed to be best-effort and the stream interface is assumed to
+// be reliable. By default memberlist uses a NetTransport which sends packets
+// over UDP and streams over TCP, but a custom Transport can be provided in the
+// Config to run over an in-memory network or some other datagram layer.
+type Transport interface {
+	// LocalAddr returns the address this transport is bound to. It is used
+	// to determine the address to advertise to other nodes when the
+	// configured BindAddr is not a wildcard address.
+	LocalAddr() net.Addr
+
+	// WriteTo is a packet-oriented interface that fires off the given
+	// payload to the given address in a connectionless fashion.
+	WriteTo(b []byte, addr string) error
+
+	// PacketCh returns a channel that can be read to receive incoming
+	// packets from other peers.
+	PacketCh() <-chan *Packet
+
+	// DialTimeout is used to create a connection that allows us to perform
+	// two-way communication with a peer. This is generally more expensive
+	// than packet connections so is used for more infrequent operations
+	// such as anti-entropy or fallback probes if the packet-oriented probe
+	// failed.
+	DialTimeout(addr string, timeout time.Duration) (net.Conn, error)
+
+	// StreamCh returns a channel that can be read to handle incoming stream
+	// connections from other peers.
+	StreamCh() <-chan net.Conn
+
+	// Shutdown is called when memberlist is shutting down; this gives the
+	// transport a chance to clean up any listeners.
+	Shutdown() error
+}
@@ -0,0 +1,184 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockNetwork is an in-memory network that connects mockTransports
+// together, keyed by their "ip:port" address.
+type mockNetwork struct {
+	sync.Mutex
+	transports map[string]*mockTransport
+	port       int
+}
+
+// newTransport returns a new transport attached to the network along
+// with the port it was assigned.
+func (n *mockNetwork) newTransport() (*mockTransport, int) {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.transports == nil {
+		n.transports = make(map[string]*mockTransport)
+		n.port = 20000
+	}
+	n.port++
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: n.port}
+	t := &mockTransport{
+		net:      n,
+		addr:     addr,
+		packetCh: make(chan *Packet, 64),
+		streamCh: make(chan net.Conn),
+	}
+	n.transports[addr.String()] = t
+	return t, n.port
+}
+
+func (n *mockNetwork) lookup(addr string) (*mockTransport, error) {
+	n.Lock()
+	defer n.Unlock()
+
+	t, ok := n.transports[addr]
+	if !ok {
+		return nil, fmt.Errorf("No route to %q", addr)
+	}
+	return t, nil
+}
+
+// mockTransport is a Transport that delivers packets and streams over
+// a mockNetwork without touching any sockets.
+type mockTransport struct {
+	net      *mockNetwork
+	addr     *net.TCPAddr
+	packetCh chan *Packet
+	streamCh chan net.Conn
+}
+
+func (t *mockTransport) LocalAddr() net.Addr {
+	return t.addr
+}
+
+func (t *mockTransport) WriteTo(b []byte, addr string) error {
+	dest, err := t.net.lookup(addr)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	from := &net.UDPAddr{IP: t.addr.IP, Port: t.addr.Port}
+	dest.packetCh <- &Packet{Buf: buf, From: from, Timestamp: time.Now()}
+	return nil
+}
+
+func (t *mockTransport) PacketCh() <-chan *Packet {
+	return t.packetCh
+}
+
+func (t *mockTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	dest, err := t.net.lookup(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	local, remote := net.Pipe()
+	select {
+	case dest.streamCh <- remote:
+		return local, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("Timeout dialing %q", addr)
+	}
+}
+
+func (t *mockTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+func (t *mockTransport) Shutdown() error {
+	return nil
+}
+
+func TestTransport_Join(t *testing.T) {
+	var network mockNetwork
+
+	t1, port1 := network.newTransport()
+	c1 := DefaultLANConfig()
+	c1.Name = "node1"
+	c1.BindAddr = "127.0.0.1"
+	c1.Port = port1
+	c1.Transport = t1
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	t2, port2 := network.newTransport()
+	c2 := DefaultLANConfig()
+	c2.Name = "node2"
+	c2.BindAddr = "127.0.0.1"
+	c2.Port = port2
+	c2.Transport = t2
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+
+	num, err := m2.Join([]string{t1.addr.String()})
+	if num != 1 {
+		t.Fatalf("bad: %d", num)
+	}
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if len(m2.Members()) != 2 {
+		t.Fatalf("bad: %v", m2.Members())
+	}
+	if len(m1.Members()) != 2 {
+		t.Fatalf("bad: %v", m1.Members())
+	}
+
+	// Make sure the nodes can also reach each other over packets
+	ackCh := make(chan ackMessage, 1)
+	seqNo := m2.nextSeqNo()
+	m2.setAckChannel(seqNo, ackCh, time.Second)
+	ping := ping{SeqNo: seqNo}
+	if err := m2.encodeAndSendMsg(t1.addr, pingMsg, &ping); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if v := <-ackCh; !v.Complete {
+		t.Fatalf("timed out waiting for ack")
+	}
+}
+
+func TestTransport_PortZero(t *testing.T) {
+	var network mockNetwork
+
+	// The port a custom transport is bound to is advertised if any free
+	// one was asked for
+	t1, port1 := network.newTransport()
+	c1 := DefaultLANConfig()
+	c1.Name = "node1"
+	c1.BindAddr = "127.0.0.1"
+	c1.Port = 0
+	c1.Transport = t1
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	if c1.Port != port1 {
+		t.Fatalf("bad port: %d", c1.Port)
+	}
+	if n := m1.LocalNode(); n.Port != uint16(port1) {
+		t.Fatalf("bad node port: %d", n.Port)
+	}
+}
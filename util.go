@@ -2,6 +2,7 @@ package memberlist
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/lzw"
 	"encoding/binary"
 	"fmt"
@@ -10,6 +11,10 @@ import (
 	"math"
 	"math/rand"
 	"net"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,11 +25,16 @@ import (
 // while the 65th will triple it.
 const pushPullScaleThreshold = 32
 
+// probeScaleNodes is the cluster size at which the adaptive probe interval
+// is the configured ProbeInterval.
+const probeScaleNodes = 32
+
 /*
  * Contains an entry for each private block:
  * 10.0.0.0/8
  * 172.16.0.0/12
  * 192.168/16
+ * fc00::/7 (IPv6 unique local addresses)
  */
 var privateBlocks []*net.IPNet
 
@@ -40,7 +50,7 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 
 	// Add each private block
-	privateBlocks = make([]*net.IPNet, 3)
+	privateBlocks = make([]*net.IPNet, 4)
 	_, block, err := net.ParseCIDR("10.0.0.0/8")
 	if err != nil {
 		panic(fmt.Sprintf("Bad cidr. Got %v", err))
@@ -59,6 +69,12 @@ func init() {
 	}
 	privateBlocks[2] = block
 
+	_, block, err = net.ParseCIDR("fc00::/7")
+	if err != nil {
+		panic(fmt.Sprintf("Bad cidr. Got %v", err))
+	}
+	privateBlocks[3] = block
+
 	_, block, err = net.ParseCIDR("127.0.0.0/8")
 	if err != nil {
 		panic(fmt.Sprintf("Bad cidr. Got %v", err))
@@ -84,12 +100,40 @@ func encode(msgType messageType, in interface{}) (*bytes.Buffer, error) {
 	return buf, err
 }
 
+// lockedSource is a rand.Source that is safe for concurrent use
+type lockedSource struct {
+	sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.src.Seed(seed)
+}
+
+// newRand returns a random number generator drawing from the given
+// source, or from one seeded with the current time if it is nil. The
+// generator is safe for concurrent use.
+func newRand(src rand.Source) *rand.Rand {
+	if src == nil {
+		src = rand.NewSource(time.Now().UnixNano())
+	}
+	return rand.New(&lockedSource{src: src})
+}
+
 // Returns a random offset between 0 and n
-func randomOffset(n int) int {
+func randomOffset(r *rand.Rand, n int) int {
 	if n == 0 {
 		return 0
 	}
-	return int(rand.Uint32() % uint32(n))
+	return int(r.Uint32() % uint32(n))
 }
 
 // suspicionTimeout computes the timeout that should be used when
@@ -108,9 +152,9 @@ func retransmitLimit(retransmitMult, n int) int {
 }
 
 // shuffleNodes randomly shuffles the input nodes
-func shuffleNodes(nodes []*nodeState) {
+func shuffleNodes(r *rand.Rand, nodes []*nodeState) {
 	for i := range nodes {
-		j := rand.Intn(i + 1)
+		j := r.Intn(i + 1)
 		nodes[i], nodes[j] = nodes[j], nodes[i]
 	}
 }
@@ -128,13 +172,36 @@ func pushPullScale(interval time.Duration, n int) time.Duration {
 	return time.Duration(multiplier) * interval
 }
 
-// moveDeadNodes moves all the nodes in the dead state
-// to the end of the slice and returns the index of the first dead node.
-func moveDeadNodes(nodes []*nodeState) int {
+// probeIntervalScale is used to scale the probe interval with the cluster
+// size. Clusters smaller than probeScaleNodes probe less often and larger
+// ones more often, by the ratio of log(probeScaleNodes+1) to log(n+1).
+func probeIntervalScale(interval time.Duration, n int) time.Duration {
+	if n < 1 {
+		n = 1
+	}
+	factor := math.Log(probeScaleNodes+1) / math.Log(float64(n)+1)
+	return time.Duration(factor * float64(interval))
+}
+
+// moveDeadNodes moves all the nodes that have been in the dead state for
+// longer than gossipToTheDeadTime to the end of the slice and returns the
+// index of the first such node. If shouldReap is given, only the nodes it
+// agrees to are moved.
+func moveDeadNodes(nodes []*nodeState, gossipToTheDeadTime time.Duration,
+	shouldReap func(*nodeState, time.Duration) bool) int {
 	numDead := 0
 	n := len(nodes)
 	for i := 0; i < n-numDead; i++ {
-		if nodes[i].State != stateDead {
+		if !nodes[i].deadOrLeft() {
+			continue
+		}
+
+		// Keep recently dead nodes so their death is still passed on
+		deadFor := time.Since(nodes[i].StateChange)
+		if deadFor <= gossipToTheDeadTime {
+			continue
+		}
+		if shouldReap != nil && !shouldReap(nodes[i], deadFor) {
 			continue
 		}
 
@@ -148,7 +215,7 @@ func moveDeadNodes(nodes []*nodeState) int {
 
 // kRandomNodes is used to select up to k random nodes, excluding a given
 // node and any non-alive nodes. It is possible that less than k nodes are returned.
-func kRandomNodes(k int, excludes []string, nodes []*nodeState) []*nodeState {
+func kRandomNodes(r *rand.Rand, k int, excludes []string, nodes []*nodeState) []*nodeState {
 	n := len(nodes)
 	kNodes := make([]*nodeState, 0, k)
 OUTER:
@@ -157,7 +224,7 @@ OUTER:
 	// exhaustive
 	for i := 0; i < 3*n && len(kNodes) < k; i++ {
 		// Get random node
-		idx := randomOffset(n)
+		idx := randomOffset(r, n)
 		node := nodes[idx]
 
 		// Exclude node if match
@@ -168,7 +235,7 @@ OUTER:
 		}
 
 		// Exclude if not alive
-		if node.State != stateAlive {
+		if node.State != StateAlive {
 			continue
 		}
 
@@ -263,14 +330,81 @@ func isPrivateIP(ip_str string) bool {
 // Returns if the given IP is in a loopback block
 func isLoopbackIP(ip_str string) bool {
 	ip := net.ParseIP(ip_str)
-	return loopbackBlock.Contains(ip)
+	return loopbackBlock.Contains(ip) || ip.Equal(net.IPv6loopback)
+}
+
+// findPrivateIP returns the first private IPv4 address among the given
+// interface addresses. If there is none, it falls back to the first
+// private (unique local) IPv6 address, which is returned in its 16-byte
+// form. Link-local addresses are never used since their zone cannot be
+// advertised to other nodes. Returns nil if no suitable address exists.
+func findPrivateIP(addresses []net.Addr) net.IP {
+	// Find private IPv4 address
+	for _, addr := range addresses {
+		ip, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip.IP.To4() == nil {
+			continue
+		}
+		if !isPrivateIP(ip.IP.String()) {
+			continue
+		}
+		return ip.IP
+	}
+
+	// Fall back to a private IPv6 address
+	for _, addr := range addresses {
+		ip, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip.IP.To4() != nil || ip.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if !isPrivateIP(ip.IP.String()) {
+			continue
+		}
+		return ip.IP.To16()
+	}
+	return nil
+}
+
+// findIPInNet returns the first of the given interface addresses within
+// ipnet, skipping link-local addresses, or nil if there is none. IPv4
+// addresses are returned in their 4-byte form.
+func findIPInNet(addresses []net.Addr, ipnet *net.IPNet) net.IP {
+	for _, addr := range addresses {
+		ip, ok := addr.(*net.IPNet)
+		if !ok || ip.IP.IsLinkLocalUnicast() || !ipnet.Contains(ip.IP) {
+			continue
+		}
+		if ip4 := ip.IP.To4(); ip4 != nil {
+			return ip4
+		}
+		return ip.IP.To16()
+	}
+	return nil
 }
 
-// compressPayload takes an opaque input buffer, compresses it
-// and wraps it in a compress{} message that is encoded.
-func compressPayload(inp []byte) (*bytes.Buffer, error) {
+// compressPayload takes an opaque input buffer, compresses it with the
+// given algorithm and wraps it in a compress{} message that is encoded.
+func compressPayload(algo CompressionType, inp []byte) (*bytes.Buffer, error) {
 	var buf bytes.Buffer
-	compressor := lzw.NewWriter(&buf, lzw.LSB, lzwLitWidth)
+	var compressor io.WriteCloser
+	switch algo {
+	case CompressionLZW:
+		compressor = lzw.NewWriter(&buf, lzw.LSB, lzwLitWidth)
+	case CompressionFlate:
+		var err error
+		compressor, err = flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Cannot compress with unknown algorithm %d", algo)
+	}
 
 	_, err := compressor.Write(inp)
 	if err != nil {
@@ -284,7 +418,7 @@ func compressPayload(inp []byte) (*bytes.Buffer, error) {
 
 	// Create a compressed message
 	c := compress{
-		Algo: lzwAlgo,
+		Algo: algo,
 		Buf:  buf.Bytes(),
 	}
 	return encode(compressMsg, &c)
@@ -304,13 +438,16 @@ func decompressPayload(msg []byte) ([]byte, error) {
 // decompressBuffer is used to decompress the buffer of
 // a single compress message, handling multiple algorithms
 func decompressBuffer(c *compress) ([]byte, error) {
-	// Verify the algorithm
-	if c.Algo != lzwAlgo {
+	// Create a uncompressor for the algorithm
+	var uncomp io.ReadCloser
+	switch c.Algo {
+	case CompressionLZW:
+		uncomp = lzw.NewReader(bytes.NewReader(c.Buf), lzw.LSB, lzwLitWidth)
+	case CompressionFlate:
+		uncomp = flate.NewReader(bytes.NewReader(c.Buf))
+	default:
 		return nil, fmt.Errorf("Cannot decompress unknown algorithm %d", c.Algo)
 	}
-
-	// Create a uncompressor
-	uncomp := lzw.NewReader(bytes.NewReader(c.Buf), lzw.LSB, lzwLitWidth)
 	defer uncomp.Close()
 
 	// Read all the data
@@ -323,3 +460,35 @@ func decompressBuffer(c *compress) ([]byte, error) {
 	// Return the uncompressed bytes
 	return b.Bytes(), nil
 }
+
+// memberlistMethodPrefix is what the names of the methods of Memberlist,
+// and of the closures within them, start with
+var memberlistMethodPrefix = reflect.TypeOf((*Memberlist)(nil)).Elem().PkgPath() + ".(*Memberlist)."
+
+// onMemberlistGoroutine returns whether the caller is running on one of
+// the goroutines a Memberlist starts, as it is when a delegate callback
+// calls back into it. It looks at the function the goroutine started in.
+func onMemberlistGoroutine() bool {
+	pcs := make([]uintptr, 64)
+	for {
+		n := runtime.Callers(1, pcs)
+		if n < len(pcs) {
+			pcs = pcs[:n]
+			break
+		}
+		pcs = make([]uintptr, 2*len(pcs))
+	}
+
+	var start string
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		if frame.Function != "runtime.goexit" {
+			start = frame.Function
+		}
+		if !more {
+			break
+		}
+	}
+	return strings.HasPrefix(start, memberlistMethodPrefix)
+}
@@ -2,6 +2,8 @@ package memberlist
 
 import (
 	"fmt"
+	"math"
+	"net"
 	"reflect"
 	"testing"
 	"time"
@@ -25,7 +27,7 @@ func TestEncodeDecode(t *testing.T) {
 func TestRandomOffset(t *testing.T) {
 	vals := make(map[int]struct{})
 	for i := 0; i < 100; i++ {
-		offset := randomOffset(2 << 30)
+		offset := randomOffset(newRand(nil), 2<<30)
 		if _, ok := vals[offset]; ok {
 			t.Fatalf("got collision")
 		}
@@ -34,7 +36,7 @@ func TestRandomOffset(t *testing.T) {
 }
 
 func TestRandomOffset_Zero(t *testing.T) {
-	offset := randomOffset(0)
+	offset := randomOffset(newRand(nil), 0)
 	if offset != 0 {
 		t.Fatalf("bad offset")
 	}
@@ -65,28 +67,28 @@ func TestRetransmitLimit(t *testing.T) {
 func TestShuffleNodes(t *testing.T) {
 	orig := []*nodeState{
 		&nodeState{
-			State: stateDead,
+			State: StateDead,
 		},
 		&nodeState{
-			State: stateAlive,
+			State: StateAlive,
 		},
 		&nodeState{
-			State: stateAlive,
+			State: StateAlive,
 		},
 		&nodeState{
-			State: stateDead,
+			State: StateDead,
 		},
 		&nodeState{
-			State: stateAlive,
+			State: StateAlive,
 		},
 		&nodeState{
-			State: stateAlive,
+			State: StateAlive,
 		},
 		&nodeState{
-			State: stateDead,
+			State: StateDead,
 		},
 		&nodeState{
-			State: stateAlive,
+			State: StateAlive,
 		},
 	}
 	nodes := make([]*nodeState, len(orig))
@@ -96,7 +98,7 @@ func TestShuffleNodes(t *testing.T) {
 		t.Fatalf("should match")
 	}
 
-	shuffleNodes(nodes)
+	shuffleNodes(newRand(nil), nodes)
 
 	if reflect.DeepEqual(nodes, orig) {
 		t.Fatalf("should not match")
@@ -120,38 +122,80 @@ func TestPushPullScale(t *testing.T) {
 			t.Fatalf("Bad time scale: %v", s)
 		}
 	}
+	for i := 513; i <= 1024; i++ {
+		if s := pushPullScale(sec, i); s != 6*sec {
+			t.Fatalf("Bad time scale: %v", s)
+		}
+	}
+}
+
+func TestProbeIntervalScale(t *testing.T) {
+	sec := time.Second
+	if s := probeIntervalScale(sec, probeScaleNodes); s != sec {
+		t.Fatalf("Bad time scale: %v", s)
+	}
+
+	// Smaller clusters probe less often, larger ones more often
+	last := time.Duration(math.MaxInt64)
+	for _, n := range []int{0, 1, 3, 10, 32, 100, 1000, 10000} {
+		s := probeIntervalScale(sec, n)
+		if s > last {
+			t.Fatalf("Bad time scale for %d nodes: %v", n, s)
+		}
+		last = s
+	}
+	if s := probeIntervalScale(sec, 3); s <= sec {
+		t.Fatalf("Bad time scale: %v", s)
+	}
+	if s := probeIntervalScale(sec, 1000); s >= sec {
+		t.Fatalf("Bad time scale: %v", s)
+	}
 }
 
 func TestMoveDeadNodes(t *testing.T) {
 	nodes := []*nodeState{
 		&nodeState{
-			State: stateDead,
+			State: StateDead,
+		},
+		&nodeState{
+			State: StateAlive,
 		},
 		&nodeState{
-			State: stateAlive,
+			State: StateAlive,
 		},
 		&nodeState{
-			State: stateAlive,
+			State: StateDead,
 		},
 		&nodeState{
-			State: stateDead,
+			State: StateAlive,
 		},
 		&nodeState{
-			State: stateAlive,
+			State:       StateDead,
+			StateChange: time.Now().Add(-20 * time.Second),
 		},
 	}
 
-	idx := moveDeadNodes(nodes)
+	idx := moveDeadNodes(nodes, 30*time.Second, nil)
+	if idx != 4 {
+		t.Fatalf("bad index")
+	}
+	for i := 0; i < idx; i++ {
+		if nodes[i].State == StateDead && time.Since(nodes[i].StateChange) > time.Minute {
+			t.Fatalf("Bad state %d", i)
+		}
+	}
+
+	idx = moveDeadNodes(nodes, 0, nil)
 	if idx != 3 {
 		t.Fatalf("bad index")
 	}
 	for i := 0; i < idx; i++ {
-		if nodes[i].State != stateAlive {
+		if nodes[i].State != StateAlive {
 			t.Fatalf("Bad state %d", i)
 		}
 	}
 	for i := idx; i < len(nodes); i++ {
-		if nodes[i].State != stateDead {
+		if nodes[i].State != StateDead {
 			t.Fatalf("Bad state %d", i)
 		}
 	}
@@ -161,14 +205,14 @@ func TestKRandomNodes(t *testing.T) {
 	nodes := []*nodeState{}
 	for i := 0; i < 90; i++ {
 		// Half the nodes are in a bad state
-		state := stateAlive
+		state := StateAlive
 		switch i % 3 {
 		case 0:
-			state = stateAlive
+			state = StateAlive
 		case 1:
-			state = stateSuspect
+			state = StateSuspect
 		case 2:
-			state = stateDead
+			state = StateDead
 		}
 		nodes = append(nodes, &nodeState{
 			Node: Node{
@@ -178,9 +222,9 @@ func TestKRandomNodes(t *testing.T) {
 		})
 	}
 
-	s1 := kRandomNodes(3, []string{"test0"}, nodes)
-	s2 := kRandomNodes(3, []string{"test0"}, nodes)
-	s3 := kRandomNodes(3, []string{"test0"}, nodes)
+	s1 := kRandomNodes(newRand(nil), 3, []string{"test0"}, nodes)
+	s2 := kRandomNodes(newRand(nil), 3, []string{"test0"}, nodes)
+	s3 := kRandomNodes(newRand(nil), 3, []string{"test0"}, nodes)
 
 	if reflect.DeepEqual(s1, s2) {
 		t.Fatalf("unexpected equal")
@@ -200,7 +244,7 @@ func TestKRandomNodes(t *testing.T) {
 			if n.Name == "test0" {
 				t.Fatalf("Bad name")
 			}
-			if n.State != stateAlive {
+			if n.State != StateAlive {
 				t.Fatalf("Bad state")
 			}
 		}
@@ -277,17 +321,135 @@ func TestDecodeCompoundMessage_Trunc(t *testing.T) {
 }
 
 func TestCompressDecompressPayload(t *testing.T) {
-	buf, err := compressPayload([]byte("testing"))
-	if err != nil {
-		t.Fatalf("unexpected err: %s", err)
+	for _, algo := range []CompressionType{CompressionLZW, CompressionFlate} {
+		buf, err := compressPayload(algo, []byte("testing"))
+		if err != nil {
+			t.Fatalf("unexpected err: %s", err)
+		}
+
+		var c compress
+		if err := decode(buf.Bytes()[1:], &c); err != nil {
+			t.Fatalf("unexpected err: %s", err)
+		}
+		if c.Algo != algo {
+			t.Fatalf("bad algo: %d", c.Algo)
+		}
+
+		decomp, err := decompressPayload(buf.Bytes()[1:])
+		if err != nil {
+			t.Fatalf("unexpected err: %s", err)
+		}
+
+		if !reflect.DeepEqual(decomp, []byte("testing")) {
+			t.Fatalf("bad payload: %v", decomp)
+		}
 	}
+}
 
-	decomp, err := decompressPayload(buf.Bytes()[1:])
-	if err != nil {
-		t.Fatalf("unexpected err: %s", err)
+func TestCompressPayload_UnknownAlgo(t *testing.T) {
+	if _, err := compressPayload(CompressionType(99), []byte("testing")); err == nil {
+		t.Fatalf("expected err")
+	}
+
+	c := compress{Algo: CompressionType(99), Buf: []byte("testing")}
+	if _, err := decompressBuffer(&c); err == nil {
+		t.Fatalf("expected err")
+	}
+}
+
+func TestFindPrivateIP(t *testing.T) {
+	parse := func(s string) net.Addr {
+		ip, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		ipnet.IP = ip
+		return ipnet
+	}
+
+	cases := []struct {
+		addrs  []string
+		expect string
+	}{
+		{[]string{"127.0.0.1/8", "8.8.8.8/24", "10.1.2.3/8"}, "10.1.2.3"},
+		{[]string{"fd00::1/64", "192.168.1.1/24"}, "192.168.1.1"},
+		{[]string{"::1/128", "fe80::1/64", "fd12:3456::1/64"}, "fd12:3456::1"},
+		{[]string{"::1/128", "fe80::1/64", "2001:db8::1/64"}, ""},
 	}
 
-	if !reflect.DeepEqual(decomp, []byte("testing")) {
-		t.Fatalf("bad payload: %v", decomp)
+	for _, tc := range cases {
+		var addrs []net.Addr
+		for _, a := range tc.addrs {
+			addrs = append(addrs, parse(a))
+		}
+
+		ip := findPrivateIP(addrs)
+		if tc.expect == "" {
+			if ip != nil {
+				t.Fatalf("expected no ip for %v: %v", tc.addrs, ip)
+			}
+			continue
+		}
+		if !ip.Equal(net.ParseIP(tc.expect)) {
+			t.Fatalf("bad ip for %v: %v", tc.addrs, ip)
+		}
+		if ip.To4() == nil && len(ip) != net.IPv6len {
+			t.Fatalf("expected 16-byte form: %v", []byte(ip))
+		}
+	}
+}
+
+func TestFindIPInNet(t *testing.T) {
+	parse := func(s string) *net.IPNet {
+		ip, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		ipnet.IP = ip
+		return ipnet
+	}
+
+	cases := []struct {
+		addrs  []string
+		cidr   string
+		expect string
+	}{
+		{[]string{"172.17.0.1/16", "10.1.2.3/8"}, "10.0.0.0/8", "10.1.2.3"},
+		{[]string{"172.17.0.1/16", "10.1.2.3/8"}, "172.17.0.0/16", "172.17.0.1"},
+		{[]string{"172.17.0.1/16", "8.8.8.8/24"}, "8.8.0.0/16", "8.8.8.8"},
+		{[]string{"fe80::1/64", "fd00::1/64"}, "fc00::/7", "fd00::1"},
+		{[]string{"fe80::1/64"}, "fe80::/10", ""},
+		{[]string{"172.17.0.1/16"}, "10.0.0.0/8", ""},
+	}
+
+	for _, tc := range cases {
+		var addrs []net.Addr
+		for _, a := range tc.addrs {
+			addrs = append(addrs, parse(a))
+		}
+
+		_, ipnet, err := net.ParseCIDR(tc.cidr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		ip := findIPInNet(addrs, ipnet)
+		if tc.expect == "" {
+			if ip != nil {
+				t.Fatalf("expected no ip for %v in %s: %v", tc.addrs, tc.cidr, ip)
+			}
+			continue
+		}
+		if !ip.Equal(net.ParseIP(tc.expect)) {
+			t.Fatalf("bad ip for %v in %s: %v", tc.addrs, tc.cidr, ip)
+		}
+	}
+}
+
+func TestIsLoopbackIP(t *testing.T) {
+	if !isLoopbackIP("127.0.0.5") || !isLoopbackIP("::1") {
+		t.Fatalf("expected loopback")
+	}
+	if isLoopbackIP("10.0.0.1") || isLoopbackIP("fd00::1") {
+		t.Fatalf("unexpected loopback")
 	}
 }